@@ -1,25 +1,144 @@
 package main
 
 import (
+	"bytes"
 	"context"
 	"encoding/json"
+	"errors"
+	"fmt"
 	"os"
-	"text/template"
+	"os/signal"
+	"strconv"
+	"strings"
+	"time"
 
 	"code.cloudfoundry.org/cli/cf/flags"
 	"code.cloudfoundry.org/cli/cf/terminal"
 	"code.cloudfoundry.org/cli/cf/trace"
 	"code.cloudfoundry.org/cli/plugin"
+	"code.cloudfoundry.org/cli/plugin/models"
 	"github.com/wfernandes/app-metrics-plugin/pkg/agent"
+	"github.com/wfernandes/app-metrics-plugin/pkg/aggregate"
+	"github.com/wfernandes/app-metrics-plugin/pkg/assert"
+	"github.com/wfernandes/app-metrics-plugin/pkg/diff"
+	"github.com/wfernandes/app-metrics-plugin/pkg/filter"
 	"github.com/wfernandes/app-metrics-plugin/pkg/parser"
+	"github.com/wfernandes/app-metrics-plugin/pkg/query"
+	"github.com/wfernandes/app-metrics-plugin/pkg/rate"
+	"github.com/wfernandes/app-metrics-plugin/pkg/rotate"
+	"github.com/wfernandes/app-metrics-plugin/pkg/snapshot"
+	"github.com/wfernandes/app-metrics-plugin/pkg/top"
 	"github.com/wfernandes/app-metrics-plugin/pkg/views"
 )
 
+const (
+	// formatAuto detects the format of the metrics endpoint.
+	formatAuto = "auto"
+	// formatCommandPrefix prefixes the commands dedicated to a format,
+	// e.g. app-metrics-prometheus.
+	formatCommandPrefix = "app-metrics-"
+	// replayCommand shows the metrics of a saved snapshot.
+	replayCommand = "app-metrics-replay"
+	// diffCommand compares a snapshot with another one or with the app.
+	diffCommand = "app-metrics-diff"
+	// topCommand shows a live dashboard of the metrics of every instance.
+	topCommand = "app-metrics-top"
+	// defaultRateInterval is the time between the scrapes of rate assertions
+	// and queries when the rate flag is not given.
+	defaultRateInterval = 10 * time.Second
+	// defaultTopInterval is the time between the scrapes of the dashboard
+	// when the interval flag is not given.
+	defaultTopInterval = 2 * time.Second
+	// outputTable renders the instance metrics as a table.
+	outputTable = "table"
+	// outputJSON, outputText and outputSnapshot are the outputs the out
+	// flag writes besides those of the output flag: the raw json, the
+	// template and a snapshot.
+	outputJSON     = "json"
+	outputText     = "text"
+	outputSnapshot = "snapshot"
+)
+
+// outputs lists the values of the output flag.
+var outputs = []string{outputTable, views.OutputCSV, views.OutputTSV, views.OutputNDJSON, views.OutputPrometheus, views.OutputHTML}
+
 type AppsMetricsPlugin struct {
-	ui terminal.UI
+	ui   terminal.UI
+	exit func(code int)
 }
 
 func (c *AppsMetricsPlugin) GetMetadata() plugin.PluginMetadata {
+	commands := []plugin.Command{
+		{
+			Name:     "app-metrics",
+			HelpText: "Hits the expvar metrics endpoint across all your app instances",
+
+			UsageDetails: plugin.Usage{
+				Usage:   "cf app-metrics APP_NAME",
+				Options: usageOptions("app-metrics", nil),
+			},
+		},
+	}
+
+	// Every other registered format gets a dedicated command.
+	for _, f := range parser.Formats() {
+		if f.Name == parser.FormatExpvar {
+			continue
+		}
+		commands = append(commands, plugin.Command{
+			Name:     formatCommandPrefix + f.Name,
+			HelpText: fmt.Sprintf("Hits the %s metrics endpoint across all your app instances", f.Name),
+
+			UsageDetails: plugin.Usage{
+				Usage: fmt.Sprintf("cf %s%s APP_NAME", formatCommandPrefix, f.Name),
+				Options: usageOptions(formatCommandPrefix+f.Name, map[string]string{
+					"include": "only show metrics matching a glob or series selector",
+					"exclude": "hide metrics matching a glob or series selector",
+				}),
+			},
+		})
+	}
+
+	commands = append(commands, plugin.Command{
+		Name:     replayCommand,
+		HelpText: "Shows the metrics of a snapshot saved with --save, without contacting the app",
+
+		UsageDetails: plugin.Usage{
+			Usage: fmt.Sprintf("cf %s FILE", replayCommand),
+			Options: usageOptions(replayCommand, map[string]string{
+				"counter": "treats the metrics matching a glob as counters when the snapshot was saved with -rate",
+				"query":   "evaluates a PromQL query like 'sum by (instance) (rate(http_requests_total[30s]))'",
+			}),
+		},
+	})
+
+	commands = append(commands, plugin.Command{
+		Name:     diffCommand,
+		HelpText: "Compares the metrics of a snapshot saved with --save with another snapshot, or else with the app",
+
+		UsageDetails: plugin.Usage{
+			Usage: fmt.Sprintf("cf %s BEFORE [AFTER]", diffCommand),
+			Options: usageOptions(diffCommand, map[string]string{
+				"memstats": "compares the memstats summary, which the snapshots need to be saved with",
+				"include":  "only compare metrics matching a glob, $.json.path or series selector",
+				"exclude":  "do not compare metrics matching a glob, $.json.path or series selector",
+				"counter":  "treats the metrics matching a glob as counters",
+			}),
+		},
+	})
+
+	commands = append(commands, plugin.Command{
+		Name:     topCommand,
+		HelpText: "Shows a live dashboard of the metrics of all your app instances",
+
+		UsageDetails: plugin.Usage{
+			Usage: fmt.Sprintf("cf %s APP_NAME", topCommand),
+			Options: usageOptions(topCommand, map[string]string{
+				"count": "number of scrapes to print before exiting when stdout is not a terminal",
+			}),
+		},
+	})
+
 	return plugin.PluginMetadata{
 		Name: "app-metrics",
 		Version: plugin.VersionType{
@@ -32,32 +151,7 @@ func (c *AppsMetricsPlugin) GetMetadata() plugin.PluginMetadata {
 			Minor: 7,
 			Build: 0,
 		},
-		Commands: []plugin.Command{
-			{
-				Name:     "app-metrics",
-				HelpText: "Hits the expvar metrics endpoint across all your app instances",
-
-				UsageDetails: plugin.Usage{
-					Usage: "cf app-metrics APP_NAME",
-					Options: map[string]string{
-						"endpoint": "path of the metrics endpoint",
-						"template": "path of the template files to render metrics",
-						"raw":      "prints raw json output",
-					},
-				},
-			},
-			{
-				Name:     "app-metrics-prometheus",
-				HelpText: "Hits the prometheus metrics endpoint across all your app instances",
-
-				UsageDetails: plugin.Usage{
-					Usage: "cf app-metrics-prometheus APP_NAME",
-					Options: map[string]string{
-						"endpoint": "path of the metrics endpoint",
-					},
-				},
-			},
-		},
+		Commands: commands,
 	}
 }
 
@@ -72,20 +166,46 @@ func (c *AppsMetricsPlugin) Run(cliConnection plugin.CliConnection, args []strin
 			return
 		}
 
-		c.getExpvarMetrics(cliConnection, args)
-	case "app-metrics-prometheus":
-		if len(args) < 2 {
-			c.ui.Say(c.GetMetadata().Commands[1].UsageDetails.Usage)
-			return
-		}
-		c.getPrometheusMetrics(cliConnection, args)
+		c.getMetrics(cliConnection, args, parser.FormatExpvar)
 	case "CLI-MESSAGE-UNINSTALL":
 		c.ui.Say("Thank you for using app-metrics")
+	default:
+		for _, cmd := range c.GetMetadata().Commands {
+			if cmd.Name != args[0] {
+				continue
+			}
+			if len(args) < 2 {
+				c.ui.Say(cmd.UsageDetails.Usage)
+				return
+			}
+			switch cmd.Name {
+			case replayCommand:
+				c.replay(args)
+			case diffCommand:
+				c.diff(cliConnection, args)
+			case topCommand:
+				c.top(cliConnection, args)
+			default:
+				c.getMetrics(cliConnection, args, strings.TrimPrefix(cmd.Name, formatCommandPrefix))
+			}
+			return
+		}
 	}
 
 }
 
-func (c *AppsMetricsPlugin) getExpvarMetrics(cliConnection plugin.CliConnection, args []string) {
+// usageFailed prints the usage of a command before failing with an error
+// in its arguments.
+func (c *AppsMetricsPlugin) usageFailed(command string, err error) {
+	for _, cmd := range c.GetMetadata().Commands {
+		if cmd.Name == command {
+			c.ui.Say(cmd.UsageDetails.Usage)
+		}
+	}
+	c.ui.Failed(err.Error())
+}
+
+func (c *AppsMetricsPlugin) getMetrics(cliConnection plugin.CliConnection, args []string, format string) {
 	// Verify we have access to the app
 	app, err := cliConnection.GetApp(args[1])
 	if err != nil {
@@ -95,111 +215,1383 @@ func (c *AppsMetricsPlugin) getExpvarMetrics(cliConnection plugin.CliConnection,
 
 	// Parse any flags that were provided
 	fc, err := parseArguments(args)
+	if err != nil {
+		c.usageFailed(args[0], err)
+		return
+	}
+
+	a, err := newAnalysis(fc)
+	if err != nil {
+		c.ui.Failed(err.Error())
+		return
+	}
+
+	interval, err := parseRateInterval(fc)
 	if err != nil {
 		c.ui.Failed(err.Error())
 		return
 	}
+	if interval == 0 && a.needsRates() {
+		interval = defaultRateInterval
+		if a.query != nil && a.query.NeedsRates() {
+			interval = a.query.Range()
+		}
+	}
+
+	if fc.IsSet("format") {
+		format = fc.String("format")
+	}
 
-	// Create the client that will GET the metrics. Currently, it is fixed
-	// to Expvar style but other parsers can be written. For example, Prometheus.
-	// We are forcing to ignore the `cmdline` and `memstats` properties as they
-	// clutter the output.
-	var client *agent.Agent
+	var opts []agent.AgentOpt
 	if fc.IsSet("endpoint") {
-		client = agent.New(
-			&app,
-			parser.NewExpvar(parser.WithPropertiesToRemove([]string{"cmdline", "memstats"})),
-			agent.WithMetricsPath(fc.String("endpoint")))
-	} else {
-		client = agent.New(
-			&app,
-			parser.NewExpvar(parser.WithPropertiesToRemove([]string{"cmdline", "memstats"})),
-		)
+		opts = append(opts, agent.WithMetricsPath(fc.String("endpoint")))
+	}
+	streaming := a.streams(fc) && interval == 0
+	if streaming {
+		view := views.New(views.WithRecords(a.output))
+		opts = append(opts, agent.WithResults(func(m agent.InstanceMetric) {
+			err := view.PresentInstance(a.filter.Apply([]agent.InstanceMetric{m})[0])
+			if err != nil {
+				c.ui.Warn(err.Error())
+			}
+		}))
+	}
+
+	// Create the client that will GET the metrics.
+	client, format, err := c.newAgent(&app, format, fc, opts...)
+	if err != nil {
+		c.ui.Failed(err.Error())
+		return
+	}
+
+	s := &snapshot.Snapshot{
+		App:      snapshot.App{Name: app.Name, Guid: app.Guid},
+		Format:   format,
+		Path:     client.Path(),
+		MemStats: format == parser.FormatExpvar && fc.IsSet("memstats"),
+	}
+	if org, err := cliConnection.GetCurrentOrg(); err == nil {
+		s.App.Org = org.Name
+	}
+	if space, err := cliConnection.GetCurrentSpace(); err == nil {
+		s.App.Space = space.Name
+	}
+
+	if a.watch > 0 {
+		c.watch(client, s, a, fc)
+		return
 	}
 
-	// Make the request(s) and get the data
-	metrics, err := client.GetMetrics(context.Background())
+	// Make the request(s) and get the data. Rates need two samples.
+	count := 1
+	if interval > 0 {
+		count = 2
+	}
+	samples, err := client.Collect(context.Background(), count, interval)
 	if err != nil {
 		c.ui.Failed("unable to get metrics: %s\n", err)
+		return
 	}
+	s.Time, s.Samples = samples[0].Time, samples
 
-	// Print json output when raw flag is specified
-	if fc.IsSet("raw") {
-		c.printDefault(metrics)
+	err = c.writeOutputs(newWriters(a), s, a, fc)
+	if err != nil {
+		c.ui.Failed(err.Error())
 		return
 	}
 
-	// Present the data
-	var view *views.View
-	if fc.IsSet("template") {
-		tmpl, err := template.ParseFiles(fc.String("template"))
+	if streaming {
+		return
+	}
+	c.present(s, a, fc)
+}
+
+// watch scrapes the app every interval of the watch flag, count times or
+// until interrupted, writing every scrape to the files of the outputs and
+// presenting it. The query is evaluated once the scrapes span its range.
+func (c *AppsMetricsPlugin) watch(client *agent.Agent, s *snapshot.Snapshot, a *analysis, fc flags.FlagContext) {
+	ctx, cancel := interruptible()
+	defer cancel()
+
+	writers := newWriters(a)
+	scrapes, presented := 0, 0
+	var window []agent.Sample
+	err := client.Watch(ctx, a.watch, func(smp agent.Sample) {
+		s.Time, s.Samples = smp.Time, []agent.Sample{smp}
+		err := writeAll(writers, s, a, fc)
+		if err != nil {
+			c.ui.Warn(err.Error())
+		}
+		scrapes++
+		if scrapes == fc.Int("count") {
+			defer cancel()
+		}
+
+		if a.query != nil {
+			var ok bool
+			window, ok = a.query.Window(append(window, smp))
+			if !ok {
+				if scrapes == 1 && !fc.IsSet("raw") {
+					c.ui.Say("Waiting for %s of scrapes to evaluate %s", a.query.Range(), a.query)
+				}
+				return
+			}
+			s.Samples = append([]agent.Sample(nil), window...)
+		}
+		if presented > 0 && !quiet(fc) && !a.redirected {
+			c.ui.Say("")
+		}
+		c.present(s, a, fc)
+		presented++
+	})
+	if cerr := closeWriters(writers); err == nil || err == context.Canceled {
+		err = cerr
+	}
+	if err != nil && err != context.Canceled {
+		c.ui.Failed("unable to get metrics: %s", err)
+	}
+}
+
+// replay presents the metrics of a snapshot saved with the save flag, as
+// they were presented when it was taken, without contacting the app.
+func (c *AppsMetricsPlugin) replay(args []string) {
+	fc, err := parseArguments(args)
+	if err != nil {
+		c.usageFailed(args[0], err)
+		return
+	}
+
+	a, err := newAnalysis(fc)
+	if err != nil {
+		c.ui.Failed(err.Error())
+		return
+	}
+
+	s, err := loadSnapshot(args[1])
+	if err != nil {
+		c.ui.Failed(err.Error())
+		return
+	}
+
+	if !quiet(fc) {
+		c.ui.Say("Replaying %s metrics of %s taken at %s", s.Format, s.App.Name, s.Time.Format(time.RFC3339))
+	}
+
+	err = c.writeOutputs(newWriters(a), s, a, fc)
+	if err != nil {
+		c.ui.Failed(err.Error())
+		return
+	}
+	c.present(s, a, fc)
+}
+
+// diff compares the last sample of a snapshot with the last sample of a
+// second snapshot, or else with a live scrape of the app the snapshot was
+// taken from.
+func (c *AppsMetricsPlugin) diff(cliConnection plugin.CliConnection, args []string) {
+	fc, err := parseArguments(args)
+	if err != nil {
+		c.usageFailed(args[0], err)
+		return
+	}
+
+	f, err := filter.New(fc.StringSlice("include"), fc.StringSlice("exclude"))
+	if err != nil {
+		c.ui.Failed(err.Error())
+		return
+	}
+
+	calculator, err := rate.New(fc.StringSlice("counter"))
+	if err != nil {
+		c.ui.Failed(err.Error())
+		return
+	}
+
+	if len(fc.Args()) < 2 {
+		c.ui.Say("cf %s BEFORE [AFTER]", diffCommand)
+		c.ui.Failed("missing the snapshot to compare")
+		return
+	}
+	before, err := loadSnapshot(fc.Args()[1])
+	if err != nil {
+		c.ui.Failed(err.Error())
+		return
+	}
+	if fc.IsSet("memstats") && !before.MemStats {
+		c.ui.Failed("%s was saved without -memstats", fc.Args()[1])
+		return
+	}
+	first := before.Samples[len(before.Samples)-1]
+
+	var second agent.Sample
+	if len(fc.Args()) > 2 {
+		after, err := loadSnapshot(fc.Args()[2])
 		if err != nil {
-			c.ui.Failed("unable to parse template files: %s\n", err)
+			c.ui.Failed(err.Error())
+			return
+		}
+		if after.MemStats != before.MemStats {
+			c.ui.Failed("only one of the snapshots was saved with -memstats")
 			return
 		}
-		view = views.New(views.WithTemplate(tmpl))
+		second = after.Samples[len(after.Samples)-1]
 	} else {
-		view = views.New()
+		second, err = c.scrape(cliConnection, before)
+		if err != nil {
+			c.ui.Failed(err.Error())
+			return
+		}
 	}
-	err = view.Present(metrics)
+
+	first.Metrics = f.Apply(first.Metrics)
+	second.Metrics = f.Apply(second.Metrics)
+	d := diff.Compare(first, second, calculator)
+	if fc.IsSet("raw") {
+		c.printDefault(d)
+		return
+	}
+
+	c.ui.Say("Comparing %s metrics of %s taken at %s and %s", before.Format, before.App.Name, first.Time.Format(time.RFC3339), second.Time.Format(time.RFC3339))
+	c.ui.Say("")
+	err = views.New().PresentDiff(d)
 	if err != nil {
 		c.ui.Warn(err.Error())
-		c.printDefault(metrics)
+		c.printDefault(d)
 	}
 }
 
-func (c *AppsMetricsPlugin) getPrometheusMetrics(cliConnection plugin.CliConnection, args []string) {
-	// Verify we have access to the app
+// top shows a live dashboard of the metrics of every instance, scraped every
+// interval, until q is pressed. When stdout or stdin is not a terminal the
+// dashboard is printed after every scrape instead.
+func (c *AppsMetricsPlugin) top(cliConnection plugin.CliConnection, args []string) {
 	app, err := cliConnection.GetApp(args[1])
 	if err != nil {
 		c.ui.Failed(err.Error())
 		return
 	}
 
-	// Parse any flags that were provided
 	fc, err := parseArguments(args)
+	if err != nil {
+		c.usageFailed(args[0], err)
+		return
+	}
+
+	f, err := filter.New(fc.StringSlice("include"), fc.StringSlice("exclude"))
 	if err != nil {
 		c.ui.Failed(err.Error())
 		return
 	}
 
-	var client *agent.Agent
+	interval := defaultTopInterval
+	if fc.IsSet("interval") {
+		interval, err = time.ParseDuration(fc.String("interval"))
+		if err != nil || interval <= 0 {
+			c.ui.Failed("invalid interval %q, expected e.g. 2s", fc.String("interval"))
+			return
+		}
+	}
+
+	format := parser.FormatExpvar
+	if fc.IsSet("format") {
+		format = fc.String("format")
+	}
+	var opts []agent.AgentOpt
 	if fc.IsSet("endpoint") {
-		client = agent.New(
-			&app,
-			parser.NewPrometheus(),
-			agent.WithMetricsPath(fc.String("endpoint")))
+		opts = append(opts, agent.WithMetricsPath(fc.String("endpoint")))
+	}
+	client, _, err := c.newAgent(&app, format, fc, opts...)
+	if err != nil {
+		c.ui.Failed(err.Error())
+		return
+	}
+
+	interactive := top.IsTerminal(os.Stdin) && top.IsTerminal(os.Stdout)
+	dopts := []top.DashboardOpt{top.WithTitle(app.Name), top.WithColumns(fc.StringSlice("columns"))}
+	if interactive {
+		dopts = append(dopts, top.WithInteractive())
+	}
+	d := top.New(dopts...)
+
+	// Ctrl-C quits like q so the terminal is restored.
+	ctx, cancel := interruptible()
+	defer cancel()
+
+	if !interactive {
+		width, _ := strconv.Atoi(os.Getenv("COLUMNS"))
+		d.SetSize(width, 0)
+		scrapes := 0
+		err = client.Watch(ctx, interval, func(s agent.Sample) {
+			s.Metrics = f.Apply(s.Metrics)
+			d.Update(s)
+			if scrapes > 0 {
+				c.ui.Say("")
+			}
+			c.ui.Say("%s", strings.TrimSuffix(d.Render(), "\n"))
+			scrapes++
+			if scrapes == fc.Int("count") {
+				cancel()
+			}
+		})
+		if err != nil && err != context.Canceled {
+			c.ui.Failed("unable to get metrics: %s", err)
+		}
+		return
+	}
+
+	samples := make(chan agent.Sample)
+	failed := make(chan error, 1)
+	go func() {
+		err := client.Watch(ctx, interval, func(s agent.Sample) {
+			s.Metrics = f.Apply(s.Metrics)
+			select {
+			case samples <- s:
+			case <-ctx.Done():
+			}
+		})
+		if err != context.Canceled {
+			failed <- err
+			cancel()
+		}
+	}()
+
+	size := func() (int, int) { return 0, 0 }
+	term, err := top.OpenTerminal()
+	if err != nil {
+		c.ui.Warn("%s, keys are read after enter", err)
 	} else {
-		client = agent.New(
-			&app,
-			parser.NewPrometheus(),
-		)
+		size = term.Size
+	}
+
+	err = top.Run(ctx, d, samples, top.ReadKeys(os.Stdin), size, os.Stdout)
+	cancel()
+	if term != nil {
+		term.Close()
+	}
+	select {
+	case err = <-failed:
+	default:
+	}
+	if err != nil && err != context.Canceled {
+		c.ui.Failed("unable to get metrics: %s", err)
+	}
+}
+
+// interruptible returns a context that is canceled on an interrupt, so that
+// watching stops cleanly on Ctrl-C.
+func interruptible() (context.Context, context.CancelFunc) {
+	ctx, cancel := context.WithCancel(context.Background())
+	interrupts := make(chan os.Signal, 1)
+	signal.Notify(interrupts, os.Interrupt)
+	go func() {
+		select {
+		case <-interrupts:
+			cancel()
+		case <-ctx.Done():
+		}
+		signal.Stop(interrupts)
+	}()
+	return ctx, cancel
+}
+
+// scrape gets the metrics of the app a snapshot was taken from, from the
+// same endpoint, in the same format and with the memstats summary when the
+// snapshot has it.
+func (c *AppsMetricsPlugin) scrape(cliConnection plugin.CliConnection, s *snapshot.Snapshot) (agent.Sample, error) {
+	app, err := cliConnection.GetApp(s.App.Name)
+	if err != nil {
+		return agent.Sample{}, err
 	}
 
-	// Make the request(s) and get the data
-	metrics, err := client.GetMetrics(context.Background())
+	f, ok := parser.Lookup(s.Format)
+	if !ok {
+		return agent.Sample{}, fmt.Errorf("unknown format %q, expected one of %s", s.Format, strings.Join(parser.Names(), ", "))
+	}
+	var opts []agent.AgentOpt
+	if s.Path != "" {
+		opts = append(opts, agent.WithMetricsPath(s.Path))
+	}
+
+	client := newFormatAgent(&app, f, s.MemStats, opts...)
+	samples, err := client.Collect(context.Background(), 1, 0)
 	if err != nil {
-		c.ui.Failed("unable to get metrics: %s\n", err)
-		return
+		return agent.Sample{}, fmt.Errorf("unable to get metrics: %s", err)
 	}
-	c.printDefault(metrics)
+	return samples[0], nil
+}
 
+// analysis holds what the flags ask to do with the scraped metrics.
+type analysis struct {
+	filter         *filter.Filter
+	detector       *aggregate.OutlierDetector
+	warnedMaxScore bool
+	calculator     *rate.Calculator
+	quantiles      []float64
+	assertions     []assert.Assertion
+	query          *query.Query
+	output         string
+	files          []outputFile
+	redirected     bool
+	watch          time.Duration
+	rotate         int64
 }
 
-func (c *AppsMetricsPlugin) printDefault(metrics []agent.InstanceMetric) {
-	bytes, err := json.Marshal(metrics)
+func newAnalysis(fc flags.FlagContext) (*analysis, error) {
+	f, err := filter.New(fc.StringSlice("include"), fc.StringSlice("exclude"))
 	if err != nil {
-		c.ui.Warn("unable to marshal metrics: %s\n", err)
-		return
+		return nil, err
 	}
-	c.ui.Say("%s\n", string(bytes))
+
+	detector, err := newOutlierDetector(fc)
+	if err != nil {
+		return nil, err
+	}
+
+	var assertions []assert.Assertion
+	counters := fc.StringSlice("counter")
+	for _, expr := range fc.StringSlice("assert") {
+		a, err := assert.Parse(expr)
+		if err != nil {
+			return nil, err
+		}
+		assertions = append(assertions, a)
+		// The metrics of rate assertions are counters.
+		if a.Rate {
+			counters = append(counters, a.Metric)
+		}
+	}
+
+	calculator, err := rate.New(counters)
+	if err != nil {
+		return nil, err
+	}
+
+	quantiles, err := parseQuantiles(fc)
+	if err != nil {
+		return nil, err
+	}
+
+	var q *query.Query
+	if fc.IsSet("query") {
+		q, err = query.Parse(fc.String("query"))
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	output := fc.String("output")
+	if output != "" && !contains(outputs, output) {
+		return nil, fmt.Errorf("unknown output %q, expected one of %s", output, strings.Join(outputs, ", "))
+	}
+
+	files, redirected, err := parseOutputs(fc)
+	if err != nil {
+		return nil, err
+	}
+
+	var watch time.Duration
+	if fc.IsSet("watch") {
+		watch, err = time.ParseDuration(fc.String("watch"))
+		if err != nil || watch <= 0 {
+			return nil, fmt.Errorf("invalid watch interval %q, expected e.g. 10s", fc.String("watch"))
+		}
+		if fc.IsSet("rate") || len(assertions) > 0 {
+			return nil, errors.New("-watch cannot be combined with -rate or -assert")
+		}
+	}
+
+	var size int64
+	if fc.IsSet("rotate") {
+		if watch == 0 {
+			return nil, errors.New("-rotate needs -watch")
+		}
+		size, err = rotate.ParseSize(fc.String("rotate"))
+		if err != nil {
+			return nil, err
+		}
+		if size == 0 {
+			return nil, fmt.Errorf("invalid rotate size %q, expected e.g. 10MiB", fc.String("rotate"))
+		}
+	}
+
+	return &analysis{
+		filter:     f,
+		detector:   detector,
+		calculator: calculator,
+		quantiles:  quantiles,
+		assertions: assertions,
+		query:      q,
+		output:     output,
+		files:      files,
+		redirected: redirected,
+		watch:      watch,
+		rotate:     size,
+	}, nil
 }
 
-func parseArguments(args []string) (flags.FlagContext, error) {
-	fc := flags.New()
-	fc.NewStringFlag("endpoint", "e", "Path of the metrics endpoint")
-	fc.NewStringFlag("template", "t", "Path of the template files to render metrics")
-	fc.NewBoolFlag("raw", "r", "Prints raw json output")
+// streams reports whether the instance metrics are printed as ndjson as
+// soon as each instance is scraped, which is when nothing needs all the
+// instances or a second scrape.
+func (a *analysis) streams(fc flags.FlagContext) bool {
+	return a.output == views.OutputNDJSON && a.query == nil && len(a.assertions) == 0 &&
+		!fc.IsSet("rate") && !fc.IsSet("aggregate") && !fc.IsSet("histograms") && !fc.IsSet("raw") &&
+		a.watch == 0 && !a.redirected
+}
+
+// needsRates reports whether an assertion or the query needs two scrapes.
+func (a *analysis) needsRates() bool {
+	if a.query != nil && a.query.NeedsRates() {
+		return true
+	}
+	for _, as := range a.assertions {
+		if as.Rate {
+			return true
+		}
+	}
+	return false
+}
+
+// present filters and analyzes the samples of a scrape, or of a snapshot,
+// and prints them. Two samples are shown as the rates of their counters.
+func (c *AppsMetricsPlugin) present(s *snapshot.Snapshot, a *analysis, fc flags.FlagContext) {
+	samples := s.Samples
+	for i := range samples {
+		samples[i].Metrics = a.filter.Apply(samples[i].Metrics)
+	}
+
+	if len(a.assertions) > 0 {
+		c.checkAssertions(samples, a, fc.IsSet("raw"))
+		return
+	}
+
+	if a.query != nil {
+		c.printQuery(samples, a.query, fc.IsSet("raw"))
+		return
+	}
+
+	if a.output == views.OutputHTML && !a.redirected {
+		c.printReport(s, a)
+		return
+	}
+
+	var resets []rate.Reset
+	metrics := samples[0].Metrics
+	if len(samples) > 1 {
+		metrics, resets = a.calculator.Rates(samples[0], samples[1])
+	}
+
+	var outliers []aggregate.Outlier
+	if a.detector != nil {
+		outliers = a.detector.Outliers(metrics)
+		c.warnMaxScore(a, metrics)
+	}
+
+	if len(samples) > 1 {
+		c.printRates(metrics, resets, outliers, s, fc)
+		return
+	}
+
+	if fc.IsSet("histograms") {
+		c.printHistograms(metrics, a.quantiles, fc.IsSet("raw"))
+		return
+	}
+
+	if fc.IsSet("aggregate") {
+		c.printAggregate(metrics, outliers, fc.IsSet("raw"))
+		return
+	}
+
+	// The out flag writes the instance metrics to a file instead.
+	if a.redirected {
+		return
+	}
+
+	// Print the json output when the raw flag is specified
+	if fc.IsSet("raw") {
+		if a.detector != nil {
+			c.printDefault(report{Instances: metrics, Outliers: outliers})
+			return
+		}
+		c.printDefault(metrics)
+		return
+	}
+
+	// Present the data
+	view, err := newView(a.output, fc, outliers, s)
+	if err != nil {
+		c.ui.Failed(err.Error())
+		return
+	}
+	err = view.Present(metrics)
+	if err != nil {
+		c.ui.Warn(err.Error())
+		c.printDefault(metrics)
+	}
+}
+
+// printReport prints the html report of the samples of a snapshot.
+func (c *AppsMetricsPlugin) printReport(s *snapshot.Snapshot, a *analysis) {
+	b, err := renderReport(s.Samples, s, a)
+	if err != nil {
+		c.ui.Failed(err.Error())
+		return
+	}
+	_, err = os.Stdout.Write(b)
+	if err != nil {
+		c.ui.Failed(err.Error())
+	}
+}
+
+// renderReport renders the html report of samples scraped from the app of a
+// snapshot.
+func renderReport(samples []agent.Sample, s *snapshot.Snapshot, a *analysis) ([]byte, error) {
+	var outliers []aggregate.Outlier
+	if a.detector != nil {
+		outliers = a.detector.Outliers(samples[len(samples)-1].Metrics)
+	}
+	var buf bytes.Buffer
+	err := views.New(views.WithWriter(&buf), views.WithOutliers(outliers), views.WithApp(s.App), views.WithTime(s.Time)).PresentReport(samples, a.quantiles)
+	return buf.Bytes(), err
+}
+
+// loadSnapshot reads the snapshot saved at path.
+func loadSnapshot(path string) (*snapshot.Snapshot, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("unable to open snapshot: %s", err)
+	}
+	defer file.Close()
+	return snapshot.Load(file)
+}
+
+// checkAssertions prints a pass/fail report of the assertions against the
+// last sample, or the rates between the samples for rate assertions, and
+// exits with a non-zero status when any failed.
+func (c *AppsMetricsPlugin) checkAssertions(samples []agent.Sample, a *analysis, raw bool) {
+	metrics := samples[len(samples)-1].Metrics
+	var rates []agent.InstanceMetric
+	if len(samples) > 1 {
+		rates, _ = a.calculator.Rates(samples[0], samples[1])
+	}
+
+	var results []assert.Result
+	failed := 0
+	for _, as := range a.assertions {
+		var r assert.Result
+		switch {
+		case !as.Rate:
+			r = as.Check(metrics)
+		case rates == nil:
+			r = assert.Result{Assertion: as.Expr, Failures: []assert.Failure{{Error: "rates need two scrapes, use a snapshot saved with -rate"}}}
+		default:
+			r = as.Check(rates)
+		}
+		if !r.Passed {
+			failed++
+		}
+		results = append(results, r)
+	}
+
+	if raw {
+		c.printDefault(report{Instances: metrics, Assertions: results})
+	} else {
+		err := views.New().PresentAssertions(results)
+		if err != nil {
+			c.ui.Warn(err.Error())
+			c.printDefault(results)
+		}
+	}
+
+	if failed > 0 {
+		if !raw {
+			c.ui.Say("%d of %d assertions failed", failed, len(results))
+		}
+		c.exitWith(1)
+	}
+}
+
+// printQuery prints the result of the query against the samples, or as
+// json next to the instance metrics of the last sample when raw output is
+// requested.
+func (c *AppsMetricsPlugin) printQuery(samples []agent.Sample, q *query.Query, raw bool) {
+	r, err := q.Eval(samples)
+	if err != nil {
+		c.ui.Failed("unable to evaluate query: %s", err)
+		return
+	}
+
+	if raw {
+		c.printDefault(report{Instances: samples[len(samples)-1].Metrics, Query: &r})
+		return
+	}
+
+	if r.Type == query.TypeVector && len(r.Vector) == 0 {
+		c.ui.Warn("no series matches %s", q)
+		return
+	}
+	err = views.New().PresentQuery(r)
+	if err != nil {
+		c.ui.Warn(err.Error())
+	}
+}
+
+// exitWith exits the plugin with the status code, which the cf CLI turns
+// into its own exit status.
+func (c *AppsMetricsPlugin) exitWith(code int) {
+	if c.exit != nil {
+		c.exit(code)
+		return
+	}
+	os.Exit(code)
+}
+
+// outputFile is an output the out flag writes to a file.
+type outputFile struct {
+	output string
+	path   string
+}
+
+// parseOutputs returns the files of the out and save flags. A file without
+// an OUTPUT: prefix gets the output that is otherwise printed, which it
+// then replaces.
+func parseOutputs(fc flags.FlagContext) ([]outputFile, bool, error) {
+	var files []outputFile
+	redirected := false
+	for _, out := range fc.StringSlice("out") {
+		f := outputFile{output: screenOutput(fc), path: out}
+		if i := strings.Index(out, ":"); i > 0 && contains(fileOutputs(), out[:i]) {
+			f = outputFile{output: out[:i], path: out[i+1:]}
+		} else {
+			redirected = true
+		}
+		if f.path == "" {
+			return nil, false, fmt.Errorf("missing FILE in -out %q", out)
+		}
+		files = append(files, f)
+	}
+	if fc.IsSet("save") {
+		files = append(files, outputFile{output: outputSnapshot, path: fc.String("save")})
+	}
+	return files, redirected, nil
+}
+
+// fileOutputs lists the outputs the out flag can write to a file.
+func fileOutputs() []string {
+	return append(append([]string(nil), outputs...), outputJSON, outputText, outputSnapshot)
+}
+
+// screenOutput names the output that is printed: the output flag, json
+// with the raw flag, or else the template.
+func screenOutput(fc flags.FlagContext) string {
+	if fc.IsSet("raw") {
+		return outputJSON
+	}
+	if output := fc.String("output"); output != "" {
+		return output
+	}
+	return outputText
+}
+
+// fileWriter writes an output of every scrape to a file, which is created
+// with the first scrape. Records are appended to the file and, in watch
+// mode, rotated; the other outputs are documents rewritten as a whole.
+type fileWriter struct {
+	outputFile
+	file    *rotate.File
+	samples []agent.Sample
+}
+
+func newWriters(a *analysis) []*fileWriter {
+	writers := make([]*fileWriter, len(a.files))
+	for i, f := range a.files {
+		writers[i] = &fileWriter{outputFile: f}
+	}
+	return writers
+}
+
+// writeOutputs writes a scrape to the files of the outputs, closes them
+// and tells where they are, unless the output printed is meant for other
+// tools.
+func (c *AppsMetricsPlugin) writeOutputs(writers []*fileWriter, s *snapshot.Snapshot, a *analysis, fc flags.FlagContext) error {
+	err := writeAll(writers, s, a, fc)
+	if cerr := closeWriters(writers); err == nil {
+		err = cerr
+	}
+	if err != nil || (quiet(fc) && !a.redirected) {
+		return err
+	}
+
+	for _, w := range writers {
+		switch w.output {
+		case outputSnapshot:
+			c.ui.Say("Saved snapshot to %s", w.path)
+		case views.OutputHTML:
+			c.ui.Say("Saved report to %s", w.path)
+		default:
+			c.ui.Say("Saved %s output to %s", w.output, w.path)
+		}
+	}
+	return nil
+}
+
+func writeAll(writers []*fileWriter, s *snapshot.Snapshot, a *analysis, fc flags.FlagContext) error {
+	for _, w := range writers {
+		err := w.write(s, a, fc)
+		if err != nil {
+			return fmt.Errorf("unable to write %s: %s", w.path, err)
+		}
+	}
+	return nil
+}
+
+func closeWriters(writers []*fileWriter) error {
+	var err error
+	for _, w := range writers {
+		if w.file == nil {
+			continue
+		}
+		if cerr := w.file.Close(); err == nil {
+			err = cerr
+		}
+	}
+	return err
+}
+
+func (w *fileWriter) write(s *snapshot.Snapshot, a *analysis, fc flags.FlagContext) error {
+	if w.file == nil {
+		file, err := rotate.Open(w.path, rotate.WithMaxSize(a.rotate))
+		if err != nil {
+			return err
+		}
+		w.file = file
+	}
+
+	switch w.output {
+	case outputSnapshot:
+		var buf bytes.Buffer
+		err := snapshot.Save(&buf, s)
+		if err != nil {
+			return err
+		}
+		return w.file.Replace(buf.Bytes())
+	case views.OutputHTML:
+		// The report charts every scrape since the file was started.
+		scraped := make([]agent.Sample, len(s.Samples))
+		for i, smp := range s.Samples {
+			scraped[i] = agent.Sample{Time: smp.Time, Metrics: a.filter.Apply(smp.Metrics)}
+		}
+		w.samples = append(w.samples, scraped...)
+		b, err := renderReport(w.samples, s, a)
+		if err != nil {
+			return err
+		}
+		if w.file.Exceeds(int64(len(b))) && len(w.samples) > len(scraped) {
+			err = w.file.Rotate()
+			if err != nil {
+				return err
+			}
+			w.samples = scraped
+			b, err = renderReport(w.samples, s, a)
+			if err != nil {
+				return err
+			}
+		}
+		return w.file.Replace(b)
+	}
+
+	b, err := renderOutput(w.output, s, a, fc)
+	if err != nil {
+		return err
+	}
+	if !appended(w.output) {
+		return w.file.Replace(b)
+	}
+
+	// Rotate first so that a new file gets the csv header.
+	if w.file.Size() > 0 && w.file.Exceeds(w.file.Size()+int64(len(b))) {
+		err = w.file.Rotate()
+		if err != nil {
+			return err
+		}
+	}
+	if w.file.Size() > 0 && (w.output == views.OutputCSV || w.output == views.OutputTSV) {
+		b = b[bytes.IndexByte(b, '\n')+1:]
+	}
+	_, err = w.file.Write(b)
+	return err
+}
+
+// appended reports whether an output is made of records, which are appended
+// to its file after every scrape.
+func appended(output string) bool {
+	switch output {
+	case views.OutputCSV, views.OutputTSV, views.OutputNDJSON, outputJSON:
+		return true
+	}
+	return false
+}
+
+// renderOutput renders the instance metrics of the last sample of a
+// snapshot.
+func renderOutput(output string, s *snapshot.Snapshot, a *analysis, fc flags.FlagContext) ([]byte, error) {
+	metrics := a.filter.Apply(s.Samples[len(s.Samples)-1].Metrics)
+	var buf bytes.Buffer
+	if output == outputJSON {
+		b, err := json.Marshal(metrics)
+		if err != nil {
+			return nil, err
+		}
+		buf.Write(b)
+		buf.WriteByte('\n')
+		return buf.Bytes(), nil
+	}
+
+	var outliers []aggregate.Outlier
+	if a.detector != nil {
+		outliers = a.detector.Outliers(metrics)
+	}
+	view, err := newView(output, fc, outliers, s, views.WithWriter(&buf))
+	if err != nil {
+		return nil, err
+	}
+	err = view.Present(metrics)
+	return buf.Bytes(), err
+}
+
+// newView returns the view rendering the instance metrics of a snapshot with
+// an output, or else with the template flags. In watch mode records start
+// with the time of the scrape.
+func newView(output string, fc flags.FlagContext, outliers []aggregate.Outlier, s *snapshot.Snapshot, opts ...views.ViewOpt) (*views.View, error) {
+	switch output {
+	case outputTable:
+		return views.New(append(opts, views.WithTable(newTable(fc)), views.WithOutliers(outliers))...), nil
+	case views.OutputCSV, views.OutputTSV, views.OutputNDJSON:
+		if fc.IsSet("watch") {
+			opts = append(opts, views.WithTime(s.Time))
+		}
+		return views.New(append(opts, views.WithRecords(output))...), nil
+	case views.OutputPrometheus:
+		return views.New(append(opts, views.WithRecords(views.OutputPrometheus), views.WithLabels(appLabels(s.App)))...), nil
+	}
+	tmpl, err := views.LoadTemplate(fc.String("template"), fc.String("template-name"))
+	if err != nil {
+		return nil, fmt.Errorf("unable to parse template files: %s", err)
+	}
+	return views.New(append(opts, views.WithTemplate(tmpl), views.WithOutliers(outliers), views.WithApp(s.App), views.WithTime(s.Time))...), nil
+}
+
+// appLabels returns the labels identifying the app in the Prometheus
+// output.
+func appLabels(app snapshot.App) map[string]string {
+	labels := map[string]string{"cf_app": app.Name}
+	if app.Org != "" {
+		labels["cf_org"] = app.Org
+	}
+	if app.Space != "" {
+		labels["cf_space"] = app.Space
+	}
+	return labels
+}
+
+// quiet reports whether the output is meant for other tools, which the
+// informational messages would get in the way of.
+func quiet(fc flags.FlagContext) bool {
+	output := fc.String("output")
+	return fc.IsSet("raw") || (output != "" && output != outputTable)
+}
+
+func contains(values []string, v string) bool {
+	for _, s := range values {
+		if s == v {
+			return true
+		}
+	}
+	return false
+}
+
+// newTable returns the table configured by the sort, transpose and width
+// flags. The width defaults to the COLUMNS environment variable.
+func newTable(fc flags.FlagContext) views.Table {
+	t := views.Table{Transpose: fc.IsSet("transpose"), Width: fc.Int("width")}
+	if !fc.IsSet("width") {
+		t.Width, _ = strconv.Atoi(os.Getenv("COLUMNS"))
+	}
+	t.Sort = fc.String("sort")
+	if i := strings.LastIndex(t.Sort, ":"); i >= 0 {
+		switch t.Sort[i+1:] {
+		case "desc":
+			t.Sort, t.Descending = t.Sort[:i], true
+		case "asc":
+			t.Sort = t.Sort[:i]
+		}
+	}
+	return t
+}
+
+// printRates prints the counter rates of each instance followed by their
+// statistics across instances, whose sum is the rate of the whole app.
+// Counter resets are reported as warnings. Record outputs only print the
+// rates of each instance.
+func (c *AppsMetricsPlugin) printRates(rates []agent.InstanceMetric, resets []rate.Reset, outliers []aggregate.Outlier, s *snapshot.Snapshot, fc flags.FlagContext) {
+	stats := aggregate.Aggregate(rates)
+	if fc.IsSet("raw") {
+		c.printDefault(report{Instances: rates, Aggregate: stats, Outliers: outliers, Resets: resets})
+		return
+	}
+
+	if !fc.IsSet("aggregate") {
+		view, err := newView(fc.String("output"), fc, outliers, s)
+		if err != nil {
+			c.ui.Failed(err.Error())
+			return
+		}
+		err = view.Present(rates)
+		if err != nil {
+			c.ui.Warn(err.Error())
+			c.printDefault(rates)
+			return
+		}
+		// Records only hold the rates of the instances.
+		if quiet(fc) {
+			return
+		}
+		c.ui.Say("")
+	}
+
+	err := views.New(views.WithOutliers(outliers)).PresentAggregate(stats)
+	if err != nil {
+		c.ui.Warn(err.Error())
+	}
+	for _, r := range resets {
+		c.ui.Warn("counter reset on instance %d: %s went from %v to %v", r.Instance, r.Metric, r.Before, r.After)
+	}
+}
+
+// detect finds the metrics endpoint of the app and its format by trying the
+// endpoint flag, or else the well known paths, in order. What it found is
+// reported unless raw json output is requested.
+func (c *AppsMetricsPlugin) detect(app *plugin_models.GetAppModel, fc flags.FlagContext, opts ...agent.AgentOpt) (*agent.Agent, string, error) {
+	paths := parser.WellKnownPaths()
+	if fc.IsSet("endpoint") {
+		paths = []string{fc.String("endpoint")}
+	}
+
+	client := agent.New(app, nil, append(opts, agent.WithAccept(parser.Accept()))...)
+	detection, err := client.Detect(context.Background(), paths, func(contentType string, body []byte) (string, agent.Parser, bool) {
+		name, _, ok := parser.Detect(contentType, body)
+		if !ok {
+			return "", nil, false
+		}
+		f, _ := parser.Lookup(name)
+		return name, newParser(f, contentType, fc.IsSet("memstats")), true
+	})
+	if err != nil {
+		return nil, "", err
+	}
+
+	if !quiet(fc) {
+		c.ui.Say("Detected %s metrics at %s (Content-Type: %s)", detection.Format, detection.Path, detection.ContentType)
+	}
+	return client, detection.Format, nil
+}
+
+// newAgent returns the client that will GET the metrics of the app in the
+// format, and the format, which is detected first when it is auto.
+func (c *AppsMetricsPlugin) newAgent(app *plugin_models.GetAppModel, format string, fc flags.FlagContext, opts ...agent.AgentOpt) (*agent.Agent, string, error) {
+	if format == formatAuto {
+		return c.detect(app, fc, opts...)
+	}
+	f, ok := parser.Lookup(format)
+	if !ok {
+		return nil, "", fmt.Errorf("unknown format %q, expected one of %s or %s", format, strings.Join(parser.Names(), ", "), formatAuto)
+	}
+	return newFormatAgent(app, f, fc.IsSet("memstats"), opts...), format, nil
+}
+
+// newFormatAgent returns the client of a format that is known up front. It
+// asks for the encodings of the format and parses every response as its
+// Content-Type tells, so prometheus apps serving the protobuf format have
+// their native histograms included.
+func newFormatAgent(app *plugin_models.GetAppModel, f parser.Format, memStats bool, opts ...agent.AgentOpt) *agent.Agent {
+	if f.Accept != "" {
+		opts = append(opts, agent.WithAccept(f.Accept))
+	}
+	opts = append(opts, agent.WithNegotiation(func(contentType string) agent.Parser {
+		return newParser(f, contentType, memStats)
+	}))
+	return agent.New(app, newParser(f, "", memStats), opts...)
+}
+
+// newParser returns the parser of the format for a response with the given
+// Content-Type. Unless memstats are requested the expvar parser ignores
+// the `cmdline` and `memstats` properties as they clutter the output.
+func newParser(f parser.Format, contentType string, memStats bool) agent.Parser {
+	if f.Name != parser.FormatExpvar {
+		return f.New(contentType)
+	}
+	if memStats {
+		return parser.NewExpvar(parser.WithMemStatsSummary())
+	}
+	return parser.NewExpvar(parser.WithPropertiesToRemove([]string{"cmdline", "memstats"}))
+}
+
+// report is the raw json output when the analysis of the instance metrics is
+// requested.
+type report struct {
+	Instances  []agent.InstanceMetric `json:"instances"`
+	Aggregate  []aggregate.Stat       `json:"aggregate,omitempty"`
+	Outliers   []aggregate.Outlier    `json:"outliers,omitempty"`
+	Resets     []rate.Reset           `json:"resets,omitempty"`
+	Histograms *aggregate.Histograms  `json:"histograms,omitempty"`
+	Assertions []assert.Result        `json:"assertions,omitempty"`
+	Query      *query.Result          `json:"query,omitempty"`
+}
+
+// printAggregate prints the statistics of every numeric metric across the
+// instances as a table, or as json next to the instance metrics when raw
+// output is requested.
+func (c *AppsMetricsPlugin) printAggregate(metrics []agent.InstanceMetric, outliers []aggregate.Outlier, raw bool) {
+	stats := aggregate.Aggregate(metrics)
+	if raw {
+		c.printDefault(report{Instances: metrics, Aggregate: stats, Outliers: outliers})
+		return
+	}
+
+	err := views.New(views.WithOutliers(outliers)).PresentAggregate(stats)
+	if err != nil {
+		c.ui.Warn(err.Error())
+	}
+}
+
+// newOutlierDetector returns the detector configured by the outlier flags,
+// or nil when outliers are not requested.
+func newOutlierDetector(fc flags.FlagContext) (*aggregate.OutlierDetector, error) {
+	if !fc.IsSet("outliers") {
+		return nil, nil
+	}
+
+	var opts []aggregate.OutlierDetectorOpt
+	if fc.IsSet("outlier-method") {
+		m := aggregate.Method(fc.String("outlier-method"))
+		if m != aggregate.MethodMAD && m != aggregate.MethodZScore {
+			return nil, fmt.Errorf("unknown outlier method %q, expected %s or %s", m, aggregate.MethodMAD, aggregate.MethodZScore)
+		}
+		opts = append(opts, aggregate.WithMethod(m))
+	}
+	if fc.IsSet("outlier-threshold") {
+		t := fc.Float64("outlier-threshold")
+		if t <= 0 {
+			return nil, fmt.Errorf("outlier threshold must be positive, got %v", t)
+		}
+		opts = append(opts, aggregate.WithThreshold(t))
+	}
+	return aggregate.NewOutlierDetector(opts...), nil
+}
+
+// warnMaxScore warns, once, when the outlier threshold is too high for
+// any of the scraped instances to be flagged.
+func (c *AppsMetricsPlugin) warnMaxScore(a *analysis, metrics []agent.InstanceMetric) {
+	n := 0
+	for _, m := range metrics {
+		if m.Error == "" {
+			n++
+		}
+	}
+	if a.warnedMaxScore || a.detector.MaxScore(n) > a.detector.Threshold() {
+		return
+	}
+	a.warnedMaxScore = true
+	c.ui.Warn("no instance can be an outlier: the z-score of %d instances is at most %.3g, which does not exceed the threshold of %g", n, a.detector.MaxScore(n), a.detector.Threshold())
+}
+
+// printHistograms prints the quantiles estimated from the histograms of
+// each instance and from the histograms merged across instances.
+func (c *AppsMetricsPlugin) printHistograms(metrics []agent.InstanceMetric, quantiles []float64, raw bool) {
+	h := aggregate.EstimateHistograms(metrics, quantiles)
+	if raw {
+		c.printDefault(report{Instances: metrics, Histograms: &h})
+		return
+	}
+
+	if len(h.Instances) == 0 {
+		c.ui.Warn("no histograms found")
+		return
+	}
+	err := views.New().PresentHistograms(h)
+	if err != nil {
+		c.ui.Warn(err.Error())
+	}
+}
+
+// parseQuantiles returns the comma separated quantiles of the quantiles
+// flag, or else the default quantiles.
+func parseQuantiles(fc flags.FlagContext) ([]float64, error) {
+	if !fc.IsSet("quantiles") {
+		return aggregate.DefaultQuantiles, nil
+	}
+
+	var quantiles []float64
+	for _, s := range strings.Split(fc.String("quantiles"), ",") {
+		q, err := strconv.ParseFloat(strings.TrimSpace(s), 64)
+		if err != nil || q < 0 || q > 1 {
+			return nil, fmt.Errorf("invalid quantile %q, expected a number between 0 and 1", s)
+		}
+		quantiles = append(quantiles, q)
+	}
+	return quantiles, nil
+}
+
+// parseRateInterval returns the sampling interval of the rate flag, or zero
+// when rates are not requested.
+func parseRateInterval(fc flags.FlagContext) (time.Duration, error) {
+	if !fc.IsSet("rate") {
+		return 0, nil
+	}
+
+	interval, err := time.ParseDuration(fc.String("rate"))
+	if err != nil || interval <= 0 {
+		return 0, fmt.Errorf("invalid rate duration %q, expected e.g. 10s", fc.String("rate"))
+	}
+	return interval, nil
+}
+
+func (c *AppsMetricsPlugin) printDefault(metrics interface{}) {
+	bytes, err := json.Marshal(metrics)
+	if err != nil {
+		c.ui.Warn("unable to marshal metrics: %s\n", err)
+		return
+	}
+	c.ui.Say("%s\n", string(bytes))
+}
+
+// Kinds of options, which set the type of their flag.
+const (
+	boolOption = iota
+	intOption
+	floatOption
+	stringOption
+	sliceOption
+)
+
+// Commands an option applies to, as a mask of the option.
+const (
+	onExpvar = 1 << iota
+	onFormats
+	onReplay
+	onDiff
+	onTop
+
+	onScrape = onExpvar | onFormats
+)
+
+// option is a flag of the commands with its usage in their help. Options
+// that can be repeated are marked as such in the help.
+type option struct {
+	name     string
+	short    string
+	kind     int
+	commands int
+	usage    string
+}
+
+// options returns every flag of the commands.
+func options() []option {
+	names := parser.Names()
+	for i, n := range names {
+		if n == parser.FormatExpvar {
+			names[i] = n + " (default)"
+		}
+	}
+
+	return []option{
+		{"endpoint", "e", stringOption, onScrape | onTop, "path of the metrics endpoint"},
+		{"template", "t", stringOption, onScrape | onReplay, "path of a template file, directory or glob to render metrics"},
+		{"template-name", "", stringOption, onScrape | onReplay, "renders metrics with a built-in template (compact, detailed, go-runtime, http-server) or one defined in the template files"},
+		{"raw", "r", boolOption, onScrape | onReplay | onDiff, "prints raw json output"},
+		{"memstats", "m", boolOption, onExpvar | onDiff | onTop, "summarizes the memstats and keeps the cmdline properties"},
+		{"format", "f", stringOption, onExpvar | onTop, fmt.Sprintf("format of the metrics endpoint: %s or %s", strings.Join(names, ", "), formatAuto)},
+		{"include", "i", sliceOption, onScrape | onReplay | onDiff | onTop, "only show metrics matching a glob, $.json.path or series selector"},
+		{"exclude", "x", sliceOption, onScrape | onReplay | onDiff | onTop, "hide metrics matching a glob, $.json.path or series selector"},
+		{"aggregate", "a", boolOption, onScrape | onReplay, "shows sum, mean, min, max and stddev of every numeric metric across instances"},
+		{"rate", "", stringOption, onScrape, "scrapes twice, DURATION apart, and shows the per-second rate of counters"},
+		{"counter", "", sliceOption, onScrape | onReplay | onDiff, "treats the metrics matching a glob as counters in rate mode"},
+		{"histograms", "", boolOption, onScrape | onReplay, "estimates quantiles from the buckets of prometheus histograms, per instance and merged"},
+		{"quantiles", "", stringOption, onScrape | onReplay, "comma separated quantiles to estimate, defaults to 0.5,0.9,0.99"},
+		{"outliers", "", boolOption, onScrape | onReplay, "flags instances whose metrics deviate from the other instances"},
+		{"outlier-method", "", stringOption, onScrape | onReplay, "scores deviations with mad (default) or zscore, which needs 11 instances to reach its default threshold"},
+		{"outlier-threshold", "", floatOption, onScrape | onReplay, "absolute score above which an instance is an outlier (3.5 for mad, 3 for zscore)"},
+		{"assert", "", sliceOption, onScrape | onReplay, "checks an assertion like 'max(memstats.heap_inuse) < 512MiB' with -memstats and exits with status 1 when it fails"},
+		{"query", "", stringOption, onScrape | onReplay, "evaluates a PromQL query like 'sum by (instance) (rate(http_requests_total[30s]))', scraping rates the range apart"},
+		{"output", "o", stringOption, onScrape | onReplay, "renders the metrics as a table, csv, tsv, ndjson, prometheus or html instead of with the template"},
+		{"sort", "", stringOption, onScrape | onReplay, "sorts the table by a COLUMN, e.g. METRIC or 0, add :desc to reverse"},
+		{"transpose", "", boolOption, onScrape | onReplay, "shows a row per instance and a column per metric in the table"},
+		{"width", "", intOption, onScrape | onReplay, "truncates the table to a width, defaults to $COLUMNS"},
+		{"save", "", stringOption, onScrape, "saves the scraped metrics to a snapshot FILE that app-metrics-replay can show"},
+		{"out", "", sliceOption, onScrape | onReplay, "writes the output to a FILE instead of stdout, or OUTPUT:FILE to write another output too"},
+		{"watch", "", stringOption, onScrape, "scrapes every DURATION until interrupted or -count scrapes"},
+		{"rotate", "", stringOption, onScrape, "rotates the files of -out once they grow past a SIZE like 10MiB in watch mode"},
+		{"columns", "", sliceOption, onTop, "shows the metrics matching a glob as columns, defaults to every numeric metric"},
+		{"interval", "", stringOption, onTop, "time between scrapes, defaults to 2s"},
+		{"count", "", intOption, onScrape | onTop, "number of scrapes before exiting in watch mode"},
+	}
+}
+
+// commandOptions returns the mask of the options that apply to a command.
+func commandOptions(command string) int {
+	switch command {
+	case "app-metrics":
+		return onExpvar
+	case replayCommand:
+		return onReplay
+	case diffCommand:
+		return onDiff
+	case topCommand:
+		return onTop
+	}
+	return onFormats
+}
+
+// usageOptions returns the help of the options that apply to a command, with
+// the usages the command words differently.
+func usageOptions(command string, usages map[string]string) map[string]string {
+	help := make(map[string]string)
+	for _, o := range options() {
+		if o.commands&commandOptions(command) == 0 {
+			continue
+		}
+		usage := o.usage
+		if u, ok := usages[o.name]; ok {
+			usage = u
+		}
+		if o.kind == sliceOption {
+			usage += " (repeatable)"
+		}
+		help[o.name] = usage
+	}
+	return help
+}
+
+// parseArguments parses the flags of the command named by the first
+// argument, for which options that do not apply are unknown flags.
+func parseArguments(args []string) (flags.FlagContext, error) {
+	fc := flags.New()
+	for _, o := range options() {
+		if o.commands&commandOptions(args[0]) == 0 {
+			continue
+		}
+		usage := strings.ToUpper(o.usage[:1]) + o.usage[1:]
+		switch o.kind {
+		case boolOption:
+			fc.NewBoolFlag(o.name, o.short, usage)
+		case intOption:
+			fc.NewIntFlag(o.name, o.short, usage)
+		case floatOption:
+			fc.NewFloat64Flag(o.name, o.short, usage)
+		case stringOption:
+			fc.NewStringFlag(o.name, o.short, usage)
+		case sliceOption:
+			fc.NewStringSliceFlag(o.name, o.short, usage)
+		}
+	}
 
 	err := fc.Parse(args...)
 	if err != nil {
@@ -6,10 +6,16 @@ import (
 	"net/http"
 	"net/http/httptest"
 	"os"
+	"path/filepath"
+	"strconv"
 	"strings"
+	"sync/atomic"
+	"time"
 
 	"code.cloudfoundry.org/cli/plugin/models"
 	"code.cloudfoundry.org/cli/plugin/pluginfakes"
+	dto "github.com/prometheus/client_model/go"
+	"github.com/prometheus/common/expfmt"
 
 	. "code.cloudfoundry.org/cli/util/testhelpers/io"
 	. "github.com/onsi/ginkgo"
@@ -73,6 +79,411 @@ var _ = Describe("AppsMetrics Integration", func() {
 			Expect(output).To(ContainElement(`[{"Instance":0,"Error":"","Metrics":{"ingress.received":12345,"ingress.sent":12345}}]`))
 		})
 
+		It("prints a memstats summary when memstats flag is specified", func() {
+			fakeCliConnection := &pluginfakes.FakeCliConnection{}
+			mux := http.NewServeMux()
+			ts := httptest.NewServer(mux)
+			defer ts.Close()
+			mux.HandleFunc("/debug/metrics", func(w http.ResponseWriter, r *http.Request) {
+				fmt.Fprintf(w, `{"cmdline":["bin/app"],"memstats":{"HeapInuse":2211840,"HeapObjects":11469,"NumGC":1,"PauseNs":[1500,0],"GCCPUFraction":0.5}}`)
+			})
+			// trimming the scheme because we'll build the url back from app model
+			model := buildAppModel(strings.TrimPrefix(ts.URL, "http://"), 1)
+			fakeCliConnection.GetAppReturns(model, nil)
+
+			appsMetricsPlugin := &AppsMetricsPlugin{}
+			output := CaptureOutput(func() {
+				appsMetricsPlugin.Run(fakeCliConnection, []string{"app-metrics", "some-app", "-memstats", "-raw"})
+			})
+
+			Expect(output).To(ContainElement(MatchJSON(`[{"Instance":0,"Error":"","Metrics":{"cmdline":["bin/app"],"memstats":{"heap_inuse":2211840,"heap_objects":11469,"num_gc":1,"gc_cpu_fraction":0.5,"last_pause":1500,"recent_pauses":[1500]}}}]`)))
+		})
+
+		It("filters metrics with include and exclude flags", func() {
+			fakeCliConnection := &pluginfakes.FakeCliConnection{}
+			mux := http.NewServeMux()
+			ts := httptest.NewServer(mux)
+			defer ts.Close()
+			mux.HandleFunc("/debug/metrics", func(w http.ResponseWriter, r *http.Request) {
+				fmt.Fprintf(w, `{"ingress.received": 12345,"ingress.sent": 12345,"egress.sent": 1,"metric.map":{"metric1":10,"metric2":11}}`)
+			})
+			// trimming the scheme because we'll build the url back from app model
+			model := buildAppModel(strings.TrimPrefix(ts.URL, "http://"), 1)
+			fakeCliConnection.GetAppReturns(model, nil)
+
+			appsMetricsPlugin := &AppsMetricsPlugin{}
+			output := CaptureOutput(func() {
+				appsMetricsPlugin.Run(fakeCliConnection, []string{"app-metrics", "some-app", "-raw",
+					"-include", "ingress.*", "-include", "$['metric.map'].metric1", "-exclude", "*.sent"})
+			})
+
+			Expect(output).To(ContainElement(`[{"Instance":0,"Error":"","Metrics":{"ingress.received":12345,"metric.map":{"metric1":10}}}]`))
+		})
+
+		It("aggregates metrics across instances", func() {
+			fakeCliConnection := &pluginfakes.FakeCliConnection{}
+			mux := http.NewServeMux()
+			ts := httptest.NewServer(mux)
+			defer ts.Close()
+			mux.HandleFunc("/debug/metrics", func(w http.ResponseWriter, r *http.Request) {
+				// The instance index is the last character of the X-CF-APP-INSTANCE header.
+				instance := r.Header.Get("X-CF-APP-INSTANCE")
+				fmt.Fprintf(w, `{"ingress.received": 1%s,"name":"app"}`, instance[len(instance)-1:])
+			})
+			// trimming the scheme because we'll build the url back from app model
+			model := buildAppModel(strings.TrimPrefix(ts.URL, "http://"), 2)
+			fakeCliConnection.GetAppReturns(model, nil)
+
+			appsMetricsPlugin := &AppsMetricsPlugin{}
+			output := CaptureOutput(func() {
+				appsMetricsPlugin.Run(fakeCliConnection, []string{"app-metrics", "some-app", "-aggregate"})
+			})
+			Expect(output).To(ContainElement("METRIC            INSTANCES  SUM  MEAN  MIN      MAX      STDDEV"))
+			Expect(output).To(ContainElement("ingress.received  2          21   10.5  10 (#0)  11 (#1)  0.5"))
+
+			output = CaptureOutput(func() {
+				appsMetricsPlugin.Run(fakeCliConnection, []string{"app-metrics", "some-app", "-aggregate", "-raw"})
+			})
+			Expect(output).To(ContainElement(ContainSubstring(`"aggregate":[{"metric":"ingress.received","instances":2,"sum":21,"mean":10.5,"min":10,"max":11,"stddev":0.5,"min_instance":0,"max_instance":1}]`)))
+			Expect(output).To(ContainElement(HavePrefix(`{"instances":[{"Instance":0,"Error":"","Metrics":{"ingress.received":10,"name":"app"}}`)))
+		})
+
+		It("highlights outlier instances", func() {
+			fakeCliConnection := &pluginfakes.FakeCliConnection{}
+			mux := http.NewServeMux()
+			ts := httptest.NewServer(mux)
+			defer ts.Close()
+			mux.HandleFunc("/debug/metrics", func(w http.ResponseWriter, r *http.Request) {
+				latency := 10
+				if strings.HasSuffix(r.Header.Get("X-CF-APP-INSTANCE"), ":2") {
+					latency = 95
+				}
+				fmt.Fprintf(w, `{"latency": %d}`, latency)
+			})
+			// trimming the scheme because we'll build the url back from app model
+			model := buildAppModel(strings.TrimPrefix(ts.URL, "http://"), 5)
+			fakeCliConnection.GetAppReturns(model, nil)
+
+			appsMetricsPlugin := &AppsMetricsPlugin{}
+			output := CaptureOutput(func() {
+				appsMetricsPlugin.Run(fakeCliConnection, []string{"app-metrics", "some-app", "-outliers"})
+			})
+			Expect(output).To(ContainElement("Instance: 1"))
+			Expect(output).To(ContainElement("Instance: 2 [OUTLIER]"))
+			Expect(output).To(ContainElement("  latency: 95 (peers 10, score 3.989)"))
+
+			output = CaptureOutput(func() {
+				appsMetricsPlugin.Run(fakeCliConnection, []string{"app-metrics", "some-app", "-outliers", "-raw"})
+			})
+			Expect(output).To(ContainElement(ContainSubstring(`"outliers":[{"instance":2,"deviations":[{"metric":"latency","value":95,"center":10,"score":3.989`)))
+		})
+
+		It("warns when the z-score threshold cannot be reached with the instances", func() {
+			fakeCliConnection := &pluginfakes.FakeCliConnection{}
+			mux := http.NewServeMux()
+			ts := httptest.NewServer(mux)
+			defer ts.Close()
+			mux.HandleFunc("/debug/metrics", func(w http.ResponseWriter, r *http.Request) {
+				latency := 10
+				if strings.HasSuffix(r.Header.Get("X-CF-APP-INSTANCE"), ":2") {
+					latency = 95
+				}
+				fmt.Fprintf(w, `{"latency": %d}`, latency)
+			})
+			model := buildAppModel(strings.TrimPrefix(ts.URL, "http://"), 5)
+			fakeCliConnection.GetAppReturns(model, nil)
+
+			appsMetricsPlugin := &AppsMetricsPlugin{}
+			output := CaptureOutput(func() {
+				appsMetricsPlugin.Run(fakeCliConnection, []string{"app-metrics", "some-app", "-outliers", "-outlier-method", "zscore"})
+			})
+			Expect(output).To(ContainElement("no instance can be an outlier: the z-score of 5 instances is at most 2, which does not exceed the threshold of 3"))
+			Expect(output).ToNot(ContainElement(ContainSubstring("[OUTLIER]")))
+		})
+
+		It("prints error for an unknown outlier method", func() {
+			fakeCliConnection := &pluginfakes.FakeCliConnection{}
+			fakeCliConnection.GetAppReturns(buildAppModel("localhost", 1), nil)
+
+			appsMetricsPlugin := &AppsMetricsPlugin{}
+			output := CaptureOutput(func() {
+				appsMetricsPlugin.Run(fakeCliConnection, []string{"app-metrics", "some-app", "-outliers", "-outlier-method", "iqr"})
+			})
+			Expect(output).To(ContainElement(`unknown outlier method "iqr", expected mad or zscore`))
+		})
+
+		It("shows counter rates with the rate flag", func() {
+			var scrapes int32
+			fakeCliConnection := &pluginfakes.FakeCliConnection{}
+			mux := http.NewServeMux()
+			ts := httptest.NewServer(mux)
+			defer ts.Close()
+			mux.HandleFunc("/debug/metrics", func(w http.ResponseWriter, r *http.Request) {
+				// the first scrape returns 0 and the second a large number,
+				// so the rate is positive whatever the interval
+				requests := 0
+				if atomic.AddInt32(&scrapes, 1) > 1 {
+					requests = 1000000
+				}
+				fmt.Fprintf(w, `{"requests": %d, "goroutines": 5}`, requests)
+			})
+			model := buildAppModel(strings.TrimPrefix(ts.URL, "http://"), 1)
+			fakeCliConnection.GetAppReturns(model, nil)
+
+			appsMetricsPlugin := &AppsMetricsPlugin{}
+			output := CaptureOutput(func() {
+				appsMetricsPlugin.Run(fakeCliConnection, []string{"app-metrics", "some-app", "-rate", "10ms", "-counter", "requests"})
+			})
+
+			Expect(output).To(ContainElement("Instance: 0"))
+			Expect(output).To(ContainElement(MatchRegexp(`^  requests: [0-9.]+$`)))
+			Expect(output).ToNot(ContainElement(ContainSubstring("goroutines")))
+			Expect(output).To(ContainElement(HavePrefix("METRIC")))
+			Expect(output).To(ContainElement(MatchRegexp(`^requests +1 +[0-9.]+`)))
+		})
+
+		It("prints error for an invalid rate duration", func() {
+			fakeCliConnection := &pluginfakes.FakeCliConnection{}
+			fakeCliConnection.GetAppReturns(buildAppModel("localhost", 1), nil)
+
+			appsMetricsPlugin := &AppsMetricsPlugin{}
+			output := CaptureOutput(func() {
+				appsMetricsPlugin.Run(fakeCliConnection, []string{"app-metrics", "some-app", "-rate", "soon"})
+			})
+			Expect(output).To(ContainElement(`invalid rate duration "soon", expected e.g. 10s`))
+		})
+
+		It("checks assertions and exits with status 1 when one fails", func() {
+			fakeCliConnection := &pluginfakes.FakeCliConnection{}
+			mux := http.NewServeMux()
+			ts := httptest.NewServer(mux)
+			defer ts.Close()
+			mux.HandleFunc("/debug/metrics", func(w http.ResponseWriter, r *http.Request) {
+				goroutines := 100
+				if strings.HasSuffix(r.Header.Get("X-CF-APP-INSTANCE"), ":1") {
+					goroutines = 6000
+				}
+				fmt.Fprintf(w, `{"goroutines": %d, "heap": 1048576}`, goroutines)
+			})
+			model := buildAppModel(strings.TrimPrefix(ts.URL, "http://"), 2)
+			fakeCliConnection.GetAppReturns(model, nil)
+
+			code := -1
+			appsMetricsPlugin := NewAppsMetricsPluginWithExit(func(c int) { code = c })
+			output := CaptureOutput(func() {
+				appsMetricsPlugin.Run(fakeCliConnection, []string{"app-metrics", "some-app", "-assert", "max(heap) < 512MiB"})
+			})
+			Expect(output).To(ContainElement("PASS  max(heap) < 512MiB"))
+			Expect(code).To(Equal(-1))
+
+			output = CaptureOutput(func() {
+				appsMetricsPlugin.Run(fakeCliConnection, []string{"app-metrics", "some-app", "-assert", "max(heap) < 512MiB", "-assert", "goroutines < 5000"})
+			})
+			Expect(output).To(ContainElement("FAIL  goroutines < 5000"))
+			Expect(output).To(ContainElement("      instance 1: goroutines: 6000"))
+			Expect(output).To(ContainElement("1 of 2 assertions failed"))
+			Expect(code).To(Equal(1))
+		})
+
+		It("checks assertions on the memstats summary", func() {
+			fakeCliConnection := &pluginfakes.FakeCliConnection{}
+			mux := http.NewServeMux()
+			ts := httptest.NewServer(mux)
+			defer ts.Close()
+			mux.HandleFunc("/debug/metrics", func(w http.ResponseWriter, r *http.Request) {
+				fmt.Fprint(w, `{"memstats": {"HeapInuse": 629145600, "NumGC": 0}}`)
+			})
+			model := buildAppModel(strings.TrimPrefix(ts.URL, "http://"), 1)
+			fakeCliConnection.GetAppReturns(model, nil)
+
+			code := -1
+			appsMetricsPlugin := NewAppsMetricsPluginWithExit(func(c int) { code = c })
+			output := CaptureOutput(func() {
+				appsMetricsPlugin.Run(fakeCliConnection, []string{"app-metrics", "some-app", "-memstats", "-assert", "max(memstats.heap_inuse) < 512MiB"})
+			})
+			Expect(output).To(ContainElement("FAIL  max(memstats.heap_inuse) < 512MiB"))
+			Expect(output).To(ContainElement("      memstats.heap_inuse: 629145600"))
+			Expect(code).To(Equal(1))
+		})
+
+		It("checks rate assertions between two scrapes", func() {
+			var scrapes int32
+			fakeCliConnection := &pluginfakes.FakeCliConnection{}
+			mux := http.NewServeMux()
+			ts := httptest.NewServer(mux)
+			defer ts.Close()
+			mux.HandleFunc("/debug/metrics", func(w http.ResponseWriter, r *http.Request) {
+				errors := 0
+				if atomic.AddInt32(&scrapes, 1) > 1 {
+					errors = 1000
+				}
+				fmt.Fprintf(w, `{"errors": %d}`, errors)
+			})
+			model := buildAppModel(strings.TrimPrefix(ts.URL, "http://"), 1)
+			fakeCliConnection.GetAppReturns(model, nil)
+
+			code := -1
+			appsMetricsPlugin := NewAppsMetricsPluginWithExit(func(c int) { code = c })
+			output := CaptureOutput(func() {
+				appsMetricsPlugin.Run(fakeCliConnection, []string{"app-metrics", "some-app", "-rate", "10ms", "-assert", "errors rate == 0", "-raw"})
+			})
+			Expect(output).To(ContainElement(ContainSubstring(`"assertions":[{"assertion":"errors rate == 0","passed":false,"failures":[{"instance":0,"metric":"errors","value":`)))
+			Expect(code).To(Equal(1))
+		})
+
+		It("prints error for an invalid assertion", func() {
+			fakeCliConnection := &pluginfakes.FakeCliConnection{}
+			fakeCliConnection.GetAppReturns(buildAppModel("localhost", 1), nil)
+
+			appsMetricsPlugin := &AppsMetricsPlugin{}
+			output := CaptureOutput(func() {
+				appsMetricsPlugin.Run(fakeCliConnection, []string{"app-metrics", "some-app", "-assert", "goroutines"})
+			})
+			Expect(output).To(ContainElement(`invalid assertion "goroutines", expected e.g. 'goroutines < 5000'`))
+		})
+
+		It("evaluates a query", func() {
+			fakeCliConnection := &pluginfakes.FakeCliConnection{}
+			mux := http.NewServeMux()
+			ts := httptest.NewServer(mux)
+			defer ts.Close()
+			mux.HandleFunc("/debug/metrics", func(w http.ResponseWriter, r *http.Request) {
+				goroutines := 100
+				if strings.HasSuffix(r.Header.Get("X-CF-APP-INSTANCE"), ":1") {
+					goroutines = 300
+				}
+				fmt.Fprintf(w, `{"goroutines": %d, "memstats": {"HeapInuse": 1048576}}`, goroutines)
+			})
+			model := buildAppModel(strings.TrimPrefix(ts.URL, "http://"), 2)
+			fakeCliConnection.GetAppReturns(model, nil)
+
+			appsMetricsPlugin := &AppsMetricsPlugin{}
+			output := CaptureOutput(func() {
+				appsMetricsPlugin.Run(fakeCliConnection, []string{"app-metrics", "some-app", "-memstats", "-query", "sum by (instance) (goroutines) * 2"})
+			})
+			Expect(output).To(ContainElement(MatchRegexp(`^SERIES +VALUE$`)))
+			Expect(output).To(ContainElement(MatchRegexp(`^{instance="0"} +200$`)))
+			Expect(output).To(ContainElement(MatchRegexp(`^{instance="1"} +600$`)))
+
+			output = CaptureOutput(func() {
+				appsMetricsPlugin.Run(fakeCliConnection, []string{"app-metrics", "some-app", "-memstats", "-query", "max(memstats.heap_inuse) / 1024", "-raw"})
+			})
+			Expect(output).To(ContainElement(ContainSubstring(`"query":{"type":"vector","vector":[{"metric":{},"value":1024}]}`)))
+		})
+
+		It("scrapes over the range of a query and evaluates it after every scrape in watch mode", func() {
+			fakeCliConnection := &pluginfakes.FakeCliConnection{}
+			mux := http.NewServeMux()
+			ts := httptest.NewServer(mux)
+			defer ts.Close()
+			var scrapes int32
+			mux.HandleFunc("/debug/metrics", func(w http.ResponseWriter, r *http.Request) {
+				fmt.Fprintf(w, `{"requests": %d}`, atomic.AddInt32(&scrapes, 1))
+			})
+			model := buildAppModel(strings.TrimPrefix(ts.URL, "http://"), 1)
+			fakeCliConnection.GetAppReturns(model, nil)
+
+			appsMetricsPlugin := &AppsMetricsPlugin{}
+			start := time.Now()
+			output := CaptureOutput(func() {
+				appsMetricsPlugin.Run(fakeCliConnection, []string{"app-metrics", "some-app", "-query", "sum(increase(requests[20ms]))"})
+			})
+			Expect(time.Since(start)).To(BeNumerically("<", time.Second))
+			Expect(output).To(ContainElement(MatchRegexp(`^{} +1$`)))
+
+			output = CaptureOutput(func() {
+				appsMetricsPlugin.Run(fakeCliConnection, []string{"app-metrics", "some-app", "-query", "sum(increase(requests[20ms]))", "-watch", "10ms", "-count", "4"})
+			})
+			Expect(output).To(ContainElement("Waiting for 20ms of scrapes to evaluate sum(increase(requests[20ms]))"))
+			results := 0
+			for _, line := range output {
+				if strings.HasPrefix(line, "{}") {
+					Expect(line).To(MatchRegexp(`^{} +[12]$`))
+					results++
+				}
+			}
+			Expect(results).To(BeNumerically(">=", 2))
+		})
+
+		It("prints error for an invalid query", func() {
+			fakeCliConnection := &pluginfakes.FakeCliConnection{}
+			fakeCliConnection.GetAppReturns(buildAppModel("localhost", 1), nil)
+
+			appsMetricsPlugin := &AppsMetricsPlugin{}
+			output := CaptureOutput(func() {
+				appsMetricsPlugin.Run(fakeCliConnection, []string{"app-metrics", "some-app", "-query", "sum(goroutines"})
+			})
+			Expect(output).To(ContainElement(`invalid query "sum(goroutines": expected ), found end of query`))
+		})
+
+		It("streams a json object per instance with ndjson output", func() {
+			fakeCliConnection := &pluginfakes.FakeCliConnection{}
+			mux := http.NewServeMux()
+			ts := httptest.NewServer(mux)
+			defer ts.Close()
+			mux.HandleFunc("/debug/metrics", func(w http.ResponseWriter, r *http.Request) {
+				fmt.Fprint(w, `{"goroutines": 5, "memstats": {"HeapInuse": 1024}}`)
+			})
+			model := buildAppModel(strings.TrimPrefix(ts.URL, "http://"), 2)
+			fakeCliConnection.GetAppReturns(model, nil)
+
+			appsMetricsPlugin := &AppsMetricsPlugin{}
+			output := CaptureOutput(func() {
+				appsMetricsPlugin.Run(fakeCliConnection, []string{"app-metrics", "some-app", "-output", "ndjson", "-format", "auto", "-include", "goroutines"})
+			})
+			Expect(output).To(ConsistOf(`{"instance":0,"metrics":{"goroutines":5}}`, `{"instance":1,"metrics":{"goroutines":5}}`, ""))
+
+			output = CaptureOutput(func() {
+				appsMetricsPlugin.Run(fakeCliConnection, []string{"app-metrics", "some-app", "-output", "csv"})
+			})
+			Expect(output).To(Equal([]string{
+				"instance,metric,value,error",
+				"0,goroutines,5,",
+				"1,goroutines,5,",
+				"",
+			}))
+		})
+
+		It("detects the format and endpoint with auto format", func() {
+			fakeCliConnection := &pluginfakes.FakeCliConnection{}
+			mux := http.NewServeMux()
+			ts := httptest.NewServer(mux)
+			defer ts.Close()
+			mux.HandleFunc("/metrics", func(w http.ResponseWriter, r *http.Request) {
+				w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+				fmt.Fprintf(w, rawPrometheus)
+			})
+			// trimming the scheme because we'll build the url back from app model
+			model := buildAppModel(strings.TrimPrefix(ts.URL, "http://"), 1)
+			fakeCliConnection.GetAppReturns(model, nil)
+
+			appsMetricsPlugin := &AppsMetricsPlugin{}
+			output := CaptureOutput(func() {
+				appsMetricsPlugin.Run(fakeCliConnection, []string{"app-metrics", "some-app", "-format", "auto"})
+			})
+
+			Expect(output).To(ContainElement("Detected prometheus metrics at /metrics (Content-Type: text/plain; version=0.0.4)"))
+			Expect(output).To(ContainElement(`  go_info [gauge] Information about the Go environment.`))
+		})
+
+		It("prints error when auto format finds no metrics", func() {
+			fakeCliConnection := &pluginfakes.FakeCliConnection{}
+			mux := http.NewServeMux()
+			ts := httptest.NewServer(mux)
+			defer ts.Close()
+			// trimming the scheme because we'll build the url back from app model
+			model := buildAppModel(strings.TrimPrefix(ts.URL, "http://"), 1)
+			fakeCliConnection.GetAppReturns(model, nil)
+
+			appsMetricsPlugin := &AppsMetricsPlugin{}
+			output := CaptureOutput(func() {
+				appsMetricsPlugin.Run(fakeCliConnection, []string{"app-metrics", "some-app", "-format", "auto"})
+			})
+
+			Expect(output).To(ContainElement("FAILED"))
+			Expect(output).To(ContainElement(ContainSubstring("unable to detect metrics endpoint: /debug/vars: 404 Not Found")))
+		})
+
 		It("prints default template output style", func() {
 			endpoint := "/myspecific/metrics/endpoint"
 			fakeCliConnection := &pluginfakes.FakeCliConnection{}
@@ -131,13 +542,13 @@ var _ = Describe("AppsMetrics Integration", func() {
 			Expect(output).To(ContainElement(`1 map[ingress.received:222]`))
 		})
 
-		It("prints error if unable to parse template files", func() {
+		It("parses custom templates with the template functions", func() {
 			// setup test server/app
 			mux := http.NewServeMux()
 			ts := httptest.NewServer(mux)
 			defer ts.Close()
 			mux.HandleFunc("/debug/metrics", func(w http.ResponseWriter, r *http.Request) {
-				fmt.Fprintf(w, `{"ingress.received": 222}`)
+				fmt.Fprintf(w, `{"ingress": {"bytes": 2048}}`)
 			})
 
 			// setup fake app model with multiple app instances
@@ -145,19 +556,416 @@ var _ = Describe("AppsMetrics Integration", func() {
 			model := buildAppModel(strings.TrimPrefix(ts.URL, "http://"), 2)
 			fakeCliConnection.GetAppReturns(model, nil)
 
+			// setup temporary template file
+			content := []byte(`{{humanizeBytes (sum "ingress.bytes" .)}}`)
+			tmpfile, err := ioutil.TempFile("", "example")
+			Expect(err).ToNot(HaveOccurred())
+			defer os.Remove(tmpfile.Name())
+			_, err = tmpfile.Write(content)
+			Expect(err).ToNot(HaveOccurred())
+			err = tmpfile.Close()
+			Expect(err).ToNot(HaveOccurred())
+
 			plugin := &AppsMetricsPlugin{}
 			output := CaptureOutput(func() {
-				plugin.Run(fakeCliConnection, []string{"app-metrics", "some-app", "-template", "/some/file/path"})
+				plugin.Run(fakeCliConnection, []string{"app-metrics", "some-app", "-template", tmpfile.Name()})
 			})
-			Expect(output).To(HaveLen(3))
+			Expect(output).To(ContainElement("4.0 KiB"))
+		})
+
+		It("prints a built-in template selected by name", func() {
+			// setup test server/app
+			mux := http.NewServeMux()
+			ts := httptest.NewServer(mux)
+			defer ts.Close()
+			mux.HandleFunc("/debug/metrics", func(w http.ResponseWriter, r *http.Request) {
+				fmt.Fprintf(w, `{"ingress.received": 222}`)
+			})
+
+			// setup fake app model with multiple app instances
+			fakeCliConnection := &pluginfakes.FakeCliConnection{}
+			model := buildAppModel(strings.TrimPrefix(ts.URL, "http://"), 2)
+			fakeCliConnection.GetAppReturns(model, nil)
+
+			plugin := &AppsMetricsPlugin{}
+			output := CaptureOutput(func() {
+				plugin.Run(fakeCliConnection, []string{"app-metrics", "some-app", "-template-name", "compact"})
+			})
+			Expect(output).To(ContainElement("0: ingress.received=222"))
+			Expect(output).To(ContainElement("1: ingress.received=222"))
+		})
+
+		It("prints error for an unknown template name", func() {
+			fakeCliConnection := &pluginfakes.FakeCliConnection{}
+			model := buildAppModel("localhost:0", 1)
+			fakeCliConnection.GetAppReturns(model, nil)
+
+			plugin := &AppsMetricsPlugin{}
+			output := CaptureOutput(func() {
+				plugin.Run(fakeCliConnection, []string{"app-metrics", "some-app", "-template-name", "fancy"})
+			})
+			Expect(output).To(ContainElement(ContainSubstring(`unknown template "fancy"`)))
+		})
+
+		It("prints error if unable to parse template files", func() {
+			// setup test server/app
+			mux := http.NewServeMux()
+			ts := httptest.NewServer(mux)
+			defer ts.Close()
+			mux.HandleFunc("/debug/metrics", func(w http.ResponseWriter, r *http.Request) {
+				fmt.Fprintf(w, `{"ingress.received": 222}`)
+			})
+
+			// setup fake app model with multiple app instances
+			fakeCliConnection := &pluginfakes.FakeCliConnection{}
+			model := buildAppModel(strings.TrimPrefix(ts.URL, "http://"), 2)
+			fakeCliConnection.GetAppReturns(model, nil)
+
+			plugin := &AppsMetricsPlugin{}
+			output := CaptureOutput(func() {
+				plugin.Run(fakeCliConnection, []string{"app-metrics", "some-app", "-template", "/some/file/path"})
+			})
+			Expect(output).To(HaveLen(3))
 			Expect(output[0]).To(Equal("FAILED"))
 			Expect(output[1]).To(ContainSubstring("unable to parse template files"))
 		})
+
+		It("writes an html report to a file", func() {
+			fakeCliConnection := &pluginfakes.FakeCliConnection{}
+			mux := http.NewServeMux()
+			ts := httptest.NewServer(mux)
+			defer ts.Close()
+			mux.HandleFunc("/debug/metrics", func(w http.ResponseWriter, r *http.Request) {
+				instance := r.Header.Get("X-CF-APP-INSTANCE")
+				fmt.Fprintf(w, `{"ingress.received": 1%s}`, instance[len(instance)-1:])
+			})
+			model := buildAppModel(strings.TrimPrefix(ts.URL, "http://"), 2)
+			model.Name = "some-app"
+			fakeCliConnection.GetAppReturns(model, nil)
+
+			tmpfile, err := ioutil.TempFile("", "report")
+			Expect(err).ToNot(HaveOccurred())
+			Expect(tmpfile.Close()).To(Succeed())
+			defer os.Remove(tmpfile.Name())
+
+			appsMetricsPlugin := &AppsMetricsPlugin{}
+			output := CaptureOutput(func() {
+				appsMetricsPlugin.Run(fakeCliConnection, []string{"app-metrics", "some-app", "-output", "html", "-out", tmpfile.Name()})
+			})
+			Expect(output).To(ContainElement("Saved report to " + tmpfile.Name()))
+
+			report, err := ioutil.ReadFile(tmpfile.Name())
+			Expect(err).ToNot(HaveOccurred())
+			Expect(string(report)).To(ContainSubstring("<h1>Metrics of some-app</h1>"))
+			Expect(string(report)).To(ContainSubstring(`<tr><td>ingress.received</td><td class="num">2</td><td class="num">21</td>`))
+			Expect(string(report)).To(ContainSubstring("<h3>Instance 1</h3>"))
+		})
+
+		It("writes other outputs to files besides the one printed", func() {
+			fakeCliConnection := &pluginfakes.FakeCliConnection{}
+			mux := http.NewServeMux()
+			ts := httptest.NewServer(mux)
+			defer ts.Close()
+			mux.HandleFunc("/debug/metrics", func(w http.ResponseWriter, r *http.Request) {
+				instance := r.Header.Get("X-CF-APP-INSTANCE")
+				fmt.Fprintf(w, `{"ingress.received": 1%s}`, instance[len(instance)-1:])
+			})
+			model := buildAppModel(strings.TrimPrefix(ts.URL, "http://"), 2)
+			model.Name = "some-app"
+			fakeCliConnection.GetAppReturns(model, nil)
+
+			dir, err := ioutil.TempDir("", "out")
+			Expect(err).ToNot(HaveOccurred())
+			defer os.RemoveAll(dir)
+			records := filepath.Join(dir, "metrics.ndjson")
+			snapshot := filepath.Join(dir, "metrics.snapshot")
+
+			appsMetricsPlugin := &AppsMetricsPlugin{}
+			output := CaptureOutput(func() {
+				appsMetricsPlugin.Run(fakeCliConnection, []string{"app-metrics", "some-app", "-output", "table", "-out", "ndjson:" + records, "-save", snapshot})
+			})
+			Expect(output).To(ContainElement("Saved ndjson output to " + records))
+			Expect(output).To(ContainElement("Saved snapshot to " + snapshot))
+			Expect(output).To(ContainElement(MatchRegexp(`^ingress\.received\s+10\s+11$`)))
+
+			b, err := ioutil.ReadFile(records)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(string(b)).To(Equal(`{"instance":0,"metrics":{"ingress.received":10}}` + "\n" + `{"instance":1,"metrics":{"ingress.received":11}}` + "\n"))
+			Expect(snapshot).To(BeAnExistingFile())
+		})
+
+		It("scrapes until the count in watch mode and rotates the files", func() {
+			fakeCliConnection := &pluginfakes.FakeCliConnection{}
+			mux := http.NewServeMux()
+			ts := httptest.NewServer(mux)
+			defer ts.Close()
+			mux.HandleFunc("/debug/metrics", func(w http.ResponseWriter, r *http.Request) {
+				fmt.Fprintf(w, `{"ingress.received": 10}`)
+			})
+			model := buildAppModel(strings.TrimPrefix(ts.URL, "http://"), 2)
+			model.Name = "some-app"
+			fakeCliConnection.GetAppReturns(model, nil)
+
+			dir, err := ioutil.TempDir("", "out")
+			Expect(err).ToNot(HaveOccurred())
+			defer os.RemoveAll(dir)
+			records := filepath.Join(dir, "metrics.csv")
+
+			appsMetricsPlugin := &AppsMetricsPlugin{}
+			output := CaptureOutput(func() {
+				appsMetricsPlugin.Run(fakeCliConnection, []string{"app-metrics", "some-app", "-output", "table", "-watch", "10ms", "-count", "3", "-out", "csv:" + records, "-rotate", "100B"})
+			})
+			var rows []string
+			for _, line := range output {
+				if strings.HasPrefix(line, "ingress.received") {
+					rows = append(rows, line)
+				}
+			}
+			Expect(rows).To(HaveLen(3))
+
+			current, err := ioutil.ReadFile(records)
+			Expect(err).ToNot(HaveOccurred())
+			rotated, err := ioutil.ReadFile(records + ".1")
+			Expect(err).ToNot(HaveOccurred())
+			Expect(string(current)).To(HavePrefix("time,instance,metric,value,error\n"))
+			Expect(string(rotated)).To(HavePrefix("time,instance,metric,value,error\n"))
+			Expect(strings.Count(string(current)+string(rotated), ",ingress.received,10,\n")).To(BeNumerically(">=", 4))
+		})
+
+		It("rewrites the files of documents with the latest scrape in watch mode", func() {
+			fakeCliConnection := &pluginfakes.FakeCliConnection{}
+			mux := http.NewServeMux()
+			ts := httptest.NewServer(mux)
+			defer ts.Close()
+			var scrapes int32
+			mux.HandleFunc("/debug/metrics", func(w http.ResponseWriter, r *http.Request) {
+				fmt.Fprintf(w, `{"ingress.received": %d}`, atomic.AddInt32(&scrapes, 1))
+			})
+			model := buildAppModel(strings.TrimPrefix(ts.URL, "http://"), 1)
+			model.Name = "some-app"
+			fakeCliConnection.GetAppReturns(model, nil)
+
+			dir, err := ioutil.TempDir("", "out")
+			Expect(err).ToNot(HaveOccurred())
+			defer os.RemoveAll(dir)
+			exposition := filepath.Join(dir, "metrics.prom")
+			table := filepath.Join(dir, "metrics.txt")
+
+			appsMetricsPlugin := &AppsMetricsPlugin{}
+			CaptureOutput(func() {
+				appsMetricsPlugin.Run(fakeCliConnection, []string{"app-metrics", "some-app", "-watch", "10ms", "-count", "3", "-out", "prometheus:" + exposition, "-out", "table:" + table})
+			})
+
+			b, err := ioutil.ReadFile(exposition)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(strings.Count(string(b), "# TYPE ")).To(Equal(1))
+			Expect(string(b)).To(ContainSubstring(` 3`))
+
+			b, err = ioutil.ReadFile(table)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(strings.Count(string(b), "METRIC")).To(Equal(1))
+		})
+
+		It("prints error for an invalid watch interval", func() {
+			fakeCliConnection := &pluginfakes.FakeCliConnection{}
+			fakeCliConnection.GetAppReturns(buildAppModel("localhost", 1), nil)
+
+			appsMetricsPlugin := &AppsMetricsPlugin{}
+			output := CaptureOutput(func() {
+				appsMetricsPlugin.Run(fakeCliConnection, []string{"app-metrics", "some-app", "-watch", "often"})
+			})
+			Expect(output).To(ContainElement("FAILED"))
+			Expect(output).To(ContainElement(`invalid watch interval "often", expected e.g. 10s`))
+		})
+
+		It("prints error for rotating without watching", func() {
+			fakeCliConnection := &pluginfakes.FakeCliConnection{}
+			fakeCliConnection.GetAppReturns(buildAppModel("localhost", 1), nil)
+
+			appsMetricsPlugin := &AppsMetricsPlugin{}
+			output := CaptureOutput(func() {
+				appsMetricsPlugin.Run(fakeCliConnection, []string{"app-metrics", "some-app", "-out", "metrics.ndjson", "-rotate", "10MiB"})
+			})
+			Expect(output).To(ContainElement("FAILED"))
+			Expect(output).To(ContainElement("-rotate needs -watch"))
+		})
 	})
 
 	Context("app-metrics-prometheus command", func() {
 
-		It("returns json output by default", func() {
+		It("prints the usage for an option that only applies to expvar", func() {
+			appsMetricsPlugin := &AppsMetricsPlugin{}
+			output := CaptureOutput(func() {
+				appsMetricsPlugin.Run(&pluginfakes.FakeCliConnection{}, []string{"app-metrics-prometheus", "some-app", "-memstats"})
+			})
+			Expect(output).To(ContainElement("cf app-metrics-prometheus APP_NAME"))
+			Expect(output).To(ContainElement("FAILED"))
+			Expect(output).To(ContainElement("Invalid flag: -memstats"))
+		})
+
+		It("asks for the protobuf format and includes native histograms", func() {
+			fakeCliConnection := &pluginfakes.FakeCliConnection{}
+			mux := http.NewServeMux()
+			ts := httptest.NewServer(mux)
+			defer ts.Close()
+			mux.HandleFunc("/metrics", func(w http.ResponseWriter, r *http.Request) {
+				format := expfmt.Negotiate(r.Header)
+				w.Header().Set("Content-Type", string(format))
+				name, typ := "rpc_latency_seconds", dto.MetricType_HISTOGRAM
+				count, schema, threshold := uint64(2), int32(0), 0.001
+				offset, length := int32(1), uint32(1)
+				enc := expfmt.NewEncoder(w, format)
+				enc.Encode(&dto.MetricFamily{Name: &name, Type: &typ, Metric: []*dto.Metric{{Histogram: &dto.Histogram{
+					SampleCount:   &count,
+					Schema:        &schema,
+					ZeroThreshold: &threshold,
+					PositiveSpan:  []*dto.BucketSpan{{Offset: &offset, Length: &length}},
+					PositiveDelta: []int64{2},
+				}}}})
+			})
+			model := buildAppModel(strings.TrimPrefix(ts.URL, "http://"), 1)
+			fakeCliConnection.GetAppReturns(model, nil)
+
+			appsMetricsPlugin := &AppsMetricsPlugin{}
+			output := CaptureOutput(func() {
+				appsMetricsPlugin.Run(fakeCliConnection, []string{"app-metrics-prometheus", "some-app", "-endpoint", "/metrics", "-raw"})
+			})
+
+			Expect(output).To(ContainElement(ContainSubstring(`"native":{"schema":0,"zero_threshold":0.001,"zero_count":0,"buckets":[{"lower":1,"upper":2,"count":2}]}`)))
+		})
+
+		It("filters series with a selector", func() {
+			fakeCliConnection := &pluginfakes.FakeCliConnection{}
+			mux := http.NewServeMux()
+			ts := httptest.NewServer(mux)
+			defer ts.Close()
+			mux.HandleFunc("/metrics", func(w http.ResponseWriter, r *http.Request) {
+				fmt.Fprintf(w, rawPrometheus)
+			})
+			// trimming the scheme because we'll build the url back from app model
+			model := buildAppModel(strings.TrimPrefix(ts.URL, "http://"), 1)
+			fakeCliConnection.GetAppReturns(model, nil)
+
+			appsMetricsPlugin := &AppsMetricsPlugin{}
+			output := CaptureOutput(func() {
+				appsMetricsPlugin.Run(fakeCliConnection, []string{"app-metrics-prometheus", "some-app", "-endpoint", "/metrics", "-include", `go_info{version=~"go1\\..*"}`, "-raw"})
+			})
+
+			Expect(output).To(ContainElement(MatchJSON(`[{"Instance":0,"Error":"","Metrics":{"go_info":{"name":"go_info","help":"Information about the Go environment.","type":"GAUGE","metrics":[{"labels":{"version":"go1.9.1"},"value":1}]}}}]`)))
+		})
+
+		It("estimates histogram quantiles per instance and merged", func() {
+			fakeCliConnection := &pluginfakes.FakeCliConnection{}
+			mux := http.NewServeMux()
+			ts := httptest.NewServer(mux)
+			defer ts.Close()
+			mux.HandleFunc("/metrics", func(w http.ResponseWriter, r *http.Request) {
+				fast := 30
+				if strings.HasSuffix(r.Header.Get("X-CF-APP-INSTANCE"), ":1") {
+					fast = 10
+				}
+				fmt.Fprintf(w, `# TYPE request_duration_seconds histogram
+request_duration_seconds_bucket{le="0.1"} %d
+request_duration_seconds_bucket{le="1"} 40
+request_duration_seconds_bucket{le="+Inf"} 40
+request_duration_seconds_sum 10
+request_duration_seconds_count 40
+`, fast)
+			})
+			model := buildAppModel(strings.TrimPrefix(ts.URL, "http://"), 2)
+			fakeCliConnection.GetAppReturns(model, nil)
+
+			appsMetricsPlugin := &AppsMetricsPlugin{}
+			output := CaptureOutput(func() {
+				appsMetricsPlugin.Run(fakeCliConnection, []string{"app-metrics-prometheus", "some-app", "-endpoint", "/metrics", "-histograms", "-quantiles", "0.5,0.9"})
+			})
+
+			Expect(output).To(ContainElement("SERIES                    INSTANCE  COUNT  P50    P90"))
+			Expect(output).To(ContainElement("request_duration_seconds  0         40     0.067  0.64"))
+			Expect(output).To(ContainElement("request_duration_seconds  1         40     0.4    0.88"))
+			Expect(output).To(ContainElement("request_duration_seconds  all       80     0.1    0.82"))
+		})
+
+		It("prints error for an invalid quantile", func() {
+			fakeCliConnection := &pluginfakes.FakeCliConnection{}
+			fakeCliConnection.GetAppReturns(buildAppModel("localhost", 1), nil)
+
+			appsMetricsPlugin := &AppsMetricsPlugin{}
+			output := CaptureOutput(func() {
+				appsMetricsPlugin.Run(fakeCliConnection, []string{"app-metrics-prometheus", "some-app", "-histograms", "-quantiles", "0.5,99"})
+			})
+			Expect(output).To(ContainElement(`invalid quantile "99", expected a number between 0 and 1`))
+		})
+
+		It("renders series as a table with the output flag", func() {
+			fakeCliConnection := &pluginfakes.FakeCliConnection{}
+			mux := http.NewServeMux()
+			ts := httptest.NewServer(mux)
+			defer ts.Close()
+			mux.HandleFunc("/metrics", func(w http.ResponseWriter, r *http.Request) {
+				requests := 7
+				if strings.HasSuffix(r.Header.Get("X-CF-APP-INSTANCE"), ":1") {
+					requests = 12
+				}
+				fmt.Fprintf(w, "# TYPE http_requests_total counter\nhttp_requests_total{code=\"200\"} %d\nup 1\n", requests)
+			})
+			model := buildAppModel(strings.TrimPrefix(ts.URL, "http://"), 2)
+			fakeCliConnection.GetAppReturns(model, nil)
+
+			appsMetricsPlugin := &AppsMetricsPlugin{}
+			output := CaptureOutput(func() {
+				appsMetricsPlugin.Run(fakeCliConnection, []string{"app-metrics-prometheus", "some-app", "-endpoint", "/metrics", "-output", "table", "-sort", "1:desc"})
+			})
+
+			Expect(output).To(ContainElement(MatchRegexp(`^METRIC +0 +1$`)))
+			Expect(output[1]).To(MatchRegexp(`^http_requests_total{code="200"} +7 +12$`))
+			Expect(output[2]).To(MatchRegexp(`^up +1 +1$`))
+		})
+
+		It("re-exports the series of every instance with the output flag", func() {
+			fakeCliConnection := &pluginfakes.FakeCliConnection{}
+			mux := http.NewServeMux()
+			ts := httptest.NewServer(mux)
+			defer ts.Close()
+			mux.HandleFunc("/metrics", func(w http.ResponseWriter, r *http.Request) {
+				fmt.Fprintf(w, rawPrometheus)
+			})
+			model := buildAppModel(strings.TrimPrefix(ts.URL, "http://"), 2)
+			model.Name = "some-app"
+			fakeCliConnection.GetAppReturns(model, nil)
+			fakeCliConnection.GetCurrentOrgReturns(plugin_models.Organization{OrganizationFields: plugin_models.OrganizationFields{Name: "some-org"}}, nil)
+			fakeCliConnection.GetCurrentSpaceReturns(plugin_models.Space{SpaceFields: plugin_models.SpaceFields{Name: "some-space"}}, nil)
+
+			appsMetricsPlugin := &AppsMetricsPlugin{}
+			output := CaptureOutput(func() {
+				appsMetricsPlugin.Run(fakeCliConnection, []string{"app-metrics-prometheus", "some-app", "-endpoint", "/metrics", "-output", "prometheus"})
+			})
+
+			Expect(output).To(Equal([]string{
+				"# HELP go_goroutines Number of goroutines that currently exist.",
+				"# TYPE go_goroutines gauge",
+				`go_goroutines{cf_app="some-app",cf_instance_index="0",cf_org="some-org",cf_space="some-space"} 6`,
+				`go_goroutines{cf_app="some-app",cf_instance_index="1",cf_org="some-org",cf_space="some-space"} 6`,
+				"# HELP go_info Information about the Go environment.",
+				"# TYPE go_info gauge",
+				`go_info{cf_app="some-app",cf_instance_index="0",cf_org="some-org",cf_space="some-space",version="go1.9.1"} 1`,
+				`go_info{cf_app="some-app",cf_instance_index="1",cf_org="some-org",cf_space="some-space",version="go1.9.1"} 1`,
+				"",
+			}))
+		})
+
+		It("prints error for an unknown output", func() {
+			fakeCliConnection := &pluginfakes.FakeCliConnection{}
+			fakeCliConnection.GetAppReturns(buildAppModel("localhost", 1), nil)
+
+			appsMetricsPlugin := &AppsMetricsPlugin{}
+			output := CaptureOutput(func() {
+				appsMetricsPlugin.Run(fakeCliConnection, []string{"app-metrics-prometheus", "some-app", "-output", "xml"})
+			})
+			Expect(output).To(ContainElement(`unknown output "xml", expected one of table, csv, tsv, ndjson, prometheus, html`))
+		})
+
+		It("renders the metric families with the default template", func() {
 			fakeCliConnection := &pluginfakes.FakeCliConnection{}
 			mux := http.NewServeMux()
 			ts := httptest.NewServer(mux)
@@ -174,10 +982,311 @@ var _ = Describe("AppsMetrics Integration", func() {
 				appsMetricsPlugin.Run(fakeCliConnection, []string{"app-metrics-prometheus", "some-app", "-endpoint", "/metrics"})
 			})
 
+			Expect(output).To(Equal([]string{
+				"",
+				"Instance: 0",
+				"Metrics:",
+				"  go_goroutines [gauge] Number of goroutines that currently exist.",
+				"    6",
+				"  go_info [gauge] Information about the Go environment.",
+				`    {version="go1.9.1"} 1`,
+				"",
+			}))
+		})
+
+		It("returns json output with raw flag", func() {
+			fakeCliConnection := &pluginfakes.FakeCliConnection{}
+			mux := http.NewServeMux()
+			ts := httptest.NewServer(mux)
+			defer ts.Close()
+			mux.HandleFunc("/metrics", func(w http.ResponseWriter, r *http.Request) {
+				fmt.Fprintf(w, rawPrometheus)
+			})
+			// trimming the scheme because we'll build the url back from app model
+			model := buildAppModel(strings.TrimPrefix(ts.URL, "http://"), 1)
+			fakeCliConnection.GetAppReturns(model, nil)
+
+			appsMetricsPlugin := &AppsMetricsPlugin{}
+			output := CaptureOutput(func() {
+				appsMetricsPlugin.Run(fakeCliConnection, []string{"app-metrics-prometheus", "some-app", "-endpoint", "/metrics", "-raw"})
+			})
+
 			Expect(output).To(ContainElement(MatchJSON(prometheusOutput)))
 		})
 
 	})
+
+	Context("app-metrics-replay command", func() {
+		var snapshotFile string
+
+		BeforeEach(func() {
+			tmpfile, err := ioutil.TempFile("", "snapshot")
+			Expect(err).ToNot(HaveOccurred())
+			Expect(tmpfile.Close()).To(Succeed())
+			snapshotFile = tmpfile.Name()
+		})
+
+		AfterEach(func() {
+			os.Remove(snapshotFile)
+		})
+
+		It("replays a saved snapshot without contacting the app", func() {
+			fakeCliConnection := &pluginfakes.FakeCliConnection{}
+			mux := http.NewServeMux()
+			ts := httptest.NewServer(mux)
+			mux.HandleFunc("/debug/metrics", func(w http.ResponseWriter, r *http.Request) {
+				instance := r.Header.Get("X-CF-APP-INSTANCE")
+				fmt.Fprintf(w, `{"ingress.received": 1%s,"name":"app"}`, instance[len(instance)-1:])
+			})
+			model := buildAppModel(strings.TrimPrefix(ts.URL, "http://"), 2)
+			model.Name = "some-app"
+			fakeCliConnection.GetAppReturns(model, nil)
+			fakeCliConnection.GetCurrentOrgReturns(plugin_models.Organization{OrganizationFields: plugin_models.OrganizationFields{Name: "some-org"}}, nil)
+			fakeCliConnection.GetCurrentSpaceReturns(plugin_models.Space{SpaceFields: plugin_models.SpaceFields{Name: "some-space"}}, nil)
+
+			appsMetricsPlugin := &AppsMetricsPlugin{}
+			output := CaptureOutput(func() {
+				appsMetricsPlugin.Run(fakeCliConnection, []string{"app-metrics", "some-app", "-save", snapshotFile, "-aggregate"})
+			})
+			ts.Close()
+			Expect(output).To(ContainElement("Saved snapshot to " + snapshotFile))
+			Expect(output).To(ContainElement("ingress.received  2          21   10.5  10 (#0)  11 (#1)  0.5"))
+
+			saved, err := ioutil.ReadFile(snapshotFile)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(string(saved)).To(ContainSubstring(`"version": 1`))
+			Expect(string(saved)).To(ContainSubstring(`"space": "some-space"`))
+
+			output = CaptureOutput(func() {
+				appsMetricsPlugin.Run(fakeCliConnection, []string{"app-metrics-replay", snapshotFile, "-aggregate"})
+			})
+			Expect(output).To(ContainElement(MatchRegexp(`^Replaying expvar metrics of some-app taken at `)))
+			Expect(output).To(ContainElement("ingress.received  2          21   10.5  10 (#0)  11 (#1)  0.5"))
+
+			output = CaptureOutput(func() {
+				appsMetricsPlugin.Run(fakeCliConnection, []string{"app-metrics-replay", snapshotFile, "-exclude", "name", "-raw"})
+			})
+			Expect(output).To(ContainElement(`[{"Instance":0,"Error":"","Metrics":{"ingress.received":10}},{"Instance":1,"Error":"","Metrics":{"ingress.received":11}}]`))
+		})
+
+		It("replays prometheus histograms", func() {
+			fakeCliConnection := &pluginfakes.FakeCliConnection{}
+			mux := http.NewServeMux()
+			ts := httptest.NewServer(mux)
+			mux.HandleFunc("/metrics", func(w http.ResponseWriter, r *http.Request) {
+				fmt.Fprint(w, `# TYPE request_duration_seconds histogram
+request_duration_seconds_bucket{le="0.1"} 30
+request_duration_seconds_bucket{le="1"} 40
+request_duration_seconds_bucket{le="+Inf"} 40
+request_duration_seconds_sum 10
+request_duration_seconds_count 40
+`)
+			})
+			model := buildAppModel(strings.TrimPrefix(ts.URL, "http://"), 1)
+			fakeCliConnection.GetAppReturns(model, nil)
+
+			appsMetricsPlugin := &AppsMetricsPlugin{}
+			CaptureOutput(func() {
+				appsMetricsPlugin.Run(fakeCliConnection, []string{"app-metrics-prometheus", "some-app", "-endpoint", "/metrics", "-save", snapshotFile})
+			})
+			ts.Close()
+
+			output := CaptureOutput(func() {
+				appsMetricsPlugin.Run(fakeCliConnection, []string{"app-metrics-replay", snapshotFile, "-histograms", "-quantiles", "0.5,0.9"})
+			})
+			Expect(output).To(ContainElement("request_duration_seconds  0         40     0.067  0.64"))
+		})
+
+		It("compares a snapshot with the app", func() {
+			var received int32 = 10
+			fakeCliConnection := &pluginfakes.FakeCliConnection{}
+			mux := http.NewServeMux()
+			ts := httptest.NewServer(mux)
+			defer ts.Close()
+			mux.HandleFunc("/debug/metrics", func(w http.ResponseWriter, r *http.Request) {
+				fmt.Fprintf(w, `{"ingress": {"received": %d}, "latency": 20}`, atomic.LoadInt32(&received))
+			})
+			model := buildAppModel(strings.TrimPrefix(ts.URL, "http://"), 1)
+			model.Name = "some-app"
+			fakeCliConnection.GetAppReturns(model, nil)
+
+			appsMetricsPlugin := &AppsMetricsPlugin{}
+			CaptureOutput(func() {
+				appsMetricsPlugin.Run(fakeCliConnection, []string{"app-metrics", "some-app", "-save", snapshotFile})
+			})
+			atomic.StoreInt32(&received, 30)
+
+			output := CaptureOutput(func() {
+				appsMetricsPlugin.Run(fakeCliConnection, []string{"app-metrics-diff", snapshotFile, "-counter", "ingress.*"})
+			})
+			Expect(output).To(ContainElement(MatchRegexp(`^Comparing expvar metrics of some-app taken at `)))
+			Expect(output).To(ContainElement("METRIC            BEFORE  AFTER  DELTA  CHANGE  RATE"))
+			Expect(output).To(ContainElement(MatchRegexp(`^ingress\.received  10      30     \+20    \+200%   [0-9.]+/s$`)))
+			Expect(output).To(ContainElement("All instances:"))
+		})
+
+		It("compares a snapshot saved with -memstats with the memstats summary of the app", func() {
+			fakeCliConnection := &pluginfakes.FakeCliConnection{}
+			mux := http.NewServeMux()
+			ts := httptest.NewServer(mux)
+			defer ts.Close()
+			mux.HandleFunc("/debug/metrics", func(w http.ResponseWriter, r *http.Request) {
+				fmt.Fprint(w, `{"latency": 20, "memstats": {"HeapInuse": 2048, "NumGC": 1, "PauseNs": [100]}}`)
+			})
+			model := buildAppModel(strings.TrimPrefix(ts.URL, "http://"), 1)
+			model.Name = "some-app"
+			fakeCliConnection.GetAppReturns(model, nil)
+
+			appsMetricsPlugin := &AppsMetricsPlugin{}
+			CaptureOutput(func() {
+				appsMetricsPlugin.Run(fakeCliConnection, []string{"app-metrics", "some-app", "-memstats", "-save", snapshotFile})
+			})
+
+			output := CaptureOutput(func() {
+				appsMetricsPlugin.Run(fakeCliConnection, []string{"app-metrics-diff", snapshotFile, "-raw"})
+			})
+			Expect(output).ToNot(ContainElement(ContainSubstring(`"removed"`)))
+			Expect(output).ToNot(ContainElement(ContainSubstring(`"added"`)))
+		})
+
+		It("refuses -memstats when the snapshot was saved without it", func() {
+			fakeCliConnection := &pluginfakes.FakeCliConnection{}
+			mux := http.NewServeMux()
+			ts := httptest.NewServer(mux)
+			defer ts.Close()
+			mux.HandleFunc("/debug/metrics", func(w http.ResponseWriter, r *http.Request) {
+				fmt.Fprint(w, `{"latency": 20}`)
+			})
+			model := buildAppModel(strings.TrimPrefix(ts.URL, "http://"), 1)
+			fakeCliConnection.GetAppReturns(model, nil)
+
+			appsMetricsPlugin := &AppsMetricsPlugin{}
+			CaptureOutput(func() {
+				appsMetricsPlugin.Run(fakeCliConnection, []string{"app-metrics", "some-app", "-save", snapshotFile})
+			})
+
+			output := CaptureOutput(func() {
+				appsMetricsPlugin.Run(fakeCliConnection, []string{"app-metrics-diff", snapshotFile, "-memstats"})
+			})
+			Expect(output).To(ContainElement("FAILED"))
+			Expect(output).To(ContainElement(snapshotFile + " was saved without -memstats"))
+		})
+
+		It("prints the usage when no snapshot is given", func() {
+			appsMetricsPlugin := &AppsMetricsPlugin{}
+			output := CaptureOutput(func() {
+				appsMetricsPlugin.Run(&pluginfakes.FakeCliConnection{}, []string{"app-metrics-diff", "-raw"})
+			})
+			Expect(output).To(ContainElement("cf app-metrics-diff BEFORE [AFTER]"))
+			Expect(output).To(ContainElement("FAILED"))
+			Expect(output).To(ContainElement("missing the snapshot to compare"))
+		})
+
+		It("compares two snapshots", func() {
+			var latency int32 = 20
+			fakeCliConnection := &pluginfakes.FakeCliConnection{}
+			mux := http.NewServeMux()
+			ts := httptest.NewServer(mux)
+			mux.HandleFunc("/debug/metrics", func(w http.ResponseWriter, r *http.Request) {
+				fmt.Fprintf(w, `{"latency": %d}`, atomic.LoadInt32(&latency))
+			})
+			model := buildAppModel(strings.TrimPrefix(ts.URL, "http://"), 1)
+			fakeCliConnection.GetAppReturns(model, nil)
+
+			after, err := ioutil.TempFile("", "snapshot")
+			Expect(err).ToNot(HaveOccurred())
+			Expect(after.Close()).To(Succeed())
+			defer os.Remove(after.Name())
+
+			appsMetricsPlugin := &AppsMetricsPlugin{}
+			CaptureOutput(func() {
+				appsMetricsPlugin.Run(fakeCliConnection, []string{"app-metrics", "some-app", "-save", snapshotFile})
+			})
+			atomic.StoreInt32(&latency, 25)
+			CaptureOutput(func() {
+				appsMetricsPlugin.Run(fakeCliConnection, []string{"app-metrics", "some-app", "-save", after.Name()})
+			})
+			ts.Close()
+
+			output := CaptureOutput(func() {
+				appsMetricsPlugin.Run(fakeCliConnection, []string{"app-metrics-diff", snapshotFile, after.Name(), "-raw"})
+			})
+			Expect(output).To(ContainElement(ContainSubstring(`"aggregate":{"changed":[{"metric":"latency","stat":"mean","before":20,"after":25,"delta":5,"percent":25}]}`)))
+		})
+
+		It("prints error for a file that is not a snapshot", func() {
+			Expect(ioutil.WriteFile(snapshotFile, []byte(`[{"Instance":0}]`), 0600)).To(Succeed())
+
+			appsMetricsPlugin := &AppsMetricsPlugin{}
+			output := CaptureOutput(func() {
+				appsMetricsPlugin.Run(&pluginfakes.FakeCliConnection{}, []string{"app-metrics-replay", snapshotFile})
+			})
+			Expect(output).To(ContainElement("FAILED"))
+			Expect(output).To(ContainElement(HavePrefix("unable to decode snapshot")))
+		})
+
+		It("prints the usage for an option that does not apply to replay", func() {
+			appsMetricsPlugin := &AppsMetricsPlugin{}
+			output := CaptureOutput(func() {
+				appsMetricsPlugin.Run(&pluginfakes.FakeCliConnection{}, []string{"app-metrics-replay", snapshotFile, "-watch", "1s"})
+			})
+			Expect(output).To(ContainElement("cf app-metrics-replay FILE"))
+			Expect(output).To(ContainElement("FAILED"))
+			Expect(output).To(ContainElement("Invalid flag: -watch"))
+		})
+
+		It("prints the usage for an option that does not apply to diff", func() {
+			appsMetricsPlugin := &AppsMetricsPlugin{}
+			output := CaptureOutput(func() {
+				appsMetricsPlugin.Run(&pluginfakes.FakeCliConnection{}, []string{"app-metrics-diff", snapshotFile, "-columns", "*"})
+			})
+			Expect(output).To(ContainElement("cf app-metrics-diff BEFORE [AFTER]"))
+			Expect(output).To(ContainElement("FAILED"))
+			Expect(output).To(ContainElement("Invalid flag: -columns"))
+		})
+	})
+
+	Context("app-metrics-top command", func() {
+		It("prints the dashboard after every scrape when stdout is not a terminal", func() {
+			fakeCliConnection := &pluginfakes.FakeCliConnection{}
+			mux := http.NewServeMux()
+			ts := httptest.NewServer(mux)
+			defer ts.Close()
+			var scrapes [2]int32
+			mux.HandleFunc("/debug/metrics", func(w http.ResponseWriter, r *http.Request) {
+				instance, _ := strconv.Atoi(r.Header.Get("X-CF-APP-INSTANCE")[len("some-app-guid:"):])
+				n := atomic.AddInt32(&scrapes[instance], 1)
+				fmt.Fprintf(w, `{"ingress.received": %d, "ingress.dropped": 0, "name": "app"}`, int(n)*10+instance)
+			})
+			model := buildAppModel(strings.TrimPrefix(ts.URL, "http://"), 2)
+			model.Name = "some-app"
+			fakeCliConnection.GetAppReturns(model, nil)
+
+			appsMetricsPlugin := &AppsMetricsPlugin{}
+			output := CaptureOutput(func() {
+				appsMetricsPlugin.Run(fakeCliConnection, []string{"app-metrics-top", "some-app", "-columns", "*.received", "-interval", "10ms", "-count", "2"})
+			})
+
+			Expect(output).To(ContainElement(MatchRegexp(`^some-app  2 instances  updated \d\d:\d\d:\d\d$`)))
+			Expect(output).To(ContainElement("INSTANCE ▲  ingress.received"))
+			Expect(output).To(ContainElement("0              10          ▁"))
+			Expect(output).To(ContainElement("0              20         ▁█"))
+			Expect(output).To(ContainElement("1              21         ▁█"))
+			Expect(output).ToNot(ContainElement(ContainSubstring("ingress.dropped")))
+		})
+
+		It("prints error for an invalid interval", func() {
+			fakeCliConnection := &pluginfakes.FakeCliConnection{}
+			fakeCliConnection.GetAppReturns(buildAppModel("localhost", 1), nil)
+
+			appsMetricsPlugin := &AppsMetricsPlugin{}
+			output := CaptureOutput(func() {
+				appsMetricsPlugin.Run(fakeCliConnection, []string{"app-metrics-top", "some-app", "-interval", "soon"})
+			})
+			Expect(output).To(ContainElement("FAILED"))
+			Expect(output).To(ContainElement(`invalid interval "soon", expected e.g. 2s`))
+		})
+	})
 })
 
 func buildTemplate() string {
@@ -214,4 +1323,4 @@ go_goroutines 6
 # TYPE go_info gauge
 go_info{version="go1.9.1"} 1
 `
-var prometheusOutput = `[{"Instance":0,"Error":"","Metrics":{"go_goroutines":{"name":"go_goroutines","help":"Number of goroutines that currently exist.","type":"GAUGE","metrics":[{"value":"6"}]},"go_info":{"name":"go_info","help":"Information about the Go environment.","type":"GAUGE","metrics":[{"labels":{"version":"go1.9.1"},"value":"1"}]}}}]`
+var prometheusOutput = `[{"Instance":0,"Error":"","Metrics":{"go_goroutines":{"name":"go_goroutines","help":"Number of goroutines that currently exist.","type":"GAUGE","metrics":[{"value":6}]},"go_info":{"name":"go_info","help":"Information about the Go environment.","type":"GAUGE","metrics":[{"labels":{"version":"go1.9.1"},"value":1}]}}}]`
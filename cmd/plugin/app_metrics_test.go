@@ -49,6 +49,30 @@ var _ = Describe("AppsMetrics", func() {
 			Expect(output).To(ContainElement("Invalid flag: -unknownFlag"))
 		})
 
+		It("prints error when a filter expression is invalid", func() {
+			fakeCliConnection := &pluginfakes.FakeCliConnection{}
+			fakeCliConnection.GetAppReturns(plugin_models.GetAppModel{}, nil)
+			plugin := &AppsMetricsPlugin{}
+
+			output := CaptureOutput(func() {
+				plugin.Run(fakeCliConnection, []string{"app-metrics", "some-app", "-include", "$.memstats[0"})
+			})
+
+			Expect(output).To(ContainElement(ContainSubstring("invalid path")))
+		})
+
+		It("prints error for an unknown format", func() {
+			fakeCliConnection := &pluginfakes.FakeCliConnection{}
+			fakeCliConnection.GetAppReturns(plugin_models.GetAppModel{}, nil)
+			plugin := &AppsMetricsPlugin{}
+
+			output := CaptureOutput(func() {
+				plugin.Run(fakeCliConnection, []string{"app-metrics", "some-app", "-format", "xml"})
+			})
+
+			Expect(output).To(ContainElement(`unknown format "xml", expected one of expvar, prometheus, influx, graphite or auto`))
+		})
+
 		It("prints error when unable to get metrics", func() {
 			fakeCliConnection := &pluginfakes.FakeCliConnection{}
 			// an app with no routes will trigger an error
@@ -122,6 +146,18 @@ var _ = Describe("AppsMetrics", func() {
 
 	})
 
+	It("has a command for every registered format but expvar", func() {
+		plugin := &AppsMetricsPlugin{}
+
+		var names []string
+		for _, cmd := range plugin.GetMetadata().Commands {
+			names = append(names, cmd.Name)
+		}
+
+		Expect(names).To(Equal([]string{"app-metrics", "app-metrics-prometheus", "app-metrics-influx", "app-metrics-graphite", "app-metrics-replay", "app-metrics-diff", "app-metrics-top"}))
+		Expect(plugin.GetMetadata().Commands[0].UsageDetails.Options["format"]).To(Equal("format of the metrics endpoint: expvar (default), prometheus, influx, graphite or auto"))
+	})
+
 	It("prints uninstall message when uninstalling", func() {
 		fakeCliConnection := &pluginfakes.FakeCliConnection{}
 		plugin := &AppsMetricsPlugin{}
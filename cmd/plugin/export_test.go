@@ -0,0 +1,7 @@
+package main
+
+// NewAppsMetricsPluginWithExit returns a plugin calling exit instead of
+// os.Exit, so tests can check the exit status.
+func NewAppsMetricsPluginWithExit(exit func(code int)) *AppsMetricsPlugin {
+	return &AppsMetricsPlugin{exit: exit}
+}
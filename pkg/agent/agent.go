@@ -7,6 +7,7 @@ import (
 	"io/ioutil"
 	"net/http"
 	"sort"
+	"strings"
 	"time"
 
 	"code.cloudfoundry.org/cli/plugin/models"
@@ -26,11 +27,32 @@ type Parser interface {
 	Parse([]byte) (map[string]interface{}, error)
 }
 
+// Sample is the metrics of all instances scraped at the given time.
+type Sample struct {
+	Time    time.Time
+	Metrics []InstanceMetric
+}
+
+// Detector chooses a parser for a response from its Content-Type and body.
+// It returns the name of the format and false when it does not recognize
+// the response.
+type Detector func(contentType string, body []byte) (string, Parser, bool)
+
+// Detection describes the metrics endpoint found by Detect.
+type Detection struct {
+	Path        string
+	Format      string
+	ContentType string
+}
+
 type Agent struct {
-	app    *plugin_models.GetAppModel
-	path   string
-	client HTTPClient
-	parser Parser
+	app       *plugin_models.GetAppModel
+	path      string
+	accept    string
+	client    HTTPClient
+	parser    Parser
+	negotiate func(contentType string) Parser
+	results   func(InstanceMetric)
 }
 
 type AgentOpt func(*Agent)
@@ -47,6 +69,31 @@ func WithMetricsPath(p string) AgentOpt {
 	}
 }
 
+// WithAccept sets the Accept header sent with every request.
+func WithAccept(accept string) AgentOpt {
+	return func(a *Agent) {
+		a.accept = accept
+	}
+}
+
+// WithNegotiation chooses the parser of every response from its
+// Content-Type, for formats served in several encodings. It is usually
+// combined with WithAccept.
+func WithNegotiation(f func(contentType string) Parser) AgentOpt {
+	return func(a *Agent) {
+		a.negotiate = f
+	}
+}
+
+// WithResults calls f with the metrics of each instance as soon as they
+// are received, before GetMetrics returns them all. f is called from the
+// goroutine calling GetMetrics.
+func WithResults(f func(InstanceMetric)) AgentOpt {
+	return func(a *Agent) {
+		a.results = f
+	}
+}
+
 func New(m *plugin_models.GetAppModel, p Parser, opts ...AgentOpt) *Agent {
 	a := &Agent{
 		app:    m,
@@ -62,6 +109,12 @@ func New(m *plugin_models.GetAppModel, p Parser, opts ...AgentOpt) *Agent {
 	return a
 }
 
+// Path returns the path of the metrics endpoint, which Detect may have
+// changed.
+func (a *Agent) Path() string {
+	return a.path
+}
+
 func (a *Agent) GetMetrics(ctx context.Context) (outputs []InstanceMetric, err error) {
 	url, err := a.buildURL()
 	if err != nil {
@@ -91,6 +144,9 @@ func (a *Agent) GetMetrics(ctx context.Context) (outputs []InstanceMetric, err e
 		select {
 		case r := <-results:
 			outputs = append(outputs, *r)
+			if a.results != nil {
+				a.results(*r)
+			}
 			if len(outputs) == a.app.RunningInstances {
 				return outputs, nil
 			}
@@ -98,49 +154,158 @@ func (a *Agent) GetMetrics(ctx context.Context) (outputs []InstanceMetric, err e
 			return outputs, ctx.Err()
 		}
 	}
+}
 
-	return outputs, nil
+// Collect gets the metrics of all instances count times, starting a scrape
+// every interval. The samples collected so far are returned when a scrape
+// fails or the context is done.
+func (a *Agent) Collect(ctx context.Context, count int, interval time.Duration) ([]Sample, error) {
+	var samples []Sample
+	for i := 0; i < count; i++ {
+		if i > 0 {
+			select {
+			case <-time.After(interval - time.Since(samples[i-1].Time)):
+			case <-ctx.Done():
+				return samples, ctx.Err()
+			}
+		}
+
+		start := time.Now()
+		metrics, err := a.GetMetrics(ctx)
+		if err != nil {
+			return samples, err
+		}
+		samples = append(samples, Sample{Time: start, Metrics: metrics})
+	}
+	return samples, nil
+}
+
+// Watch gets the metrics of all instances every interval and passes each
+// sample to f until the context is done, which it returns the error of.
+func (a *Agent) Watch(ctx context.Context, interval time.Duration, f func(Sample)) error {
+	for {
+		start := time.Now()
+		metrics, err := a.GetMetrics(ctx)
+		if err != nil {
+			return err
+		}
+		f(Sample{Time: start, Metrics: metrics})
+
+		select {
+		case <-time.After(interval - time.Since(start)):
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
+// Detect requests each of the paths from the first running instance, in
+// order, and uses the first response the detector recognizes. Subsequent
+// calls to GetMetrics use the detected path and parser.
+func (a *Agent) Detect(ctx context.Context, paths []string, detect Detector) (*Detection, error) {
+	base, err := a.routeURL()
+	if err != nil {
+		return nil, err
+	}
+
+	instance := -1
+	for i, inst := range a.app.Instances {
+		if inst.State == "running" {
+			instance = i
+			break
+		}
+	}
+	if instance < 0 {
+		return nil, errors.New("app does not have any running instances")
+	}
+
+	var failures []string
+	for _, p := range paths {
+		resp, body, err := a.fetch(ctx, base+p, instance)
+		if err != nil {
+			failures = append(failures, fmt.Sprintf("%s: %s", p, err))
+			continue
+		}
+		if resp.StatusCode < 200 || resp.StatusCode > 299 {
+			failures = append(failures, fmt.Sprintf("%s: %s", p, resp.Status))
+			continue
+		}
+		contentType := resp.Header.Get("Content-Type")
+		format, parser, ok := detect(contentType, body)
+		if !ok {
+			failures = append(failures, fmt.Sprintf("%s: unrecognized response (Content-Type %q)", p, contentType))
+			continue
+		}
+
+		a.path = p
+		a.parser = parser
+		return &Detection{Path: p, Format: format, ContentType: contentType}, nil
+	}
+
+	return nil, fmt.Errorf("unable to detect metrics endpoint: %s", strings.Join(failures, "; "))
 }
 
 func (a *Agent) makeRequest(url string, i int, ctx context.Context) *InstanceMetric {
-	request, err := http.NewRequest(http.MethodGet, url, nil)
+	resp, bytes, err := a.fetch(ctx, url, i)
 	if err != nil {
 		return &InstanceMetric{Instance: i, Error: err.Error()}
 	}
+
+	parser := a.parser
+	if a.negotiate != nil {
+		parser = a.negotiate(resp.Header.Get("Content-Type"))
+	}
+	metrics, err := parser.Parse(bytes)
+	if err != nil {
+		return &InstanceMetric{Instance: i, Error: fmt.Sprintf("unable to parse response: %s", err)}
+	}
+
+	return &InstanceMetric{Instance: i, Metrics: metrics}
+}
+
+// fetch GETs the url from the given app instance and reads the body.
+func (a *Agent) fetch(ctx context.Context, url string, i int) (*http.Response, []byte, error) {
+	request, err := http.NewRequest(http.MethodGet, url, nil)
+	if err != nil {
+		return nil, nil, err
+	}
 	request.Header.Add("X-CF-APP-INSTANCE", fmt.Sprintf("%s:%d", a.app.Guid, i))
+	if a.accept != "" {
+		request.Header.Set("Accept", a.accept)
+	}
 	request = request.WithContext(ctx)
 
 	resp, err := a.client.Do(request)
 	if err != nil {
-		return &InstanceMetric{Instance: i, Error: err.Error()}
+		return nil, nil, err
 	}
 	defer resp.Body.Close()
 	bytes, err := ioutil.ReadAll(resp.Body)
 	if err != nil {
-		return &InstanceMetric{Instance: i, Error: err.Error()}
+		return nil, nil, err
 	}
+	return resp, bytes, nil
+}
 
-	metrics, err := a.parser.Parse(bytes)
+func (a *Agent) buildURL() (string, error) {
+	url, err := a.routeURL()
 	if err != nil {
-		return &InstanceMetric{Instance: i, Error: fmt.Sprintf("unable to parse response: %s", err)}
+		return "", err
 	}
-
-	return &InstanceMetric{Instance: i, Metrics: metrics}
+	return url + a.path, nil
 }
 
-func (a *Agent) buildURL() (string, error) {
+// routeURL returns the url of the app route without a path.
+func (a *Agent) routeURL() (string, error) {
 	// TODO: be able to parse multiple routes
 	if len(a.app.Routes) == 0 {
 		return "", errors.New("app does not have any routes to hit")
 	}
 	route := a.app.Routes[0]
-	var url string
 	if route.Host == "" {
-		url = "http://" + route.Domain.Name + a.path
-	} else {
-		url = "http://" + route.Host + "." + route.Domain.Name + a.path
+		return "http://" + route.Domain.Name, nil
 	}
-	return url, nil
+	return "http://" + route.Host + "." + route.Domain.Name, nil
 }
 
 type byInstance []InstanceMetric
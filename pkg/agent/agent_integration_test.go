@@ -6,6 +6,7 @@ import (
 	"net/http"
 	"net/http/httptest"
 	"strings"
+	"sync/atomic"
 	"time"
 
 	"code.cloudfoundry.org/cli/plugin/models"
@@ -110,6 +111,177 @@ var _ = Describe("Agent", func() {
 		Expect(output[1].Instance).To(Equal(1))
 		Expect(output[2].Instance).To(Equal(2))
 	})
+
+	It("chooses the parser of every response from its Content-Type", func() {
+		mux := http.NewServeMux()
+		ts := httptest.NewServer(mux)
+		defer ts.Close()
+		mux.HandleFunc("/debug/metrics", func(w http.ResponseWriter, r *http.Request) {
+			if r.Header.Get("X-CF-APP-INSTANCE") == "some-app-guid:1" {
+				w.Header().Set("Content-Type", "text/plain")
+				fmt.Fprint(w, "go_goroutines 6\n")
+				return
+			}
+			w.Header().Set("Content-Type", "application/json")
+			fmt.Fprint(w, `{"goroutines": 6}`)
+		})
+		model := buildAppModel(strings.TrimPrefix(ts.URL, "http://"), 2)
+
+		a := agent.New(&model, nil, agent.WithNegotiation(func(contentType string) agent.Parser {
+			if contentType == "text/plain" {
+				return parser.NewPrometheus()
+			}
+			return parser.NewExpvar()
+		}))
+
+		output, err := a.GetMetrics(context.Background())
+
+		Expect(err).ToNot(HaveOccurred())
+		Expect(output).To(HaveLen(2))
+		Expect(output[0].Metrics).To(HaveKeyWithValue("goroutines", int64(6)))
+		Expect(output[1].Metrics["go_goroutines"]).To(BeAssignableToTypeOf(&parser.Family{}))
+	})
+
+	Context("Collect", func() {
+		It("scrapes all instances every interval", func() {
+			var scrapes int32
+			mux := http.NewServeMux()
+			ts := httptest.NewServer(mux)
+			defer ts.Close()
+			mux.HandleFunc("/debug/metrics", func(w http.ResponseWriter, r *http.Request) {
+				fmt.Fprintf(w, `{"requests": %d}`, atomic.AddInt32(&scrapes, 1))
+			})
+			model := buildAppModel(strings.TrimPrefix(ts.URL, "http://"), 2)
+
+			a := agent.New(&model, parser.NewExpvar())
+			samples, err := a.Collect(context.Background(), 3, 50*time.Millisecond)
+
+			Expect(err).ToNot(HaveOccurred())
+			Expect(samples).To(HaveLen(3))
+			Expect(samples[1].Time.Sub(samples[0].Time)).To(BeNumerically(">=", 50*time.Millisecond))
+			Expect(samples[2].Time.Sub(samples[1].Time)).To(BeNumerically("<", time.Second))
+			for _, s := range samples {
+				Expect(s.Metrics).To(HaveLen(2))
+			}
+			Expect(scrapes).To(Equal(int32(6)))
+		})
+
+		It("returns the samples collected when the context is done", func() {
+			mux := http.NewServeMux()
+			ts := httptest.NewServer(mux)
+			defer ts.Close()
+			mux.HandleFunc("/debug/metrics", func(w http.ResponseWriter, r *http.Request) {
+				fmt.Fprintf(w, `{"requests": 1}`)
+			})
+			model := buildAppModel(strings.TrimPrefix(ts.URL, "http://"), 1)
+			ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+			defer cancel()
+
+			a := agent.New(&model, parser.NewExpvar())
+			samples, err := a.Collect(ctx, 2, time.Minute)
+
+			Expect(err).To(Equal(context.DeadlineExceeded))
+			Expect(samples).To(HaveLen(1))
+		})
+	})
+
+	Context("Watch", func() {
+		It("passes a sample every interval until the context is done", func() {
+			var scrapes int32
+			mux := http.NewServeMux()
+			ts := httptest.NewServer(mux)
+			defer ts.Close()
+			mux.HandleFunc("/debug/metrics", func(w http.ResponseWriter, r *http.Request) {
+				fmt.Fprintf(w, `{"requests": %d}`, atomic.AddInt32(&scrapes, 1))
+			})
+			model := buildAppModel(strings.TrimPrefix(ts.URL, "http://"), 2)
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+
+			var samples []agent.Sample
+			a := agent.New(&model, parser.NewExpvar())
+			err := a.Watch(ctx, 20*time.Millisecond, func(s agent.Sample) {
+				samples = append(samples, s)
+				if len(samples) == 3 {
+					cancel()
+				}
+			})
+
+			Expect(err).To(Equal(context.Canceled))
+			Expect(samples).To(HaveLen(3))
+			Expect(samples[1].Time.Sub(samples[0].Time)).To(BeNumerically(">=", 20*time.Millisecond))
+			for _, s := range samples {
+				Expect(s.Metrics).To(HaveLen(2))
+			}
+		})
+	})
+
+	Context("Detect", func() {
+		detector := func(contentType string, body []byte) (string, agent.Parser, bool) {
+			return parser.Detect(contentType, body)
+		}
+
+		It("uses the first path with a recognized response", func() {
+			var accept string
+			mux := http.NewServeMux()
+			ts := httptest.NewServer(mux)
+			defer ts.Close()
+			mux.HandleFunc("/debug/vars", func(w http.ResponseWriter, r *http.Request) {
+				http.NotFound(w, r)
+			})
+			mux.HandleFunc("/debug/metrics", func(w http.ResponseWriter, r *http.Request) {
+				w.Header().Set("Content-Type", "text/html")
+				fmt.Fprintf(w, "<html></html>")
+			})
+			mux.HandleFunc("/metrics", func(w http.ResponseWriter, r *http.Request) {
+				accept = r.Header.Get("Accept")
+				w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+				fmt.Fprintf(w, "# TYPE go_goroutines gauge\ngo_goroutines 6\n")
+			})
+			model := buildAppModel(strings.TrimPrefix(ts.URL, "http://"), 2)
+
+			a := agent.New(&model, nil, agent.WithAccept(parser.Accept()))
+			detection, err := a.Detect(context.Background(), parser.WellKnownPaths(), detector)
+
+			Expect(err).ToNot(HaveOccurred())
+			Expect(detection).To(Equal(&agent.Detection{
+				Path:        "/metrics",
+				Format:      parser.FormatPrometheus,
+				ContentType: "text/plain; version=0.0.4",
+			}))
+			Expect(accept).To(Equal(parser.Accept()))
+
+			output, err := a.GetMetrics(context.Background())
+			Expect(err).ToNot(HaveOccurred())
+			Expect(output).To(HaveLen(2))
+			Expect(output[1].Metrics).To(HaveKey("go_goroutines"))
+		})
+
+		It("returns an error describing every path tried", func() {
+			mux := http.NewServeMux()
+			ts := httptest.NewServer(mux)
+			defer ts.Close()
+			mux.HandleFunc("/debug/metrics", func(w http.ResponseWriter, r *http.Request) {
+				fmt.Fprintf(w, "OK")
+			})
+			model := buildAppModel(strings.TrimPrefix(ts.URL, "http://"), 1)
+
+			a := agent.New(&model, nil)
+			_, err := a.Detect(context.Background(), []string{"/debug/vars", "/debug/metrics"}, detector)
+
+			Expect(err).To(MatchError(ContainSubstring("/debug/vars: 404 Not Found")))
+			Expect(err).To(MatchError(ContainSubstring(`/debug/metrics: unrecognized response`)))
+		})
+
+		It("returns an error when no instance is running", func() {
+			model := buildAppModel("domain.cf-app.com", 0)
+
+			a := agent.New(&model, nil)
+			_, err := a.Detect(context.Background(), parser.WellKnownPaths(), detector)
+
+			Expect(err).To(MatchError("app does not have any running instances"))
+		})
+	})
 })
 
 func buildAppModel(host string, runningInstances int) plugin_models.GetAppModel {
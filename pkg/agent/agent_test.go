@@ -128,13 +128,48 @@ var _ = Describe("Agent", func() {
 		Expect(metric.Metrics).To(HaveLen(5))
 		Expect(metric.Metrics).To(HaveKeyWithValue("metric.float", 123.345))
 		Expect(metric.Metrics).To(HaveKeyWithValue("metric.string", "expvarApp"))
-		Expect(metric.Metrics).To(HaveKeyWithValue("metric.int", float64(10)))
+		Expect(metric.Metrics).To(HaveKeyWithValue("metric.int", int64(10)))
 		Expect(metric.Metrics["cmdline"]).To(ContainElement("bin/event-alerts"))
-		Expect(metric.Metrics["metric.map"]).To(HaveKeyWithValue("metric1", float64(10)))
-		Expect(metric.Metrics["metric.map"]).To(HaveKeyWithValue("metric2", float64(11)))
+		Expect(metric.Metrics["metric.map"]).To(HaveKeyWithValue("metric1", int64(10)))
+		Expect(metric.Metrics["metric.map"]).To(HaveKeyWithValue("metric2", int64(11)))
 		Expect(request.Header.Get("X-CF-APP-INSTANCE")).ToNot(BeEmpty())
 	})
 
+	It("passes each instance to the results handler as it is received", func() {
+		fakeClient := NewFakeClient()
+		fakeClient.SetResponse(expvarJSON)
+
+		fakeApp := &plugin_models.GetAppModel{
+			RunningInstances: 2,
+			Instances: []plugin_models.GetApp_AppInstanceFields{
+				{
+					State: "running",
+				},
+				{
+					State: "running",
+				},
+			},
+			Routes: []plugin_models.GetApp_RouteSummary{
+				{
+					Domain: plugin_models.GetApp_DomainFields{
+						Name: "domain.cf-app.com",
+					},
+				},
+			},
+		}
+
+		var received []int
+		a := agent.New(fakeApp, parser.NewExpvar(), agent.WithClient(fakeClient), agent.WithResults(func(m agent.InstanceMetric) {
+			Expect(m.Metrics).To(HaveKeyWithValue("metric.int", int64(10)))
+			received = append(received, m.Instance)
+		}))
+		metrics, err := a.GetMetrics(context.Background())
+
+		Expect(err).ToNot(HaveOccurred())
+		Expect(metrics).To(HaveLen(2))
+		Expect(received).To(ConsistOf(0, 1))
+	})
+
 	It("returns error upon unsuccessful request", func() {
 		fakeApp := &plugin_models.GetAppModel{
 			RunningInstances: 1,
@@ -0,0 +1,235 @@
+package aggregate
+
+import (
+	"encoding/json"
+	"math"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/wfernandes/app-metrics-plugin/pkg/agent"
+	"github.com/wfernandes/app-metrics-plugin/pkg/parser"
+)
+
+// Stat summarizes one numeric metric across the app instances reporting it.
+type Stat struct {
+	Metric      string  `json:"metric"`
+	Instances   int     `json:"instances"`
+	Sum         float64 `json:"sum"`
+	Mean        float64 `json:"mean"`
+	Min         float64 `json:"min"`
+	Max         float64 `json:"max"`
+	StdDev      float64 `json:"stddev"`
+	MinInstance int     `json:"min_instance"`
+	MaxInstance int     `json:"max_instance"`
+}
+
+// Aggregate computes a Stat for every numeric metric of the instances,
+// sorted by metric. Instances that returned an error are ignored, as are
+// NaN and infinite values.
+func Aggregate(metrics []agent.InstanceMetric) []Stat {
+	samples := collect(metrics)
+
+	result := make([]Stat, 0, len(samples))
+	for k, values := range samples {
+		first := values[0]
+		s := Stat{Metric: k, Instances: len(values), Min: first.value, Max: first.value, MinInstance: first.instance, MaxInstance: first.instance}
+		for _, v := range values {
+			if v.value < s.Min {
+				s.Min, s.MinInstance = v.value, v.instance
+			}
+			if v.value > s.Max {
+				s.Max, s.MaxInstance = v.value, v.instance
+			}
+			s.Sum += v.value
+		}
+		s.Mean, s.StdDev = meanStdDev(values)
+		result = append(result, s)
+	}
+	sort.Slice(result, func(i, j int) bool {
+		return result[i].Metric < result[j].Metric
+	})
+	return result
+}
+
+// sample is the value of a metric reported by one instance.
+type sample struct {
+	instance int
+	value    float64
+}
+
+// collect groups the finite numeric values of the instances by metric, in
+// instance order.
+func collect(metrics []agent.InstanceMetric) map[string][]sample {
+	samples := make(map[string][]sample)
+	for _, m := range metrics {
+		if m.Metrics == nil {
+			continue
+		}
+		for k, v := range Flatten(m.Metrics) {
+			if math.IsNaN(v) || math.IsInf(v, 0) {
+				continue
+			}
+			samples[k] = append(samples[k], sample{instance: m.Instance, value: v})
+		}
+	}
+	return samples
+}
+
+func meanStdDev(samples []sample) (float64, float64) {
+	var sum float64
+	for _, s := range samples {
+		sum += s.value
+	}
+	mean := sum / float64(len(samples))
+
+	var squares float64
+	for _, s := range samples {
+		squares += (s.value - mean) * (s.value - mean)
+	}
+	return mean, math.Sqrt(squares / float64(len(samples)))
+}
+
+// Flatten returns the numeric values of the metrics of one instance keyed
+// by name. Nested expvar values are keyed by their path, e.g.
+// `memstats.PauseNs[0]`. Prometheus series are keyed like in the
+// exposition format, e.g. `http_requests_total{code="200"}`, with summaries
+// and histograms split into their quantiles or buckets, sum and count.
+func Flatten(metrics map[string]interface{}) map[string]float64 {
+	out := make(map[string]float64)
+	for k, v := range FlattenValues(metrics) {
+		out[k], _ = Float(v)
+	}
+	return out
+}
+
+// FlattenValues keys the numeric values like Flatten but keeps integers
+// exact, as int64 or uint64, so values above 2^53 such as unix nanosecond
+// timestamps print without rounding. json.Number values are kept as they
+// are and every other number is a float64.
+func FlattenValues(metrics map[string]interface{}) map[string]interface{} {
+	out := make(map[string]interface{})
+	for k, v := range metrics {
+		flatten(out, k, v)
+	}
+	return out
+}
+
+func flatten(out map[string]interface{}, key string, v interface{}) {
+	switch t := v.(type) {
+	case map[string]interface{}:
+		for k, child := range t {
+			flatten(out, key+"."+k, child)
+		}
+	case []interface{}:
+		for i, child := range t {
+			flatten(out, key+"["+strconv.Itoa(i)+"]", child)
+		}
+	case *parser.Family:
+		flattenFamily(out, t)
+	default:
+		if n, ok := number(v); ok {
+			out[key] = n
+		}
+	}
+}
+
+func flattenFamily(out map[string]interface{}, family *parser.Family) {
+	EachSeries(family, func(name string, labels map[string]string, value float64) {
+		out[SeriesKey(name, labels)] = value
+	})
+}
+
+// EachSeries calls f with the name, labels and value of every series of a
+// family, split like the exposition format does: summaries and histograms
+// into their quantile or _bucket series, _sum and _count. Native histogram
+// buckets have no series and are left out.
+func EachSeries(family *parser.Family, f func(name string, labels map[string]string, value float64)) {
+	for _, series := range family.Metrics {
+		switch s := series.(type) {
+		case parser.Metric:
+			f(family.Name, s.Labels, s.Value)
+		case parser.Summary:
+			for _, q := range s.Quantiles {
+				f(family.Name, withLabel(s.Labels, "quantile", parser.FormatFloat(q.Quantile)), q.Value)
+			}
+			f(family.Name+"_sum", s.Labels, s.Sum)
+			f(family.Name+"_count", s.Labels, float64(s.Count))
+		case parser.Histogram:
+			for _, b := range s.Buckets {
+				f(family.Name+"_bucket", withLabel(s.Labels, "le", parser.FormatFloat(b.UpperBound)), float64(b.CumulativeCount))
+			}
+			f(family.Name+"_sum", s.Labels, s.Sum)
+			f(family.Name+"_count", s.Labels, float64(s.Count))
+		}
+	}
+}
+
+// SeriesKey returns the name of a series with its labels sorted, e.g.
+// `http_requests_total{code="200",method="GET"}`.
+func SeriesKey(name string, labels map[string]string) string {
+	if len(labels) == 0 {
+		return name
+	}
+	names := make([]string, 0, len(labels))
+	for k := range labels {
+		names = append(names, k)
+	}
+	sort.Strings(names)
+
+	pairs := make([]string, len(names))
+	for i, k := range names {
+		pairs[i] = k + "=" + strconv.Quote(labels[k])
+	}
+	return name + "{" + strings.Join(pairs, ",") + "}"
+}
+
+func withLabel(labels map[string]string, name, value string) map[string]string {
+	l := make(map[string]string, len(labels)+1)
+	for k, v := range labels {
+		l[k] = v
+	}
+	l[name] = value
+	return l
+}
+
+// Float returns v as a float64 if it is a number. Numeric types such as
+// time.Duration are converted from their underlying value.
+func Float(v interface{}) (float64, bool) {
+	if n, ok := v.(json.Number); ok {
+		f, err := n.Float64()
+		return f, err == nil
+	}
+
+	rv := reflect.ValueOf(v)
+	switch rv.Kind() {
+	case reflect.Float32, reflect.Float64:
+		return rv.Float(), true
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return float64(rv.Int()), true
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return float64(rv.Uint()), true
+	}
+	return 0, false
+}
+
+// number returns v as an int64, uint64 or float64 if it is a number, or as
+// is for a valid json.Number.
+func number(v interface{}) (interface{}, bool) {
+	if n, ok := v.(json.Number); ok {
+		_, err := n.Float64()
+		return n, err == nil
+	}
+
+	rv := reflect.ValueOf(v)
+	switch rv.Kind() {
+	case reflect.Float32, reflect.Float64:
+		return rv.Float(), true
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return rv.Int(), true
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return rv.Uint(), true
+	}
+	return nil, false
+}
@@ -0,0 +1,13 @@
+package aggregate_test
+
+import (
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+
+	"testing"
+)
+
+func TestAggregate(t *testing.T) {
+	RegisterFailHandler(Fail)
+	RunSpecs(t, "Aggregate Suite")
+}
@@ -0,0 +1,138 @@
+package aggregate_test
+
+import (
+	"encoding/json"
+	"math"
+	"time"
+
+	"github.com/wfernandes/app-metrics-plugin/pkg/agent"
+	"github.com/wfernandes/app-metrics-plugin/pkg/aggregate"
+	"github.com/wfernandes/app-metrics-plugin/pkg/parser"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Aggregate", func() {
+	It("computes statistics of every numeric metric across instances", func() {
+		metrics := []agent.InstanceMetric{
+			{Instance: 0, Metrics: map[string]interface{}{"requests": int64(10), "name": "app", "map": map[string]interface{}{"a": 1.5}}},
+			{Instance: 1, Error: "unable to parse response"},
+			{Instance: 2, Metrics: map[string]interface{}{"requests": int64(30), "map": map[string]interface{}{"a": 0.5}}},
+			{Instance: 3, Metrics: map[string]interface{}{"requests": json.Number("20")}},
+		}
+
+		stats := aggregate.Aggregate(metrics)
+
+		Expect(stats).To(Equal([]aggregate.Stat{
+			{Metric: "map.a", Instances: 2, Sum: 2, Mean: 1, Min: 0.5, Max: 1.5, StdDev: 0.5, MinInstance: 2, MaxInstance: 0},
+			{Metric: "requests", Instances: 3, Sum: 60, Mean: 20, Min: 10, Max: 30, StdDev: math.Sqrt(200.0 / 3), MinInstance: 0, MaxInstance: 2},
+		}))
+	})
+
+	It("keys prometheus series by their labels", func() {
+		family := func(value float64) *parser.Family {
+			return &parser.Family{
+				Name: "http_requests_total",
+				Type: "COUNTER",
+				Metrics: []interface{}{
+					parser.Metric{Labels: map[string]string{"method": "GET", "code": "200"}, Value: value},
+					parser.Metric{Labels: map[string]string{"method": "GET", "code": "500"}, Value: 1},
+				},
+			}
+		}
+		metrics := []agent.InstanceMetric{
+			{Instance: 0, Metrics: map[string]interface{}{"http_requests_total": family(5)}},
+			{Instance: 1, Metrics: map[string]interface{}{"http_requests_total": family(7)}},
+		}
+
+		stats := aggregate.Aggregate(metrics)
+
+		Expect(stats).To(HaveLen(2))
+		Expect(stats[0].Metric).To(Equal(`http_requests_total{code="200",method="GET"}`))
+		Expect(stats[0].Sum).To(Equal(12.0))
+		Expect(stats[0].MaxInstance).To(Equal(1))
+		Expect(stats[1].Metric).To(Equal(`http_requests_total{code="500",method="GET"}`))
+		Expect(stats[1].StdDev).To(Equal(0.0))
+	})
+
+	It("ignores NaN and infinite values", func() {
+		metrics := []agent.InstanceMetric{
+			{Instance: 0, Metrics: map[string]interface{}{"ratio": math.NaN()}},
+			{Instance: 1, Metrics: map[string]interface{}{"ratio": 0.25}},
+			{Instance: 2, Metrics: map[string]interface{}{"ratio": math.Inf(1)}},
+		}
+
+		stats := aggregate.Aggregate(metrics)
+
+		Expect(stats).To(Equal([]aggregate.Stat{
+			{Metric: "ratio", Instances: 1, Sum: 0.25, Mean: 0.25, Min: 0.25, Max: 0.25, MinInstance: 1, MaxInstance: 1},
+		}))
+	})
+})
+
+var _ = Describe("Flatten", func() {
+	It("splits summaries and histograms into series", func() {
+		metrics := map[string]interface{}{
+			"rpc_duration_seconds": &parser.Family{
+				Name: "rpc_duration_seconds",
+				Type: "SUMMARY",
+				Metrics: []interface{}{
+					parser.Summary{Quantiles: []parser.Quantile{{Quantile: 0.5, Value: 0.01}}, Count: 10, Sum: 0.2},
+				},
+			},
+			"request_size_bytes": &parser.Family{
+				Name: "request_size_bytes",
+				Type: "HISTOGRAM",
+				Metrics: []interface{}{
+					parser.Histogram{
+						Labels:  map[string]string{"path": "/"},
+						Buckets: []parser.Bucket{{UpperBound: 100, CumulativeCount: 3}, {UpperBound: math.Inf(1), CumulativeCount: 4}},
+						Count:   4,
+						Sum:     450,
+					},
+				},
+			},
+			"memstats": map[string]interface{}{
+				"pause_total": 3 * time.Millisecond,
+				"heap_inuse":  parser.Bytes(2048),
+			},
+			"cmdline": []interface{}{"./app", "-port"},
+			"PauseNs": []interface{}{float64(1), float64(2)},
+		}
+
+		Expect(aggregate.Flatten(metrics)).To(Equal(map[string]float64{
+			`rpc_duration_seconds{quantile="0.5"}`:          0.01,
+			"rpc_duration_seconds_sum":                      0.2,
+			"rpc_duration_seconds_count":                    10,
+			`request_size_bytes_bucket{le="100",path="/"}`:  3,
+			`request_size_bytes_bucket{le="+Inf",path="/"}`: 4,
+			`request_size_bytes_sum{path="/"}`:              450,
+			`request_size_bytes_count{path="/"}`:            4,
+			"memstats.pause_total":                          3e6,
+			"memstats.heap_inuse":                           2048,
+			"PauseNs[0]":                                    1,
+			"PauseNs[1]":                                    2,
+		}))
+	})
+
+	It("keeps integers exact with FlattenValues", func() {
+		metrics := map[string]interface{}{
+			"last_gc":  int64(9007199254740993),
+			"received": uint64(18446744073709551615),
+			"huge":     json.Number("123456789012345678901234567890"),
+			"memstats": map[string]interface{}{"heap_inuse": parser.Bytes(2048), "pause_total": 3 * time.Millisecond},
+			"ratio":    float32(0.5),
+			"name":     "app",
+		}
+
+		Expect(aggregate.FlattenValues(metrics)).To(Equal(map[string]interface{}{
+			"last_gc":              int64(9007199254740993),
+			"received":             uint64(18446744073709551615),
+			"huge":                 json.Number("123456789012345678901234567890"),
+			"memstats.heap_inuse":  uint64(2048),
+			"memstats.pause_total": int64(3e6),
+			"ratio":                0.5,
+		}))
+	})
+})
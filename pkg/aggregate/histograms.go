@@ -0,0 +1,247 @@
+package aggregate
+
+import (
+	"math"
+	"sort"
+
+	"github.com/wfernandes/app-metrics-plugin/pkg/agent"
+	"github.com/wfernandes/app-metrics-plugin/pkg/parser"
+)
+
+// DefaultQuantiles are estimated when no quantiles are given.
+var DefaultQuantiles = []float64{0.5, 0.9, 0.99}
+
+// Histograms holds the quantiles estimated from the Prometheus histograms
+// of every instance and from the histograms merged across instances.
+type Histograms struct {
+	Quantiles    []float64            `json:"quantiles"`
+	Instances    []InstanceHistograms `json:"instances"`
+	Merged       []Estimate           `json:"merged"`
+	Incompatible []Incompatible       `json:"incompatible,omitempty"`
+}
+
+type InstanceHistograms struct {
+	Instance  int        `json:"instance"`
+	Estimates []Estimate `json:"estimates"`
+}
+
+// Estimate holds the estimated quantiles of one histogram series. Quantiles
+// that cannot be estimated, e.g. of an empty histogram, are left out.
+type Estimate struct {
+	Series    string     `json:"series"`
+	Count     uint64     `json:"count"`
+	Quantiles []Quantile `json:"quantiles"`
+}
+
+type Quantile struct {
+	Quantile float64 `json:"quantile"`
+	Value    float64 `json:"value"`
+}
+
+// Incompatible is a histogram series that cannot be merged because the
+// instances use different buckets.
+type Incompatible struct {
+	Series  string   `json:"series"`
+	Layouts []Layout `json:"layouts"`
+}
+
+// Layout is the upper bounds of the buckets used by some instances.
+type Layout struct {
+	UpperBounds []string `json:"upper_bounds"`
+	Instances   []int    `json:"instances"`
+}
+
+// EstimateHistograms estimates the quantiles of every classic Prometheus
+// histogram series of each instance. Series with the same name and labels
+// are merged across instances by adding up their buckets when all
+// instances use the same bucket layout, and reported as Incompatible when
+// they do not.
+func EstimateHistograms(metrics []agent.InstanceMetric, quantiles []float64) Histograms {
+	h := Histograms{Quantiles: quantiles, Instances: []InstanceHistograms{}, Merged: []Estimate{}}
+
+	type merged struct {
+		buckets []parser.Bucket
+		count   uint64
+		layouts []Layout
+	}
+	bySeries := make(map[string]*merged)
+	var names []string
+
+	for _, m := range metrics {
+		if m.Metrics == nil {
+			continue
+		}
+		histograms := ClassicHistograms(m.Metrics)
+		if len(histograms) == 0 {
+			continue
+		}
+
+		keys := make([]string, 0, len(histograms))
+		for k := range histograms {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+
+		ih := InstanceHistograms{Instance: m.Instance}
+		for _, series := range keys {
+			hist := histograms[series]
+			ih.Estimates = append(ih.Estimates, estimate(series, hist.Count, hist.Buckets, quantiles))
+
+			bounds := upperBounds(hist.Buckets)
+			s, ok := bySeries[series]
+			if !ok {
+				s = &merged{buckets: append([]parser.Bucket(nil), hist.Buckets...)}
+				bySeries[series] = s
+				names = append(names, series)
+			} else if sameLayout(s.buckets, hist.Buckets) {
+				for i, b := range hist.Buckets {
+					s.buckets[i].CumulativeCount += b.CumulativeCount
+				}
+			}
+			s.count += hist.Count
+			s.layouts = addLayout(s.layouts, bounds, m.Instance)
+		}
+		h.Instances = append(h.Instances, ih)
+	}
+
+	sort.Strings(names)
+	for _, series := range names {
+		s := bySeries[series]
+		if len(s.layouts) > 1 {
+			h.Incompatible = append(h.Incompatible, Incompatible{Series: series, Layouts: s.layouts})
+			continue
+		}
+		h.Merged = append(h.Merged, estimate(series, s.count, s.buckets, quantiles))
+	}
+	return h
+}
+
+// EstimateQuantile estimates the q quantile from cumulative buckets sorted
+// by upper bound, the last one being +Inf, like the histogram_quantile
+// function of Prometheus: values are assumed to be spread evenly within
+// their bucket, and the first bucket starts at zero unless its upper bound
+// is negative. It returns NaN when the quantile cannot be estimated.
+func EstimateQuantile(q float64, buckets []parser.Bucket) float64 {
+	bounds := make([]float64, len(buckets))
+	counts := make([]float64, len(buckets))
+	for i, b := range buckets {
+		bounds[i], counts[i] = b.UpperBound, float64(b.CumulativeCount)
+	}
+	return EstimateBucketQuantile(q, bounds, counts)
+}
+
+// EstimateBucketQuantile is EstimateQuantile for buckets given as upper
+// bounds and cumulative counts, which need not be integers, e.g. when they
+// are rates.
+func EstimateBucketQuantile(q float64, bounds, counts []float64) float64 {
+	n := len(bounds)
+	if q < 0 || q > 1 || n < 2 || len(counts) != n || !math.IsInf(bounds[n-1], 1) {
+		return math.NaN()
+	}
+	total := counts[n-1]
+	if total <= 0 {
+		return math.NaN()
+	}
+
+	rank := q * total
+	b := sort.Search(n-1, func(i int) bool {
+		return counts[i] >= rank
+	})
+	if b == n-1 {
+		// The quantile is in the +Inf bucket, the best guess is the largest
+		// finite upper bound.
+		return bounds[n-2]
+	}
+	if b == 0 && bounds[0] <= 0 {
+		return bounds[0]
+	}
+
+	lower, below := 0.0, 0.0
+	if b > 0 {
+		lower = bounds[b-1]
+		below = counts[b-1]
+	}
+	upper := bounds[b]
+	inBucket := counts[b] - below
+	if inBucket == 0 {
+		return upper
+	}
+	return lower + (upper-lower)*(rank-below)/inBucket
+}
+
+func estimate(series string, count uint64, buckets []parser.Bucket, quantiles []float64) Estimate {
+	e := Estimate{Series: series, Count: count, Quantiles: []Quantile{}}
+	for _, q := range quantiles {
+		if v := EstimateQuantile(q, buckets); !math.IsNaN(v) {
+			e.Quantiles = append(e.Quantiles, Quantile{Quantile: q, Value: v})
+		}
+	}
+	return e
+}
+
+// ClassicHistograms returns the histograms with classic buckets keyed by
+// series. The +Inf bucket, which the protobuf format may leave out, is
+// added when missing.
+func ClassicHistograms(metrics map[string]interface{}) map[string]parser.Histogram {
+	out := make(map[string]parser.Histogram)
+	for _, v := range metrics {
+		family, ok := v.(*parser.Family)
+		if !ok {
+			continue
+		}
+		for _, series := range family.Metrics {
+			h, ok := series.(parser.Histogram)
+			if !ok || len(h.Buckets) == 0 {
+				continue
+			}
+			if !math.IsInf(h.Buckets[len(h.Buckets)-1].UpperBound, 1) {
+				h.Buckets = append(append([]parser.Bucket(nil), h.Buckets...), parser.Bucket{UpperBound: math.Inf(1), CumulativeCount: h.Count})
+			}
+			out[SeriesKey(family.Name, h.Labels)] = h
+		}
+	}
+	return out
+}
+
+func sameLayout(a, b []parser.Bucket) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i].UpperBound != b[i].UpperBound {
+			return false
+		}
+	}
+	return true
+}
+
+func upperBounds(buckets []parser.Bucket) []string {
+	bounds := make([]string, len(buckets))
+	for i, b := range buckets {
+		bounds[i] = parser.FormatFloat(b.UpperBound)
+	}
+	return bounds
+}
+
+// addLayout records that the instance uses the bucket layout.
+func addLayout(layouts []Layout, bounds []string, instance int) []Layout {
+	for i, l := range layouts {
+		if equalStrings(l.UpperBounds, bounds) {
+			layouts[i].Instances = append(layouts[i].Instances, instance)
+			return layouts
+		}
+	}
+	return append(layouts, Layout{UpperBounds: bounds, Instances: []int{instance}})
+}
+
+func equalStrings(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
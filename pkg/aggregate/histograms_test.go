@@ -0,0 +1,113 @@
+package aggregate_test
+
+import (
+	"math"
+
+	"github.com/wfernandes/app-metrics-plugin/pkg/agent"
+	"github.com/wfernandes/app-metrics-plugin/pkg/aggregate"
+	"github.com/wfernandes/app-metrics-plugin/pkg/parser"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("EstimateQuantile", func() {
+	buckets := []parser.Bucket{
+		{UpperBound: 0.1, CumulativeCount: 10},
+		{UpperBound: 0.5, CumulativeCount: 30},
+		{UpperBound: 1, CumulativeCount: 40},
+		{UpperBound: math.Inf(1), CumulativeCount: 40},
+	}
+
+	It("interpolates within the bucket of the quantile", func() {
+		Expect(aggregate.EstimateQuantile(0.1, buckets)).To(BeNumerically("~", 0.04, 1e-9))
+		Expect(aggregate.EstimateQuantile(0.5, buckets)).To(BeNumerically("~", 0.3, 1e-9))
+		Expect(aggregate.EstimateQuantile(0.9, buckets)).To(BeNumerically("~", 0.8, 1e-9))
+		Expect(aggregate.EstimateQuantile(0.99, buckets)).To(BeNumerically("~", 0.98, 1e-9))
+	})
+
+	It("returns the largest finite bound for quantiles in the +Inf bucket", func() {
+		b := []parser.Bucket{{UpperBound: 1, CumulativeCount: 5}, {UpperBound: math.Inf(1), CumulativeCount: 10}}
+
+		Expect(aggregate.EstimateQuantile(0.9, b)).To(Equal(1.0))
+	})
+
+	It("returns NaN for empty histograms and invalid quantiles", func() {
+		empty := []parser.Bucket{{UpperBound: 1}, {UpperBound: math.Inf(1)}}
+
+		Expect(math.IsNaN(aggregate.EstimateQuantile(0.5, empty))).To(BeTrue())
+		Expect(math.IsNaN(aggregate.EstimateQuantile(1.5, buckets))).To(BeTrue())
+		Expect(math.IsNaN(aggregate.EstimateQuantile(0.5, buckets[:3]))).To(BeTrue())
+	})
+})
+
+var _ = Describe("EstimateHistograms", func() {
+	histogram := func(bounds []float64, counts []uint64) map[string]interface{} {
+		h := parser.Histogram{Labels: map[string]string{"path": "/"}, Count: counts[len(counts)-1]}
+		for i, b := range bounds {
+			h.Buckets = append(h.Buckets, parser.Bucket{UpperBound: b, CumulativeCount: counts[i]})
+		}
+		return map[string]interface{}{
+			"request_duration_seconds": &parser.Family{
+				Name:    "request_duration_seconds",
+				Type:    "HISTOGRAM",
+				Metrics: []interface{}{h},
+			},
+		}
+	}
+	inf := math.Inf(1)
+
+	It("estimates quantiles per instance and merged across instances", func() {
+		metrics := []agent.InstanceMetric{
+			{Instance: 0, Metrics: histogram([]float64{0.1, 0.5, 1, inf}, []uint64{10, 30, 40, 40})},
+			{Instance: 1, Metrics: histogram([]float64{0.1, 0.5, 1, inf}, []uint64{0, 10, 40, 40})},
+			{Instance: 2, Error: "unable to parse response"},
+		}
+
+		h := aggregate.EstimateHistograms(metrics, aggregate.DefaultQuantiles)
+
+		Expect(h.Incompatible).To(BeEmpty())
+		Expect(h.Instances).To(HaveLen(2))
+		Expect(h.Instances[0].Instance).To(Equal(0))
+		Expect(h.Instances[0].Estimates[0].Series).To(Equal(`request_duration_seconds{path="/"}`))
+		Expect(h.Instances[0].Estimates[0].Count).To(Equal(uint64(40)))
+		Expect(h.Merged).To(HaveLen(1))
+		Expect(h.Merged[0].Count).To(Equal(uint64(80)))
+		Expect(h.Merged[0].Quantiles).To(HaveLen(3))
+		Expect(h.Merged[0].Quantiles[0].Value).To(BeNumerically("~", 0.5, 1e-9))
+		Expect(h.Merged[0].Quantiles[1].Value).To(BeNumerically("~", 0.9, 1e-9))
+		Expect(h.Merged[0].Quantiles[2].Value).To(BeNumerically("~", 0.99, 1e-9))
+	})
+
+	It("reports series with incompatible bucket layouts", func() {
+		metrics := []agent.InstanceMetric{
+			{Instance: 0, Metrics: histogram([]float64{0.1, 0.5, 1, inf}, []uint64{10, 30, 40, 40})},
+			{Instance: 1, Metrics: histogram([]float64{0.25, 1, inf}, []uint64{5, 10, 10})},
+			{Instance: 2, Metrics: histogram([]float64{0.1, 0.5, 1, inf}, []uint64{1, 2, 3, 4})},
+		}
+
+		h := aggregate.EstimateHistograms(metrics, aggregate.DefaultQuantiles)
+
+		Expect(h.Instances).To(HaveLen(3))
+		Expect(h.Merged).To(BeEmpty())
+		Expect(h.Incompatible).To(Equal([]aggregate.Incompatible{
+			{
+				Series: `request_duration_seconds{path="/"}`,
+				Layouts: []aggregate.Layout{
+					{UpperBounds: []string{"0.1", "0.5", "1", "+Inf"}, Instances: []int{0, 2}},
+					{UpperBounds: []string{"0.25", "1", "+Inf"}, Instances: []int{1}},
+				},
+			},
+		}))
+	})
+
+	It("adds the +Inf bucket when it is missing", func() {
+		metrics := []agent.InstanceMetric{
+			{Instance: 0, Metrics: histogram([]float64{1, 2}, []uint64{5, 10})},
+		}
+
+		h := aggregate.EstimateHistograms(metrics, []float64{0.5})
+
+		Expect(h.Merged[0].Quantiles).To(Equal([]aggregate.Quantile{{Quantile: 0.5, Value: 1}}))
+	})
+})
@@ -0,0 +1,180 @@
+package aggregate
+
+import (
+	"math"
+	"sort"
+
+	"github.com/wfernandes/app-metrics-plugin/pkg/agent"
+)
+
+// Method scores how far the value of an instance is from its peers.
+type Method string
+
+const (
+	// MethodMAD uses the modified z-score based on the median absolute
+	// deviation. It is robust against the outlier itself skewing the peers.
+	MethodMAD Method = "mad"
+	// MethodZScore uses the number of standard deviations from the mean.
+	MethodZScore Method = "zscore"
+)
+
+// Default thresholds of the methods, the modified z-score threshold is the
+// one suggested by Iglewicz and Hoaglin.
+const (
+	DefaultMADThreshold    = 3.5
+	DefaultZScoreThreshold = 3
+)
+
+// minPeers is the number of instances needed to tell an outlier apart.
+const minPeers = 3
+
+// Outlier is an instance with metrics deviating from its peers.
+type Outlier struct {
+	Instance   int         `json:"instance"`
+	Deviations []Deviation `json:"deviations"`
+}
+
+// Deviation is a metric that caused an instance to be flagged. Center is
+// the median of all instances for MethodMAD and the mean for MethodZScore.
+type Deviation struct {
+	Metric string  `json:"metric"`
+	Value  float64 `json:"value"`
+	Center float64 `json:"center"`
+	Score  float64 `json:"score"`
+}
+
+type OutlierDetector struct {
+	method    Method
+	threshold float64
+}
+
+type OutlierDetectorOpt func(*OutlierDetector)
+
+func WithMethod(m Method) OutlierDetectorOpt {
+	return func(d *OutlierDetector) {
+		d.method = m
+	}
+}
+
+// WithThreshold sets the absolute score above which a value is an outlier.
+func WithThreshold(t float64) OutlierDetectorOpt {
+	return func(d *OutlierDetector) {
+		d.threshold = t
+	}
+}
+
+func NewOutlierDetector(opts ...OutlierDetectorOpt) *OutlierDetector {
+	d := &OutlierDetector{
+		method: MethodMAD,
+	}
+
+	for _, o := range opts {
+		o(d)
+	}
+
+	if d.threshold <= 0 {
+		d.threshold = DefaultMADThreshold
+		if d.method == MethodZScore {
+			d.threshold = DefaultZScoreThreshold
+		}
+	}
+	return d
+}
+
+// Outliers returns the instances with at least one metric scoring above the
+// threshold, sorted by instance. Their deviations are sorted by decreasing
+// absolute score. Metrics reported by fewer than three instances or with no
+// spread between the instances are not scored.
+func (d *OutlierDetector) Outliers(metrics []agent.InstanceMetric) []Outlier {
+	byInstance := make(map[int][]Deviation)
+	for k, samples := range collect(metrics) {
+		if len(samples) < minPeers {
+			continue
+		}
+		center, score := d.scorer(samples)
+		if score == nil {
+			continue
+		}
+		for _, s := range samples {
+			if z := score(s.value); math.Abs(z) > d.threshold {
+				byInstance[s.instance] = append(byInstance[s.instance], Deviation{Metric: k, Value: s.value, Center: center, Score: z})
+			}
+		}
+	}
+
+	outliers := make([]Outlier, 0, len(byInstance))
+	for i, deviations := range byInstance {
+		sort.Slice(deviations, func(a, b int) bool {
+			sa, sb := math.Abs(deviations[a].Score), math.Abs(deviations[b].Score)
+			if sa != sb {
+				return sa > sb
+			}
+			return deviations[a].Metric < deviations[b].Metric
+		})
+		outliers = append(outliers, Outlier{Instance: i, Deviations: deviations})
+	}
+	sort.Slice(outliers, func(a, b int) bool {
+		return outliers[a].Instance < outliers[b].Instance
+	})
+	return outliers
+}
+
+// Threshold returns the absolute score above which a value is an outlier.
+func (d *OutlierDetector) Threshold() float64 {
+	return d.threshold
+}
+
+// MaxScore returns the highest absolute score a value can reach among n
+// instances. The z-score of one of n values is at most √(n-1), so the
+// default threshold of MethodZScore needs at least 11 instances. The
+// modified z-score has no such limit.
+func (d *OutlierDetector) MaxScore(n int) float64 {
+	if d.method == MethodZScore {
+		return math.Sqrt(float64(n - 1))
+	}
+	return math.Inf(1)
+}
+
+// scorer returns the center of the samples and a function scoring a value,
+// or a nil function when all samples are the same.
+func (d *OutlierDetector) scorer(samples []sample) (float64, func(float64) float64) {
+	if d.method == MethodZScore {
+		mean, sd := meanStdDev(samples)
+		if sd == 0 {
+			return mean, nil
+		}
+		return mean, func(v float64) float64 { return (v - mean) / sd }
+	}
+
+	values := make([]float64, len(samples))
+	for i, s := range samples {
+		values[i] = s.value
+	}
+	m := median(values)
+
+	deviations := make([]float64, len(values))
+	var sum float64
+	for i, v := range values {
+		deviations[i] = math.Abs(v - m)
+		sum += deviations[i]
+	}
+	if mad := median(deviations); mad > 0 {
+		return m, func(v float64) float64 { return 0.6745 * (v - m) / mad }
+	}
+	// More than half of the instances agree, fall back to the mean absolute
+	// deviation so the instances that do not are still scored.
+	if meanAD := sum / float64(len(values)); meanAD > 0 {
+		return m, func(v float64) float64 { return (v - m) / (1.253314 * meanAD) }
+	}
+	return m, nil
+}
+
+func median(values []float64) float64 {
+	sorted := append([]float64(nil), values...)
+	sort.Float64s(sorted)
+	n := len(sorted)
+	if n%2 == 1 {
+		return sorted[n/2]
+	}
+	return (sorted[n/2-1] + sorted[n/2]) / 2
+}
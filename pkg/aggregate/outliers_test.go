@@ -0,0 +1,74 @@
+package aggregate_test
+
+import (
+	"math"
+
+	"github.com/wfernandes/app-metrics-plugin/pkg/agent"
+	"github.com/wfernandes/app-metrics-plugin/pkg/aggregate"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("OutlierDetector", func() {
+	var metrics []agent.InstanceMetric
+
+	BeforeEach(func() {
+		metrics = []agent.InstanceMetric{
+			{Instance: 0, Metrics: map[string]interface{}{"latency": 10.0, "goroutines": 50.0, "errors": 0.0}},
+			{Instance: 1, Metrics: map[string]interface{}{"latency": 12.0, "goroutines": 52.0, "errors": 0.0}},
+			{Instance: 2, Metrics: map[string]interface{}{"latency": 11.0, "goroutines": 51.0, "errors": 0.0}},
+			{Instance: 3, Metrics: map[string]interface{}{"latency": 95.0, "goroutines": 49.0, "errors": 7.0}},
+			{Instance: 4, Metrics: map[string]interface{}{"latency": 9.0, "goroutines": 50.0, "errors": 0.0}},
+			{Instance: 5, Error: "unable to parse response"},
+		}
+	})
+
+	It("flags instances by median absolute deviation", func() {
+		outliers := aggregate.NewOutlierDetector().Outliers(metrics)
+
+		Expect(outliers).To(HaveLen(1))
+		Expect(outliers[0].Instance).To(Equal(3))
+		Expect(outliers[0].Deviations).To(HaveLen(2))
+		Expect(outliers[0].Deviations[0]).To(Equal(aggregate.Deviation{Metric: "latency", Value: 95, Center: 11, Score: 0.6745 * 84}))
+		Expect(outliers[0].Deviations[1].Metric).To(Equal("errors"))
+		Expect(outliers[0].Deviations[1].Center).To(Equal(0.0))
+		Expect(outliers[0].Deviations[1].Score).To(BeNumerically("~", 7/(1.253314*1.4), 1e-9))
+	})
+
+	It("flags instances by z-score", func() {
+		outliers := aggregate.NewOutlierDetector(
+			aggregate.WithMethod(aggregate.MethodZScore),
+			aggregate.WithThreshold(1.6),
+		).Outliers(metrics)
+
+		Expect(outliers).To(HaveLen(1))
+		Expect(outliers[0].Instance).To(Equal(3))
+		Expect(outliers[0].Deviations).To(HaveLen(2))
+		Expect(outliers[0].Deviations[0].Metric).To(Equal("errors"))
+		Expect(outliers[0].Deviations[0].Center).To(Equal(1.4))
+		Expect(outliers[0].Deviations[0].Score).To(BeNumerically("~", 2, 1e-9))
+		Expect(outliers[0].Deviations[1].Metric).To(Equal("latency"))
+	})
+
+	It("does not flag anything with the default z-score threshold and few instances", func() {
+		outliers := aggregate.NewOutlierDetector(aggregate.WithMethod(aggregate.MethodZScore)).Outliers(metrics)
+
+		Expect(outliers).To(BeEmpty())
+	})
+
+	It("tells the highest score a value can reach among the instances", func() {
+		zscore := aggregate.NewOutlierDetector(aggregate.WithMethod(aggregate.MethodZScore))
+		Expect(zscore.Threshold()).To(Equal(3.0))
+		Expect(zscore.MaxScore(5)).To(Equal(2.0))
+		Expect(zscore.MaxScore(11)).To(BeNumerically(">", zscore.Threshold()))
+
+		Expect(aggregate.NewOutlierDetector().MaxScore(3)).To(Equal(math.Inf(1)))
+	})
+
+	It("needs at least three instances", func() {
+		outliers := aggregate.NewOutlierDetector().Outliers(metrics[2:4])
+
+		Expect(outliers).To(BeEmpty())
+	})
+})
@@ -0,0 +1,221 @@
+package assert
+
+import (
+	"fmt"
+	"math"
+	"path"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/wfernandes/app-metrics-plugin/pkg/agent"
+	"github.com/wfernandes/app-metrics-plugin/pkg/aggregate"
+)
+
+// Functions aggregating a metric across instances.
+const (
+	FuncSum   = "sum"
+	FuncAvg   = "avg"
+	FuncMin   = "min"
+	FuncMax   = "max"
+	FuncCount = "count"
+)
+
+var (
+	exprPattern = regexp.MustCompile(`^(?:(\w+)\s*\(\s*(.+?)\s*\)|(.+?))\s*(<=|>=|==|!=|<|>)\s*(\S+)$`)
+	// units of the values, powers of 1000 and of 1024 for bytes.
+	units = map[string]float64{
+		"":    1,
+		"k":   1e3,
+		"m":   1e6,
+		"g":   1e9,
+		"b":   1,
+		"kb":  1e3,
+		"mb":  1e6,
+		"gb":  1e9,
+		"tb":  1e12,
+		"kib": 1 << 10,
+		"mib": 1 << 20,
+		"gib": 1 << 30,
+		"tib": 1 << 40,
+	}
+)
+
+// Assertion is a threshold on the metrics matching a glob, e.g.
+// `goroutines < 5000`. Without a Func every instance is checked, with one
+// the metric aggregated across instances is, e.g.
+// `max(memstats.heap_inuse) < 512MiB`. Rate assertions, e.g.
+// `errors_total rate == 0`, check the per-second rate of the metric
+// between two scrapes.
+type Assertion struct {
+	Expr   string
+	Func   string
+	Metric string
+	Rate   bool
+	Op     string
+	Value  float64
+}
+
+// Result is the outcome of an assertion. An assertion that matches no
+// metric fails.
+type Result struct {
+	Assertion string    `json:"assertion"`
+	Passed    bool      `json:"passed"`
+	Failures  []Failure `json:"failures,omitempty"`
+}
+
+// Failure is a value violating an assertion, or the reason it could not be
+// checked. Instance is nil for assertions across instances.
+type Failure struct {
+	Instance *int    `json:"instance,omitempty"`
+	Metric   string  `json:"metric,omitempty"`
+	Value    float64 `json:"value"`
+	Error    string  `json:"error,omitempty"`
+}
+
+// Parse parses an assertion such as `goroutines < 5000`,
+// `max(memstats.heap_inuse) < 512MiB` or `errors_total rate == 0`. Values
+// may have a k, M, G or byte unit suffix, e.g. KB or MiB.
+func Parse(expr string) (Assertion, error) {
+	m := exprPattern.FindStringSubmatch(strings.TrimSpace(expr))
+	if m == nil {
+		return Assertion{}, fmt.Errorf("invalid assertion %q, expected e.g. 'goroutines < 5000'", expr)
+	}
+
+	a := Assertion{Expr: expr, Func: m[1], Metric: m[3], Op: m[4]}
+	if a.Func != "" {
+		a.Metric = m[2]
+		switch a.Func {
+		case FuncSum, FuncAvg, FuncMin, FuncMax, FuncCount:
+		default:
+			return Assertion{}, fmt.Errorf("invalid assertion %q, unknown function %s", expr, a.Func)
+		}
+	}
+	if fields := strings.Fields(a.Metric); len(fields) == 2 && fields[1] == "rate" {
+		a.Metric, a.Rate = fields[0], true
+	}
+	if _, err := path.Match(a.Metric, ""); err != nil || strings.ContainsAny(a.Metric, " \t") {
+		return Assertion{}, fmt.Errorf("invalid assertion %q, bad metric %q", expr, a.Metric)
+	}
+
+	v, err := parseValue(m[5])
+	if err != nil {
+		return Assertion{}, fmt.Errorf("invalid assertion %q, %s", expr, err)
+	}
+	a.Value = v
+	return a, nil
+}
+
+func parseValue(s string) (float64, error) {
+	i := strings.LastIndexAny(s, "0123456789.") + 1
+	unit, ok := units[strings.ToLower(s[i:])]
+	if !ok {
+		return 0, fmt.Errorf("unknown unit %q", s[i:])
+	}
+	v, err := strconv.ParseFloat(s[:i], 64)
+	if err != nil {
+		return 0, fmt.Errorf("bad value %q", s)
+	}
+	return v * unit, nil
+}
+
+// Check evaluates the assertion against the metrics of the instances, or
+// their rates for rate assertions. Instances that could not be scraped
+// fail every assertion.
+func (a Assertion) Check(metrics []agent.InstanceMetric) Result {
+	r := Result{Assertion: a.Expr}
+	matched := false
+
+	// An instance that could not be scraped fails the aggregate too, as
+	// the value it is missing might not hold.
+	for _, m := range metrics {
+		if m.Metrics == nil {
+			instance := m.Instance
+			r.Failures = append(r.Failures, Failure{Instance: &instance, Error: m.Error})
+		}
+	}
+
+	if a.Func == "" {
+		for _, m := range metrics {
+			if m.Metrics == nil {
+				continue
+			}
+			instance := m.Instance
+			values := aggregate.Flatten(m.Metrics)
+			for _, k := range sortedKeys(values) {
+				if !a.matches(k) {
+					continue
+				}
+				matched = true
+				if !a.holds(values[k]) {
+					r.Failures = append(r.Failures, Failure{Instance: &instance, Metric: k, Value: values[k]})
+				}
+			}
+		}
+	} else {
+		for _, s := range aggregate.Aggregate(metrics) {
+			if !a.matches(s.Metric) {
+				continue
+			}
+			matched = true
+			if v := a.aggregate(s); !a.holds(v) {
+				r.Failures = append(r.Failures, Failure{Metric: s.Metric, Value: v})
+			}
+		}
+	}
+
+	if !matched {
+		r.Failures = append(r.Failures, Failure{Error: fmt.Sprintf("no metric matches %s", a.Metric)})
+	}
+	r.Passed = len(r.Failures) == 0
+	return r
+}
+
+func (a Assertion) matches(metric string) bool {
+	ok, _ := path.Match(a.Metric, metric)
+	return ok
+}
+
+func (a Assertion) aggregate(s aggregate.Stat) float64 {
+	switch a.Func {
+	case FuncSum:
+		return s.Sum
+	case FuncMin:
+		return s.Min
+	case FuncMax:
+		return s.Max
+	case FuncCount:
+		return float64(s.Instances)
+	}
+	return s.Mean
+}
+
+// holds compares the value with the threshold. NaN never holds.
+func (a Assertion) holds(v float64) bool {
+	if math.IsNaN(v) {
+		return false
+	}
+	switch a.Op {
+	case "<":
+		return v < a.Value
+	case "<=":
+		return v <= a.Value
+	case ">":
+		return v > a.Value
+	case ">=":
+		return v >= a.Value
+	case "==":
+		return v == a.Value
+	}
+	return v != a.Value
+}
+
+func sortedKeys(m map[string]float64) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
@@ -0,0 +1,135 @@
+package assert_test
+
+import (
+	"github.com/wfernandes/app-metrics-plugin/pkg/agent"
+	"github.com/wfernandes/app-metrics-plugin/pkg/assert"
+	"github.com/wfernandes/app-metrics-plugin/pkg/parser"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Assertion", func() {
+	instance := func(i int) *int {
+		return &i
+	}
+
+	Describe("Parse", func() {
+		It("parses per instance, aggregate and rate assertions", func() {
+			a, err := assert.Parse("goroutines < 5000")
+			Expect(err).ToNot(HaveOccurred())
+			Expect(a).To(Equal(assert.Assertion{Expr: "goroutines < 5000", Metric: "goroutines", Op: "<", Value: 5000}))
+
+			a, err = assert.Parse("max(memstats.HeapInuse) <= 512MiB")
+			Expect(err).ToNot(HaveOccurred())
+			Expect(a).To(Equal(assert.Assertion{Expr: "max(memstats.HeapInuse) <= 512MiB", Func: "max", Metric: "memstats.HeapInuse", Op: "<=", Value: 512 << 20}))
+
+			a, err = assert.Parse("sum(errors_total rate)==0")
+			Expect(err).ToNot(HaveOccurred())
+			Expect(a).To(Equal(assert.Assertion{Expr: "sum(errors_total rate)==0", Func: "sum", Metric: "errors_total", Rate: true, Op: "==", Value: 0}))
+		})
+
+		It("parses units", func() {
+			for expr, value := range map[string]float64{
+				"x > 1.5k":  1500,
+				"x > 2M":    2e6,
+				"x > 1e3":   1000,
+				"x > 10KB":  10000,
+				"x > 1GiB":  1 << 30,
+				"x > -0.25": -0.25,
+			} {
+				a, err := assert.Parse(expr)
+				Expect(err).ToNot(HaveOccurred())
+				Expect(a.Value).To(Equal(value))
+			}
+		})
+
+		It("returns an error for invalid assertions", func() {
+			_, err := assert.Parse("goroutines")
+			Expect(err).To(MatchError(`invalid assertion "goroutines", expected e.g. 'goroutines < 5000'`))
+
+			_, err = assert.Parse("median(latency) < 5")
+			Expect(err).To(MatchError(`invalid assertion "median(latency) < 5", unknown function median`))
+
+			_, err = assert.Parse("heap < 5furlongs")
+			Expect(err).To(MatchError(`invalid assertion "heap < 5furlongs", unknown unit "furlongs"`))
+		})
+	})
+
+	Describe("Check", func() {
+		var metrics []agent.InstanceMetric
+
+		BeforeEach(func() {
+			metrics = []agent.InstanceMetric{
+				{Instance: 0, Metrics: map[string]interface{}{"goroutines": int64(100), "memstats": map[string]interface{}{"HeapInuse": int64(100 << 20)}}},
+				{Instance: 1, Metrics: map[string]interface{}{"goroutines": int64(6000), "memstats": map[string]interface{}{"HeapInuse": int64(600 << 20)}}},
+			}
+		})
+
+		It("checks every instance", func() {
+			a, err := assert.Parse("goroutines < 5000")
+			Expect(err).ToNot(HaveOccurred())
+
+			Expect(a.Check(metrics)).To(Equal(assert.Result{
+				Assertion: "goroutines < 5000",
+				Failures:  []assert.Failure{{Instance: instance(1), Metric: "goroutines", Value: 6000}},
+			}))
+		})
+
+		It("checks the metric aggregated across instances", func() {
+			a, err := assert.Parse("max(memstats.HeapInuse) < 512MiB")
+			Expect(err).ToNot(HaveOccurred())
+			Expect(a.Check(metrics).Failures).To(Equal([]assert.Failure{{Metric: "memstats.HeapInuse", Value: 600 << 20}}))
+
+			a, err = assert.Parse("avg(memstats.HeapInuse) < 512MiB")
+			Expect(err).ToNot(HaveOccurred())
+			Expect(a.Check(metrics).Passed).To(BeTrue())
+
+			a, err = assert.Parse("count(goroutines) == 2")
+			Expect(err).ToNot(HaveOccurred())
+			Expect(a.Check(metrics).Passed).To(BeTrue())
+		})
+
+		It("matches metrics with globs", func() {
+			metrics = []agent.InstanceMetric{{Instance: 0, Metrics: map[string]interface{}{
+				"http_errors_total": &parser.Family{
+					Name: "http_errors_total",
+					Type: "COUNTER",
+					Metrics: []interface{}{
+						parser.Metric{Labels: map[string]string{"code": "500"}, Value: 0},
+						parser.Metric{Labels: map[string]string{"code": "503"}, Value: 2},
+					},
+				},
+			}}}
+			a, err := assert.Parse("http_errors_total{*} == 0")
+			Expect(err).ToNot(HaveOccurred())
+
+			Expect(a.Check(metrics).Failures).To(Equal([]assert.Failure{
+				{Instance: instance(0), Metric: `http_errors_total{code="503"}`, Value: 2},
+			}))
+		})
+
+		It("fails when no metric matches or an instance failed", func() {
+			a, err := assert.Parse("threads < 10")
+			Expect(err).ToNot(HaveOccurred())
+			Expect(a.Check(metrics).Failures).To(Equal([]assert.Failure{{Error: "no metric matches threads"}}))
+
+			a, err = assert.Parse("goroutines > 0")
+			Expect(err).ToNot(HaveOccurred())
+			metrics = append(metrics, agent.InstanceMetric{Instance: 2, Error: "connection refused"})
+			Expect(a.Check(metrics).Failures).To(Equal([]assert.Failure{{Instance: instance(2), Error: "connection refused"}}))
+		})
+
+		It("fails aggregates when an instance failed", func() {
+			a, err := assert.Parse("max(memstats.HeapInuse) < 1GiB")
+			Expect(err).ToNot(HaveOccurred())
+			Expect(a.Check(metrics).Passed).To(BeTrue())
+
+			metrics = append(metrics, agent.InstanceMetric{Instance: 2, Error: "connection refused"})
+			Expect(a.Check(metrics)).To(Equal(assert.Result{
+				Assertion: "max(memstats.HeapInuse) < 1GiB",
+				Failures:  []assert.Failure{{Instance: instance(2), Error: "connection refused"}},
+			}))
+		})
+	})
+})
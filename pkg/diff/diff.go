@@ -0,0 +1,203 @@
+package diff
+
+import (
+	"fmt"
+	"math"
+	"sort"
+	"time"
+
+	"github.com/wfernandes/app-metrics-plugin/pkg/agent"
+	"github.com/wfernandes/app-metrics-plugin/pkg/aggregate"
+	"github.com/wfernandes/app-metrics-plugin/pkg/rate"
+)
+
+// Change is a numeric metric whose value differs between two scrapes.
+// Percent is nil when the metric was zero before. The Rate of a counter is
+// its per-second increase between the scrapes, computed from zero when it
+// was Reset. Stat is only set for the changes across instances and tells
+// whether the sum or the mean of the instances was compared.
+type Change struct {
+	Metric  string   `json:"metric"`
+	Stat    string   `json:"stat,omitempty"`
+	Before  float64  `json:"before"`
+	After   float64  `json:"after"`
+	Delta   float64  `json:"delta"`
+	Percent *float64 `json:"percent,omitempty"`
+	Counter bool     `json:"counter,omitempty"`
+	Rate    float64  `json:"rate,omitempty"`
+	Reset   bool     `json:"reset,omitempty"`
+}
+
+// Changes lists the metrics that only one of the scrapes reported and the
+// metrics whose value changed, sorted by metric.
+type Changes struct {
+	Added   []string `json:"added,omitempty"`
+	Removed []string `json:"removed,omitempty"`
+	Changed []Change `json:"changed,omitempty"`
+}
+
+// InstanceDiff holds the changes of one instance, or the reason it could
+// not be compared.
+type InstanceDiff struct {
+	Instance int    `json:"instance"`
+	Error    string `json:"error,omitempty"`
+	Changes
+}
+
+// Diff compares two scrapes of an app, instance by instance and across
+// instances.
+type Diff struct {
+	Before    time.Time      `json:"before"`
+	After     time.Time      `json:"after"`
+	Instances []InstanceDiff `json:"instances"`
+	Aggregate Changes        `json:"aggregate"`
+}
+
+// Compare returns the changes of every numeric metric, keyed like
+// aggregate.Flatten, between two samples. Across instances the sum of
+// counters and the mean of other metrics are compared, and the rate of a
+// counter is the sum of the rates of the instances, so that instances
+// coming and going do not count as increases. The calculator tells which
+// metrics are counters.
+func Compare(before, after agent.Sample, c *rate.Calculator) Diff {
+	elapsed := after.Time.Sub(before.Time).Seconds()
+	d := Diff{Before: before.Time, After: after.Time, Instances: []InstanceDiff{}}
+
+	previous := make(map[int]agent.InstanceMetric, len(before.Metrics))
+	for _, m := range before.Metrics {
+		previous[m.Instance] = m
+	}
+
+	for _, m := range after.Metrics {
+		b, ok := previous[m.Instance]
+		delete(previous, m.Instance)
+
+		id := InstanceDiff{Instance: m.Instance}
+		switch {
+		case !ok:
+			id.Error = "instance missing from the first scrape"
+		case b.Metrics == nil:
+			id.Error = fmt.Sprintf("first scrape failed: %s", b.Error)
+		case m.Metrics == nil:
+			id.Error = fmt.Sprintf("second scrape failed: %s", m.Error)
+		default:
+			counters := counterKeys(c, []agent.InstanceMetric{b, m})
+			id.Changes = compare(finite(aggregate.Flatten(b.Metrics)), finite(aggregate.Flatten(m.Metrics)), counters, elapsed, nil)
+		}
+		d.Instances = append(d.Instances, id)
+	}
+	rates := make(map[string]float64)
+	resets := make(map[string]bool)
+	for _, id := range d.Instances {
+		for _, ch := range id.Changed {
+			rates[ch.Metric] += ch.Rate
+			resets[ch.Metric] = resets[ch.Metric] || ch.Reset
+		}
+	}
+	for i := range previous {
+		d.Instances = append(d.Instances, InstanceDiff{Instance: i, Error: "instance missing from the second scrape"})
+	}
+	sort.Slice(d.Instances, func(i, j int) bool {
+		return d.Instances[i].Instance < d.Instances[j].Instance
+	})
+
+	counters := counterKeys(c, append(append([]agent.InstanceMetric(nil), before.Metrics...), after.Metrics...))
+	stat := func(metric string) string {
+		if counters[metric] {
+			return "sum"
+		}
+		return "mean"
+	}
+	d.Aggregate = compare(aggregateValues(before.Metrics, counters), aggregateValues(after.Metrics, counters), counters, elapsed, stat)
+	for i, ch := range d.Aggregate.Changed {
+		if ch.Counter {
+			d.Aggregate.Changed[i].Rate, d.Aggregate.Changed[i].Reset = rates[ch.Metric], resets[ch.Metric]
+		}
+	}
+	return d
+}
+
+func compare(before, after map[string]float64, counters map[string]bool, elapsed float64, stat func(string) string) Changes {
+	var changes Changes
+	for k, a := range after {
+		b, ok := before[k]
+		if !ok {
+			changes.Added = append(changes.Added, k)
+			continue
+		}
+		if a == b {
+			continue
+		}
+
+		c := Change{Metric: k, Before: b, After: a, Delta: a - b}
+		if stat != nil {
+			c.Stat = stat(k)
+		}
+		if b != 0 {
+			p := c.Delta / math.Abs(b) * 100
+			c.Percent = &p
+		}
+		if counters[k] {
+			c.Counter = true
+			increase := c.Delta
+			if increase < 0 {
+				c.Reset = true
+				increase = a
+			}
+			if elapsed > 0 {
+				c.Rate = increase / elapsed
+			}
+		}
+		changes.Changed = append(changes.Changed, c)
+	}
+	for k := range before {
+		if _, ok := after[k]; !ok {
+			changes.Removed = append(changes.Removed, k)
+		}
+	}
+
+	sort.Strings(changes.Added)
+	sort.Strings(changes.Removed)
+	sort.Slice(changes.Changed, func(i, j int) bool {
+		return changes.Changed[i].Metric < changes.Changed[j].Metric
+	})
+	return changes
+}
+
+// counterKeys returns the metrics that are counters on any of the instances.
+func counterKeys(c *rate.Calculator, metrics []agent.InstanceMetric) map[string]bool {
+	keys := make(map[string]bool)
+	for _, m := range metrics {
+		if m.Metrics == nil {
+			continue
+		}
+		for k := range c.Counters(m.Metrics) {
+			keys[k] = true
+		}
+	}
+	return keys
+}
+
+// aggregateValues returns the sum of the counters and the mean of the other
+// metrics across instances.
+func aggregateValues(metrics []agent.InstanceMetric, counters map[string]bool) map[string]float64 {
+	values := make(map[string]float64)
+	for _, s := range aggregate.Aggregate(metrics) {
+		if counters[s.Metric] {
+			values[s.Metric] = s.Sum
+		} else {
+			values[s.Metric] = s.Mean
+		}
+	}
+	return values
+}
+
+// finite drops NaN and infinite values, which have no meaningful delta.
+func finite(values map[string]float64) map[string]float64 {
+	for k, v := range values {
+		if math.IsNaN(v) || math.IsInf(v, 0) {
+			delete(values, k)
+		}
+	}
+	return values
+}
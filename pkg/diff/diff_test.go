@@ -0,0 +1,143 @@
+package diff_test
+
+import (
+	"time"
+
+	"github.com/wfernandes/app-metrics-plugin/pkg/agent"
+	"github.com/wfernandes/app-metrics-plugin/pkg/diff"
+	"github.com/wfernandes/app-metrics-plugin/pkg/parser"
+	"github.com/wfernandes/app-metrics-plugin/pkg/rate"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Compare", func() {
+	var (
+		start      time.Time
+		calculator *rate.Calculator
+	)
+
+	BeforeEach(func() {
+		start = time.Date(2017, 10, 1, 12, 0, 0, 0, time.UTC)
+		var err error
+		calculator, err = rate.New([]string{"requests"})
+		Expect(err).ToNot(HaveOccurred())
+	})
+
+	percent := func(p float64) *float64 {
+		return &p
+	}
+	// percentOf computes the percentage at run time, like Compare does,
+	// rather than with the exact arithmetic of constants.
+	percentOf := func(delta, before float64) *float64 {
+		return percent(delta / before * 100)
+	}
+
+	It("reports added, removed and changed metrics per instance", func() {
+		d := diff.Compare(
+			agent.Sample{Time: start, Metrics: []agent.InstanceMetric{
+				{Instance: 0, Metrics: map[string]interface{}{"latency": 10.0, "old": int64(1), "name": "app"}},
+			}},
+			agent.Sample{Time: start.Add(10 * time.Second), Metrics: []agent.InstanceMetric{
+				{Instance: 0, Metrics: map[string]interface{}{"latency": 15.0, "new": int64(1), "name": "app"}},
+			}},
+			calculator,
+		)
+
+		Expect(d.Instances).To(Equal([]diff.InstanceDiff{
+			{Instance: 0, Changes: diff.Changes{
+				Added:   []string{"new"},
+				Removed: []string{"old"},
+				Changed: []diff.Change{{Metric: "latency", Before: 10, After: 15, Delta: 5, Percent: percent(50)}},
+			}},
+		}))
+	})
+
+	It("computes the rate of counters and detects resets", func() {
+		d := diff.Compare(
+			agent.Sample{Time: start, Metrics: []agent.InstanceMetric{
+				{Instance: 0, Metrics: map[string]interface{}{"requests": int64(100)}},
+				{Instance: 1, Metrics: map[string]interface{}{"requests": int64(300)}},
+			}},
+			agent.Sample{Time: start.Add(10 * time.Second), Metrics: []agent.InstanceMetric{
+				{Instance: 0, Metrics: map[string]interface{}{"requests": int64(200)}},
+				{Instance: 1, Metrics: map[string]interface{}{"requests": int64(50)}},
+			}},
+			calculator,
+		)
+
+		Expect(d.Instances[0].Changed).To(Equal([]diff.Change{
+			{Metric: "requests", Before: 100, After: 200, Delta: 100, Percent: percent(100), Counter: true, Rate: 10},
+		}))
+		Expect(d.Instances[1].Changed).To(Equal([]diff.Change{
+			{Metric: "requests", Before: 300, After: 50, Delta: -250, Percent: percentOf(-250, 300), Counter: true, Rate: 5, Reset: true},
+		}))
+		Expect(d.Aggregate.Changed).To(Equal([]diff.Change{
+			{Metric: "requests", Stat: "sum", Before: 400, After: 250, Delta: -150, Percent: percent(-37.5), Counter: true, Rate: 15, Reset: true},
+		}))
+	})
+
+	It("compares the mean of other metrics across instances", func() {
+		d := diff.Compare(
+			agent.Sample{Time: start, Metrics: []agent.InstanceMetric{
+				{Instance: 0, Metrics: map[string]interface{}{"latency": 10.0}},
+				{Instance: 1, Metrics: map[string]interface{}{"latency": 20.0}},
+			}},
+			agent.Sample{Time: start.Add(time.Minute), Metrics: []agent.InstanceMetric{
+				{Instance: 0, Metrics: map[string]interface{}{"latency": 10.0}},
+				{Instance: 1, Metrics: map[string]interface{}{"latency": 30.0}},
+			}},
+			calculator,
+		)
+
+		Expect(d.Instances[0].Changes).To(Equal(diff.Changes{}))
+		Expect(d.Aggregate.Changed).To(Equal([]diff.Change{
+			{Metric: "latency", Stat: "mean", Before: 15, After: 20, Delta: 5, Percent: percentOf(5, 15)},
+		}))
+	})
+
+	It("treats prometheus counters as counters", func() {
+		family := func(v float64) map[string]interface{} {
+			return map[string]interface{}{
+				"http_requests_total": &parser.Family{
+					Name:    "http_requests_total",
+					Type:    "COUNTER",
+					Metrics: []interface{}{parser.Metric{Labels: map[string]string{"code": "500"}, Value: v}},
+				},
+			}
+		}
+		c, err := rate.New(nil)
+		Expect(err).ToNot(HaveOccurred())
+
+		d := diff.Compare(
+			agent.Sample{Time: start, Metrics: []agent.InstanceMetric{{Instance: 0, Metrics: family(0)}}},
+			agent.Sample{Time: start.Add(10 * time.Second), Metrics: []agent.InstanceMetric{{Instance: 0, Metrics: family(20)}}},
+			c,
+		)
+
+		Expect(d.Instances[0].Changed).To(Equal([]diff.Change{
+			{Metric: `http_requests_total{code="500"}`, Before: 0, After: 20, Delta: 20, Counter: true, Rate: 2},
+		}))
+	})
+
+	It("reports instances that cannot be compared", func() {
+		d := diff.Compare(
+			agent.Sample{Time: start, Metrics: []agent.InstanceMetric{
+				{Instance: 0, Error: "connection refused"},
+				{Instance: 2, Metrics: map[string]interface{}{}},
+			}},
+			agent.Sample{Time: start.Add(time.Minute), Metrics: []agent.InstanceMetric{
+				{Instance: 0, Metrics: map[string]interface{}{}},
+				{Instance: 1, Metrics: map[string]interface{}{}},
+			}},
+			calculator,
+		)
+
+		Expect(d.Instances).To(Equal([]diff.InstanceDiff{
+			{Instance: 0, Error: "first scrape failed: connection refused"},
+			{Instance: 1, Error: "instance missing from the first scrape"},
+			{Instance: 2, Error: "instance missing from the second scrape"},
+		}))
+	})
+})
@@ -0,0 +1,266 @@
+package filter
+
+import (
+	"fmt"
+	"path"
+	"sort"
+	"strings"
+
+	"github.com/wfernandes/app-metrics-plugin/pkg/agent"
+	"github.com/wfernandes/app-metrics-plugin/pkg/parser"
+)
+
+// Filter keeps or drops parts of the collected metrics. Expressions come in
+// three flavours:
+//
+//   - globs such as `ingress.*` match top-level keys,
+//   - JSONPath-style paths such as `$.memstats.HeapInuse` or
+//     `$['metric.map'].*` match values nested in expvar maps and arrays,
+//   - Prometheus series selectors such as `http_requests_total{code=~"5.."}`
+//     match metric families by name and their series by label.
+//
+// When include expressions are given only the matching parts are kept.
+// Exclude expressions are applied afterwards and drop what they match.
+type Filter struct {
+	includes []matcher
+	excludes []matcher
+}
+
+type matcher interface {
+	mark(metrics map[string]interface{}, sel *selection)
+}
+
+// New returns a Filter for the given include and exclude expressions.
+func New(includes, excludes []string) (*Filter, error) {
+	f := &Filter{}
+	for _, e := range includes {
+		m, err := parseExpression(e)
+		if err != nil {
+			return nil, err
+		}
+		f.includes = append(f.includes, m)
+	}
+	for _, e := range excludes {
+		m, err := parseExpression(e)
+		if err != nil {
+			return nil, err
+		}
+		f.excludes = append(f.excludes, m)
+	}
+	return f, nil
+}
+
+// Apply returns a copy of the instance metrics with the filter applied to
+// each instance. The given metrics are not modified.
+func (f *Filter) Apply(metrics []agent.InstanceMetric) []agent.InstanceMetric {
+	out := make([]agent.InstanceMetric, len(metrics))
+	for i, m := range metrics {
+		out[i] = m
+		if m.Metrics != nil {
+			out[i].Metrics = f.Metrics(m.Metrics)
+		}
+	}
+	return out
+}
+
+// Metrics applies the filter to the metrics of a single instance.
+func (f *Filter) Metrics(metrics map[string]interface{}) map[string]interface{} {
+	result := metrics
+
+	if len(f.includes) > 0 {
+		sel := &selection{}
+		for _, m := range f.includes {
+			m.mark(result, sel)
+		}
+		pruned, ok := prune(result, sel)
+		if !ok {
+			return map[string]interface{}{}
+		}
+		result = pruned.(map[string]interface{})
+	}
+
+	if len(f.excludes) > 0 {
+		sel := &selection{}
+		for _, m := range f.excludes {
+			m.mark(result, sel)
+		}
+		remaining, ok := remove(result, sel)
+		if !ok {
+			return map[string]interface{}{}
+		}
+		result = remaining.(map[string]interface{})
+	}
+
+	return result
+}
+
+func parseExpression(e string) (matcher, error) {
+	e = strings.TrimSpace(e)
+	switch {
+	case e == "":
+		return nil, fmt.Errorf("empty filter expression")
+	case strings.HasPrefix(e, "$"):
+		return parsePath(e)
+	case strings.Contains(e, "{"):
+		return parseSelector(e)
+	}
+	if _, err := path.Match(e, ""); err != nil {
+		return nil, fmt.Errorf("invalid glob %q: %s", e, err)
+	}
+	return globMatcher(e), nil
+}
+
+// globMatcher matches top-level keys.
+type globMatcher string
+
+func (g globMatcher) mark(metrics map[string]interface{}, sel *selection) {
+	for k := range metrics {
+		if ok, _ := path.Match(string(g), k); ok {
+			sel.key(k).all = true
+		}
+	}
+}
+
+// selection records which parts of a value a set of matchers matched. Keys
+// select entries of maps, indices select elements of arrays or series of a
+// metric family.
+type selection struct {
+	all     bool
+	keys    map[string]*selection
+	indices map[int]*selection
+}
+
+func (s *selection) key(k string) *selection {
+	if s.keys == nil {
+		s.keys = make(map[string]*selection)
+	}
+	c, ok := s.keys[k]
+	if !ok {
+		c = &selection{}
+		s.keys[k] = c
+	}
+	return c
+}
+
+func (s *selection) index(i int) *selection {
+	if s.indices == nil {
+		s.indices = make(map[int]*selection)
+	}
+	c, ok := s.indices[i]
+	if !ok {
+		c = &selection{}
+		s.indices[i] = c
+	}
+	return c
+}
+
+func (s *selection) sortedIndices() []int {
+	idx := make([]int, 0, len(s.indices))
+	for i := range s.indices {
+		idx = append(idx, i)
+	}
+	sort.Ints(idx)
+	return idx
+}
+
+// prune returns the selected parts of v. It returns false when nothing
+// of v was selected.
+func prune(v interface{}, sel *selection) (interface{}, bool) {
+	if sel.all {
+		return v, true
+	}
+
+	switch t := v.(type) {
+	case map[string]interface{}:
+		out := make(map[string]interface{})
+		for k, c := range sel.keys {
+			child, ok := t[k]
+			if !ok {
+				continue
+			}
+			if p, ok := prune(child, c); ok {
+				out[k] = p
+			}
+		}
+		return out, len(out) > 0
+	case []interface{}:
+		var out []interface{}
+		for _, i := range sel.sortedIndices() {
+			if i >= len(t) {
+				continue
+			}
+			if p, ok := prune(t[i], sel.indices[i]); ok {
+				out = append(out, p)
+			}
+		}
+		return out, len(out) > 0
+	case *parser.Family:
+		out := *t
+		out.Metrics = nil
+		for _, i := range sel.sortedIndices() {
+			if i < len(t.Metrics) {
+				out.Metrics = append(out.Metrics, t.Metrics[i])
+			}
+		}
+		return &out, len(out.Metrics) > 0
+	}
+
+	return nil, false
+}
+
+// remove returns v without the selected parts. It returns false when all
+// of v was selected.
+func remove(v interface{}, sel *selection) (interface{}, bool) {
+	if sel.all {
+		return nil, false
+	}
+
+	switch t := v.(type) {
+	case map[string]interface{}:
+		if len(sel.keys) == 0 {
+			return t, true
+		}
+		out := make(map[string]interface{}, len(t))
+		for k, child := range t {
+			c, ok := sel.keys[k]
+			if !ok {
+				out[k] = child
+				continue
+			}
+			if r, ok := remove(child, c); ok {
+				out[k] = r
+			}
+		}
+		return out, len(out) > 0 || len(t) == 0
+	case []interface{}:
+		if len(sel.indices) == 0 {
+			return t, true
+		}
+		out := make([]interface{}, 0, len(t))
+		for i, child := range t {
+			c, ok := sel.indices[i]
+			if !ok {
+				out = append(out, child)
+				continue
+			}
+			if r, ok := remove(child, c); ok {
+				out = append(out, r)
+			}
+		}
+		return out, len(out) > 0 || len(t) == 0
+	case *parser.Family:
+		if len(sel.indices) == 0 {
+			return t, true
+		}
+		out := *t
+		out.Metrics = nil
+		for i, series := range t.Metrics {
+			if c, ok := sel.indices[i]; !ok || !c.all {
+				out.Metrics = append(out.Metrics, series)
+			}
+		}
+		return &out, len(out.Metrics) > 0
+	}
+
+	return v, true
+}
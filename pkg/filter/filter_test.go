@@ -0,0 +1,194 @@
+package filter_test
+
+import (
+	"github.com/wfernandes/app-metrics-plugin/pkg/agent"
+	"github.com/wfernandes/app-metrics-plugin/pkg/filter"
+	"github.com/wfernandes/app-metrics-plugin/pkg/parser"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Filter", func() {
+	var expvar map[string]interface{}
+
+	BeforeEach(func() {
+		expvar = map[string]interface{}{
+			"ingress.received": int64(10),
+			"ingress.sent":     int64(8),
+			"egress.sent":      int64(3),
+			"cmdline":          []interface{}{"bin/app", "-debug"},
+			"memstats": map[string]interface{}{
+				"HeapInuse": int64(2048),
+				"NumGC":     int64(12),
+				"PauseNs":   []interface{}{int64(100), int64(200)},
+			},
+		}
+	})
+
+	It("keeps everything without expressions", func() {
+		f, err := filter.New(nil, nil)
+		Expect(err).ToNot(HaveOccurred())
+
+		Expect(f.Metrics(expvar)).To(Equal(expvar))
+	})
+
+	It("includes top-level keys matching a glob", func() {
+		f, err := filter.New([]string{"ingress.*"}, nil)
+		Expect(err).ToNot(HaveOccurred())
+
+		Expect(f.Metrics(expvar)).To(Equal(map[string]interface{}{
+			"ingress.received": int64(10),
+			"ingress.sent":     int64(8),
+		}))
+	})
+
+	It("excludes top-level keys matching a glob", func() {
+		f, err := filter.New(nil, []string{"*.sent", "cmdline"})
+		Expect(err).ToNot(HaveOccurred())
+
+		result := f.Metrics(expvar)
+		Expect(result).To(HaveLen(2))
+		Expect(result).To(HaveKey("ingress.received"))
+		Expect(result).To(HaveKey("memstats"))
+	})
+
+	It("includes nested values with a path", func() {
+		f, err := filter.New([]string{"$.memstats.HeapInuse", "$.memstats.PauseNs[1]", "$['egress.sent']"}, nil)
+		Expect(err).ToNot(HaveOccurred())
+
+		Expect(f.Metrics(expvar)).To(Equal(map[string]interface{}{
+			"egress.sent": int64(3),
+			"memstats": map[string]interface{}{
+				"HeapInuse": int64(2048),
+				"PauseNs":   []interface{}{int64(200)},
+			},
+		}))
+	})
+
+	It("excludes nested values with a path and leaves the input untouched", func() {
+		f, err := filter.New([]string{"memstats"}, []string{"$.memstats.PauseNs", `$["memstats"].*[0]`})
+		Expect(err).ToNot(HaveOccurred())
+
+		Expect(f.Metrics(expvar)).To(Equal(map[string]interface{}{
+			"memstats": map[string]interface{}{
+				"HeapInuse": int64(2048),
+				"NumGC":     int64(12),
+			},
+		}))
+		Expect(expvar["memstats"]).To(HaveKey("PauseNs"))
+	})
+
+	Context("with prometheus metrics", func() {
+		var prom map[string]interface{}
+
+		BeforeEach(func() {
+			prom = map[string]interface{}{
+				"http_requests_total": &parser.Family{
+					Name: "http_requests_total",
+					Type: "COUNTER",
+					Metrics: []interface{}{
+						parser.Metric{Labels: map[string]string{"code": "200", "method": "GET"}, Value: 10},
+						parser.Metric{Labels: map[string]string{"code": "500", "method": "GET"}, Value: 2},
+						parser.Metric{Labels: map[string]string{"code": "503", "method": "POST"}, Value: 1},
+					},
+				},
+				"go_goroutines": &parser.Family{
+					Name:    "go_goroutines",
+					Type:    "GAUGE",
+					Metrics: []interface{}{parser.Metric{Labels: map[string]string{}, Value: 6}},
+				},
+			}
+		})
+
+		It("includes series matching a selector", func() {
+			f, err := filter.New([]string{`http_requests_total{code=~"5.."}`}, nil)
+			Expect(err).ToNot(HaveOccurred())
+
+			result := f.Metrics(prom)
+			Expect(result).To(HaveLen(1))
+			family := result["http_requests_total"].(*parser.Family)
+			Expect(family.Metrics).To(HaveLen(2))
+			Expect(parser.SeriesLabels(family.Metrics[0])).To(HaveKeyWithValue("code", "500"))
+			Expect(parser.SeriesLabels(family.Metrics[1])).To(HaveKeyWithValue("code", "503"))
+		})
+
+		It("excludes series matching a selector", func() {
+			f, err := filter.New(nil, []string{`{method="GET", code!="500"}`, "go_*"})
+			Expect(err).ToNot(HaveOccurred())
+
+			result := f.Metrics(prom)
+			Expect(result).To(HaveLen(1))
+			family := result["http_requests_total"].(*parser.Family)
+			Expect(family.Metrics).To(HaveLen(2))
+			Expect(prom["http_requests_total"].(*parser.Family).Metrics).To(HaveLen(3))
+		})
+
+		It("drops families without matching series", func() {
+			f, err := filter.New([]string{`http_requests_total{code="404"}`}, nil)
+			Expect(err).ToNot(HaveOccurred())
+
+			Expect(f.Metrics(prom)).To(BeEmpty())
+		})
+	})
+
+	It("applies to every instance and skips instances with errors", func() {
+		f, err := filter.New([]string{"egress.*"}, nil)
+		Expect(err).ToNot(HaveOccurred())
+
+		result := f.Apply([]agent.InstanceMetric{
+			{Instance: 0, Metrics: expvar},
+			{Instance: 1, Error: "some error"},
+		})
+
+		Expect(result).To(Equal([]agent.InstanceMetric{
+			{Instance: 0, Metrics: map[string]interface{}{"egress.sent": int64(3)}},
+			{Instance: 1, Error: "some error"},
+		}))
+	})
+
+	It("returns an error for invalid expressions", func() {
+		for _, expr := range []string{
+			"ingress.[a",
+			"$.memstats[0",
+			"$.memstats[x]",
+			`http_requests_total{code="500"`,
+			`http_requests_total{code=500}`,
+			`http_requests_total{code=~"5(("}`,
+		} {
+			_, err := filter.New([]string{expr}, nil)
+			Expect(err).To(HaveOccurred(), expr)
+		}
+	})
+})
+
+var _ = Describe("LabelMatcher", func() {
+	It("matches labels with anchored regular expressions", func() {
+		m, err := filter.NewLabelMatcher("code", "=~", "5..")
+		Expect(err).ToNot(HaveOccurred())
+		Expect(m.Matches(map[string]string{"code": "503"})).To(BeTrue())
+		Expect(m.Matches(map[string]string{"code": "5030"})).To(BeFalse())
+
+		m, err = filter.NewLabelMatcher("code", "!=", "")
+		Expect(err).ToNot(HaveOccurred())
+		Expect(m.Matches(map[string]string{})).To(BeFalse())
+
+		_, err = filter.NewLabelMatcher("code", "==", "200")
+		Expect(err).To(MatchError(`unknown operator "=="`))
+	})
+
+	It("unquotes label values", func() {
+		v, n, err := filter.Unquote(`"a\"b",x`)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(v).To(Equal(`a"b`))
+		Expect(n).To(Equal(6))
+
+		v, n, err = filter.Unquote("`\\d+`}")
+		Expect(err).ToNot(HaveOccurred())
+		Expect(v).To(Equal(`\d+`))
+		Expect(n).To(Equal(5))
+
+		_, _, err = filter.Unquote(`"open`)
+		Expect(err).To(MatchError(`unterminated label value "\"open"`))
+	})
+})
@@ -0,0 +1,147 @@
+package filter
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// pathMatcher matches values nested in expvar maps and arrays using a
+// JSONPath-style expression, e.g. `$.memstats.PauseNs[0]`,
+// `$['metric.map'].metric1` or `$.*.count`.
+type pathMatcher []step
+
+type step struct {
+	name     string
+	index    int
+	isIndex  bool
+	wildcard bool
+}
+
+func parsePath(e string) (pathMatcher, error) {
+	if !strings.HasPrefix(e, "$") {
+		return nil, fmt.Errorf("invalid path %q: must start with $", e)
+	}
+
+	var steps pathMatcher
+	rest := e[1:]
+	for len(rest) > 0 {
+		switch rest[0] {
+		case '.':
+			rest = rest[1:]
+			end := strings.IndexAny(rest, ".[")
+			if end < 0 {
+				end = len(rest)
+			}
+			name := rest[:end]
+			if name == "" {
+				return nil, fmt.Errorf("invalid path %q: empty key", e)
+			}
+			if name == "*" {
+				steps = append(steps, step{wildcard: true})
+			} else {
+				steps = append(steps, step{name: name})
+			}
+			rest = rest[end:]
+		case '[':
+			end := closingBracket(rest)
+			if end < 0 {
+				return nil, fmt.Errorf("invalid path %q: missing ]", e)
+			}
+			s, err := parseBracket(rest[1:end])
+			if err != nil {
+				return nil, fmt.Errorf("invalid path %q: %s", e, err)
+			}
+			steps = append(steps, s)
+			rest = rest[end+1:]
+		default:
+			return nil, fmt.Errorf("invalid path %q: unexpected %q", e, rest[0])
+		}
+	}
+
+	if len(steps) == 0 {
+		return nil, fmt.Errorf("invalid path %q: no keys", e)
+	}
+	return steps, nil
+}
+
+// closingBracket returns the position of the ] closing the bracket at the
+// start of s, skipping over quoted keys.
+func closingBracket(s string) int {
+	var quote byte
+	for i := 1; i < len(s); i++ {
+		switch {
+		case quote != 0 && s[i] == '\\':
+			i++
+		case quote != 0 && s[i] == quote:
+			quote = 0
+		case quote == 0 && (s[i] == '\'' || s[i] == '"'):
+			quote = s[i]
+		case quote == 0 && s[i] == ']':
+			return i
+		}
+	}
+	return -1
+}
+
+func parseBracket(s string) (step, error) {
+	s = strings.TrimSpace(s)
+	switch {
+	case s == "*":
+		return step{wildcard: true}, nil
+	case len(s) >= 2 && (s[0] == '\'' || s[0] == '"') && s[len(s)-1] == s[0]:
+		name := s[1 : len(s)-1]
+		if s[0] == '\'' {
+			name = strings.Replace(name, `\'`, `'`, -1)
+			name = strings.Replace(name, `"`, `\"`, -1)
+		}
+		unquoted, err := strconv.Unquote(`"` + name + `"`)
+		if err != nil {
+			return step{}, fmt.Errorf("bad key %s", s)
+		}
+		return step{name: unquoted}, nil
+	}
+	i, err := strconv.Atoi(s)
+	if err != nil || i < 0 {
+		return step{}, fmt.Errorf("bad index %q", s)
+	}
+	return step{index: i, isIndex: true}, nil
+}
+
+func (p pathMatcher) mark(metrics map[string]interface{}, sel *selection) {
+	markPath(metrics, p, sel)
+}
+
+func markPath(v interface{}, steps []step, sel *selection) {
+	if len(steps) == 0 {
+		sel.all = true
+		return
+	}
+	s, rest := steps[0], steps[1:]
+
+	switch t := v.(type) {
+	case map[string]interface{}:
+		if s.isIndex {
+			return
+		}
+		if s.wildcard {
+			for k, child := range t {
+				markPath(child, rest, sel.key(k))
+			}
+			return
+		}
+		if child, ok := t[s.name]; ok {
+			markPath(child, rest, sel.key(s.name))
+		}
+	case []interface{}:
+		if s.wildcard {
+			for i, child := range t {
+				markPath(child, rest, sel.index(i))
+			}
+			return
+		}
+		if s.isIndex && s.index < len(t) {
+			markPath(t[s.index], rest, sel.index(s.index))
+		}
+	}
+}
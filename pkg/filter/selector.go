@@ -0,0 +1,203 @@
+package filter
+
+import (
+	"fmt"
+	"path"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/wfernandes/app-metrics-plugin/pkg/parser"
+)
+
+// selectorMatcher matches Prometheus series, e.g.
+// `http_requests_total{code=~"5..",method!="GET"}`. The metric name may be a
+// glob and may be omitted to match every family.
+type selectorMatcher struct {
+	name     string
+	matchers []LabelMatcher
+}
+
+// LabelMatcher matches a label of a series, e.g. `code=~"5.."`. It is
+// shared with the query selectors so both dialects match labels alike.
+type LabelMatcher struct {
+	Name  string
+	Op    string
+	Value string
+	re    *regexp.Regexp
+}
+
+// NewLabelMatcher returns a matcher of the label with one of the =, !=, =~
+// and !~ operators. Like in Prometheus, regular expressions are fully
+// anchored.
+func NewLabelMatcher(name, op, value string) (LabelMatcher, error) {
+	m := LabelMatcher{Name: name, Op: op, Value: value}
+	switch op {
+	case "=", "!=":
+	case "=~", "!~":
+		re, err := regexp.Compile("^(?:" + value + ")$")
+		if err != nil {
+			return LabelMatcher{}, err
+		}
+		m.re = re
+	default:
+		return LabelMatcher{}, fmt.Errorf("unknown operator %q", op)
+	}
+	return m, nil
+}
+
+// Matches reports whether the labels satisfy the matcher. A missing label
+// has the empty value.
+func (l LabelMatcher) Matches(labels map[string]string) bool {
+	v := labels[l.Name]
+	switch l.Op {
+	case "=":
+		return v == l.Value
+	case "!=":
+		return v != l.Value
+	case "=~":
+		return l.re.MatchString(v)
+	case "!~":
+		return !l.re.MatchString(v)
+	}
+	return false
+}
+
+func parseSelector(e string) (*selectorMatcher, error) {
+	open := strings.Index(e, "{")
+	if !strings.HasSuffix(e, "}") {
+		return nil, fmt.Errorf("invalid selector %q: missing }", e)
+	}
+
+	s := &selectorMatcher{name: strings.TrimSpace(e[:open])}
+	if s.name != "" {
+		if _, err := path.Match(s.name, ""); err != nil {
+			return nil, fmt.Errorf("invalid selector %q: %s", e, err)
+		}
+	}
+
+	matchers, err := parseLabelMatchers(e[open+1 : len(e)-1])
+	if err != nil {
+		return nil, fmt.Errorf("invalid selector %q: %s", e, err)
+	}
+	s.matchers = matchers
+	return s, nil
+}
+
+// parseLabelMatchers parses the comma separated label matchers found
+// between the braces of a Prometheus series selector.
+func parseLabelMatchers(s string) ([]LabelMatcher, error) {
+	var matchers []LabelMatcher
+	rest := strings.TrimSpace(s)
+	for rest != "" {
+		end := strings.IndexAny(rest, "=!")
+		if end <= 0 {
+			return nil, fmt.Errorf("expected label matcher at %q", rest)
+		}
+		name := strings.TrimSpace(rest[:end])
+		rest = rest[end:]
+
+		var op string
+		for _, o := range []string{"=~", "!~", "!=", "="} {
+			if strings.HasPrefix(rest, o) {
+				op = o
+				break
+			}
+		}
+		if op == "" {
+			return nil, fmt.Errorf("unknown operator at %q", rest)
+		}
+		rest = strings.TrimSpace(rest[len(op):])
+
+		value, n, err := Unquote(rest)
+		if err != nil {
+			return nil, err
+		}
+		rest = strings.TrimSpace(rest[n:])
+
+		m, err := NewLabelMatcher(name, op, value)
+		if err != nil {
+			return nil, err
+		}
+		matchers = append(matchers, m)
+
+		if strings.HasPrefix(rest, ",") {
+			rest = strings.TrimSpace(rest[1:])
+		} else if rest != "" {
+			return nil, fmt.Errorf("expected , at %q", rest)
+		}
+	}
+	return matchers, nil
+}
+
+// Unquote reads the label value quoted with ", ' or ` at the start of s and
+// returns it and the number of bytes consumed.
+func Unquote(s string) (string, int, error) {
+	if s == "" || (s[0] != '"' && s[0] != '\'' && s[0] != '`') {
+		return "", 0, fmt.Errorf("expected quoted label value at %q", s)
+	}
+	q := s[0]
+	for i := 1; i < len(s); i++ {
+		if s[i] == '\\' && q != '`' {
+			i++
+			continue
+		}
+		if s[i] != q {
+			continue
+		}
+		raw := s[:i+1]
+		if q == '\'' {
+			raw = `"` + strings.Replace(strings.Replace(raw[1:i], `\'`, `'`, -1), `"`, `\"`, -1) + `"`
+		}
+		v, err := strconv.Unquote(raw)
+		if err != nil {
+			return "", 0, fmt.Errorf("bad label value %s", s[:i+1])
+		}
+		return v, i + 1, nil
+	}
+	return "", 0, fmt.Errorf("unterminated label value %q", s)
+}
+
+// matches reports whether a series with the given name and labels is
+// selected.
+func (s *selectorMatcher) matches(name string, labels map[string]string) bool {
+	if !s.matchesName(name) {
+		return false
+	}
+	for _, m := range s.matchers {
+		if !m.Matches(labels) {
+			return false
+		}
+	}
+	return true
+}
+
+func (s *selectorMatcher) matchesName(name string) bool {
+	if s.name == "" {
+		return true
+	}
+	ok, _ := path.Match(s.name, name)
+	return ok
+}
+
+func (s *selectorMatcher) mark(metrics map[string]interface{}, sel *selection) {
+	for k, v := range metrics {
+		family, ok := v.(*parser.Family)
+		if !ok {
+			// Non Prometheus values have no labels, only a bare name can
+			// match them.
+			if len(s.matchers) == 0 && s.matches(k, nil) {
+				sel.key(k).all = true
+			}
+			continue
+		}
+		if !s.matchesName(family.Name) {
+			continue
+		}
+		for i, series := range family.Metrics {
+			if s.matches(family.Name, parser.SeriesLabels(series)) {
+				sel.key(k).index(i).all = true
+			}
+		}
+	}
+}
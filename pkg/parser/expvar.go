@@ -1,9 +1,15 @@
 package parser
 
-import "encoding/json"
+import (
+	"bytes"
+	"encoding/json"
+	"strconv"
+	"strings"
+)
 
 type Expvar struct {
-	propsToRemove []string
+	propsToRemove     []string
+	summarizeMemStats bool
 }
 
 type ExpvarOpt func(*Expvar)
@@ -26,7 +32,17 @@ func NewExpvar(opts ...ExpvarOpt) *Expvar {
 
 func (e *Expvar) Parse(b []byte) (map[string]interface{}, error) {
 	output := make(map[string]interface{})
-	err := json.Unmarshal(b, &output)
+	if !json.Valid(b) {
+		// The decoder below stops at the first value, let json.Unmarshal
+		// describe what is wrong with the whole input.
+		return nil, json.Unmarshal(b, &output)
+	}
+
+	// Decoding numbers as json.Number keeps int64 counters and nanosecond
+	// totals exact instead of rounding them through float64.
+	dec := json.NewDecoder(bytes.NewReader(b))
+	dec.UseNumber()
+	err := dec.Decode(&output)
 	if err != nil {
 		return nil, err
 	}
@@ -35,5 +51,48 @@ func (e *Expvar) Parse(b []byte) (map[string]interface{}, error) {
 		delete(output, prop)
 	}
 
+	for k, v := range output {
+		output[k] = convertNumbers(v)
+	}
+
+	if e.summarizeMemStats {
+		if summary, ok := SummarizeMemStats(output); ok {
+			output["memstats"] = summary
+		}
+	}
+
 	return output, nil
 }
+
+// convertNumbers walks decoded JSON and replaces every json.Number with an
+// int64 when it is an integer that fits, a uint64 for larger unsigned
+// integers and a float64 otherwise. Integers that overflow both are left as
+// json.Number so they are still printed verbatim.
+func convertNumbers(v interface{}) interface{} {
+	switch t := v.(type) {
+	case json.Number:
+		s := t.String()
+		if !strings.ContainsAny(s, ".eE") {
+			if i, err := strconv.ParseInt(s, 10, 64); err == nil {
+				return i
+			}
+			if u, err := strconv.ParseUint(s, 10, 64); err == nil {
+				return u
+			}
+			return t
+		}
+		if f, err := t.Float64(); err == nil {
+			return f
+		}
+		return t
+	case map[string]interface{}:
+		for k, e := range t {
+			t[k] = convertNumbers(e)
+		}
+	case []interface{}:
+		for i, e := range t {
+			t[i] = convertNumbers(e)
+		}
+	}
+	return v
+}
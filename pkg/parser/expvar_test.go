@@ -2,6 +2,9 @@ package parser_test
 
 import (
 	"encoding/json"
+	"fmt"
+	"math"
+	"time"
 
 	. "github.com/onsi/ginkgo"
 	. "github.com/onsi/gomega"
@@ -22,6 +25,66 @@ var _ = Describe("Expvar", func() {
 
 	})
 
+	It("keeps integer precision", func() {
+		p := parser.NewExpvar()
+		output, err := p.Parse([]byte(`{"ns": 9007199254740993, "big": 18446744073709551615, "huge": 123456789012345678901234567890, "ratio": 0.5, "nested": {"count": 12345678901}, "list": [1, 2.5]}`))
+
+		Expect(err).ToNot(HaveOccurred())
+		Expect(output).To(HaveKeyWithValue("ns", int64(9007199254740993)))
+		Expect(output).To(HaveKeyWithValue("big", uint64(18446744073709551615)))
+		Expect(output).To(HaveKeyWithValue("huge", json.Number("123456789012345678901234567890")))
+		Expect(output).To(HaveKeyWithValue("ratio", 0.5))
+		Expect(output["nested"]).To(HaveKeyWithValue("count", int64(12345678901)))
+		Expect(output["list"]).To(Equal([]interface{}{int64(1), 2.5}))
+
+		b, err := json.Marshal(output)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(string(b)).To(ContainSubstring(`"ns":9007199254740993`))
+		Expect(string(b)).To(ContainSubstring(`"huge":123456789012345678901234567890`))
+	})
+
+	It("summarizes memstats and keeps cmdline", func() {
+		p := parser.NewExpvar(parser.WithMemStatsSummary())
+		output, err := p.Parse([]byte(expvarJSON))
+
+		Expect(err).ToNot(HaveOccurred())
+		Expect(output).To(HaveLen(7))
+		Expect(output["cmdline"]).To(ConsistOf("bin/event-alerts"))
+		summary, ok := output["memstats"].(map[string]interface{})
+		Expect(ok).To(BeTrue())
+		Expect(summary).To(HaveKeyWithValue("heap_inuse", parser.Bytes(2211840)))
+		Expect(summary).To(HaveKeyWithValue("heap_objects", uint64(11469)))
+		Expect(summary).To(HaveKeyWithValue("num_gc", uint64(4319)))
+		Expect(summary).To(HaveKeyWithValue("gc_cpu_fraction", 0.0000109818988389847))
+		// NumGC is 4319, so the most recent pause is at index (4319+255)%256 = 222
+		Expect(summary).To(HaveKeyWithValue("last_pause", 120075*time.Nanosecond))
+		Expect(summary["recent_pauses"]).To(Equal([]time.Duration{120075, 183217, 221605, 172153, 210967}))
+		Expect(summary).ToNot(HaveKey("goroutines"))
+		Expect(fmt.Sprint(summary["heap_inuse"])).To(Equal("2.1 MiB"))
+	})
+
+	It("includes goroutines in the memstats summary when available", func() {
+		summary, ok := parser.SummarizeMemStats(map[string]interface{}{
+			"goroutines": int64(42),
+			"memstats":   map[string]interface{}{"NumGC": int64(0)},
+		})
+
+		Expect(ok).To(BeTrue())
+		Expect(summary).To(HaveKeyWithValue("goroutines", uint64(42)))
+		Expect(summary).ToNot(HaveKey("last_pause"))
+	})
+
+	It("drops memstats integers that do not fit in 64 bits", func() {
+		p := parser.NewExpvar(parser.WithMemStatsSummary())
+		output, err := p.Parse([]byte(`{"memstats": {"Sys": 123456789012345678901234567890, "HeapInuse": 2211840, "GCCPUFraction": 1e400}}`))
+
+		Expect(err).ToNot(HaveOccurred())
+		summary := output["memstats"].(map[string]interface{})
+		Expect(summary).ToNot(HaveKey("sys"))
+		Expect(summary).To(HaveKeyWithValue("heap_inuse", parser.Bytes(2211840)))
+		Expect(summary).To(HaveKeyWithValue("gc_cpu_fraction", math.Inf(1)))
+	})
+
 	It("returns error when unable to unmarshal", func() {
 		p := parser.NewExpvar()
 		_, err := p.Parse([]byte(`{"a": 123, "b": 456,}`))
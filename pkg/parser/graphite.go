@@ -0,0 +1,76 @@
+package parser
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// Graphite parses the Graphite plaintext protocol, e.g.
+// `servers.web1.requests;dc=east 42 1600000000`. Every dotted path becomes a
+// Family of that name. Tags become the labels of the series. Timestamps are
+// ignored.
+type Graphite struct{}
+
+func NewGraphite() *Graphite {
+	return &Graphite{}
+}
+
+func (p *Graphite) Parse(b []byte) (map[string]interface{}, error) {
+	m := make(map[string]interface{})
+
+	scanner := bufio.NewScanner(bytes.NewReader(b))
+	scanner.Buffer(make([]byte, 0, 64*1024), len(b)+1)
+	n := 0
+	for scanner.Scan() {
+		n++
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		if err := parseGraphiteLine(m, line); err != nil {
+			return nil, fmt.Errorf("line %d: %s", n, err)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+
+	return m, nil
+}
+
+func parseGraphiteLine(m map[string]interface{}, line string) error {
+	fields := strings.Fields(line)
+	if len(fields) < 2 || len(fields) > 3 {
+		return fmt.Errorf("expected path, value and timestamp")
+	}
+	if len(fields) == 3 {
+		if _, err := strconv.ParseFloat(fields[2], 64); err != nil {
+			return fmt.Errorf("invalid timestamp %q", fields[2])
+		}
+	}
+
+	value, err := strconv.ParseFloat(fields[1], 64)
+	if err != nil {
+		return fmt.Errorf("invalid value %q", fields[1])
+	}
+
+	parts := strings.Split(fields[0], ";")
+	path := parts[0]
+	if path == "" || strings.Contains(path, "..") || strings.HasPrefix(path, ".") || strings.HasSuffix(path, ".") {
+		return fmt.Errorf("invalid path %q", fields[0])
+	}
+	labels := make(map[string]string, len(parts)-1)
+	for _, tag := range parts[1:] {
+		kv := strings.SplitN(tag, "=", 2)
+		if len(kv) != 2 || kv[0] == "" || kv[1] == "" {
+			return fmt.Errorf("invalid tag %q", tag)
+		}
+		labels[sanitizeName(kv[0])] = kv[1]
+	}
+
+	addSample(m, path, labels, value)
+	return nil
+}
@@ -0,0 +1,66 @@
+package parser_test
+
+import (
+	"strings"
+
+	"github.com/wfernandes/app-metrics-plugin/pkg/parser"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Graphite", func() {
+
+	It("maps dotted paths to families and tags to labels", func() {
+		p := parser.NewGraphite()
+
+		metrics, err := p.Parse([]byte(graphiteOutput))
+
+		Expect(err).ToNot(HaveOccurred())
+		Expect(metrics).To(HaveLen(3))
+		Expect(metrics["servers.web1.cpu.user"]).To(Equal(&parser.Family{
+			Name: "servers.web1.cpu.user",
+			Type: "UNTYPED",
+			Metrics: []interface{}{
+				parser.Metric{Labels: map[string]string{}, Value: 2.5},
+			},
+		}))
+		Expect(metrics["requests.count"].(*parser.Family).Metrics).To(ConsistOf(
+			parser.Metric{Labels: map[string]string{"dc": "east", "status_code": "200"}, Value: 1027},
+			parser.Metric{Labels: map[string]string{"dc": "west", "status_code": "200"}, Value: 12},
+		))
+	})
+
+	It("parses lines longer than the default scanner buffer", func() {
+		p := parser.NewGraphite()
+		value := strings.Repeat("a", 128*1024)
+
+		metrics, err := p.Parse([]byte("servers.web1.cpu;host=" + value + " 2.5 1600000000\n"))
+
+		Expect(err).ToNot(HaveOccurred())
+		Expect(metrics["servers.web1.cpu"].(*parser.Family).Metrics).To(ConsistOf(
+			parser.Metric{Labels: map[string]string{"host": value}, Value: 2.5},
+		))
+	})
+
+	It("returns an error for invalid input", func() {
+		p := parser.NewGraphite()
+
+		for _, line := range []string{
+			"servers.web1.cpu",
+			"servers.web1.cpu abc 1600000000",
+			"servers..cpu 1 1600000000",
+			"servers.web1.cpu;dc 1 1600000000",
+			"servers.web1.cpu 1 1600000000 extra",
+		} {
+			_, err := p.Parse([]byte(line))
+			Expect(err).To(HaveOccurred(), line)
+		}
+	})
+})
+
+var graphiteOutput = `servers.web1.cpu.user 2.5 1600000000
+servers.web1.cpu.idle 97.5 1600000000
+requests.count;dc=east;status-code=200 1027 1600000000
+requests.count;dc=west;status-code=200 12 1600000000
+`
@@ -0,0 +1,207 @@
+package parser
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// Influx parses the InfluxDB line protocol. Every numeric or boolean field
+// becomes a Family named MEASUREMENT_FIELD, or MEASUREMENT for fields named
+// `value`, like Telegraf's Prometheus output does. Tags become the labels of
+// the series. String fields and timestamps are ignored.
+type Influx struct{}
+
+func NewInflux() *Influx {
+	return &Influx{}
+}
+
+func (p *Influx) Parse(b []byte) (map[string]interface{}, error) {
+	m := make(map[string]interface{})
+
+	scanner := bufio.NewScanner(bytes.NewReader(b))
+	scanner.Buffer(make([]byte, 0, 64*1024), len(b)+1)
+	n := 0
+	for scanner.Scan() {
+		n++
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		if err := parseInfluxLine(m, line); err != nil {
+			return nil, fmt.Errorf("line %d: %s", n, err)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+
+	return m, nil
+}
+
+func parseInfluxLine(m map[string]interface{}, line string) error {
+	key, rest := splitUnescaped(line, ' ', false)
+	fields, timestamp := splitUnescaped(strings.TrimLeft(rest, " "), ' ', true)
+	if key == "" || fields == "" {
+		return errors.New("expected measurement and fields")
+	}
+	if timestamp = strings.TrimSpace(timestamp); timestamp != "" {
+		if _, err := strconv.ParseInt(timestamp, 10, 64); err != nil {
+			return fmt.Errorf("invalid timestamp %q", timestamp)
+		}
+	}
+
+	parts := splitAllUnescaped(key, ',', false)
+	measurement := unescapeInflux(parts[0])
+	labels := make(map[string]string, len(parts)-1)
+	for _, tag := range parts[1:] {
+		k, v := splitUnescaped(tag, '=', false)
+		if k == "" || v == "" {
+			return fmt.Errorf("invalid tag %q", tag)
+		}
+		labels[sanitizeName(unescapeInflux(k))] = unescapeInflux(v)
+	}
+
+	for _, field := range splitAllUnescaped(fields, ',', true) {
+		k, v := splitUnescaped(field, '=', false)
+		if k == "" || v == "" {
+			return fmt.Errorf("invalid field %q", field)
+		}
+		value, ok, err := parseInfluxValue(v)
+		if err != nil {
+			return fmt.Errorf("invalid value for field %q: %s", k, err)
+		}
+		if !ok {
+			continue
+		}
+
+		name := measurement
+		if k = unescapeInflux(k); k != "value" {
+			name += "_" + k
+		}
+		// Every field is its own series, which must not share the labels.
+		series := make(map[string]string, len(labels))
+		for l, lv := range labels {
+			series[l] = lv
+		}
+		addSample(m, sanitizeName(name), series, value)
+	}
+	return nil
+}
+
+// parseInfluxValue returns the numeric value of a field. It returns false
+// for string fields.
+func parseInfluxValue(v string) (float64, bool, error) {
+	switch v {
+	case "t", "T", "true", "True", "TRUE":
+		return 1, true, nil
+	case "f", "F", "false", "False", "FALSE":
+		return 0, true, nil
+	}
+	if strings.HasPrefix(v, `"`) {
+		if len(v) < 2 || !strings.HasSuffix(v, `"`) {
+			return 0, false, errors.New("unterminated string")
+		}
+		return 0, false, nil
+	}
+	switch v[len(v)-1] {
+	case 'i':
+		i, err := strconv.ParseInt(v[:len(v)-1], 10, 64)
+		return float64(i), err == nil, err
+	case 'u':
+		u, err := strconv.ParseUint(v[:len(v)-1], 10, 64)
+		return float64(u), err == nil, err
+	}
+	f, err := strconv.ParseFloat(v, 64)
+	return f, err == nil, err
+}
+
+// splitUnescaped splits s at the first sep not escaped by a backslash and,
+// when quotes is set, not inside a double quoted string.
+func splitUnescaped(s string, sep byte, quotes bool) (string, string) {
+	inQuotes := false
+	for i := 0; i < len(s); i++ {
+		switch {
+		case s[i] == '\\':
+			i++
+		case quotes && s[i] == '"':
+			inQuotes = !inQuotes
+		case !inQuotes && s[i] == sep:
+			return s[:i], s[i+1:]
+		}
+	}
+	return s, ""
+}
+
+func splitAllUnescaped(s string, sep byte, quotes bool) []string {
+	var parts []string
+	for {
+		part, rest := splitUnescaped(s, sep, quotes)
+		parts = append(parts, part)
+		if len(rest) == 0 && len(part) == len(s) {
+			return parts
+		}
+		s = rest
+	}
+}
+
+func unescapeInflux(s string) string {
+	if !strings.Contains(s, `\`) {
+		return s
+	}
+	var buf bytes.Buffer
+	for i := 0; i < len(s); i++ {
+		if s[i] == '\\' && i+1 < len(s) && strings.IndexByte(`, ="\`, s[i+1]) >= 0 {
+			i++
+		}
+		buf.WriteByte(s[i])
+	}
+	return buf.String()
+}
+
+// addSample sets the value of the series with the given labels in the
+// untyped Family of the given name. A later sample of the same series
+// replaces an earlier one.
+func addSample(m map[string]interface{}, name string, labels map[string]string, value float64) {
+	family, ok := m[name].(*Family)
+	if !ok {
+		family = &Family{Name: name, Type: "UNTYPED"}
+		m[name] = family
+	}
+
+	for i, series := range family.Metrics {
+		if sameLabels(SeriesLabels(series), labels) {
+			family.Metrics[i] = Metric{Labels: labels, Value: value}
+			return
+		}
+	}
+	family.Metrics = append(family.Metrics, Metric{Labels: labels, Value: value})
+}
+
+func sameLabels(a, b map[string]string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for k, v := range a {
+		if w, ok := b[k]; !ok || v != w {
+			return false
+		}
+	}
+	return true
+}
+
+// sanitizeName replaces the characters Prometheus does not allow in metric
+// and label names with underscores.
+func sanitizeName(s string) string {
+	b := []byte(s)
+	for i, c := range b {
+		valid := c == '_' || c == ':' || (c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z') || (i > 0 && c >= '0' && c <= '9')
+		if !valid {
+			b[i] = '_'
+		}
+	}
+	return string(b)
+}
@@ -0,0 +1,116 @@
+package parser_test
+
+import (
+	"encoding/json"
+
+	"github.com/wfernandes/app-metrics-plugin/pkg/parser"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Influx", func() {
+
+	It("maps measurements and fields to families and tags to labels", func() {
+		p := parser.NewInflux()
+
+		metrics, err := p.Parse([]byte(influxOutput))
+
+		Expect(err).ToNot(HaveOccurred())
+		Expect(metrics).To(HaveLen(4))
+		Expect(metrics["cpu_usage_user"]).To(Equal(&parser.Family{
+			Name: "cpu_usage_user",
+			Type: "UNTYPED",
+			Metrics: []interface{}{
+				parser.Metric{Labels: map[string]string{"cpu": "cpu0", "host": "web 1"}, Value: 2.5},
+				parser.Metric{Labels: map[string]string{"cpu": "cpu1", "host": "web 1"}, Value: 1.75},
+			},
+		}))
+		Expect(metrics["cpu_usage_idle"].(*parser.Family).Metrics).To(HaveLen(2))
+		Expect(metrics["mem_available"].(*parser.Family).Metrics).To(ConsistOf(
+			parser.Metric{Labels: map[string]string{"host": "web 1"}, Value: 1073741824},
+		))
+		Expect(metrics["http_requests"].(*parser.Family).Metrics).To(ConsistOf(
+			parser.Metric{Labels: map[string]string{"status_code": "200"}, Value: 1027},
+		))
+	})
+
+	It("gives every field of a line its own labels", func() {
+		p := parser.NewInflux()
+
+		metrics, err := p.Parse([]byte(`cpu,host=web1 usage_user=2.5,usage_idle=97.5`))
+
+		Expect(err).ToNot(HaveOccurred())
+		user := metrics["cpu_usage_user"].(*parser.Family).Metrics[0].(parser.Metric)
+		idle := metrics["cpu_usage_idle"].(*parser.Family).Metrics[0].(parser.Metric)
+		user.Labels["host"] = "web2"
+		Expect(idle.Labels).To(Equal(map[string]string{"host": "web1"}))
+	})
+
+	It("converts booleans and skips string fields", func() {
+		p := parser.NewInflux()
+
+		metrics, err := p.Parse([]byte(`service,name=db up=true,healthy=F,version="1.2, beta" 1600000000000000000`))
+
+		Expect(err).ToNot(HaveOccurred())
+		Expect(metrics).To(HaveLen(2))
+		Expect(metrics["service_up"].(*parser.Family).Metrics).To(ConsistOf(
+			parser.Metric{Labels: map[string]string{"name": "db"}, Value: 1},
+		))
+		Expect(metrics["service_healthy"].(*parser.Family).Metrics).To(ConsistOf(
+			parser.Metric{Labels: map[string]string{"name": "db"}, Value: 0},
+		))
+	})
+
+	It("keeps the last sample of a series", func() {
+		p := parser.NewInflux()
+
+		metrics, err := p.Parse([]byte("queue,name=jobs depth=3i 1\nqueue,name=jobs depth=5i 2\n"))
+
+		Expect(err).ToNot(HaveOccurred())
+		Expect(metrics["queue_depth"].(*parser.Family).Metrics).To(ConsistOf(
+			parser.Metric{Labels: map[string]string{"name": "jobs"}, Value: 5},
+		))
+	})
+
+	It("marshals like prometheus families", func() {
+		p := parser.NewInflux()
+
+		metrics, err := p.Parse([]byte("mem,host=a available=42i\n"))
+
+		Expect(err).ToNot(HaveOccurred())
+		b, err := json.Marshal(metrics)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(b).To(MatchJSON(`{
+			"mem_available": {
+				"name": "mem_available",
+				"help": "",
+				"type": "UNTYPED",
+				"metrics": [{"labels": {"host": "a"}, "value": 42}]
+			}
+		}`))
+	})
+
+	It("returns an error for invalid input", func() {
+		p := parser.NewInflux()
+
+		for _, line := range []string{
+			"cpu",
+			"cpu usage",
+			"cpu,host usage=1",
+			"cpu usage=abc",
+			`cpu msg="unterminated`,
+			"cpu usage=1 yesterday",
+		} {
+			_, err := p.Parse([]byte(line))
+			Expect(err).To(HaveOccurred(), line)
+		}
+	})
+})
+
+var influxOutput = `# Telegraf
+cpu,cpu=cpu0,host=web\ 1 usage_user=2.5,usage_idle=97.5 1600000000000000000
+cpu,cpu=cpu1,host=web\ 1 usage_user=1.75,usage_idle=98.25 1600000000000000000
+mem,host=web\ 1 available=1073741824i 1600000000000000000
+http,status-code=200 requests=1027u
+`
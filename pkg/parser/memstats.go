@@ -0,0 +1,169 @@
+package parser
+
+import (
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"time"
+)
+
+// recentPauses is the number of GC pauses kept in the memstats summary.
+const recentPauses = 5
+
+// goroutineKeys are the top-level expvar properties apps commonly use to
+// publish runtime.NumGoroutine().
+var goroutineKeys = []string{"goroutines", "Goroutines", "NumGoroutine", "num_goroutine", "runtime.goroutines"}
+
+// Bytes is a byte count that prints with binary units, e.g. 2.1 MiB.
+// It is still encoded as a plain number in JSON.
+type Bytes uint64
+
+func (b Bytes) String() string {
+	const unit = 1024
+	if b < unit {
+		return fmt.Sprintf("%d B", uint64(b))
+	}
+	div, exp := uint64(unit), 0
+	for n := uint64(b) / unit; n >= unit; n /= unit {
+		div *= unit
+		exp++
+	}
+	return fmt.Sprintf("%.1f %ciB", float64(b)/float64(div), "KMGTPE"[exp])
+}
+
+// WithMemStatsSummary replaces the large runtime.MemStats `memstats`
+// property with a compact summary. See SummarizeMemStats.
+func WithMemStatsSummary() ExpvarOpt {
+	return func(e *Expvar) {
+		e.summarizeMemStats = true
+	}
+}
+
+// SummarizeMemStats derives a compact summary from the `memstats` property
+// published by the expvar package. Byte counts are Bytes and pause times are
+// time.Duration so they print in human readable units. The goroutine count
+// is included when the app publishes it under one of the common names.
+// It returns false when the metrics do not contain memstats.
+func SummarizeMemStats(metrics map[string]interface{}) (map[string]interface{}, bool) {
+	ms, ok := metrics["memstats"].(map[string]interface{})
+	if !ok {
+		return nil, false
+	}
+
+	numGC, _ := toUint64(ms["NumGC"])
+	summary := map[string]interface{}{
+		"num_gc":          numGC,
+		"gc_cpu_fraction": toFloat64(ms["GCCPUFraction"]),
+	}
+	if v, ok := toUint64(ms["HeapInuse"]); ok {
+		summary["heap_inuse"] = Bytes(v)
+	}
+	if v, ok := toUint64(ms["HeapAlloc"]); ok {
+		summary["heap_alloc"] = Bytes(v)
+	}
+	if v, ok := toUint64(ms["HeapObjects"]); ok {
+		summary["heap_objects"] = v
+	}
+	if v, ok := toUint64(ms["Sys"]); ok {
+		summary["sys"] = Bytes(v)
+	}
+	if v, ok := toUint64(ms["PauseTotalNs"]); ok {
+		summary["pause_total"] = time.Duration(v)
+	}
+
+	// PauseNs is a circular buffer, the most recent pause is at
+	// PauseNs[(NumGC+255)%256].
+	if pauses, ok := ms["PauseNs"].([]interface{}); ok && numGC > 0 && len(pauses) > 0 {
+		n := uint64(len(pauses))
+		recent := make([]time.Duration, 0, recentPauses)
+		for i := uint64(0); i < recentPauses && i < numGC && i < n; i++ {
+			v, _ := toUint64(pauses[(numGC+n-1-i)%n])
+			recent = append(recent, time.Duration(v))
+		}
+		summary["last_pause"] = recent[0]
+		summary["recent_pauses"] = recent
+	}
+
+	for _, k := range goroutineKeys {
+		if v, ok := toUint64(metrics[k]); ok {
+			summary["goroutines"] = v
+			break
+		}
+	}
+
+	return summary, true
+}
+
+// RestoreMemStatsSummary restores the types of a summary made by
+// SummarizeMemStats that was encoded as json and decoded by the expvar
+// parser, e.g. from a snapshot, so it prints like the original summary.
+func RestoreMemStatsSummary(summary map[string]interface{}) {
+	for k, v := range summary {
+		switch k {
+		case "heap_inuse", "heap_alloc", "sys":
+			if n, ok := toUint64(v); ok {
+				summary[k] = Bytes(n)
+			}
+		case "pause_total", "last_pause":
+			if n, ok := toUint64(v); ok {
+				summary[k] = time.Duration(n)
+			}
+		case "num_gc", "heap_objects", "goroutines":
+			if n, ok := toUint64(v); ok {
+				summary[k] = n
+			}
+		case "gc_cpu_fraction":
+			summary[k] = toFloat64(v)
+		case "recent_pauses":
+			pauses, ok := v.([]interface{})
+			if !ok {
+				continue
+			}
+			recent := make([]time.Duration, len(pauses))
+			for i, p := range pauses {
+				n, _ := toUint64(p)
+				recent[i] = time.Duration(n)
+			}
+			summary[k] = recent
+		}
+	}
+}
+
+func toUint64(v interface{}) (uint64, bool) {
+	switch n := v.(type) {
+	case int64:
+		if n < 0 {
+			return 0, false
+		}
+		return uint64(n), true
+	case uint64:
+		return n, true
+	case float64:
+		if n < 0 {
+			return 0, false
+		}
+		return uint64(n), true
+	case json.Number:
+		// convertNumbers leaves integers beyond uint64 as json.Number,
+		// they are dropped rather than summarized with a wrong value.
+		u, err := strconv.ParseUint(n.String(), 10, 64)
+		return u, err == nil
+	}
+	return 0, false
+}
+
+func toFloat64(v interface{}) float64 {
+	switch n := v.(type) {
+	case int64:
+		return float64(n)
+	case uint64:
+		return float64(n)
+	case float64:
+		return n
+	case json.Number:
+		// Out of range values parse as ±Inf.
+		f, _ := n.Float64()
+		return f
+	}
+	return 0
+}
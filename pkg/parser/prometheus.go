@@ -2,27 +2,63 @@ package parser
 
 import (
 	"bytes"
+	"encoding/json"
+	"errors"
 	"fmt"
+	"io"
+	"math"
+	"sort"
+	"strconv"
 
 	dto "github.com/prometheus/client_model/go"
 	"github.com/prometheus/common/expfmt"
 )
 
+const (
+	protobufType  = "application/vnd.google.protobuf"
+	protobufProto = "io.prometheus.client.MetricFamily"
+)
+
 type Prometheus struct {
-	parser expfmt.TextParser
+	parser   expfmt.TextParser
+	protobuf bool
 }
 
-func NewPrometheus() *Prometheus {
-	return &Prometheus{
+type PrometheusOpt func(*Prometheus)
+
+// WithProtobuf parses the delimited protobuf exposition format instead of
+// the text format. Native histograms are only exposed in this format.
+func WithProtobuf() PrometheusOpt {
+	return func(p *Prometheus) {
+		p.protobuf = true
+	}
+}
+
+func NewPrometheus(opts ...PrometheusOpt) *Prometheus {
+	p := &Prometheus{
 		parser: expfmt.TextParser{},
 	}
+
+	for _, o := range opts {
+		o(p)
+	}
+
+	return p
 }
 
 func (p *Prometheus) Parse(b []byte) (map[string]interface{}, error) {
 
 	m := make(map[string]interface{})
 	buf := bytes.NewBuffer(b)
-	metricFamilies, err := p.parser.TextToMetricFamilies(buf)
+	var (
+		metricFamilies map[string]*dto.MetricFamily
+		err            error
+	)
+	if p.protobuf {
+		metricFamilies, err = decodeProtobuf(buf)
+	} else {
+		metricFamilies, err = p.parser.TextToMetricFamilies(buf)
+	}
 	if err != nil {
 		return m, err
 	}
@@ -34,6 +70,26 @@ func (p *Prometheus) Parse(b []byte) (map[string]interface{}, error) {
 	return m, nil
 }
 
+func decodeProtobuf(r io.Reader) (map[string]*dto.MetricFamily, error) {
+	result := make(map[string]*dto.MetricFamily)
+	dec := expfmt.NewDecoder(r, expfmt.NewFormat(expfmt.TypeProtoDelim))
+	for {
+		mf := &dto.MetricFamily{}
+		err := dec.Decode(mf)
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		result[mf.GetName()] = mf
+	}
+	if len(result) == 0 {
+		return nil, errors.New("no metric families found")
+	}
+	return result, nil
+}
+
 // Copied below from https://github.com/prometheus/prom2json/blob/49f15d03cf3744b17ef104f648663e95e0486341/prom2json.go
 // By default the dto.MetricFamily object cannot be marshalled into json because Prometheus allows sample values
 // like NaN or +Inf, which cannot be encoded as JSON numbers
@@ -48,29 +104,276 @@ type Family struct {
 	Name    string        `json:"name"`
 	Help    string        `json:"help"`
 	Type    string        `json:"type"`
-	Metrics []interface{} `json:"metrics,omitempty"` // Either metric or summary.
+	Metrics []interface{} `json:"metrics,omitempty"` // Either metric, summary or histogram.
 }
 
 // Metric is for all "single value" metrics, i.e. Counter, Gauge, and Untyped.
 type Metric struct {
-	Labels map[string]string `json:"labels,omitempty"`
-	Value  string            `json:"value"`
+	Labels map[string]string
+	Value  float64
 }
 
 // Summary mirrors the Summary proto message.
 type Summary struct {
-	Labels    map[string]string `json:"labels,omitempty"`
-	Quantiles map[string]string `json:"quantiles,omitempty"`
-	Count     string            `json:"count"`
-	Sum       string            `json:"sum"`
+	Labels    map[string]string
+	Quantiles []Quantile
+	Count     uint64
+	Sum       float64
+}
+
+// Quantile is a single quantile of a Summary.
+type Quantile struct {
+	Quantile float64
+	Value    float64
 }
 
-// Histogram mirrors the Histogram proto message.
+// Histogram mirrors the Histogram proto message. Buckets are sorted by
+// upper bound and hold cumulative counts. Native is only set when the
+// histogram carries native (sparse) buckets.
 type Histogram struct {
-	Labels  map[string]string `json:"labels,omitempty"`
-	Buckets map[string]string `json:"buckets,omitempty"`
-	Count   string            `json:"count"`
-	Sum     string            `json:"sum"`
+	Labels  map[string]string
+	Buckets []Bucket
+	Count   uint64
+	Sum     float64
+	Native  *NativeHistogram
+}
+
+// Bucket is a single classic histogram bucket.
+type Bucket struct {
+	UpperBound      float64
+	CumulativeCount uint64
+}
+
+// NativeHistogram holds the exponential buckets of a native histogram,
+// expanded from the spans and deltas of the proto message into absolute
+// counts. Buckets are sorted by their lower bound.
+type NativeHistogram struct {
+	Schema        int32
+	ZeroThreshold float64
+	ZeroCount     float64
+	Buckets       []NativeBucket
+}
+
+// NativeBucket is a single native histogram bucket covering (Lower, Upper].
+type NativeBucket struct {
+	Lower float64
+	Upper float64
+	Count float64
+}
+
+// MarshalJSON encodes the value as a JSON number, or a string for NaN and ±Inf.
+func (m Metric) MarshalJSON() ([]byte, error) {
+	return json.Marshal(struct {
+		Labels map[string]string `json:"labels,omitempty"`
+		Value  interface{}       `json:"value"`
+	}{
+		Labels: m.Labels,
+		Value:  jsonFloat(m.Value),
+	})
+}
+
+// MarshalJSON encodes the quantiles as a map keyed by quantile, matching
+// the prom2json output.
+func (s Summary) MarshalJSON() ([]byte, error) {
+	var quantiles map[string]interface{}
+	if len(s.Quantiles) > 0 {
+		quantiles = make(map[string]interface{}, len(s.Quantiles))
+		for _, q := range s.Quantiles {
+			quantiles[FormatFloat(q.Quantile)] = jsonFloat(q.Value)
+		}
+	}
+	return json.Marshal(struct {
+		Labels    map[string]string      `json:"labels,omitempty"`
+		Quantiles map[string]interface{} `json:"quantiles,omitempty"`
+		Count     uint64                 `json:"count"`
+		Sum       interface{}            `json:"sum"`
+	}{
+		Labels:    s.Labels,
+		Quantiles: quantiles,
+		Count:     s.Count,
+		Sum:       jsonFloat(s.Sum),
+	})
+}
+
+// MarshalJSON encodes the buckets as a map keyed by upper bound, matching
+// the prom2json output.
+func (h Histogram) MarshalJSON() ([]byte, error) {
+	var buckets map[string]uint64
+	if len(h.Buckets) > 0 {
+		buckets = make(map[string]uint64, len(h.Buckets))
+		for _, b := range h.Buckets {
+			buckets[FormatFloat(b.UpperBound)] = b.CumulativeCount
+		}
+	}
+	return json.Marshal(struct {
+		Labels  map[string]string `json:"labels,omitempty"`
+		Buckets map[string]uint64 `json:"buckets,omitempty"`
+		Count   uint64            `json:"count"`
+		Sum     interface{}       `json:"sum"`
+		Native  *NativeHistogram  `json:"native,omitempty"`
+	}{
+		Labels:  h.Labels,
+		Buckets: buckets,
+		Count:   h.Count,
+		Sum:     jsonFloat(h.Sum),
+		Native:  h.Native,
+	})
+}
+
+// MarshalJSON encodes the native histogram with NaN and ±Inf safe floats.
+func (n NativeHistogram) MarshalJSON() ([]byte, error) {
+	type bucket struct {
+		Lower interface{} `json:"lower"`
+		Upper interface{} `json:"upper"`
+		Count interface{} `json:"count"`
+	}
+	buckets := make([]bucket, len(n.Buckets))
+	for i, b := range n.Buckets {
+		buckets[i] = bucket{
+			Lower: jsonFloat(b.Lower),
+			Upper: jsonFloat(b.Upper),
+			Count: jsonFloat(b.Count),
+		}
+	}
+	return json.Marshal(struct {
+		Schema        int32       `json:"schema"`
+		ZeroThreshold interface{} `json:"zero_threshold"`
+		ZeroCount     interface{} `json:"zero_count"`
+		Buckets       []bucket    `json:"buckets,omitempty"`
+	}{
+		Schema:        n.Schema,
+		ZeroThreshold: jsonFloat(n.ZeroThreshold),
+		ZeroCount:     jsonFloat(n.ZeroCount),
+		Buckets:       buckets,
+	})
+}
+
+// UnmarshalJSON decodes a family encoded by MarshalJSON, e.g. from a saved
+// snapshot. The series are decoded as Metric, Summary or Histogram
+// depending on the type of the family.
+func (f *Family) UnmarshalJSON(b []byte) error {
+	var raw struct {
+		Name    string            `json:"name"`
+		Help    string            `json:"help"`
+		Type    string            `json:"type"`
+		Metrics []json.RawMessage `json:"metrics"`
+	}
+	if err := json.Unmarshal(b, &raw); err != nil {
+		return err
+	}
+
+	f.Name, f.Help, f.Type = raw.Name, raw.Help, raw.Type
+	f.Metrics = make([]interface{}, len(raw.Metrics))
+	for i, m := range raw.Metrics {
+		var err error
+		switch f.Type {
+		case "SUMMARY":
+			var s Summary
+			err = json.Unmarshal(m, &s)
+			f.Metrics[i] = s
+		case "HISTOGRAM", "GAUGE_HISTOGRAM":
+			var h Histogram
+			err = json.Unmarshal(m, &h)
+			f.Metrics[i] = h
+		default:
+			var v Metric
+			err = json.Unmarshal(m, &v)
+			f.Metrics[i] = v
+		}
+		if err != nil {
+			return fmt.Errorf("%s: %s", f.Name, err)
+		}
+	}
+	return nil
+}
+
+// UnmarshalJSON decodes a metric encoded by MarshalJSON.
+func (m *Metric) UnmarshalJSON(b []byte) error {
+	var raw struct {
+		Labels map[string]string `json:"labels"`
+		Value  floatValue        `json:"value"`
+	}
+	if err := json.Unmarshal(b, &raw); err != nil {
+		return err
+	}
+	*m = Metric{Labels: raw.Labels, Value: float64(raw.Value)}
+	return nil
+}
+
+// UnmarshalJSON decodes a summary encoded by MarshalJSON.
+func (s *Summary) UnmarshalJSON(b []byte) error {
+	var raw struct {
+		Labels    map[string]string     `json:"labels"`
+		Quantiles map[string]floatValue `json:"quantiles"`
+		Count     uint64                `json:"count"`
+		Sum       floatValue            `json:"sum"`
+	}
+	if err := json.Unmarshal(b, &raw); err != nil {
+		return err
+	}
+
+	*s = Summary{Labels: raw.Labels, Count: raw.Count, Sum: float64(raw.Sum)}
+	for k, v := range raw.Quantiles {
+		q, err := strconv.ParseFloat(k, 64)
+		if err != nil {
+			return fmt.Errorf("invalid quantile %q", k)
+		}
+		s.Quantiles = append(s.Quantiles, Quantile{Quantile: q, Value: float64(v)})
+	}
+	sort.Slice(s.Quantiles, func(i, j int) bool {
+		return s.Quantiles[i].Quantile < s.Quantiles[j].Quantile
+	})
+	return nil
+}
+
+// UnmarshalJSON decodes a histogram encoded by MarshalJSON.
+func (h *Histogram) UnmarshalJSON(b []byte) error {
+	var raw struct {
+		Labels  map[string]string `json:"labels"`
+		Buckets map[string]uint64 `json:"buckets"`
+		Count   uint64            `json:"count"`
+		Sum     floatValue        `json:"sum"`
+		Native  *NativeHistogram  `json:"native"`
+	}
+	if err := json.Unmarshal(b, &raw); err != nil {
+		return err
+	}
+
+	*h = Histogram{Labels: raw.Labels, Count: raw.Count, Sum: float64(raw.Sum), Native: raw.Native}
+	for k, v := range raw.Buckets {
+		ub, err := strconv.ParseFloat(k, 64)
+		if err != nil {
+			return fmt.Errorf("invalid bucket upper bound %q", k)
+		}
+		h.Buckets = append(h.Buckets, Bucket{UpperBound: ub, CumulativeCount: v})
+	}
+	sort.Slice(h.Buckets, func(i, j int) bool {
+		return h.Buckets[i].UpperBound < h.Buckets[j].UpperBound
+	})
+	return nil
+}
+
+// UnmarshalJSON decodes a native histogram encoded by MarshalJSON.
+func (n *NativeHistogram) UnmarshalJSON(b []byte) error {
+	var raw struct {
+		Schema        int32      `json:"schema"`
+		ZeroThreshold floatValue `json:"zero_threshold"`
+		ZeroCount     floatValue `json:"zero_count"`
+		Buckets       []struct {
+			Lower floatValue `json:"lower"`
+			Upper floatValue `json:"upper"`
+			Count floatValue `json:"count"`
+		} `json:"buckets"`
+	}
+	if err := json.Unmarshal(b, &raw); err != nil {
+		return err
+	}
+
+	*n = NativeHistogram{Schema: raw.Schema, ZeroThreshold: float64(raw.ZeroThreshold), ZeroCount: float64(raw.ZeroCount)}
+	for _, b := range raw.Buckets {
+		n.Buckets = append(n.Buckets, NativeBucket{Lower: float64(b.Lower), Upper: float64(b.Upper), Count: float64(b.Count)})
+	}
+	return nil
 }
 
 // NewFamily consumes a MetricFamily and transforms it to the local Family type.
@@ -83,30 +386,46 @@ func newFamily(dtoMF *dto.MetricFamily) *Family {
 		Metrics: make([]interface{}, len(dtoMF.Metric)),
 	}
 	for i, m := range dtoMF.Metric {
-		if dtoMF.GetType() == dto.MetricType_SUMMARY {
+		switch dtoMF.GetType() {
+		case dto.MetricType_SUMMARY:
 			mf.Metrics[i] = Summary{
 				Labels:    makeLabels(m),
 				Quantiles: makeQuantiles(m),
-				Count:     fmt.Sprint(m.GetSummary().GetSampleCount()),
-				Sum:       fmt.Sprint(m.GetSummary().GetSampleSum()),
+				Count:     m.GetSummary().GetSampleCount(),
+				Sum:       m.GetSummary().GetSampleSum(),
 			}
-		} else if dtoMF.GetType() == dto.MetricType_HISTOGRAM {
+		case dto.MetricType_HISTOGRAM, dto.MetricType_GAUGE_HISTOGRAM:
 			mf.Metrics[i] = Histogram{
 				Labels:  makeLabels(m),
 				Buckets: makeBuckets(m),
-				Count:   fmt.Sprint(m.GetHistogram().GetSampleCount()),
-				Sum:     fmt.Sprint(m.GetSummary().GetSampleSum()),
+				Count:   m.GetHistogram().GetSampleCount(),
+				Sum:     m.GetHistogram().GetSampleSum(),
+				Native:  makeNative(m),
 			}
-		} else {
+		default:
 			mf.Metrics[i] = Metric{
 				Labels: makeLabels(m),
-				Value:  fmt.Sprint(getValue(m)),
+				Value:  getValue(m),
 			}
 		}
 	}
 	return mf
 }
 
+// SeriesLabels returns the labels of a Metric, Summary or Histogram found
+// in Family.Metrics.
+func SeriesLabels(series interface{}) map[string]string {
+	switch s := series.(type) {
+	case Metric:
+		return s.Labels
+	case Summary:
+		return s.Labels
+	case Histogram:
+		return s.Labels
+	}
+	return nil
+}
+
 func makeLabels(m *dto.Metric) map[string]string {
 	result := map[string]string{}
 	for _, lp := range m.Label {
@@ -115,18 +434,95 @@ func makeLabels(m *dto.Metric) map[string]string {
 	return result
 }
 
-func makeQuantiles(m *dto.Metric) map[string]string {
-	result := map[string]string{}
-	for _, q := range m.GetSummary().Quantile {
-		result[fmt.Sprint(q.GetQuantile())] = fmt.Sprint(q.GetValue())
+func makeQuantiles(m *dto.Metric) []Quantile {
+	result := make([]Quantile, 0, len(m.GetSummary().GetQuantile()))
+	for _, q := range m.GetSummary().GetQuantile() {
+		result = append(result, Quantile{Quantile: q.GetQuantile(), Value: q.GetValue()})
 	}
+	sort.Slice(result, func(i, j int) bool {
+		return result[i].Quantile < result[j].Quantile
+	})
 	return result
 }
 
-func makeBuckets(m *dto.Metric) map[string]string {
-	result := map[string]string{}
-	for _, b := range m.GetHistogram().Bucket {
-		result[fmt.Sprint(b.GetUpperBound())] = fmt.Sprint(b.GetCumulativeCount())
+func makeBuckets(m *dto.Metric) []Bucket {
+	result := make([]Bucket, 0, len(m.GetHistogram().GetBucket()))
+	for _, b := range m.GetHistogram().GetBucket() {
+		result = append(result, Bucket{UpperBound: b.GetUpperBound(), CumulativeCount: b.GetCumulativeCount()})
+	}
+	sort.Slice(result, func(i, j int) bool {
+		return result[i].UpperBound < result[j].UpperBound
+	})
+	return result
+}
+
+// makeNative expands the spans and deltas of a native histogram into
+// absolute buckets. It returns nil for classic histograms.
+func makeNative(m *dto.Metric) *NativeHistogram {
+	h := m.GetHistogram()
+	if h.GetZeroThreshold() == 0 && h.GetZeroCount() == 0 && h.GetZeroCountFloat() == 0 &&
+		len(h.GetPositiveSpan()) == 0 && len(h.GetNegativeSpan()) == 0 {
+		return nil
+	}
+
+	n := &NativeHistogram{
+		Schema:        h.GetSchema(),
+		ZeroThreshold: h.GetZeroThreshold(),
+		ZeroCount:     float64(h.GetZeroCount()),
+	}
+	if h.GetZeroCountFloat() != 0 {
+		n.ZeroCount = h.GetZeroCountFloat()
+	}
+
+	base := math.Pow(2, math.Pow(2, -float64(h.GetSchema())))
+	negative := nativeBuckets(base, h.GetNegativeSpan(), h.GetNegativeDelta(), h.GetNegativeCount())
+	for i := len(negative) - 1; i >= 0; i-- {
+		b := negative[i]
+		n.Buckets = append(n.Buckets, NativeBucket{Lower: -b.Upper, Upper: -b.Lower, Count: b.Count})
+	}
+	n.Buckets = append(n.Buckets, nativeBuckets(base, h.GetPositiveSpan(), h.GetPositiveDelta(), h.GetPositiveCount())...)
+
+	return n
+}
+
+// nativeBuckets walks the spans of one side of a native histogram. Integer
+// histograms encode each count as a delta to the previous bucket, float
+// histograms carry absolute counts.
+func nativeBuckets(base float64, spans []*dto.BucketSpan, deltas []int64, counts []float64) []NativeBucket {
+	var (
+		result []NativeBucket
+		index  int32
+		pos    int
+		count  int64
+	)
+	for i, s := range spans {
+		if i == 0 {
+			index = s.GetOffset()
+		} else {
+			index += s.GetOffset()
+		}
+		for j := uint32(0); j < s.GetLength(); j++ {
+			var c float64
+			if len(counts) > 0 {
+				if pos >= len(counts) {
+					return result
+				}
+				c = counts[pos]
+			} else {
+				if pos >= len(deltas) {
+					return result
+				}
+				count += deltas[pos]
+				c = float64(count)
+			}
+			result = append(result, NativeBucket{
+				Lower: math.Pow(base, float64(index-1)),
+				Upper: math.Pow(base, float64(index)),
+				Count: c,
+			})
+			index++
+			pos++
+		}
 	}
 	return result
 }
@@ -143,3 +539,40 @@ func getValue(m *dto.Metric) float64 {
 	}
 	return 0.
 }
+
+// jsonFloat returns f as is, unless it is NaN or ±Inf which JSON numbers
+// cannot represent. Those are returned in their Prometheus text form.
+func jsonFloat(f float64) interface{} {
+	if math.IsNaN(f) || math.IsInf(f, 0) {
+		return FormatFloat(f)
+	}
+	return f
+}
+
+// floatValue decodes a float encoded by jsonFloat, either a JSON number or
+// its Prometheus text form.
+type floatValue float64
+
+func (f *floatValue) UnmarshalJSON(b []byte) error {
+	var s string
+	if json.Unmarshal(b, &s) == nil {
+		v, err := strconv.ParseFloat(s, 64)
+		if err != nil {
+			return fmt.Errorf("invalid float %q", s)
+		}
+		*f = floatValue(v)
+		return nil
+	}
+	var v float64
+	if err := json.Unmarshal(b, &v); err != nil {
+		return err
+	}
+	*f = floatValue(v)
+	return nil
+}
+
+// FormatFloat formats a value like the Prometheus text format does, e.g.
+// +Inf or 0.25.
+func FormatFloat(f float64) string {
+	return strconv.FormatFloat(f, 'g', -1, 64)
+}
@@ -1,8 +1,12 @@
 package parser_test
 
 import (
+	"bytes"
 	"encoding/json"
+	"math"
 
+	dto "github.com/prometheus/client_model/go"
+	"github.com/prometheus/common/expfmt"
 	"github.com/wfernandes/app-metrics-plugin/pkg/parser"
 
 	. "github.com/onsi/ginkgo"
@@ -23,6 +27,79 @@ var _ = Describe("Prometheus", func() {
 		Expect(b).To(MatchJSON(promJSON))
 	})
 
+	It("keeps sample values numeric", func() {
+		p := parser.NewPrometheus()
+
+		metrics, err := p.Parse([]byte(prometheusOutput))
+
+		Expect(err).ToNot(HaveOccurred())
+		family := metrics["go_goroutines"].(*parser.Family)
+		Expect(family.Metrics).To(ConsistOf(parser.Metric{Labels: map[string]string{}, Value: 6}))
+	})
+
+	It("reports the histogram sum", func() {
+		p := parser.NewPrometheus()
+
+		metrics, err := p.Parse([]byte(histogramOutput))
+
+		Expect(err).ToNot(HaveOccurred())
+		family := metrics["http_request_duration_seconds"].(*parser.Family)
+		Expect(family.Metrics).To(HaveLen(1))
+		h := family.Metrics[0].(parser.Histogram)
+		Expect(h.Sum).To(Equal(53.423))
+		Expect(h.Count).To(Equal(uint64(144320)))
+		Expect(h.Native).To(BeNil())
+		Expect(h.Buckets).To(Equal([]parser.Bucket{
+			{UpperBound: 0.05, CumulativeCount: 24054},
+			{UpperBound: 0.1, CumulativeCount: 33444},
+			{UpperBound: 0.2, CumulativeCount: 100392},
+			{UpperBound: math.Inf(1), CumulativeCount: 144320},
+		}))
+	})
+
+	It("encodes NaN and infinite values as strings", func() {
+		p := parser.NewPrometheus()
+
+		metrics, err := p.Parse([]byte(specialValuesOutput))
+
+		Expect(err).ToNot(HaveOccurred())
+		b, err := json.Marshal(metrics)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(b).To(MatchJSON(specialValuesJSON))
+	})
+
+	It("decodes the families it encodes", func() {
+		p := parser.NewPrometheus()
+
+		for _, output := range []string{prometheusOutput, histogramOutput, specialValuesOutput} {
+			metrics, err := p.Parse([]byte(output))
+			Expect(err).ToNot(HaveOccurred())
+			b, err := json.Marshal(metrics)
+			Expect(err).ToNot(HaveOccurred())
+
+			var decoded map[string]*parser.Family
+			Expect(json.Unmarshal(b, &decoded)).To(Succeed())
+			Expect(json.Marshal(decoded)).To(MatchJSON(b))
+		}
+	})
+
+	It("decodes the series with their types", func() {
+		p := parser.NewPrometheus()
+		metrics, err := p.Parse([]byte(histogramOutput))
+		Expect(err).ToNot(HaveOccurred())
+		b, err := json.Marshal(metrics["http_request_duration_seconds"])
+		Expect(err).ToNot(HaveOccurred())
+
+		var family parser.Family
+		Expect(json.Unmarshal(b, &family)).To(Succeed())
+
+		h := family.Metrics[0].(parser.Histogram)
+		Expect(h.Sum).To(Equal(53.423))
+		Expect(h.Buckets).To(HaveLen(4))
+		Expect(h.Buckets[0].UpperBound).To(Equal(0.05))
+		Expect(h.Buckets[3]).To(Equal(parser.Bucket{UpperBound: math.Inf(1), CumulativeCount: 144320}))
+	})
+
 	It("returns error and empty map if error occurs in parsing", func() {
 		p := parser.NewPrometheus()
 
@@ -34,6 +111,137 @@ var _ = Describe("Prometheus", func() {
 
 })
 
+var _ = Describe("Prometheus protobuf", func() {
+	It("expands native histogram buckets", func() {
+		p := parser.NewPrometheus(parser.WithProtobuf())
+
+		metrics, err := p.Parse(encodeProtobuf(nativeHistogramFamily()))
+
+		Expect(err).ToNot(HaveOccurred())
+		family := metrics["rpc_latency_seconds"].(*parser.Family)
+		Expect(family.Type).To(Equal("HISTOGRAM"))
+		h := family.Metrics[0].(parser.Histogram)
+		Expect(h.Count).To(Equal(uint64(9)))
+		Expect(h.Sum).To(Equal(12.5))
+		Expect(h.Native).To(Equal(&parser.NativeHistogram{
+			Schema:        0,
+			ZeroThreshold: 0.001,
+			ZeroCount:     1,
+			Buckets: []parser.NativeBucket{
+				{Lower: -2, Upper: -1, Count: 1},
+				{Lower: 1, Upper: 2, Count: 2},
+				{Lower: 2, Upper: 4, Count: 3},
+				{Lower: 8, Upper: 16, Count: 2},
+			},
+		}))
+	})
+
+	It("reads the absolute counts of float histograms", func() {
+		mf := nativeHistogramFamily()
+		h := mf.Metric[0].Histogram
+		schema, zeroCount := int32(1), 0.5
+		h.Schema = &schema
+		h.ZeroCount = nil
+		h.ZeroCountFloat = &zeroCount
+		h.NegativeSpan, h.NegativeDelta = nil, nil
+		h.PositiveDelta = nil
+		h.PositiveCount = []float64{1.5, 2, 0.25}
+		p := parser.NewPrometheus(parser.WithProtobuf())
+
+		metrics, err := p.Parse(encodeProtobuf(mf))
+
+		Expect(err).ToNot(HaveOccurred())
+		native := metrics["rpc_latency_seconds"].(*parser.Family).Metrics[0].(parser.Histogram).Native
+		Expect(native.Schema).To(Equal(int32(1)))
+		Expect(native.ZeroCount).To(Equal(0.5))
+		Expect(native.Buckets).To(HaveLen(3))
+		Expect(native.Buckets[0].Lower).To(Equal(1.0))
+		Expect(native.Buckets[0].Upper).To(BeNumerically("~", math.Sqrt2, 1e-12))
+		Expect(native.Buckets[0].Count).To(Equal(1.5))
+		Expect(native.Buckets[2].Lower).To(BeNumerically("~", 2*math.Sqrt2, 1e-12))
+		Expect(native.Buckets[2].Count).To(Equal(0.25))
+	})
+
+	It("stops at the last delta when the spans are longer", func() {
+		mf := nativeHistogramFamily()
+		mf.Metric[0].Histogram.PositiveDelta = []int64{2}
+		p := parser.NewPrometheus(parser.WithProtobuf())
+
+		metrics, err := p.Parse(encodeProtobuf(mf))
+
+		Expect(err).ToNot(HaveOccurred())
+		native := metrics["rpc_latency_seconds"].(*parser.Family).Metrics[0].(parser.Histogram).Native
+		Expect(native.Buckets).To(Equal([]parser.NativeBucket{
+			{Lower: -2, Upper: -1, Count: 1},
+			{Lower: 1, Upper: 2, Count: 2},
+		}))
+	})
+
+	It("leaves out the native part of classic histograms", func() {
+		mf := nativeHistogramFamily()
+		h := mf.Metric[0].Histogram
+		upper, cumulative := 1.0, uint64(9)
+		h.Bucket = []*dto.Bucket{{UpperBound: &upper, CumulativeCount: &cumulative}}
+		h.Schema, h.ZeroThreshold, h.ZeroCount = nil, nil, nil
+		h.NegativeSpan, h.NegativeDelta, h.PositiveSpan, h.PositiveDelta = nil, nil, nil, nil
+		p := parser.NewPrometheus(parser.WithProtobuf())
+
+		metrics, err := p.Parse(encodeProtobuf(mf))
+
+		Expect(err).ToNot(HaveOccurred())
+		histogram := metrics["rpc_latency_seconds"].(*parser.Family).Metrics[0].(parser.Histogram)
+		Expect(histogram.Buckets).To(Equal([]parser.Bucket{{UpperBound: 1, CumulativeCount: 9}}))
+		Expect(histogram.Native).To(BeNil())
+	})
+
+	It("returns an error for invalid input", func() {
+		p := parser.NewPrometheus(parser.WithProtobuf())
+
+		_, err := p.Parse([]byte("go_goroutines 6\n"))
+
+		Expect(err).To(HaveOccurred())
+	})
+})
+
+func nativeHistogramFamily() *dto.MetricFamily {
+	name, help := "rpc_latency_seconds", "RPC latency."
+	typ := dto.MetricType_HISTOGRAM
+	count, sum := uint64(9), 12.5
+	schema, threshold, zeroCount := int32(0), 0.001, uint64(1)
+	offset := int32(1)
+	length1, length2 := uint32(1), uint32(2)
+	return &dto.MetricFamily{
+		Name: &name,
+		Help: &help,
+		Type: &typ,
+		Metric: []*dto.Metric{
+			{
+				Histogram: &dto.Histogram{
+					SampleCount:   &count,
+					SampleSum:     &sum,
+					Schema:        &schema,
+					ZeroThreshold: &threshold,
+					ZeroCount:     &zeroCount,
+					// (-2, -1]
+					NegativeSpan:  []*dto.BucketSpan{{Offset: &offset, Length: &length1}},
+					NegativeDelta: []int64{1},
+					// (1, 2], (2, 4], then a gap of one bucket and (8, 16]
+					PositiveSpan:  []*dto.BucketSpan{{Offset: &offset, Length: &length2}, {Offset: &offset, Length: &length1}},
+					PositiveDelta: []int64{2, 1, -1},
+				},
+			},
+		},
+	}
+}
+
+func encodeProtobuf(mf *dto.MetricFamily) []byte {
+	buf := &bytes.Buffer{}
+	enc := expfmt.NewEncoder(buf, expfmt.NewFormat(expfmt.TypeProtoDelim))
+	err := enc.Encode(mf)
+	Expect(err).ToNot(HaveOccurred())
+	return buf.Bytes()
+}
+
 var prometheusOutput = `# HELP go_gc_duration_seconds A summary of the GC invocation durations.
 # TYPE go_gc_duration_seconds summary
 go_gc_duration_seconds{quantile="0"} 0
@@ -59,4 +267,23 @@ rpc_durations_histogram_seconds_sum 0
 rpc_durations_histogram_seconds_count 0
 `
 
-var promJSON = `{"go_gc_duration_seconds":{"name":"go_gc_duration_seconds","help":"A summary of the GC invocation durations.","type":"SUMMARY","metrics":[{"quantiles":{"0":"0","0.25":"0","0.5":"0","0.75":"0","1":"0"},"count":"0","sum":"0"}]},"go_goroutines":{"name":"go_goroutines","help":"Number of goroutines that currently exist.","type":"GAUGE","metrics":[{"value":"6"}]},"go_info":{"name":"go_info","help":"Information about the Go environment.","type":"GAUGE","metrics":[{"labels":{"version":"go1.9.1"},"value":"1"}]},"go_memstats_alloc_bytes":{"name":"go_memstats_alloc_bytes","help":"Number of bytes allocated and still in use.","type":"GAUGE","metrics":[{"value":"483504"}]},"rpc_durations_histogram_seconds":{"name":"rpc_durations_histogram_seconds","help":"RPC latency distributions.","type":"HISTOGRAM","metrics":[{"buckets":{"+Inf":"0"},"count":"0","sum":"0"}]}}`
+var promJSON = `{"go_gc_duration_seconds":{"name":"go_gc_duration_seconds","help":"A summary of the GC invocation durations.","type":"SUMMARY","metrics":[{"quantiles":{"0":0,"0.25":0,"0.5":0,"0.75":0,"1":0},"count":0,"sum":0}]},"go_goroutines":{"name":"go_goroutines","help":"Number of goroutines that currently exist.","type":"GAUGE","metrics":[{"value":6}]},"go_info":{"name":"go_info","help":"Information about the Go environment.","type":"GAUGE","metrics":[{"labels":{"version":"go1.9.1"},"value":1}]},"go_memstats_alloc_bytes":{"name":"go_memstats_alloc_bytes","help":"Number of bytes allocated and still in use.","type":"GAUGE","metrics":[{"value":483504}]},"rpc_durations_histogram_seconds":{"name":"rpc_durations_histogram_seconds","help":"RPC latency distributions.","type":"HISTOGRAM","metrics":[{"buckets":{"+Inf":0},"count":0,"sum":0}]}}`
+
+var histogramOutput = `# HELP http_request_duration_seconds A histogram of the request duration.
+# TYPE http_request_duration_seconds histogram
+http_request_duration_seconds_bucket{le="0.05"} 24054
+http_request_duration_seconds_bucket{le="0.1"} 33444
+http_request_duration_seconds_bucket{le="0.2"} 100392
+http_request_duration_seconds_bucket{le="+Inf"} 144320
+http_request_duration_seconds_sum 53.423
+http_request_duration_seconds_count 144320
+`
+
+var specialValuesOutput = `# TYPE temperature gauge
+temperature{sensor="a"} NaN
+temperature{sensor="b"} +Inf
+temperature{sensor="c"} -Inf
+temperature{sensor="d"} 21.5
+`
+
+var specialValuesJSON = `{"temperature":{"name":"temperature","help":"","type":"GAUGE","metrics":[{"labels":{"sensor":"a"},"value":"NaN"},{"labels":{"sensor":"b"},"value":"+Inf"},{"labels":{"sensor":"c"},"value":"-Inf"},{"labels":{"sensor":"d"},"value":21.5}]}}`
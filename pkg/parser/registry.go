@@ -0,0 +1,250 @@
+package parser
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"mime"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// Parser turns the body of a metrics endpoint response into metrics.
+type Parser interface {
+	Parse([]byte) (map[string]interface{}, error)
+}
+
+// Format describes a metrics format that can be registered with Register.
+type Format struct {
+	// Name identifies the format, e.g. in the --format flag and in the
+	// app-metrics-NAME command.
+	Name string
+	// Help is a one line description of the format.
+	Help string
+	// ContentTypes are the media types, without parameters, the format is
+	// served with.
+	ContentTypes []string
+	// Accept is the part of the Accept header asking for this format,
+	// including a q value. It may be empty.
+	Accept string
+	// Paths are the endpoints commonly serving this format. They are tried
+	// in registration order when detecting the format of an app.
+	Paths []string
+	// Sniff reports whether a body looks like this format. It is used when
+	// the Content-Type of a response is missing or misleading.
+	Sniff func(body []byte) bool
+	// New returns a parser for a response with the given Content-Type. The
+	// Content-Type is empty when the format was chosen explicitly.
+	New func(contentType string) Parser
+}
+
+const (
+	FormatExpvar     = "expvar"
+	FormatPrometheus = "prometheus"
+	FormatInflux     = "influx"
+	FormatGraphite   = "graphite"
+)
+
+var (
+	registryMu sync.RWMutex
+	registry   []Format
+)
+
+func init() {
+	Register(Format{
+		Name:         FormatExpvar,
+		Help:         "expvar style json",
+		ContentTypes: []string{"application/json"},
+		Accept:       "application/json;q=0.3",
+		Paths:        []string{"/debug/vars", "/debug/metrics"},
+		Sniff: func(b []byte) bool {
+			b = bytes.TrimSpace(b)
+			return len(b) > 0 && b[0] == '{' && json.Valid(b)
+		},
+		New: func(string) Parser {
+			return NewExpvar()
+		},
+	})
+	Register(Format{
+		Name:         FormatPrometheus,
+		Help:         "prometheus text or protobuf exposition",
+		ContentTypes: []string{"text/plain", "application/openmetrics-text", protobufType},
+		// The protobuf format is preferred as only it carries native histograms.
+		Accept: protobufType + ";proto=" + protobufProto + ";encoding=delimited;q=0.7,text/plain;version=0.0.4;q=0.5",
+		Paths:  []string{"/metrics", "/actuator/prometheus"},
+		Sniff: func(b []byte) bool {
+			b = bytes.TrimSpace(b)
+			if len(b) == 0 {
+				return false
+			}
+			c := b[0]
+			return c == '#' || c == '_' || c == ':' || (c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z')
+		},
+		New: func(contentType string) Parser {
+			mediaType, params, _ := mime.ParseMediaType(contentType)
+			if mediaType == protobufType && params["proto"] == protobufProto {
+				return NewPrometheus(WithProtobuf())
+			}
+			return NewPrometheus()
+		},
+	})
+	// Telegraf style exporters serve both formats as text/plain and have no
+	// common endpoints, so they are only found by sniffing.
+	Register(Format{
+		Name:         FormatInflux,
+		Help:         "influxdb line protocol",
+		ContentTypes: []string{"text/plain"},
+		Sniff: func(b []byte) bool {
+			key, fields := splitUnescaped(firstLine(b), ' ', false)
+			return key != "" && strings.Contains(fields, "=")
+		},
+		New: func(string) Parser {
+			return NewInflux()
+		},
+	})
+	Register(Format{
+		Name:         FormatGraphite,
+		Help:         "graphite plaintext protocol",
+		ContentTypes: []string{"text/plain"},
+		Sniff: func(b []byte) bool {
+			fields := strings.Fields(firstLine(b))
+			if len(fields) < 2 || len(fields) > 3 {
+				return false
+			}
+			_, err := strconv.ParseFloat(fields[1], 64)
+			return err == nil
+		},
+		New: func(string) Parser {
+			return NewGraphite()
+		},
+	})
+}
+
+// firstLine returns the first line of b that is neither blank nor a comment.
+func firstLine(b []byte) string {
+	for _, line := range strings.Split(string(b), "\n") {
+		if line = strings.TrimSpace(line); line != "" && !strings.HasPrefix(line, "#") {
+			return line
+		}
+	}
+	return ""
+}
+
+// Register makes a format available to the plugin commands, the --format
+// flag and format detection. It panics if the format has no name or parser
+// constructor, or if a format with the same name is already registered.
+func Register(f Format) {
+	registryMu.Lock()
+	defer registryMu.Unlock()
+
+	if f.Name == "" || f.New == nil {
+		panic("parser: Register format without name or constructor")
+	}
+	for _, r := range registry {
+		if r.Name == f.Name {
+			panic(fmt.Sprintf("parser: Register called twice for format %s", f.Name))
+		}
+	}
+	registry = append(registry, f)
+}
+
+// Lookup returns the registered format with the given name.
+func Lookup(name string) (Format, bool) {
+	registryMu.RLock()
+	defer registryMu.RUnlock()
+
+	for _, f := range registry {
+		if f.Name == name {
+			return f, true
+		}
+	}
+	return Format{}, false
+}
+
+// Formats returns the registered formats in registration order.
+func Formats() []Format {
+	registryMu.RLock()
+	defer registryMu.RUnlock()
+
+	return append([]Format(nil), registry...)
+}
+
+// Names returns the names of the registered formats in registration order.
+func Names() []string {
+	var names []string
+	for _, f := range Formats() {
+		names = append(names, f.Name)
+	}
+	return names
+}
+
+// WellKnownPaths returns the endpoints tried, in order, when detecting the
+// format of an app.
+func WellKnownPaths() []string {
+	var paths []string
+	seen := make(map[string]bool)
+	for _, f := range Formats() {
+		for _, p := range f.Paths {
+			if !seen[p] {
+				seen[p] = true
+				paths = append(paths, p)
+			}
+		}
+	}
+	return paths
+}
+
+// Accept returns the Accept header sent when detecting the format. It asks
+// for every registered format, then anything else.
+func Accept() string {
+	var parts []string
+	for _, f := range Formats() {
+		if f.Accept != "" {
+			parts = append(parts, f.Accept)
+		}
+	}
+	return strings.Join(append(parts, "*/*;q=0.1"), ",")
+}
+
+// Detect chooses a registered format for a response. Formats registered
+// for the Content-Type are tried first, then the formats whose Sniff
+// accepts the body. It returns the name of the format and its parser, or
+// false when no format parses the response into at least one metric.
+func Detect(contentType string, body []byte) (string, Parser, bool) {
+	mediaType, _, _ := mime.ParseMediaType(contentType)
+	formats := Formats()
+
+	var candidates []Format
+	for _, f := range formats {
+		for _, ct := range f.ContentTypes {
+			if ct == mediaType {
+				candidates = append(candidates, f)
+				break
+			}
+		}
+	}
+	if mediaType == protobufType {
+		// The binary format cannot be sniffed, trust the header.
+		formats = nil
+	}
+	for _, f := range formats {
+		if f.Sniff != nil && f.Sniff(body) {
+			candidates = append(candidates, f)
+		}
+	}
+
+	tried := make(map[string]bool)
+	for _, f := range candidates {
+		if tried[f.Name] {
+			continue
+		}
+		tried[f.Name] = true
+
+		p := f.New(contentType)
+		if m, err := p.Parse(body); err == nil && len(m) > 0 {
+			return f.Name, p, true
+		}
+	}
+	return "", nil, false
+}
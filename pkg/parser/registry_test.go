@@ -0,0 +1,105 @@
+package parser_test
+
+import (
+	"github.com/wfernandes/app-metrics-plugin/pkg/parser"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Registry", func() {
+	It("registers the built-in formats in order", func() {
+		Expect(parser.Names()).To(HaveLen(4))
+		Expect(parser.Names()).To(Equal([]string{parser.FormatExpvar, parser.FormatPrometheus, parser.FormatInflux, parser.FormatGraphite}))
+		Expect(parser.WellKnownPaths()).To(Equal([]string{"/debug/vars", "/debug/metrics", "/metrics", "/actuator/prometheus"}))
+		Expect(parser.Accept()).To(HavePrefix("application/json;q=0.3,application/vnd.google.protobuf"))
+		Expect(parser.Accept()).To(HaveSuffix(",*/*;q=0.1"))
+	})
+
+	It("looks up formats by name", func() {
+		f, ok := parser.Lookup(parser.FormatPrometheus)
+		Expect(ok).To(BeTrue())
+		Expect(f.New("")).To(Equal(parser.NewPrometheus()))
+
+		_, ok = parser.Lookup("xml")
+		Expect(ok).To(BeFalse())
+	})
+
+	It("panics when registering a format twice or without constructor", func() {
+		Expect(func() {
+			parser.Register(parser.Format{Name: parser.FormatExpvar, New: func(string) parser.Parser { return nil }})
+		}).To(Panic())
+		Expect(func() {
+			parser.Register(parser.Format{Name: "no-constructor"})
+		}).To(Panic())
+	})
+})
+
+var _ = Describe("Detect", func() {
+	It("uses the json content type", func() {
+		format, p, ok := parser.Detect("application/json; charset=utf-8", []byte(expvarJSON))
+
+		Expect(ok).To(BeTrue())
+		Expect(format).To(Equal(parser.FormatExpvar))
+		Expect(p).To(BeAssignableToTypeOf(&parser.Expvar{}))
+	})
+
+	It("uses the prometheus text content type", func() {
+		format, p, ok := parser.Detect("text/plain; version=0.0.4; charset=utf-8", []byte(prometheusOutput))
+
+		Expect(ok).To(BeTrue())
+		Expect(format).To(Equal(parser.FormatPrometheus))
+		Expect(p).To(BeAssignableToTypeOf(&parser.Prometheus{}))
+	})
+
+	It("sniffs the body when the content type is not specific", func() {
+		format, _, ok := parser.Detect("text/plain; charset=utf-8", []byte(expvarJSON))
+		Expect(ok).To(BeTrue())
+		Expect(format).To(Equal(parser.FormatExpvar))
+
+		format, _, ok = parser.Detect("", []byte(prometheusOutput))
+		Expect(ok).To(BeTrue())
+		Expect(format).To(Equal(parser.FormatPrometheus))
+	})
+
+	It("sniffs the body when the content type is wrong", func() {
+		format, _, ok := parser.Detect("application/json", []byte(prometheusOutput))
+
+		Expect(ok).To(BeTrue())
+		Expect(format).To(Equal(parser.FormatPrometheus))
+	})
+
+	It("uses the protobuf content type", func() {
+		format, p, ok := parser.Detect(
+			"application/vnd.google.protobuf; proto=io.prometheus.client.MetricFamily; encoding=delimited",
+			encodeProtobuf(nativeHistogramFamily()),
+		)
+
+		Expect(ok).To(BeTrue())
+		Expect(format).To(Equal(parser.FormatPrometheus))
+		Expect(p).To(Equal(parser.NewPrometheus(parser.WithProtobuf())))
+	})
+
+	It("sniffs influx and graphite bodies served as text", func() {
+		format, p, ok := parser.Detect("text/plain; charset=utf-8", []byte(influxOutput))
+		Expect(ok).To(BeTrue())
+		Expect(format).To(Equal(parser.FormatInflux))
+		Expect(p).To(BeAssignableToTypeOf(&parser.Influx{}))
+
+		format, p, ok = parser.Detect("", []byte(graphiteOutput))
+		Expect(ok).To(BeTrue())
+		Expect(format).To(Equal(parser.FormatGraphite))
+		Expect(p).To(BeAssignableToTypeOf(&parser.Graphite{}))
+	})
+
+	It("does not recognize other responses", func() {
+		_, _, ok := parser.Detect("text/html", []byte("<html><body>Whitelabel Error Page</body></html>"))
+		Expect(ok).To(BeFalse())
+
+		_, _, ok = parser.Detect("text/plain", []byte("404 page not found\n"))
+		Expect(ok).To(BeFalse())
+
+		_, _, ok = parser.Detect("application/json", []byte("{}"))
+		Expect(ok).To(BeFalse())
+	})
+})
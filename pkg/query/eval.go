@@ -0,0 +1,399 @@
+package query
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/prometheus/common/model"
+	"github.com/wfernandes/app-metrics-plugin/pkg/agent"
+	"github.com/wfernandes/app-metrics-plugin/pkg/aggregate"
+	"github.com/wfernandes/app-metrics-plugin/pkg/parser"
+)
+
+type vector []Sample
+
+type evaluator struct {
+	samples []agent.Sample
+	series  map[int]vector
+}
+
+func (e *evaluator) eval(n node) (interface{}, error) {
+	if len(e.samples) == 0 {
+		return nil, errors.New("no samples to query")
+	}
+
+	switch t := n.(type) {
+	case numberNode:
+		return float64(t), nil
+	case *selectorNode:
+		return e.selectSeries(len(e.samples)-1, t), nil
+	case *aggregateNode:
+		v, err := e.evalVector(t.expr, t.op)
+		if err != nil {
+			return nil, err
+		}
+		return aggregateVector(t, v), nil
+	case *callNode:
+		return e.evalCall(t)
+	case *binaryNode:
+		lhs, err := e.eval(t.lhs)
+		if err != nil {
+			return nil, err
+		}
+		rhs, err := e.eval(t.rhs)
+		if err != nil {
+			return nil, err
+		}
+		return binary(t.op, lhs, rhs)
+	}
+	return nil, fmt.Errorf("unexpected node %T", n)
+}
+
+func (e *evaluator) evalVector(n node, context string) (vector, error) {
+	v, err := e.eval(n)
+	if err != nil {
+		return nil, err
+	}
+	vec, ok := v.(vector)
+	if !ok {
+		return nil, fmt.Errorf("%s expects a vector, got a scalar", context)
+	}
+	return vec, nil
+}
+
+func (e *evaluator) evalCall(c *callNode) (interface{}, error) {
+	switch c.fn {
+	case "rate", "increase":
+		return e.increase(c.args[0].(*selectorNode), c.fn == "rate")
+	case "histogram_quantile":
+		q, err := e.eval(c.args[0])
+		if err != nil {
+			return nil, err
+		}
+		phi, ok := q.(float64)
+		if !ok {
+			return nil, errors.New("histogram_quantile expects a scalar quantile")
+		}
+		v, err := e.evalVector(c.args[1], c.fn)
+		if err != nil {
+			return nil, err
+		}
+		return histogramQuantile(phi, v), nil
+	}
+	return nil, fmt.Errorf("unknown function %s", c.fn)
+}
+
+// increase computes the increase of the selected series over its range,
+// between the last sample and the latest sample at least the range older,
+// or its per-second rate. A series that decreased was reset and increased
+// from zero, like Prometheus assumes.
+func (e *evaluator) increase(s *selectorNode, perSecond bool) (vector, error) {
+	if len(e.samples) < 2 {
+		return nil, errors.New("rate and increase need two scrapes, use -rate")
+	}
+	i := startOf(e.samples, s.rng)
+	if i < 0 {
+		return nil, fmt.Errorf("the range of %s[%s] is longer than the %s between the scrapes", s.name, model.Duration(s.rng), e.samples[len(e.samples)-1].Time.Sub(e.samples[0].Time).Round(time.Millisecond))
+	}
+	first, last := e.samples[i], e.samples[len(e.samples)-1]
+	elapsed := last.Time.Sub(first.Time).Seconds()
+
+	before := make(map[string]float64)
+	for _, smp := range e.selectSeries(i, s) {
+		before[smp.Name()] = smp.Value
+	}
+
+	var out vector
+	for _, smp := range e.selectSeries(len(e.samples)-1, s) {
+		b, ok := before[smp.Name()]
+		if !ok {
+			continue
+		}
+		increase := smp.Value - b
+		if increase < 0 {
+			increase = smp.Value
+		}
+		if perSecond {
+			increase /= elapsed
+		}
+		out = append(out, Sample{Labels: dropName(smp.Labels), Value: increase})
+	}
+	return out, nil
+}
+
+// startOf returns the index of the latest sample at least rng older than
+// the last sample, or -1 when there is none.
+func startOf(samples []agent.Sample, rng time.Duration) int {
+	last := samples[len(samples)-1].Time
+	for i := len(samples) - 2; i >= 0; i-- {
+		if last.Sub(samples[i].Time) >= rng {
+			return i
+		}
+	}
+	return -1
+}
+
+// selectSeries returns the series of the i-th sample matching the selector.
+func (e *evaluator) selectSeries(i int, s *selectorNode) vector {
+	if e.series == nil {
+		e.series = make(map[int]vector)
+	}
+	all, ok := e.series[i]
+	if !ok {
+		all = seriesOf(e.samples[i].Metrics)
+		e.series[i] = all
+	}
+
+	var out vector
+	for _, smp := range all {
+		if s.name != "" && smp.Labels[NameLabel] != s.name {
+			continue
+		}
+		matched := true
+		for _, m := range s.matchers {
+			if !m.Matches(smp.Labels) {
+				matched = false
+				break
+			}
+		}
+		if matched {
+			out = append(out, smp)
+		}
+	}
+	return out
+}
+
+func aggregateVector(a *aggregateNode, v vector) vector {
+	type group struct {
+		labels map[string]string
+		values []float64
+	}
+	groups := make(map[string]*group)
+	var keys []string
+	for _, smp := range v {
+		labels := groupLabels(a, smp.Labels)
+		key := aggregate.SeriesKey("", labels)
+		g, ok := groups[key]
+		if !ok {
+			g = &group{labels: labels}
+			groups[key] = g
+			keys = append(keys, key)
+		}
+		g.values = append(g.values, smp.Value)
+	}
+
+	out := make(vector, 0, len(keys))
+	for _, k := range keys {
+		g := groups[k]
+		out = append(out, Sample{Labels: g.labels, Value: reduce(a.op, g.values)})
+	}
+	return out
+}
+
+// groupLabels returns the labels kept by the by or without clause.
+func groupLabels(a *aggregateNode, labels map[string]string) map[string]string {
+	out := make(map[string]string)
+	if !a.without {
+		for _, l := range a.grouping {
+			if v, ok := labels[l]; ok {
+				out[l] = v
+			}
+		}
+		return out
+	}
+
+	for k, v := range labels {
+		out[k] = v
+	}
+	delete(out, NameLabel)
+	for _, l := range a.grouping {
+		delete(out, l)
+	}
+	return out
+}
+
+func reduce(op string, values []float64) float64 {
+	result := values[0]
+	switch op {
+	case "count":
+		return float64(len(values))
+	case "min":
+		for _, v := range values[1:] {
+			result = math.Min(result, v)
+		}
+	case "max":
+		for _, v := range values[1:] {
+			result = math.Max(result, v)
+		}
+	default:
+		for _, v := range values[1:] {
+			result += v
+		}
+		if op == "avg" {
+			result /= float64(len(values))
+		}
+	}
+	return result
+}
+
+// histogramQuantile estimates the quantile of the histograms whose buckets
+// are the series of the vector, grouped by their labels other than le.
+func histogramQuantile(phi float64, v vector) vector {
+	type histogram struct {
+		labels map[string]string
+		counts map[float64]float64
+	}
+	histograms := make(map[string]*histogram)
+	var keys []string
+	for _, smp := range v {
+		le, err := strconv.ParseFloat(smp.Labels["le"], 64)
+		if err != nil {
+			continue
+		}
+		labels := dropName(smp.Labels)
+		delete(labels, "le")
+		key := aggregate.SeriesKey("", labels)
+		h, ok := histograms[key]
+		if !ok {
+			h = &histogram{labels: labels, counts: make(map[float64]float64)}
+			histograms[key] = h
+			keys = append(keys, key)
+		}
+		h.counts[le] += smp.Value
+	}
+
+	out := make(vector, 0, len(keys))
+	for _, k := range keys {
+		h := histograms[k]
+		bounds := make([]float64, 0, len(h.counts))
+		for le := range h.counts {
+			bounds = append(bounds, le)
+		}
+		sort.Float64s(bounds)
+		counts := make([]float64, len(bounds))
+		for i, le := range bounds {
+			counts[i] = h.counts[le]
+		}
+		out = append(out, Sample{Labels: h.labels, Value: aggregate.EstimateBucketQuantile(phi, bounds, counts)})
+	}
+	return out
+}
+
+// binary applies an arithmetic operator. Between two vectors the series
+// with the same labels, ignoring the metric name, are matched one to one.
+// Like in Prometheus, several series with the same labels on either side
+// are an error rather than an arbitrary match.
+func binary(op string, lhs, rhs interface{}) (interface{}, error) {
+	l, lok := lhs.(float64)
+	r, rok := rhs.(float64)
+	switch {
+	case lok && rok:
+		return arithmetic(op, l, r), nil
+	case lok:
+		out := make(vector, 0, len(rhs.(vector)))
+		for _, smp := range rhs.(vector) {
+			out = append(out, Sample{Labels: dropName(smp.Labels), Value: arithmetic(op, l, smp.Value)})
+		}
+		return out, nil
+	case rok:
+		out := make(vector, 0, len(lhs.(vector)))
+		for _, smp := range lhs.(vector) {
+			out = append(out, Sample{Labels: dropName(smp.Labels), Value: arithmetic(op, smp.Value, r)})
+		}
+		return out, nil
+	}
+
+	right := make(map[string]float64)
+	for _, smp := range rhs.(vector) {
+		key := aggregate.SeriesKey("", dropName(smp.Labels))
+		if _, ok := right[key]; ok {
+			return nil, fmt.Errorf("found duplicate series for the match group %s on the right-hand side of %s, many-to-one matching is not supported", key, op)
+		}
+		right[key] = smp.Value
+	}
+	matched := make(map[string]bool)
+	var out vector
+	for _, smp := range lhs.(vector) {
+		labels := dropName(smp.Labels)
+		key := aggregate.SeriesKey("", labels)
+		v, ok := right[key]
+		if !ok {
+			continue
+		}
+		if matched[key] {
+			return nil, fmt.Errorf("found duplicate series for the match group %s on the left-hand side of %s, many-to-one matching is not supported", key, op)
+		}
+		matched[key] = true
+		out = append(out, Sample{Labels: labels, Value: arithmetic(op, smp.Value, v)})
+	}
+	return out, nil
+}
+
+func arithmetic(op string, l, r float64) float64 {
+	switch op {
+	case "+":
+		return l + r
+	case "-":
+		return l - r
+	case "*":
+		return l * r
+	case "/":
+		return l / r
+	}
+	return math.Mod(l, r)
+}
+
+func dropName(labels map[string]string) map[string]string {
+	out := make(map[string]string, len(labels))
+	for k, v := range labels {
+		if k != NameLabel {
+			out[k] = v
+		}
+	}
+	return out
+}
+
+// seriesOf returns the series of every instance. Prometheus families are
+// split into series like the exposition format does, with summaries and
+// histograms turned into their quantile, _bucket, _sum and _count series.
+// A label named instance is renamed exported_instance, as Prometheus does
+// when scraping.
+func seriesOf(metrics []agent.InstanceMetric) vector {
+	var out vector
+	for _, m := range metrics {
+		if m.Metrics == nil {
+			continue
+		}
+		instance := strconv.Itoa(m.Instance)
+		add := func(name string, labels map[string]string, value float64) {
+			l := make(map[string]string, len(labels)+2)
+			for k, v := range labels {
+				if k == InstanceLabel {
+					k = "exported_" + InstanceLabel
+				}
+				l[k] = v
+			}
+			l[NameLabel] = name
+			l[InstanceLabel] = instance
+			out = append(out, Sample{Labels: l, Value: value})
+		}
+
+		others := make(map[string]interface{})
+		for k, v := range m.Metrics {
+			family, ok := v.(*parser.Family)
+			if !ok {
+				others[k] = v
+				continue
+			}
+			aggregate.EachSeries(family, add)
+		}
+		for k, v := range aggregate.Flatten(others) {
+			add(k, nil, v)
+		}
+	}
+	return out
+}
@@ -0,0 +1,483 @@
+package query
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/prometheus/common/model"
+	"github.com/wfernandes/app-metrics-plugin/pkg/filter"
+)
+
+type node interface{}
+
+type numberNode float64
+
+// selectorNode selects series by name and labels. A range selector, e.g.
+// `requests_total[5m]`, is only allowed as the argument of rate and
+// increase.
+type selectorNode struct {
+	name     string
+	matchers []filter.LabelMatcher
+	ranged   bool
+	rng      time.Duration
+}
+
+type aggregateNode struct {
+	op       string
+	without  bool
+	grouping []string
+	expr     node
+}
+
+type callNode struct {
+	fn   string
+	args []node
+}
+
+type binaryNode struct {
+	op       string
+	lhs, rhs node
+}
+
+var aggregations = map[string]bool{"sum": true, "avg": true, "min": true, "max": true, "count": true}
+
+// functions maps the supported functions to their number of arguments.
+var functions = map[string]int{"rate": 1, "increase": 1, "histogram_quantile": 2}
+
+type tokenKind int
+
+const (
+	tokenEOF tokenKind = iota
+	tokenIdent
+	tokenNumber
+	tokenString
+	tokenRange
+	tokenPunct
+)
+
+type token struct {
+	kind tokenKind
+	text string
+	pos  int
+}
+
+type queryParser struct {
+	expr   string
+	tokens []token
+	pos    int
+}
+
+func newParser(expr string) (*queryParser, error) {
+	tokens, err := lex(expr)
+	if err != nil {
+		return nil, fmt.Errorf("invalid query %q: %s", expr, err)
+	}
+	return &queryParser{expr: expr, tokens: tokens}, nil
+}
+
+// lex splits the expression into tokens. The duration of a range selector,
+// between square brackets, is a single token.
+func lex(s string) ([]token, error) {
+	var tokens []token
+	for i := 0; i < len(s); {
+		c := s[i]
+		switch {
+		case c == ' ' || c == '\t' || c == '\n':
+			i++
+		case isIdentStart(c):
+			j := i + 1
+			for j < len(s) && (isIdentStart(s[j]) || isDigit(s[j]) || s[j] == '.') {
+				j++
+			}
+			tokens = append(tokens, token{tokenIdent, s[i:j], i})
+			i = j
+		case isDigit(c) || (c == '.' && i+1 < len(s) && isDigit(s[i+1])):
+			j := i
+			for j < len(s) && (isDigit(s[j]) || s[j] == '.') {
+				j++
+			}
+			if j < len(s) && (s[j] == 'e' || s[j] == 'E') {
+				k := j + 1
+				if k < len(s) && (s[k] == '+' || s[k] == '-') {
+					k++
+				}
+				if k < len(s) && isDigit(s[k]) {
+					for j = k; j < len(s) && isDigit(s[j]); j++ {
+					}
+				}
+			}
+			tokens = append(tokens, token{tokenNumber, s[i:j], i})
+			i = j
+		case c == '"' || c == '\'' || c == '`':
+			v, n, err := filter.Unquote(s[i:])
+			if err != nil {
+				return nil, err
+			}
+			tokens = append(tokens, token{tokenString, v, i})
+			i += n
+		case c == '[':
+			j := strings.IndexByte(s[i:], ']')
+			if j < 0 {
+				return nil, fmt.Errorf("missing ] at %d", i)
+			}
+			tokens = append(tokens, token{tokenRange, strings.TrimSpace(s[i+1 : i+j]), i})
+			i += j + 1
+		default:
+			if i+1 < len(s) {
+				if two := s[i : i+2]; two == "!=" || two == "=~" || two == "!~" {
+					tokens = append(tokens, token{tokenPunct, two, i})
+					i += 2
+					continue
+				}
+			}
+			if !strings.ContainsRune("(){},=+-*/%", rune(c)) {
+				return nil, fmt.Errorf("unexpected character %q at %d", c, i)
+			}
+			tokens = append(tokens, token{tokenPunct, string(c), i})
+			i++
+		}
+	}
+	return append(tokens, token{tokenEOF, "", len(s)}), nil
+}
+
+func isIdentStart(c byte) bool {
+	return c == '_' || c == ':' || (c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z')
+}
+
+func isDigit(c byte) bool {
+	return c >= '0' && c <= '9'
+}
+
+func (p *queryParser) peek() token {
+	return p.tokens[p.pos]
+}
+
+func (p *queryParser) next() token {
+	t := p.tokens[p.pos]
+	if t.kind != tokenEOF {
+		p.pos++
+	}
+	return t
+}
+
+func (p *queryParser) accept(punct string) bool {
+	if t := p.peek(); t.kind == tokenPunct && t.text == punct {
+		p.pos++
+		return true
+	}
+	return false
+}
+
+func (p *queryParser) expect(punct string) error {
+	if !p.accept(punct) {
+		return p.errorf("expected %s", punct)
+	}
+	return nil
+}
+
+func (p *queryParser) errorf(format string, args ...interface{}) error {
+	t := p.peek()
+	at := "end of query"
+	if t.kind != tokenEOF {
+		at = fmt.Sprintf("%q at %d", p.expr[t.pos:], t.pos)
+	}
+	return fmt.Errorf("invalid query %q: %s, found %s", p.expr, fmt.Sprintf(format, args...), at)
+}
+
+func (p *queryParser) parse() (node, error) {
+	n, err := p.parseSum()
+	if err != nil {
+		return nil, err
+	}
+	if p.peek().kind != tokenEOF {
+		return nil, p.errorf("unexpected input")
+	}
+	if err := checkRanges(n, false); err != nil {
+		return nil, fmt.Errorf("invalid query %q: %s", p.expr, err)
+	}
+	return n, nil
+}
+
+func (p *queryParser) parseSum() (node, error) {
+	lhs, err := p.parseProduct()
+	if err != nil {
+		return nil, err
+	}
+	for {
+		t := p.peek()
+		if t.kind != tokenPunct || (t.text != "+" && t.text != "-") {
+			return lhs, nil
+		}
+		p.next()
+		rhs, err := p.parseProduct()
+		if err != nil {
+			return nil, err
+		}
+		lhs = &binaryNode{op: t.text, lhs: lhs, rhs: rhs}
+	}
+}
+
+func (p *queryParser) parseProduct() (node, error) {
+	lhs, err := p.parseUnary()
+	if err != nil {
+		return nil, err
+	}
+	for {
+		t := p.peek()
+		if t.kind != tokenPunct || (t.text != "*" && t.text != "/" && t.text != "%") {
+			return lhs, nil
+		}
+		p.next()
+		rhs, err := p.parseUnary()
+		if err != nil {
+			return nil, err
+		}
+		lhs = &binaryNode{op: t.text, lhs: lhs, rhs: rhs}
+	}
+}
+
+func (p *queryParser) parseUnary() (node, error) {
+	if p.accept("-") {
+		n, err := p.parseUnary()
+		if err != nil {
+			return nil, err
+		}
+		return &binaryNode{op: "*", lhs: numberNode(-1), rhs: n}, nil
+	}
+	p.accept("+")
+	return p.parsePrimary()
+}
+
+func (p *queryParser) parsePrimary() (node, error) {
+	t := p.peek()
+	switch {
+	case t.kind == tokenNumber:
+		p.next()
+		f, err := strconv.ParseFloat(t.text, 64)
+		if err != nil {
+			return nil, p.errorf("bad number %s", t.text)
+		}
+		return numberNode(f), nil
+	case t.kind == tokenPunct && t.text == "(":
+		p.next()
+		n, err := p.parseSum()
+		if err != nil {
+			return nil, err
+		}
+		return n, p.expect(")")
+	case t.kind == tokenPunct && t.text == "{":
+		return p.parseSelector("")
+	case t.kind == tokenIdent:
+		p.next()
+		next := p.peek()
+		if aggregations[t.text] && (next.text == "(" || next.text == "by" || next.text == "without") {
+			return p.parseAggregation(t.text)
+		}
+		if _, ok := functions[t.text]; ok && next.text == "(" {
+			return p.parseCall(t.text)
+		}
+		return p.parseSelector(t.text)
+	}
+	return nil, p.errorf("expected a number, selector, aggregation or function")
+}
+
+func (p *queryParser) parseSelector(name string) (node, error) {
+	s := &selectorNode{name: name}
+	if p.accept("{") {
+		for !p.accept("}") {
+			m, err := p.parseMatcher()
+			if err != nil {
+				return nil, err
+			}
+			s.matchers = append(s.matchers, m)
+			if !p.accept(",") && p.peek().text != "}" {
+				return nil, p.errorf("expected , or }")
+			}
+		}
+	}
+	if s.name == "" && len(s.matchers) == 0 {
+		return nil, p.errorf("selector needs a metric name or a label matcher")
+	}
+
+	if t := p.peek(); t.kind == tokenRange {
+		p.next()
+		d, err := model.ParseDuration(t.text)
+		if err != nil {
+			return nil, fmt.Errorf("invalid query %q: bad range %q", p.expr, t.text)
+		}
+		s.ranged, s.rng = true, time.Duration(d)
+	}
+	return s, nil
+}
+
+func (p *queryParser) parseMatcher() (filter.LabelMatcher, error) {
+	name := p.next()
+	if name.kind != tokenIdent {
+		return filter.LabelMatcher{}, p.errorf("expected label name")
+	}
+
+	op := p.next()
+	switch op.text {
+	case "=", "!=", "=~", "!~":
+	default:
+		return filter.LabelMatcher{}, p.errorf("expected =, !=, =~ or !~")
+	}
+
+	v := p.next()
+	if v.kind != tokenString {
+		return filter.LabelMatcher{}, p.errorf("expected quoted label value")
+	}
+	m, err := filter.NewLabelMatcher(name.text, op.text, v.text)
+	if err != nil {
+		return filter.LabelMatcher{}, fmt.Errorf("invalid query %q: %s", p.expr, err)
+	}
+	return m, nil
+}
+
+func (p *queryParser) parseAggregation(op string) (node, error) {
+	a := &aggregateNode{op: op}
+	if err := p.parseGrouping(a); err != nil {
+		return nil, err
+	}
+	if err := p.expect("("); err != nil {
+		return nil, err
+	}
+	expr, err := p.parseSum()
+	if err != nil {
+		return nil, err
+	}
+	if err := p.expect(")"); err != nil {
+		return nil, err
+	}
+	a.expr = expr
+	// The grouping may also follow the expression, e.g. sum(x) by (code).
+	if a.grouping == nil && !a.without {
+		if err := p.parseGrouping(a); err != nil {
+			return nil, err
+		}
+	}
+	return a, nil
+}
+
+func (p *queryParser) parseGrouping(a *aggregateNode) error {
+	t := p.peek()
+	if t.kind != tokenIdent || (t.text != "by" && t.text != "without") {
+		return nil
+	}
+	p.next()
+	a.without = t.text == "without"
+	a.grouping = []string{}
+	if err := p.expect("("); err != nil {
+		return err
+	}
+	for !p.accept(")") {
+		l := p.next()
+		if l.kind != tokenIdent {
+			return p.errorf("expected label name")
+		}
+		a.grouping = append(a.grouping, l.text)
+		if !p.accept(",") && p.peek().text != ")" {
+			return p.errorf("expected , or )")
+		}
+	}
+	return nil
+}
+
+func (p *queryParser) parseCall(fn string) (node, error) {
+	c := &callNode{fn: fn}
+	if err := p.expect("("); err != nil {
+		return nil, err
+	}
+	for !p.accept(")") {
+		arg, err := p.parseSum()
+		if err != nil {
+			return nil, err
+		}
+		c.args = append(c.args, arg)
+		if !p.accept(",") && p.peek().text != ")" {
+			return nil, p.errorf("expected , or )")
+		}
+	}
+	if len(c.args) != functions[fn] {
+		return nil, fmt.Errorf("invalid query %q: %s expects %d argument(s), got %d", p.expr, fn, functions[fn], len(c.args))
+	}
+	return c, nil
+}
+
+// checkRanges makes sure that range selectors are only used as the
+// argument of rate and increase, and that those get one.
+func checkRanges(n node, rangeAllowed bool) error {
+	switch t := n.(type) {
+	case *selectorNode:
+		if t.ranged && !rangeAllowed {
+			return fmt.Errorf("range selector %s[%s] is only allowed in rate and increase", t.name, model.Duration(t.rng))
+		}
+		if !t.ranged && rangeAllowed {
+			return fmt.Errorf("expected a range selector, e.g. %s[5m]", t.name)
+		}
+	case *aggregateNode:
+		return checkRanges(t.expr, false)
+	case *binaryNode:
+		if err := checkRanges(t.lhs, false); err != nil {
+			return err
+		}
+		return checkRanges(t.rhs, false)
+	case *callNode:
+		if t.fn == "rate" || t.fn == "increase" {
+			if _, ok := t.args[0].(*selectorNode); !ok {
+				return fmt.Errorf("%s expects a range selector, e.g. %s(requests_total[5m])", t.fn, t.fn)
+			}
+			return checkRanges(t.args[0], true)
+		}
+		for _, a := range t.args {
+			if err := checkRanges(a, false); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// longestRange returns the longest range of the range selectors.
+func longestRange(n node) time.Duration {
+	var longest time.Duration
+	switch t := n.(type) {
+	case *selectorNode:
+		longest = t.rng
+	case *aggregateNode:
+		longest = longestRange(t.expr)
+	case *binaryNode:
+		longest = longestRange(t.lhs)
+		if r := longestRange(t.rhs); r > longest {
+			longest = r
+		}
+	case *callNode:
+		for _, a := range t.args {
+			if r := longestRange(a); r > longest {
+				longest = r
+			}
+		}
+	}
+	return longest
+}
+
+func usesRates(n node) bool {
+	switch t := n.(type) {
+	case *aggregateNode:
+		return usesRates(t.expr)
+	case *binaryNode:
+		return usesRates(t.lhs) || usesRates(t.rhs)
+	case *callNode:
+		if t.fn == "rate" || t.fn == "increase" {
+			return true
+		}
+		for _, a := range t.args {
+			if usesRates(a) {
+				return true
+			}
+		}
+	}
+	return false
+}
@@ -0,0 +1,173 @@
+package query
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"sort"
+	"time"
+
+	"github.com/wfernandes/app-metrics-plugin/pkg/agent"
+	"github.com/wfernandes/app-metrics-plugin/pkg/aggregate"
+	"github.com/wfernandes/app-metrics-plugin/pkg/parser"
+)
+
+// Labels every series gets. NameLabel holds the metric name and
+// InstanceLabel the index of the app instance.
+const (
+	NameLabel     = "__name__"
+	InstanceLabel = "instance"
+)
+
+// Query is a parsed expression in a subset of PromQL: selectors with label
+// matchers, the sum, avg, min, max and count aggregations with by and
+// without, the rate, increase and histogram_quantile functions and
+// arithmetic between numbers and vectors.
+type Query struct {
+	expr  string
+	root  node
+	rates bool
+	rng   time.Duration
+}
+
+// Types of results.
+const (
+	TypeScalar = "scalar"
+	TypeVector = "vector"
+)
+
+// Result is the value of a query, either a Scalar or a Vector depending on
+// its Type.
+type Result struct {
+	Type   string
+	Scalar float64
+	Vector []Sample
+}
+
+// MarshalJSON encodes the result as its type and either its scalar or its
+// vector.
+func (r Result) MarshalJSON() ([]byte, error) {
+	if r.Type == TypeScalar {
+		return json.Marshal(struct {
+			Type   string      `json:"type"`
+			Scalar interface{} `json:"scalar"`
+		}{r.Type, jsonFloat(r.Scalar)})
+	}
+	v := r.Vector
+	if v == nil {
+		v = []Sample{}
+	}
+	return json.Marshal(struct {
+		Type   string   `json:"type"`
+		Vector []Sample `json:"vector"`
+	}{r.Type, v})
+}
+
+// Sample is one series of a vector.
+type Sample struct {
+	Labels map[string]string `json:"metric"`
+	Value  float64           `json:"value"`
+}
+
+// MarshalJSON encodes NaN and ±Inf values as strings, like the Prometheus
+// parser does.
+func (s Sample) MarshalJSON() ([]byte, error) {
+	return json.Marshal(struct {
+		Labels map[string]string `json:"metric"`
+		Value  interface{}       `json:"value"`
+	}{s.Labels, jsonFloat(s.Value)})
+}
+
+// Name returns the series name of the sample, e.g. `up{instance="0"}`.
+func (s Sample) Name() string {
+	labels := make(map[string]string, len(s.Labels))
+	for k, v := range s.Labels {
+		if k != NameLabel {
+			labels[k] = v
+		}
+	}
+	if name := aggregate.SeriesKey(s.Labels[NameLabel], labels); name != "" {
+		return name
+	}
+	return "{}"
+}
+
+// Parse parses a query.
+func Parse(expr string) (*Query, error) {
+	p, err := newParser(expr)
+	if err != nil {
+		return nil, err
+	}
+	root, err := p.parse()
+	if err != nil {
+		return nil, err
+	}
+	return &Query{expr: expr, root: root, rates: usesRates(root), rng: longestRange(root)}, nil
+}
+
+// String returns the expression of the query.
+func (q *Query) String() string {
+	return q.expr
+}
+
+// NeedsRates reports whether the query uses rate or increase, which need
+// at least two samples.
+func (q *Query) NeedsRates() bool {
+	return q.rates
+}
+
+// Range returns the longest range of the range selectors of rate and
+// increase, which the samples must span.
+func (q *Query) Range() time.Duration {
+	return q.rng
+}
+
+// Window returns the samples the query needs to be evaluated at the last
+// one: from the latest sample at least the longest range older. It reports
+// false when the samples do not span the range yet.
+func (q *Query) Window(samples []agent.Sample) ([]agent.Sample, bool) {
+	if len(samples) == 0 {
+		return samples, false
+	}
+	if q.rng == 0 {
+		return samples[len(samples)-1:], true
+	}
+	i := startOf(samples, q.rng)
+	if i < 0 {
+		return samples, false
+	}
+	return samples[i:], true
+}
+
+// Eval evaluates the query against the samples. The metrics of every
+// instance are series: Prometheus series by their name and labels, other
+// metrics by their aggregate.Flatten name, e.g. `memstats.HeapInuse`, and
+// every series has an instance label holding the index of the instance.
+// Instant selectors select the series of the last sample. Range selectors
+// also select those of the latest sample at least their range older,
+// which rate and increase compare the last sample with.
+func (q *Query) Eval(samples []agent.Sample) (Result, error) {
+	e := &evaluator{samples: samples}
+	v, err := e.eval(q.root)
+	if err != nil {
+		return Result{}, err
+	}
+
+	switch t := v.(type) {
+	case float64:
+		return Result{Type: TypeScalar, Scalar: t}, nil
+	case vector:
+		sort.Slice(t, func(i, j int) bool {
+			return t[i].Name() < t[j].Name()
+		})
+		return Result{Type: TypeVector, Vector: t}, nil
+	}
+	return Result{}, fmt.Errorf("unexpected result %T", v)
+}
+
+func jsonFloat(f float64) interface{} {
+	if math.IsNaN(f) || math.IsInf(f, 0) {
+		return parser.FormatFloat(f)
+	}
+	return f
+}
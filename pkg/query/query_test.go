@@ -0,0 +1,238 @@
+package query_test
+
+import (
+	"encoding/json"
+	"math"
+	"time"
+
+	"github.com/wfernandes/app-metrics-plugin/pkg/agent"
+	"github.com/wfernandes/app-metrics-plugin/pkg/parser"
+	"github.com/wfernandes/app-metrics-plugin/pkg/query"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Query", func() {
+	requests := func(ok, failed float64) *parser.Family {
+		return &parser.Family{
+			Name: "http_requests_total",
+			Type: "COUNTER",
+			Metrics: []interface{}{
+				parser.Metric{Labels: map[string]string{"code": "200"}, Value: ok},
+				parser.Metric{Labels: map[string]string{"code": "500"}, Value: failed},
+			},
+		}
+	}
+	latency := func(fast, slow uint64) *parser.Family {
+		return &parser.Family{
+			Name: "latency_seconds",
+			Type: "HISTOGRAM",
+			Metrics: []interface{}{
+				parser.Histogram{
+					Buckets: []parser.Bucket{{UpperBound: 0.1, CumulativeCount: fast}, {UpperBound: 1, CumulativeCount: fast + slow}, {UpperBound: math.Inf(1), CumulativeCount: fast + slow}},
+					Count:   fast + slow,
+					Sum:     1,
+				},
+			},
+		}
+	}
+
+	start := time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC)
+	samples := []agent.Sample{
+		{Time: start, Metrics: []agent.InstanceMetric{
+			{Instance: 0, Metrics: map[string]interface{}{"http_requests_total": requests(100, 10), "latency_seconds": latency(10, 0)}},
+			{Instance: 1, Metrics: map[string]interface{}{"http_requests_total": requests(200, 0), "latency_seconds": latency(10, 0)}},
+		}},
+		{Time: start.Add(10 * time.Second), Metrics: []agent.InstanceMetric{
+			{Instance: 0, Metrics: map[string]interface{}{"http_requests_total": requests(150, 20), "latency_seconds": latency(50, 50)}},
+			{Instance: 1, Metrics: map[string]interface{}{"http_requests_total": requests(50, 0), "latency_seconds": latency(50, 50)}},
+		}},
+	}
+	expvar := []agent.Sample{{Time: start, Metrics: []agent.InstanceMetric{
+		{Instance: 0, Metrics: map[string]interface{}{"goroutines": int64(10), "memstats": map[string]interface{}{"HeapInuse": int64(100)}}},
+		{Instance: 1, Metrics: map[string]interface{}{"goroutines": int64(30), "memstats": map[string]interface{}{"HeapInuse": int64(300)}}},
+		{Instance: 2, Error: "connection refused"},
+	}}}
+
+	eval := func(expr string, samples []agent.Sample) query.Result {
+		q, err := query.Parse(expr)
+		Expect(err).ToNot(HaveOccurred())
+		r, err := q.Eval(samples)
+		Expect(err).ToNot(HaveOccurred())
+		return r
+	}
+	vector := func(samples ...query.Sample) query.Result {
+		return query.Result{Type: query.TypeVector, Vector: samples}
+	}
+	labels := func(pairs ...string) map[string]string {
+		l := make(map[string]string)
+		for i := 0; i < len(pairs); i += 2 {
+			l[pairs[i]] = pairs[i+1]
+		}
+		return l
+	}
+
+	It("selects the series of the last sample with label matchers", func() {
+		Expect(eval(`http_requests_total{code="500"}`, samples)).To(Equal(vector(
+			query.Sample{Labels: labels("__name__", "http_requests_total", "code", "500", "instance", "0"), Value: 20},
+			query.Sample{Labels: labels("__name__", "http_requests_total", "code", "500", "instance", "1"), Value: 0},
+		)))
+
+		Expect(eval(`http_requests_total{code!~"2..",instance="0"}`, samples)).To(Equal(vector(
+			query.Sample{Labels: labels("__name__", "http_requests_total", "code", "500", "instance", "0"), Value: 20},
+		)))
+	})
+
+	It("selects flattened expvar metrics by name", func() {
+		Expect(eval(`memstats.HeapInuse`, expvar)).To(Equal(vector(
+			query.Sample{Labels: labels("__name__", "memstats.HeapInuse", "instance", "0"), Value: 100},
+			query.Sample{Labels: labels("__name__", "memstats.HeapInuse", "instance", "1"), Value: 300},
+		)))
+
+		Expect(eval(`{__name__=~"gor.*", instance="1"}`, expvar)).To(Equal(vector(
+			query.Sample{Labels: labels("__name__", "goroutines", "instance", "1"), Value: 30},
+		)))
+	})
+
+	It("aggregates by and without labels", func() {
+		Expect(eval(`sum by (code) (http_requests_total)`, samples)).To(Equal(vector(
+			query.Sample{Labels: labels("code", "200"), Value: 200},
+			query.Sample{Labels: labels("code", "500"), Value: 20},
+		)))
+		Expect(eval(`max(goroutines)`, expvar)).To(Equal(vector(
+			query.Sample{Labels: labels(), Value: 30},
+		)))
+		Expect(eval(`avg without (code) (http_requests_total)`, samples)).To(Equal(vector(
+			query.Sample{Labels: labels("instance", "0"), Value: 85},
+			query.Sample{Labels: labels("instance", "1"), Value: 25},
+		)))
+		Expect(eval(`count(http_requests_total) by (instance)`, samples)).To(Equal(vector(
+			query.Sample{Labels: labels("instance", "0"), Value: 2},
+			query.Sample{Labels: labels("instance", "1"), Value: 2},
+		)))
+	})
+
+	It("computes rates over the range of the selector", func() {
+		Expect(eval(`rate(http_requests_total{code="200"}[10s])`, samples)).To(Equal(vector(
+			query.Sample{Labels: labels("code", "200", "instance", "0"), Value: 5},
+			query.Sample{Labels: labels("code", "200", "instance", "1"), Value: 5},
+		)))
+		Expect(eval(`sum(increase(http_requests_total[10s]))`, samples)).To(Equal(vector(
+			query.Sample{Labels: labels(), Value: 110},
+		)))
+
+		// Only the last sample and the latest one at least 10s older count.
+		later := append(samples, agent.Sample{Time: start.Add(20 * time.Second), Metrics: []agent.InstanceMetric{
+			{Instance: 0, Metrics: map[string]interface{}{"http_requests_total": requests(250, 20)}},
+		}})
+		Expect(eval(`rate(http_requests_total{code="200"}[10s])`, later)).To(Equal(vector(
+			query.Sample{Labels: labels("code", "200", "instance", "0"), Value: 10},
+		)))
+		Expect(eval(`rate(http_requests_total{code="200"}[15s])`, later)).To(Equal(vector(
+			query.Sample{Labels: labels("code", "200", "instance", "0"), Value: 7.5},
+		)))
+	})
+
+	It("returns the samples spanning the range of the query", func() {
+		q, err := query.Parse(`rate(x[10s]) / rate(y[5s])`)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(q.Range()).To(Equal(10 * time.Second))
+
+		window, ok := q.Window(samples[:1])
+		Expect(ok).To(BeFalse())
+		window, ok = q.Window(samples)
+		Expect(ok).To(BeTrue())
+		Expect(window).To(Equal(samples))
+
+		q, err = query.Parse(`sum(x)`)
+		Expect(err).ToNot(HaveOccurred())
+		window, ok = q.Window(samples)
+		Expect(ok).To(BeTrue())
+		Expect(window).To(Equal(samples[1:]))
+	})
+
+	It("returns an error when the range is longer than the samples span", func() {
+		q, err := query.Parse(`rate(http_requests_total[1m])`)
+		Expect(err).ToNot(HaveOccurred())
+
+		_, err = q.Eval(samples)
+		Expect(err).To(MatchError("the range of http_requests_total[1m] is longer than the 10s between the scrapes"))
+	})
+
+	It("estimates quantiles from histogram buckets", func() {
+		Expect(eval(`histogram_quantile(0.5, latency_seconds_bucket{instance="0"})`, samples)).To(Equal(vector(
+			query.Sample{Labels: labels("instance", "0"), Value: 0.1},
+		)))
+		Expect(eval(`histogram_quantile(0.75, sum by (le) (latency_seconds_bucket))`, samples)).To(Equal(vector(
+			query.Sample{Labels: labels(), Value: 0.55},
+		)))
+	})
+
+	It("evaluates arithmetic between scalars and vectors", func() {
+		Expect(eval(`2 * (3 + 4) % 5`, samples)).To(Equal(query.Result{Type: query.TypeScalar, Scalar: 4}))
+
+		Expect(eval(`memstats.HeapInuse / goroutines - 1`, expvar)).To(Equal(vector(
+			query.Sample{Labels: labels("instance", "0"), Value: 9},
+			query.Sample{Labels: labels("instance", "1"), Value: 9},
+		)))
+
+		Expect(eval(`sum(rate(http_requests_total{code="500"}[10s])) / sum(rate(http_requests_total{code="200"}[10s])) * 100`, samples)).To(Equal(vector(
+			query.Sample{Labels: labels(), Value: 10},
+		)))
+	})
+
+	It("returns an error for many-to-one matches between vectors", func() {
+		q, err := query.Parse(`goroutines / {instance="0"}`)
+		Expect(err).ToNot(HaveOccurred())
+		_, err = q.Eval(expvar)
+		Expect(err).To(MatchError(`found duplicate series for the match group {instance="0"} on the right-hand side of /, many-to-one matching is not supported`))
+
+		q, err = query.Parse(`{instance="0"} - goroutines`)
+		Expect(err).ToNot(HaveOccurred())
+		_, err = q.Eval(expvar)
+		Expect(err).To(MatchError(`found duplicate series for the match group {instance="0"} on the left-hand side of -, many-to-one matching is not supported`))
+	})
+
+	It("tells whether the query needs rates", func() {
+		q, err := query.Parse(`sum(rate(x[1m]))`)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(q.NeedsRates()).To(BeTrue())
+
+		q, err = query.Parse(`sum(x)`)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(q.NeedsRates()).To(BeFalse())
+	})
+
+	It("returns an error for invalid queries", func() {
+		for expr, msg := range map[string]string{
+			`sum(`:                  `invalid query "sum(": expected a number, selector, aggregation or function, found end of query`,
+			`x{code=200}`:           `invalid query "x{code=200}": expected quoted label value, found "}" at 10`,
+			`x[5m]`:                 `invalid query "x[5m]": range selector x[5m] is only allowed in rate and increase`,
+			`rate(x)`:               `invalid query "rate(x)": expected a range selector, e.g. x[5m]`,
+			`histogram_quantile(x)`: `invalid query "histogram_quantile(x)": histogram_quantile expects 2 argument(s), got 1`,
+			`x $ 2`:                 `invalid query "x $ 2": unexpected character '$' at 2`,
+		} {
+			_, err := query.Parse(expr)
+			Expect(err).To(MatchError(msg))
+		}
+	})
+
+	It("returns an error when rates have a single sample", func() {
+		q, err := query.Parse(`rate(http_requests_total[1m])`)
+		Expect(err).ToNot(HaveOccurred())
+
+		_, err = q.Eval(samples[:1])
+		Expect(err).To(MatchError("rate and increase need two scrapes, use -rate"))
+	})
+
+	It("encodes results as json", func() {
+		b, err := json.Marshal(eval(`goroutines{instance="0"} / 0`, expvar))
+		Expect(err).ToNot(HaveOccurred())
+		Expect(b).To(MatchJSON(`{"type": "vector", "vector": [{"metric": {"instance": "0"}, "value": "+Inf"}]}`))
+
+		b, err = json.Marshal(eval(`1 / 4`, expvar))
+		Expect(err).ToNot(HaveOccurred())
+		Expect(b).To(MatchJSON(`{"type": "scalar", "scalar": 0.25}`))
+	})
+})
@@ -0,0 +1,135 @@
+package rate
+
+import (
+	"fmt"
+	"path"
+
+	"github.com/wfernandes/app-metrics-plugin/pkg/agent"
+	"github.com/wfernandes/app-metrics-plugin/pkg/aggregate"
+	"github.com/wfernandes/app-metrics-plugin/pkg/parser"
+)
+
+// Reset is a counter that decreased between two samples, usually because
+// the instance restarted.
+type Reset struct {
+	Instance int     `json:"instance"`
+	Metric   string  `json:"metric"`
+	Before   float64 `json:"before"`
+	After    float64 `json:"after"`
+}
+
+// Calculator computes the per-second rates of counters. Prometheus
+// counters, histograms and the sum and count of summaries are always
+// counters. Other metrics, such as expvar Ints, are counters when they
+// match one of the globs given to New.
+type Calculator struct {
+	counters []string
+}
+
+// New returns a Calculator treating the metrics matching the globs as
+// counters. The globs are matched against the metric names used by
+// aggregate.Flatten, e.g. `ingress.*` or `memstats.NumGC`.
+func New(counters []string) (*Calculator, error) {
+	for _, g := range counters {
+		if _, err := path.Match(g, ""); err != nil {
+			return nil, fmt.Errorf("invalid counter glob %q: %s", g, err)
+		}
+	}
+	return &Calculator{counters: counters}, nil
+}
+
+// Rates returns the per-second rate of every counter of each instance
+// between two samples, keyed like aggregate.Flatten. A counter that
+// decreased is reported as a Reset and its rate is computed from zero, like
+// Prometheus does. Instances that failed in either sample get an error.
+func (c *Calculator) Rates(first, second agent.Sample) ([]agent.InstanceMetric, []Reset) {
+	elapsed := second.Time.Sub(first.Time).Seconds()
+
+	previous := make(map[int]agent.InstanceMetric, len(first.Metrics))
+	for _, m := range first.Metrics {
+		previous[m.Instance] = m
+	}
+
+	var resets []Reset
+	rates := make([]agent.InstanceMetric, 0, len(second.Metrics))
+	for _, m := range second.Metrics {
+		before, ok := previous[m.Instance]
+		switch {
+		case m.Metrics == nil:
+			rates = append(rates, agent.InstanceMetric{Instance: m.Instance, Error: m.Error})
+			continue
+		case !ok:
+			rates = append(rates, agent.InstanceMetric{Instance: m.Instance, Error: "instance missing from the first sample"})
+			continue
+		case before.Metrics == nil:
+			rates = append(rates, agent.InstanceMetric{Instance: m.Instance, Error: fmt.Sprintf("first sample failed: %s", before.Error)})
+			continue
+		}
+
+		values := c.Counters(before.Metrics)
+		r := make(map[string]interface{})
+		for k, v := range c.Counters(m.Metrics) {
+			b, ok := values[k]
+			if !ok {
+				continue
+			}
+			increase := v - b
+			if increase < 0 {
+				resets = append(resets, Reset{Instance: m.Instance, Metric: k, Before: b, After: v})
+				increase = v
+			}
+			r[k] = increase / elapsed
+		}
+		rates = append(rates, agent.InstanceMetric{Instance: m.Instance, Metrics: r})
+	}
+
+	return rates, resets
+}
+
+// Counters returns the values of the counters of one instance.
+func (c *Calculator) Counters(metrics map[string]interface{}) map[string]float64 {
+	counters := make(map[string]interface{})
+	for k, v := range metrics {
+		if family, ok := v.(*parser.Family); ok {
+			if f := counterSeries(family); f != nil {
+				counters[k] = f
+			}
+		}
+	}
+	out := aggregate.Flatten(counters)
+
+	if len(c.counters) == 0 {
+		return out
+	}
+	for k, v := range aggregate.Flatten(metrics) {
+		for _, g := range c.counters {
+			if ok, _ := path.Match(g, k); ok {
+				out[k] = v
+				break
+			}
+		}
+	}
+	return out
+}
+
+// counterSeries returns the family with only the series that are counters,
+// or nil if it has none.
+func counterSeries(family *parser.Family) *parser.Family {
+	switch family.Type {
+	case "COUNTER", "HISTOGRAM":
+		return family
+	case "SUMMARY":
+		// Quantiles go up and down, the sum and count do not.
+		f := *family
+		f.Metrics = make([]interface{}, len(family.Metrics))
+		for i, series := range family.Metrics {
+			if s, ok := series.(parser.Summary); ok {
+				s.Quantiles = nil
+				series = s
+			}
+			f.Metrics[i] = series
+		}
+		return &f
+	}
+	return nil
+}
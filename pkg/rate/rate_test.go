@@ -0,0 +1,130 @@
+package rate_test
+
+import (
+	"time"
+
+	"github.com/wfernandes/app-metrics-plugin/pkg/agent"
+	"github.com/wfernandes/app-metrics-plugin/pkg/parser"
+	"github.com/wfernandes/app-metrics-plugin/pkg/rate"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Calculator", func() {
+	var start time.Time
+
+	BeforeEach(func() {
+		start = time.Date(2017, 10, 1, 12, 0, 0, 0, time.UTC)
+	})
+
+	It("computes per-second rates of prometheus counters", func() {
+		family := func(requests, goroutines float64) map[string]interface{} {
+			return map[string]interface{}{
+				"http_requests_total": &parser.Family{
+					Name: "http_requests_total",
+					Type: "COUNTER",
+					Metrics: []interface{}{
+						parser.Metric{Labels: map[string]string{"code": "200"}, Value: requests},
+					},
+				},
+				"go_goroutines": &parser.Family{
+					Name:    "go_goroutines",
+					Type:    "GAUGE",
+					Metrics: []interface{}{parser.Metric{Value: goroutines}},
+				},
+				"rpc_duration_seconds": &parser.Family{
+					Name: "rpc_duration_seconds",
+					Type: "SUMMARY",
+					Metrics: []interface{}{
+						parser.Summary{Quantiles: []parser.Quantile{{Quantile: 0.5, Value: goroutines}}, Count: uint64(requests), Sum: requests / 10},
+					},
+				},
+			}
+		}
+		c, err := rate.New(nil)
+		Expect(err).ToNot(HaveOccurred())
+
+		rates, resets := c.Rates(
+			agent.Sample{Time: start, Metrics: []agent.InstanceMetric{{Instance: 0, Metrics: family(100, 5)}}},
+			agent.Sample{Time: start.Add(10 * time.Second), Metrics: []agent.InstanceMetric{{Instance: 0, Metrics: family(150, 9)}}},
+		)
+
+		Expect(resets).To(BeEmpty())
+		Expect(rates).To(Equal([]agent.InstanceMetric{
+			{Instance: 0, Metrics: map[string]interface{}{
+				`http_requests_total{code="200"}`: 5.0,
+				"rpc_duration_seconds_count":      5.0,
+				"rpc_duration_seconds_sum":        0.5,
+			}},
+		}))
+	})
+
+	It("treats the metrics matching the globs as counters", func() {
+		c, err := rate.New([]string{"ingress.*", "memstats.NumGC"})
+		Expect(err).ToNot(HaveOccurred())
+
+		rates, _ := c.Rates(
+			agent.Sample{Time: start, Metrics: []agent.InstanceMetric{
+				{Instance: 0, Metrics: map[string]interface{}{"ingress.received": int64(1000), "egress.sent": int64(5), "memstats": map[string]interface{}{"NumGC": 10.0}}},
+			}},
+			agent.Sample{Time: start.Add(2 * time.Second), Metrics: []agent.InstanceMetric{
+				{Instance: 0, Metrics: map[string]interface{}{"ingress.received": int64(1500), "egress.sent": int64(9), "memstats": map[string]interface{}{"NumGC": 11.0}}},
+			}},
+		)
+
+		Expect(rates[0].Metrics).To(Equal(map[string]interface{}{
+			"ingress.received": 250.0,
+			"memstats.NumGC":   0.5,
+		}))
+	})
+
+	It("detects counter resets", func() {
+		c, err := rate.New([]string{"requests"})
+		Expect(err).ToNot(HaveOccurred())
+
+		rates, resets := c.Rates(
+			agent.Sample{Time: start, Metrics: []agent.InstanceMetric{
+				{Instance: 0, Metrics: map[string]interface{}{"requests": 100.0}},
+				{Instance: 1, Metrics: map[string]interface{}{"requests": 900.0}},
+			}},
+			agent.Sample{Time: start.Add(4 * time.Second), Metrics: []agent.InstanceMetric{
+				{Instance: 0, Metrics: map[string]interface{}{"requests": 120.0}},
+				{Instance: 1, Metrics: map[string]interface{}{"requests": 8.0}},
+			}},
+		)
+
+		Expect(rates[0].Metrics).To(Equal(map[string]interface{}{"requests": 5.0}))
+		Expect(rates[1].Metrics).To(Equal(map[string]interface{}{"requests": 2.0}))
+		Expect(resets).To(Equal([]rate.Reset{{Instance: 1, Metric: "requests", Before: 900, After: 8}}))
+	})
+
+	It("reports instances that failed in either sample", func() {
+		c, err := rate.New([]string{"requests"})
+		Expect(err).ToNot(HaveOccurred())
+
+		rates, _ := c.Rates(
+			agent.Sample{Time: start, Metrics: []agent.InstanceMetric{
+				{Instance: 0, Error: "connection refused"},
+				{Instance: 1, Metrics: map[string]interface{}{"requests": 1.0}},
+			}},
+			agent.Sample{Time: start.Add(time.Second), Metrics: []agent.InstanceMetric{
+				{Instance: 0, Metrics: map[string]interface{}{"requests": 1.0}},
+				{Instance: 1, Error: "unable to parse response"},
+				{Instance: 2, Metrics: map[string]interface{}{"requests": 1.0}},
+			}},
+		)
+
+		Expect(rates).To(Equal([]agent.InstanceMetric{
+			{Instance: 0, Error: "first sample failed: connection refused"},
+			{Instance: 1, Error: "unable to parse response"},
+			{Instance: 2, Error: "instance missing from the first sample"},
+		}))
+	})
+
+	It("returns an error for invalid globs", func() {
+		_, err := rate.New([]string{"[requests"})
+
+		Expect(err).To(HaveOccurred())
+	})
+})
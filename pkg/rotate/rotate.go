@@ -0,0 +1,176 @@
+package rotate
+
+import (
+	"fmt"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// defaultKeep is the number of rotated files kept when WithKeep is not
+// given.
+const defaultKeep = 5
+
+// sizeUnits are the byte units of sizes, decimal and binary.
+var sizeUnits = map[string]int64{
+	"":    1,
+	"b":   1,
+	"kb":  1e3,
+	"mb":  1e6,
+	"gb":  1e9,
+	"kib": 1 << 10,
+	"mib": 1 << 20,
+	"gib": 1 << 30,
+}
+
+var sizeRegexp = regexp.MustCompile(`^(\d+)\s*([a-zA-Z]*)$`)
+
+// ParseSize parses a number of bytes with an optional byte unit, e.g. 10MiB
+// or 500KB.
+func ParseSize(s string) (int64, error) {
+	m := sizeRegexp.FindStringSubmatch(strings.TrimSpace(s))
+	if m == nil {
+		return 0, fmt.Errorf("invalid size %q, expected e.g. 10MiB", s)
+	}
+	unit, ok := sizeUnits[strings.ToLower(m[2])]
+	if !ok {
+		return 0, fmt.Errorf("invalid size %q, unknown unit %q, expected B, KB, MB, GB, KiB, MiB or GiB", s, m[2])
+	}
+	n, err := strconv.ParseInt(m[1], 10, 64)
+	if err != nil || n > (1<<63-1)/unit {
+		return 0, fmt.Errorf("invalid size %q, too large", s)
+	}
+	return n * unit, nil
+}
+
+type FileOpt func(*File)
+
+// WithMaxSize rotates the file before it would grow past n bytes. Zero,
+// the default, never rotates.
+func WithMaxSize(n int64) FileOpt {
+	return func(f *File) {
+		f.maxSize = n
+	}
+}
+
+// WithKeep sets the number of rotated files that are kept.
+func WithKeep(n int) FileOpt {
+	return func(f *File) {
+		f.keep = n
+	}
+}
+
+// File is a file that is rotated once it grows past a maximum size: it is
+// renamed to PATH.1, the older files shift to PATH.2 and so on, and writing
+// continues in a new file at PATH.
+type File struct {
+	path    string
+	maxSize int64
+	keep    int
+	file    *os.File
+	size    int64
+}
+
+// Open creates the file at path, truncating it if it exists.
+func Open(path string, opts ...FileOpt) (*File, error) {
+	f := &File{
+		path: path,
+		keep: defaultKeep,
+	}
+
+	for _, o := range opts {
+		o(f)
+	}
+
+	file, err := os.Create(path)
+	if err != nil {
+		return nil, err
+	}
+	f.file = file
+	return f, nil
+}
+
+// Path returns the path the file is written to.
+func (f *File) Path() string {
+	return f.path
+}
+
+// Size returns the number of bytes written since the file was started.
+func (f *File) Size() int64 {
+	return f.size
+}
+
+// Exceeds reports whether content of n bytes is larger than the maximum
+// size.
+func (f *File) Exceeds(n int64) bool {
+	return f.maxSize > 0 && n > f.maxSize
+}
+
+// Write appends p, rotating the file first when it is not empty and p would
+// make it exceed the maximum size. Records written with a single call are
+// never split across files.
+func (f *File) Write(p []byte) (int, error) {
+	if f.size > 0 && f.Exceeds(f.size+int64(len(p))) {
+		if err := f.Rotate(); err != nil {
+			return 0, err
+		}
+	}
+	n, err := f.file.Write(p)
+	f.size += int64(n)
+	return n, err
+}
+
+// Replace replaces the content of the file with p, for files that are
+// rewritten as a whole.
+func (f *File) Replace(p []byte) error {
+	err := f.file.Truncate(0)
+	if err != nil {
+		return err
+	}
+	_, err = f.file.Seek(0, 0)
+	if err != nil {
+		return err
+	}
+	f.size = 0
+	_, err = f.Write(p)
+	return err
+}
+
+// Rotate renames the file to PATH.1, shifting older files and removing the
+// oldest, and starts a new file.
+func (f *File) Rotate() error {
+	err := f.file.Close()
+	if err != nil {
+		return err
+	}
+
+	if f.keep > 0 {
+		for i := f.keep - 1; i > 0; i-- {
+			err = os.Rename(f.rotated(i), f.rotated(i+1))
+			if err != nil && !os.IsNotExist(err) {
+				return err
+			}
+		}
+		err = os.Rename(f.path, f.rotated(1))
+		if err != nil {
+			return err
+		}
+	}
+
+	f.file, err = os.Create(f.path)
+	if err != nil {
+		return err
+	}
+	f.size = 0
+	return nil
+}
+
+// Close closes the file.
+func (f *File) Close() error {
+	return f.file.Close()
+}
+
+func (f *File) rotated(i int) string {
+	return fmt.Sprintf("%s.%d", f.path, i)
+}
@@ -0,0 +1,108 @@
+package rotate_test
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	"github.com/wfernandes/app-metrics-plugin/pkg/rotate"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Rotate", func() {
+	var (
+		dir  string
+		path string
+	)
+
+	BeforeEach(func() {
+		var err error
+		dir, err = ioutil.TempDir("", "rotate")
+		Expect(err).ToNot(HaveOccurred())
+		path = filepath.Join(dir, "metrics.ndjson")
+	})
+
+	AfterEach(func() {
+		os.RemoveAll(dir)
+	})
+
+	var read = func(path string) string {
+		b, err := ioutil.ReadFile(path)
+		Expect(err).ToNot(HaveOccurred())
+		return string(b)
+	}
+
+	It("appends without rotating when there is no maximum size", func() {
+		f, err := rotate.Open(path)
+		Expect(err).ToNot(HaveOccurred())
+		for i := 0; i < 3; i++ {
+			_, err = f.Write([]byte("record\n"))
+			Expect(err).ToNot(HaveOccurred())
+		}
+		Expect(f.Close()).To(Succeed())
+
+		Expect(read(path)).To(Equal("record\nrecord\nrecord\n"))
+		Expect(path + ".1").ToNot(BeAnExistingFile())
+	})
+
+	It("rotates before a write would exceed the maximum size and keeps whole records", func() {
+		f, err := rotate.Open(path, rotate.WithMaxSize(11), rotate.WithKeep(2))
+		Expect(err).ToNot(HaveOccurred())
+		for _, r := range []string{"one\n", "two\n", "three\n", "four\n", "a record longer than the maximum\n"} {
+			_, err = f.Write([]byte(r))
+			Expect(err).ToNot(HaveOccurred())
+		}
+		Expect(f.Close()).To(Succeed())
+
+		Expect(read(path)).To(Equal("a record longer than the maximum\n"))
+		Expect(read(path + ".1")).To(Equal("three\nfour\n"))
+		Expect(read(path + ".2")).To(Equal("one\ntwo\n"))
+		Expect(path + ".3").ToNot(BeAnExistingFile())
+	})
+
+	It("replaces the content of files rewritten as a whole", func() {
+		f, err := rotate.Open(path, rotate.WithMaxSize(10))
+		Expect(err).ToNot(HaveOccurred())
+		Expect(f.Replace([]byte("first version"))).To(Succeed())
+		Expect(f.Replace([]byte("second"))).To(Succeed())
+		Expect(f.Size()).To(BeEquivalentTo(6))
+		Expect(f.Exceeds(11)).To(BeTrue())
+		Expect(f.Exceeds(10)).To(BeFalse())
+		Expect(f.Close()).To(Succeed())
+
+		Expect(read(path)).To(Equal("second"))
+	})
+
+	It("parses sizes with byte units", func() {
+		for s, n := range map[string]int64{"512": 512, "100B": 100, "10kb": 10000, "2MB": 2e6, "1GB": 1e9, "4KiB": 4096, "10MiB": 10 << 20, "1 GiB": 1 << 30} {
+			size, err := rotate.ParseSize(s)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(size).To(Equal(n), s)
+		}
+
+		for s, msg := range map[string]string{
+			"10M":   `invalid size "10M", unknown unit "M", expected B, KB, MB, GB, KiB, MiB or GiB`,
+			"1e3":   `invalid size "1e3", expected e.g. 10MiB`,
+			"1.5MB": `invalid size "1.5MB", expected e.g. 10MiB`,
+			"-1":    `invalid size "-1", expected e.g. 10MiB`,
+		} {
+			_, err := rotate.ParseSize(s)
+			Expect(err).To(MatchError(msg))
+		}
+	})
+
+	It("truncates the file instead when no rotated files are kept", func() {
+		f, err := rotate.Open(path, rotate.WithMaxSize(4), rotate.WithKeep(0))
+		Expect(err).ToNot(HaveOccurred())
+		_, err = f.Write([]byte("one\n"))
+		Expect(err).ToNot(HaveOccurred())
+		_, err = f.Write([]byte("two\n"))
+		Expect(err).ToNot(HaveOccurred())
+		Expect(f.Close()).To(Succeed())
+
+		Expect(read(path)).To(Equal("two\n"))
+		Expect(path + ".1").ToNot(BeAnExistingFile())
+	})
+})
@@ -0,0 +1,158 @@
+package snapshot
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"time"
+
+	"github.com/wfernandes/app-metrics-plugin/pkg/agent"
+	"github.com/wfernandes/app-metrics-plugin/pkg/parser"
+)
+
+// Version is the version of the snapshot file format written by Save.
+// Load refuses snapshots written with a newer version.
+const Version = 1
+
+// Snapshot is a saved scrape of all the instances of an app. It holds a
+// single sample, or two when counter rates were requested. MemStats tells
+// that the expvar memstats were summarized with parser.WithMemStatsSummary.
+type Snapshot struct {
+	App      App
+	Time     time.Time
+	Format   string
+	Path     string
+	MemStats bool
+	Samples  []agent.Sample
+}
+
+// App identifies the app the snapshot was taken from.
+type App struct {
+	Name  string `json:"name"`
+	Guid  string `json:"guid"`
+	Org   string `json:"org,omitempty"`
+	Space string `json:"space,omitempty"`
+}
+
+// file is the json layout of a snapshot.
+type file struct {
+	Version  int       `json:"version"`
+	App      App       `json:"app"`
+	Time     time.Time `json:"time"`
+	Format   string    `json:"format"`
+	Path     string    `json:"path,omitempty"`
+	MemStats bool      `json:"memstats,omitempty"`
+	Samples  []sample  `json:"samples"`
+}
+
+type sample struct {
+	Time      time.Time  `json:"time"`
+	Instances []instance `json:"instances"`
+}
+
+type instance struct {
+	Instance int             `json:"instance"`
+	Error    string          `json:"error,omitempty"`
+	Metrics  json.RawMessage `json:"metrics,omitempty"`
+}
+
+// Save writes the snapshot as indented json.
+func Save(w io.Writer, s *Snapshot) error {
+	f := file{
+		Version:  Version,
+		App:      s.App,
+		Time:     s.Time,
+		Format:   s.Format,
+		Path:     s.Path,
+		MemStats: s.MemStats,
+		Samples:  make([]sample, len(s.Samples)),
+	}
+	for i, smp := range s.Samples {
+		f.Samples[i] = sample{Time: smp.Time, Instances: make([]instance, len(smp.Metrics))}
+		for j, m := range smp.Metrics {
+			inst := instance{Instance: m.Instance, Error: m.Error}
+			if m.Metrics != nil {
+				b, err := json.Marshal(m.Metrics)
+				if err != nil {
+					return fmt.Errorf("unable to encode the metrics of instance %d: %s", m.Instance, err)
+				}
+				inst.Metrics = b
+			}
+			f.Samples[i].Instances[j] = inst
+		}
+	}
+
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	return enc.Encode(f)
+}
+
+// Load reads a snapshot written by Save. The metrics are decoded into the
+// same types the parser of the snapshot format returns, so they can be
+// filtered and analyzed like metrics that were just scraped.
+func Load(r io.Reader) (*Snapshot, error) {
+	var f file
+	err := json.NewDecoder(r).Decode(&f)
+	if err != nil {
+		return nil, fmt.Errorf("unable to decode snapshot: %s", err)
+	}
+	if f.Version < 1 || f.Version > Version {
+		return nil, fmt.Errorf("unsupported snapshot version %d, expected %d", f.Version, Version)
+	}
+	if len(f.Samples) == 0 {
+		return nil, fmt.Errorf("snapshot has no samples")
+	}
+
+	s := &Snapshot{
+		App:      f.App,
+		Time:     f.Time,
+		Format:   f.Format,
+		Path:     f.Path,
+		MemStats: f.MemStats,
+		Samples:  make([]agent.Sample, len(f.Samples)),
+	}
+	for i, smp := range f.Samples {
+		s.Samples[i] = agent.Sample{Time: smp.Time, Metrics: make([]agent.InstanceMetric, len(smp.Instances))}
+		for j, inst := range smp.Instances {
+			m := agent.InstanceMetric{Instance: inst.Instance, Error: inst.Error}
+			if len(inst.Metrics) > 0 {
+				m.Metrics, err = decodeMetrics(f.Format, f.MemStats, inst.Metrics)
+				if err != nil {
+					return nil, fmt.Errorf("unable to decode the metrics of instance %d: %s", inst.Instance, err)
+				}
+			}
+			s.Samples[i].Metrics[j] = m
+		}
+	}
+	return s, nil
+}
+
+// decodeMetrics decodes expvar metrics like the expvar parser does, with
+// the types of the memstats summary, and the metrics of any other format as
+// metric families. Values that are not families are kept as decoded by the
+// expvar parser.
+func decodeMetrics(format string, memStats bool, b []byte) (map[string]interface{}, error) {
+	metrics, err := parser.NewExpvar().Parse(b)
+	if err != nil {
+		return nil, err
+	}
+	if format == parser.FormatExpvar {
+		if summary, ok := metrics["memstats"].(map[string]interface{}); ok && memStats {
+			parser.RestoreMemStatsSummary(summary)
+		}
+		return metrics, nil
+	}
+
+	var raw map[string]json.RawMessage
+	err = json.Unmarshal(b, &raw)
+	if err != nil {
+		return nil, err
+	}
+	for k, v := range raw {
+		var family parser.Family
+		if json.Unmarshal(v, &family) == nil && family.Name != "" {
+			metrics[k] = &family
+		}
+	}
+	return metrics, nil
+}
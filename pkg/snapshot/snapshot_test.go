@@ -0,0 +1,136 @@
+package snapshot_test
+
+import (
+	"bytes"
+	"math"
+	"strings"
+	"time"
+
+	"github.com/wfernandes/app-metrics-plugin/pkg/agent"
+	"github.com/wfernandes/app-metrics-plugin/pkg/parser"
+	"github.com/wfernandes/app-metrics-plugin/pkg/snapshot"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Snapshot", func() {
+	var start time.Time
+
+	BeforeEach(func() {
+		start = time.Date(2017, 10, 1, 12, 0, 0, 0, time.UTC)
+	})
+
+	It("saves and loads expvar metrics", func() {
+		s := &snapshot.Snapshot{
+			App:    snapshot.App{Name: "some-app", Guid: "some-guid", Org: "some-org", Space: "some-space"},
+			Time:   start,
+			Format: parser.FormatExpvar,
+			Path:   "/debug/metrics",
+			Samples: []agent.Sample{{Time: start, Metrics: []agent.InstanceMetric{
+				{Instance: 0, Metrics: map[string]interface{}{
+					"ingress": map[string]interface{}{"received": int64(9007199254740993)},
+					"ratio":   0.5,
+				}},
+				{Instance: 1, Error: "connection refused"},
+			}}},
+		}
+
+		var buf bytes.Buffer
+		Expect(snapshot.Save(&buf, s)).To(Succeed())
+		Expect(buf.String()).To(ContainSubstring(`"version": 1`))
+
+		loaded, err := snapshot.Load(&buf)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(loaded).To(Equal(s))
+	})
+
+	It("loads the memstats summary with its types", func() {
+		metrics, err := parser.NewExpvar(parser.WithMemStatsSummary()).Parse([]byte(`{"goroutines": 12, "memstats": {"HeapInuse": 2211840, "HeapObjects": 11469, "NumGC": 1, "PauseTotalNs": 1500, "PauseNs": [1500, 0], "GCCPUFraction": 0.5}}`))
+		Expect(err).ToNot(HaveOccurred())
+		s := &snapshot.Snapshot{
+			Time:     start,
+			Format:   parser.FormatExpvar,
+			MemStats: true,
+			Samples:  []agent.Sample{{Time: start, Metrics: []agent.InstanceMetric{{Instance: 0, Metrics: metrics}}}},
+		}
+
+		var buf bytes.Buffer
+		Expect(snapshot.Save(&buf, s)).To(Succeed())
+		loaded, err := snapshot.Load(&buf)
+		Expect(err).ToNot(HaveOccurred())
+		summary := loaded.Samples[0].Metrics[0].Metrics["memstats"].(map[string]interface{})
+		Expect(summary["heap_inuse"]).To(Equal(parser.Bytes(2211840)))
+		Expect(summary["last_pause"]).To(Equal(1500 * time.Nanosecond))
+		Expect(loaded).To(Equal(s))
+	})
+
+	It("loads metric families with their types", func() {
+		s := &snapshot.Snapshot{
+			Time:   start,
+			Format: parser.FormatPrometheus,
+			Samples: []agent.Sample{{Time: start, Metrics: []agent.InstanceMetric{
+				{Instance: 0, Metrics: map[string]interface{}{
+					"temperature": &parser.Family{
+						Name: "temperature",
+						Type: "GAUGE",
+						Metrics: []interface{}{
+							parser.Metric{Labels: map[string]string{"sensor": "a"}, Value: math.Inf(1)},
+						},
+					},
+					"latency_seconds": &parser.Family{
+						Name: "latency_seconds",
+						Type: "HISTOGRAM",
+						Metrics: []interface{}{
+							parser.Histogram{
+								Buckets: []parser.Bucket{{UpperBound: 0.1, CumulativeCount: 3}, {UpperBound: math.Inf(1), CumulativeCount: 4}},
+								Count:   4,
+								Sum:     0.5,
+							},
+						},
+					},
+				}},
+			}}},
+		}
+
+		var buf bytes.Buffer
+		Expect(snapshot.Save(&buf, s)).To(Succeed())
+		loaded, err := snapshot.Load(&buf)
+		Expect(err).ToNot(HaveOccurred())
+
+		metrics := loaded.Samples[0].Metrics[0].Metrics
+		Expect(metrics["temperature"]).To(Equal(s.Samples[0].Metrics[0].Metrics["temperature"]))
+		Expect(metrics["latency_seconds"]).To(Equal(s.Samples[0].Metrics[0].Metrics["latency_seconds"]))
+	})
+
+	It("keeps every sample", func() {
+		s := &snapshot.Snapshot{
+			Time:   start,
+			Format: parser.FormatExpvar,
+			Samples: []agent.Sample{
+				{Time: start, Metrics: []agent.InstanceMetric{{Instance: 0, Metrics: map[string]interface{}{"requests": int64(1)}}}},
+				{Time: start.Add(10 * time.Second), Metrics: []agent.InstanceMetric{{Instance: 0, Metrics: map[string]interface{}{"requests": int64(2)}}}},
+			},
+		}
+
+		var buf bytes.Buffer
+		Expect(snapshot.Save(&buf, s)).To(Succeed())
+		loaded, err := snapshot.Load(&buf)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(loaded.Samples).To(Equal(s.Samples))
+	})
+
+	It("refuses snapshots of a newer version", func() {
+		_, err := snapshot.Load(strings.NewReader(`{"version": 2, "format": "expvar", "samples": [{"instances": []}]}`))
+
+		Expect(err).To(MatchError("unsupported snapshot version 2, expected 1"))
+	})
+
+	It("returns an error for files that are not snapshots", func() {
+		_, err := snapshot.Load(strings.NewReader(`{"Instance": 0}`))
+		Expect(err).To(MatchError("unsupported snapshot version 0, expected 1"))
+
+		_, err = snapshot.Load(strings.NewReader(`not json`))
+		Expect(err).To(MatchError(HavePrefix("unable to decode snapshot")))
+	})
+})
@@ -0,0 +1,187 @@
+package top
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"strings"
+
+	"github.com/wfernandes/app-metrics-plugin/pkg/agent"
+)
+
+// Key is a key binding of the dashboard.
+type Key int
+
+const (
+	KeyNone Key = iota
+	KeyUp
+	KeyDown
+	KeyLeft
+	KeyRight
+	KeyEnter
+	KeyBack
+	KeyReverse
+	KeyQuit
+)
+
+// Escape sequences switching to the alternate screen of the terminal,
+// hiding the cursor and clearing the screen.
+const (
+	enterScreen = "\x1b[?1049h\x1b[?25l"
+	exitScreen  = "\x1b[?25h\x1b[?1049l"
+	clearScreen = "\x1b[H\x1b[2J"
+)
+
+// ParseKeys returns the key bindings of the bytes read from a terminal.
+// Arrow keys are read from their escape sequences, and a lone escape goes
+// back.
+func ParseKeys(b []byte) []Key {
+	var keys []Key
+	for len(b) > 0 {
+		if b[0] == 0x1b && len(b) >= 3 && (b[1] == '[' || b[1] == 'O') {
+			switch b[2] {
+			case 'A':
+				keys = append(keys, KeyUp)
+			case 'B':
+				keys = append(keys, KeyDown)
+			case 'C':
+				keys = append(keys, KeyRight)
+			case 'D':
+				keys = append(keys, KeyLeft)
+			}
+			b = b[3:]
+			continue
+		}
+
+		switch b[0] {
+		case 'k':
+			keys = append(keys, KeyUp)
+		case 'j':
+			keys = append(keys, KeyDown)
+		case 'h':
+			keys = append(keys, KeyLeft)
+		case 'l':
+			keys = append(keys, KeyRight)
+		case '\r', '\n':
+			keys = append(keys, KeyEnter)
+		case 0x1b, 0x7f, 'b':
+			keys = append(keys, KeyBack)
+		case 'r':
+			keys = append(keys, KeyReverse)
+		case 'q', 'Q', 0x03:
+			keys = append(keys, KeyQuit)
+		}
+		b = b[1:]
+	}
+	return keys
+}
+
+// ReadKeys sends the key bindings read from r until it is closed.
+func ReadKeys(r io.Reader) <-chan Key {
+	keys := make(chan Key)
+	go func() {
+		defer close(keys)
+		buf := make([]byte, 64)
+		for {
+			n, err := r.Read(buf)
+			for _, k := range ParseKeys(buf[:n]) {
+				keys <- k
+			}
+			if err != nil {
+				return
+			}
+		}
+	}()
+	return keys
+}
+
+// IsTerminal reports whether f is a terminal rather than a file or a pipe.
+func IsTerminal(f *os.File) bool {
+	info, err := f.Stat()
+	return err == nil && info.Mode()&os.ModeCharDevice != 0
+}
+
+// Terminal reads keys as they are pressed, without echoing them, from the
+// terminal of stdin. It relies on stty, so where stty is not available
+// keys are only read after enter.
+type Terminal struct {
+	state string
+}
+
+// OpenTerminal switches the terminal of stdin to read keys as they are
+// pressed. Close restores it.
+func OpenTerminal() (*Terminal, error) {
+	state, err := stty("-g")
+	if err != nil {
+		return nil, err
+	}
+	_, err = stty("-icanon", "-echo", "min", "1")
+	if err != nil {
+		return nil, err
+	}
+	return &Terminal{state: state}, nil
+}
+
+// Size returns the width and height of the terminal, or zero when they
+// are not known.
+func (t *Terminal) Size() (int, int) {
+	size, err := stty("size")
+	if err != nil {
+		return 0, 0
+	}
+	var height, width int
+	_, err = fmt.Sscan(size, &height, &width)
+	if err != nil {
+		return 0, 0
+	}
+	return width, height
+}
+
+// Close restores the terminal to the state it was opened in.
+func (t *Terminal) Close() error {
+	_, err := stty(t.state)
+	return err
+}
+
+func stty(args ...string) (string, error) {
+	cmd := exec.Command("stty", args...)
+	cmd.Stdin = os.Stdin
+	out, err := cmd.Output()
+	if err != nil {
+		return "", fmt.Errorf("unable to set up terminal: %s", err)
+	}
+	return strings.TrimSpace(string(out)), nil
+}
+
+// Run shows the dashboard full screen on out, redrawing it for every sample
+// and key until q is pressed, the keys are closed or the context is done.
+// The size function is asked for the size of the terminal before every
+// redraw so the dashboard follows resizes.
+func Run(ctx context.Context, d *Dashboard, samples <-chan agent.Sample, keys <-chan Key, size func() (int, int), out io.Writer) error {
+	_, err := fmt.Fprint(out, enterScreen)
+	if err != nil {
+		return err
+	}
+	defer fmt.Fprint(out, exitScreen)
+
+	for {
+		d.SetSize(size())
+		_, err = fmt.Fprint(out, clearScreen+d.Render())
+		if err != nil {
+			return err
+		}
+
+		select {
+		case s := <-samples:
+			d.Update(s)
+		case k, ok := <-keys:
+			if !ok || !d.Press(k) {
+				return nil
+			}
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
@@ -0,0 +1,466 @@
+package top
+
+import (
+	"fmt"
+	"math"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/wfernandes/app-metrics-plugin/pkg/agent"
+	"github.com/wfernandes/app-metrics-plugin/pkg/aggregate"
+)
+
+const (
+	// defaultHistory is the number of recent values kept for the sparklines.
+	defaultHistory = 10
+	// maxHeaderWidth is the width metric names are truncated to in the
+	// header.
+	maxHeaderWidth = 30
+	// instanceColumn names the first column, which sorts by instance index.
+	instanceColumn = "INSTANCE"
+	// missingValue fills the cells of metrics an instance does not have.
+	missingValue = "-"
+	// gap is drawn in sparklines for NaN and infinite values, which have no
+	// height.
+	gap = '·'
+)
+
+// sparks are the bars of the sparklines, from the lowest value to the
+// highest.
+var sparks = []rune("▁▂▃▄▅▆▇█")
+
+// keyHelp lists the key bindings below the interactive dashboard.
+const keyHelp = "↑/k ↓/j select  ←/h →/l sort column  r reverse  enter details  esc back  q quit"
+
+type DashboardOpt func(*Dashboard)
+
+// WithTitle is shown at the top of the dashboard, e.g. the name of the app.
+func WithTitle(t string) DashboardOpt {
+	return func(d *Dashboard) {
+		d.title = t
+	}
+}
+
+// WithColumns chooses the metrics shown as columns with globs matching
+// their aggregate.Flatten keys. Columns follow the order of the globs, and
+// every numeric metric is shown when there are none.
+func WithColumns(globs []string) DashboardOpt {
+	return func(d *Dashboard) {
+		d.columns = globs
+	}
+}
+
+// WithHistory sets the number of recent values shown in the sparklines.
+func WithHistory(n int) DashboardOpt {
+	return func(d *Dashboard) {
+		d.history = n
+	}
+}
+
+// WithInteractive marks the selected instance and lists the key bindings,
+// for dashboards driven with Press.
+func WithInteractive() DashboardOpt {
+	return func(d *Dashboard) {
+		d.interactive = true
+	}
+}
+
+// Dashboard shows the latest metrics of every instance as a row, with a
+// sparkline of the recent values of each metric. It can be sorted by any
+// column and drilled into to show every metric of one instance.
+type Dashboard struct {
+	title       string
+	columns     []string
+	history     int
+	interactive bool
+	width       int
+	height      int
+
+	time      time.Time
+	instances []agent.InstanceMetric
+	values    map[int]map[string][]float64
+
+	sort     int
+	desc     bool
+	selected int
+	detail   bool
+	offset   int
+}
+
+func New(opts ...DashboardOpt) *Dashboard {
+	d := &Dashboard{
+		history: defaultHistory,
+		values:  make(map[int]map[string][]float64),
+	}
+
+	for _, o := range opts {
+		o(d)
+	}
+
+	return d
+}
+
+// SetSize sets the size the dashboard is rendered in. Zero means no limit.
+func (d *Dashboard) SetSize(width, height int) {
+	d.width, d.height = width, height
+}
+
+// Update adds a sample, keeping the recent values of every numeric metric.
+// Metrics an instance no longer has are forgotten.
+func (d *Dashboard) Update(s agent.Sample) {
+	d.time = s.Time
+	d.instances = s.Metrics
+	for _, i := range s.Metrics {
+		if i.Metrics == nil {
+			continue
+		}
+		values, ok := d.values[i.Instance]
+		if !ok {
+			values = make(map[string][]float64)
+			d.values[i.Instance] = values
+		}
+		flat := aggregate.Flatten(i.Metrics)
+		for k := range values {
+			if _, ok := flat[k]; !ok {
+				delete(values, k)
+			}
+		}
+		for k, f := range flat {
+			v := append(values[k], f)
+			if len(v) > d.history {
+				v = v[len(v)-d.history:]
+			}
+			values[k] = v
+		}
+	}
+	d.selected = max(min(d.selected, len(d.instances)-1), 0)
+	if len(d.instances) == 0 {
+		d.detail = false
+	}
+}
+
+// Press handles a key and reports whether the dashboard is still shown.
+func (d *Dashboard) Press(k Key) bool {
+	switch k {
+	case KeyQuit:
+		return false
+	case KeyUp:
+		if d.detail {
+			d.offset = max(d.offset-1, 0)
+		} else {
+			d.selected = max(d.selected-1, 0)
+		}
+	case KeyDown:
+		if d.detail {
+			d.offset++
+		} else {
+			d.selected = min(d.selected+1, len(d.instances)-1)
+		}
+	case KeyLeft:
+		d.sort = max(d.sort-1, 0)
+	case KeyRight:
+		d.sort = min(d.sort+1, len(d.metrics()))
+	case KeyReverse:
+		d.desc = !d.desc
+	case KeyEnter:
+		if len(d.instances) > 0 {
+			d.detail, d.offset = true, 0
+		}
+	case KeyBack:
+		d.detail = false
+	}
+	return true
+}
+
+// Render returns the dashboard, or the metrics of the selected instance
+// after it was drilled into.
+func (d *Dashboard) Render() string {
+	var lines []string
+	if d.detail {
+		lines = d.renderDetail()
+	} else {
+		lines = d.renderTable()
+	}
+	if d.interactive {
+		lines = append(lines, "", truncate(keyHelp, d.width))
+	}
+	return strings.Join(lines, "\n") + "\n"
+}
+
+// metrics returns the keys of the metric columns.
+func (d *Dashboard) metrics() []string {
+	names := make(map[string]bool)
+	for _, i := range d.instances {
+		for k := range d.values[i.Instance] {
+			names[k] = true
+		}
+	}
+	all := make([]string, 0, len(names))
+	for k := range names {
+		all = append(all, k)
+	}
+	sort.Strings(all)
+	if len(d.columns) == 0 {
+		return all
+	}
+
+	var chosen []string
+	seen := make(map[string]bool)
+	for _, g := range d.columns {
+		for _, k := range all {
+			if ok, _ := path.Match(g, k); ok && !seen[k] {
+				chosen = append(chosen, k)
+				seen[k] = true
+			}
+		}
+	}
+	return chosen
+}
+
+// rows returns the instances in the order of the sort column.
+func (d *Dashboard) rows(metrics []string) []agent.InstanceMetric {
+	rows := append([]agent.InstanceMetric(nil), d.instances...)
+	if d.sort == 0 || d.sort > len(metrics) {
+		sort.SliceStable(rows, func(i, j int) bool {
+			if d.desc {
+				return rows[i].Instance > rows[j].Instance
+			}
+			return rows[i].Instance < rows[j].Instance
+		})
+		return rows
+	}
+
+	metric := metrics[d.sort-1]
+	sort.SliceStable(rows, func(i, j int) bool {
+		a, okA := d.latest(rows[i], metric)
+		b, okB := d.latest(rows[j], metric)
+		if !okA || !okB {
+			// Missing values always come last.
+			return okA && !okB
+		}
+		if d.desc {
+			return a > b
+		}
+		return a < b
+	})
+	return rows
+}
+
+// latest returns the last value of a metric of an instance that was
+// scraped.
+func (d *Dashboard) latest(i agent.InstanceMetric, metric string) (float64, bool) {
+	if i.Metrics == nil {
+		return 0, false
+	}
+	v := d.values[i.Instance][metric]
+	if len(v) == 0 {
+		return 0, false
+	}
+	return v[len(v)-1], true
+}
+
+func (d *Dashboard) heading(what string) string {
+	parts := []string{}
+	if d.title != "" {
+		parts = append(parts, d.title)
+	}
+	parts = append(parts, what)
+	if !d.time.IsZero() {
+		parts = append(parts, "updated "+d.time.Format("15:04:05"))
+	}
+	return truncate(strings.Join(parts, "  "), d.width)
+}
+
+func (d *Dashboard) renderTable() []string {
+	metrics := d.metrics()
+	rows := d.rows(metrics)
+
+	header := []string{instanceColumn}
+	for _, m := range metrics {
+		header = append(header, truncate(m, maxHeaderWidth))
+	}
+	arrow := "▲"
+	if d.desc {
+		arrow = "▼"
+	}
+	if d.sort < len(header) {
+		header[d.sort] += " " + arrow
+	}
+
+	cells := [][]string{header}
+	var failures []string
+	for _, i := range rows {
+		row := []string{strconv.Itoa(i.Instance)}
+		if i.Metrics == nil {
+			failures = append(failures, fmt.Sprintf("Instance %d: %s", i.Instance, i.Error))
+		}
+		for _, m := range metrics {
+			row = append(row, d.cell(i, m))
+		}
+		cells = append(cells, row)
+	}
+
+	widths := make([]int, len(header))
+	for _, r := range cells {
+		for c, s := range r {
+			widths[c] = max(widths[c], utf8.RuneCountInString(s))
+		}
+	}
+	// Drop the last columns that do not fit.
+	shown, total := len(widths), 0
+	if d.interactive {
+		// The selection marker takes two characters.
+		total = 2
+	}
+	for c, w := range widths {
+		total += w + 2
+		if d.width > 0 && total-2 > d.width && c > 0 {
+			shown = c
+			break
+		}
+	}
+
+	lines := []string{d.heading(fmt.Sprintf("%d instances", len(d.instances))), ""}
+	visible := len(rows)
+	if d.height > 0 {
+		// The heading, the header, the failures and the key bindings take
+		// the other lines.
+		visible = max(d.height-6-len(failures), 1)
+	}
+	start := 0
+	if d.interactive && d.selected >= visible {
+		start = d.selected - visible + 1
+	}
+	for r, row := range cells {
+		if r > 0 && (r-1 < start || r-1 >= start+visible) {
+			continue
+		}
+		var b strings.Builder
+		if d.interactive {
+			if r > 0 && r-1 == d.selected {
+				b.WriteString("> ")
+			} else {
+				b.WriteString("  ")
+			}
+		}
+		for c := 0; c < shown; c++ {
+			pad := strings.Repeat(" ", widths[c]-utf8.RuneCountInString(row[c]))
+			if c == 0 {
+				b.WriteString(row[c] + pad)
+				continue
+			}
+			b.WriteString("  " + pad + row[c])
+		}
+		lines = append(lines, strings.TrimRight(b.String(), " "))
+	}
+	if hidden := len(rows) - visible; hidden > 0 {
+		lines = append(lines, fmt.Sprintf("%d more instances", hidden))
+	}
+	if hidden := len(widths) - shown; hidden > 0 {
+		lines = append(lines, fmt.Sprintf("%d more columns do not fit in %d characters", hidden, d.width))
+	}
+	return append(lines, failures...)
+}
+
+// cell shows the latest value of a metric followed by its sparkline.
+func (d *Dashboard) cell(i agent.InstanceMetric, metric string) string {
+	if _, ok := d.latest(i, metric); !ok {
+		return missingValue
+	}
+	v := d.values[i.Instance][metric]
+	return formatValue(v[len(v)-1]) + " " + sparkline(v, d.history)
+}
+
+func (d *Dashboard) renderDetail() []string {
+	i := d.rows(d.metrics())[d.selected]
+	lines := []string{d.heading(fmt.Sprintf("instance %d", i.Instance)), ""}
+	if i.Metrics == nil {
+		return append(lines, "Error: "+i.Error)
+	}
+
+	values := d.values[i.Instance]
+	keys := make([]string, 0, len(values))
+	for k := range values {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	width := 0
+	for _, k := range keys {
+		width = max(width, utf8.RuneCountInString(k))
+	}
+	visible := len(keys)
+	if d.height > 0 {
+		visible = max(d.height-4, 1)
+	}
+	d.offset = min(d.offset, max(len(keys)-visible, 0))
+	for _, k := range keys[d.offset:min(d.offset+visible, len(keys))] {
+		v := values[k]
+		line := k + strings.Repeat(" ", width-utf8.RuneCountInString(k)) + "  " + formatValue(v[len(v)-1]) + " " + sparkline(v, d.history)
+		lines = append(lines, truncate(line, d.width))
+	}
+	return lines
+}
+
+// sparkline draws the finite values from the lowest to the highest, padded
+// to the width so the columns stay aligned while the history fills up.
+func sparkline(values []float64, width int) string {
+	lo, hi := math.Inf(1), math.Inf(-1)
+	for _, v := range values {
+		if finite(v) {
+			lo, hi = math.Min(lo, v), math.Max(hi, v)
+		}
+	}
+	line := make([]rune, 0, width)
+	for i := len(values); i < width; i++ {
+		line = append(line, ' ')
+	}
+	for _, v := range values {
+		if !finite(v) {
+			line = append(line, gap)
+			continue
+		}
+		s := 0
+		if hi > lo {
+			s = int((v - lo) / (hi - lo) * float64(len(sparks)-1))
+		}
+		line = append(line, sparks[s])
+	}
+	return string(line)
+}
+
+func finite(f float64) bool {
+	return !math.IsNaN(f) && !math.IsInf(f, 0)
+}
+
+func formatValue(f float64) string {
+	return strconv.FormatFloat(math.Round(f*1000)/1000, 'f', -1, 64)
+}
+
+// truncate shortens s to width characters, ending with an ellipsis. Zero
+// means no limit.
+func truncate(s string, width int) string {
+	if width <= 0 || utf8.RuneCountInString(s) <= width {
+		return s
+	}
+	r := []rune(s)
+	return string(r[:width-1]) + "…"
+}
+
+func min(a, b int) int {
+	if a < b {
+		return a
+	}
+	return b
+}
+
+func max(a, b int) int {
+	if a > b {
+		return a
+	}
+	return b
+}
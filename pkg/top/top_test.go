@@ -0,0 +1,135 @@
+package top_test
+
+import (
+	"bytes"
+	"context"
+	"math"
+	"strings"
+	"time"
+
+	"github.com/wfernandes/app-metrics-plugin/pkg/agent"
+	"github.com/wfernandes/app-metrics-plugin/pkg/top"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Top", func() {
+	sample := func(minute int, requests ...float64) agent.Sample {
+		s := agent.Sample{Time: time.Date(2017, 11, 5, 10, minute, 0, 0, time.UTC)}
+		for i, r := range requests {
+			s.Metrics = append(s.Metrics, agent.InstanceMetric{
+				Instance: i,
+				Metrics:  map[string]interface{}{"requests": r, "heap": map[string]interface{}{"inuse": float64(100 * (i + 1))}},
+			})
+		}
+		return s
+	}
+
+	It("shows a row per instance with the latest values and their sparklines", func() {
+		d := top.New(top.WithTitle("my-app"), top.WithHistory(4))
+		d.Update(sample(0, 1, 10))
+		d.Update(sample(1, 2, 10))
+		d.Update(sample(2, 4, 10))
+
+		Expect(d.Render()).To(Equal(`my-app  2 instances  updated 10:02:00
+
+INSTANCE ▲  heap.inuse  requests
+0             100  ▁▁▁    4  ▁▃█
+1             200  ▁▁▁   10  ▁▁▁
+`))
+	})
+
+	It("draws a gap in the sparklines for NaN and infinite values", func() {
+		d := top.New(top.WithColumns([]string{"requests"}), top.WithHistory(4))
+		d.Update(sample(0, 1))
+		d.Update(sample(1, 2))
+		d.Update(sample(2, math.Inf(1)))
+		d.Update(sample(3, math.NaN()))
+
+		Expect(d.Render()).To(ContainSubstring("▁█··"))
+	})
+
+	It("shows the chosen columns in order and sorts by any column", func() {
+		d := top.New(top.WithColumns([]string{"req*", "heap.*"}), top.WithHistory(1))
+		d.Update(sample(0, 7, 3))
+
+		d.Press(top.KeyRight)
+		d.Press(top.KeyReverse)
+
+		Expect(d.Render()).To(Equal(`2 instances  updated 10:00:00
+
+INSTANCE  requests ▼  heap.inuse
+0                7 ▁       100 ▁
+1                3 ▁       200 ▁
+`))
+
+		d.Press(top.KeyReverse)
+		Expect(strings.Split(d.Render(), "\n")[3]).To(HavePrefix("1"))
+	})
+
+	It("lists the failed instances and drops the columns that do not fit", func() {
+		d := top.New(top.WithHistory(1))
+		d.SetSize(24, 0)
+		s := sample(0, 1)
+		s.Metrics = append(s.Metrics, agent.InstanceMetric{Instance: 1, Error: "timeout"})
+		d.Update(s)
+
+		Expect(d.Render()).To(Equal(`2 instances  updated 10…
+
+INSTANCE ▲  heap.inuse
+0                100 ▁
+1                    -
+1 more columns do not fit in 24 characters
+Instance 1: timeout
+`))
+	})
+
+	It("selects an instance and drills into its metrics", func() {
+		d := top.New(top.WithInteractive(), top.WithHistory(2))
+		d.Update(sample(0, 1, 2))
+		d.Update(sample(1, 3, 2))
+
+		d.Press(top.KeyDown)
+		Expect(d.Render()).To(ContainSubstring("\n> 1 "))
+
+		d.Press(top.KeyEnter)
+		Expect(d.Render()).To(Equal(`instance 1  updated 10:01:00
+
+heap.inuse  200 ▁▁
+requests    2 ▁▁
+
+↑/k ↓/j select  ←/h →/l sort column  r reverse  enter details  esc back  q quit
+`))
+
+		d.Press(top.KeyBack)
+		Expect(d.Render()).To(HavePrefix("2 instances"))
+		Expect(d.Press(top.KeyQuit)).To(BeFalse())
+	})
+
+	It("parses keys and arrow escape sequences", func() {
+		Expect(top.ParseKeys([]byte("jk\x1b[A\x1b[B\x1b[C\x1b[Dr\r\x1bq"))).To(Equal([]top.Key{
+			top.KeyDown, top.KeyUp, top.KeyUp, top.KeyDown, top.KeyRight, top.KeyLeft,
+			top.KeyReverse, top.KeyEnter, top.KeyBack, top.KeyQuit,
+		}))
+	})
+
+	It("redraws the dashboard full screen until q is pressed", func() {
+		d := top.New()
+		samples := make(chan agent.Sample, 1)
+		samples <- sample(0, 1)
+		keys := make(chan top.Key)
+		go func() {
+			time.Sleep(50 * time.Millisecond)
+			keys <- top.KeyQuit
+		}()
+		buf := &bytes.Buffer{}
+
+		err := top.Run(context.Background(), d, samples, keys, func() (int, int) { return 80, 24 }, buf)
+
+		Expect(err).ToNot(HaveOccurred())
+		Expect(buf.String()).To(HavePrefix("\x1b[?1049h"))
+		Expect(buf.String()).To(ContainSubstring("1 instances  updated 10:00:00"))
+		Expect(buf.String()).To(HaveSuffix("\x1b[?1049l"))
+	})
+})
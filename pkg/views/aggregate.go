@@ -0,0 +1,55 @@
+package views
+
+import (
+	"fmt"
+	"math"
+	"strconv"
+	"text/tabwriter"
+	"text/template"
+
+	"github.com/wfernandes/app-metrics-plugin/pkg/aggregate"
+)
+
+// PresentAggregate prints the cross-instance statistics as one table,
+// followed by the outlier instances.
+func (v *View) PresentAggregate(stats []aggregate.Stat) error {
+	w := tabwriter.NewWriter(v.writer, 0, 4, 2, ' ', 0)
+
+	tmpl := buildAggregateTemplate()
+	err := tmpl.Execute(w, stats)
+	if err != nil {
+		return fmt.Errorf("unable to render template %s: %s", tmpl.Name(), err)
+	}
+	err = w.Flush()
+	if err != nil {
+		return err
+	}
+
+	err = tmpl.ExecuteTemplate(v.writer, "outliers", v.outliers)
+	if err != nil {
+		return fmt.Errorf("unable to render template %s: %s", tmpl.Name(), err)
+	}
+	return nil
+}
+
+func buildAggregateTemplate() *template.Template {
+	t := template.New("aggregate").Funcs(template.FuncMap{
+		"formatStat": formatStat,
+	})
+	// Columns are separated by tabs and aligned by the tabwriter.
+	t, _ = t.Parse(`METRIC	INSTANCES	SUM	MEAN	MIN	MAX	STDDEV
+{{range .}}{{.Metric}}	{{.Instances}}	{{formatStat .Sum}}	{{formatStat .Mean}}	{{formatStat .Min}} (#{{.MinInstance}})	{{formatStat .Max}} (#{{.MaxInstance}})	{{formatStat .StdDev}}
+{{end}}`)
+	t, _ = t.Parse(deviationsTemplate)
+	t, _ = t.Parse(`{{define "outliers"}}{{range .}}
+Instance: {{.Instance}} [OUTLIER]{{template "deviations" .}}
+{{end}}{{end}}`)
+
+	return t
+}
+
+// formatStat prints a statistic in plain decimal notation with at most three
+// decimals.
+func formatStat(f float64) string {
+	return strconv.FormatFloat(math.Round(f*1000)/1000, 'f', -1, 64)
+}
@@ -0,0 +1,30 @@
+package views
+
+import (
+	"fmt"
+	"text/template"
+
+	"github.com/wfernandes/app-metrics-plugin/pkg/assert"
+)
+
+// PresentAssertions prints whether each assertion passed, followed by the
+// values that violated the failed ones.
+func (v *View) PresentAssertions(results []assert.Result) error {
+	tmpl := buildAssertionsTemplate()
+	err := tmpl.Execute(v.writer, results)
+	if err != nil {
+		return fmt.Errorf("unable to render template %s: %s", tmpl.Name(), err)
+	}
+	return nil
+}
+
+func buildAssertionsTemplate() *template.Template {
+	t := template.New("assertions").Funcs(template.FuncMap{
+		"formatStat": formatStat,
+	})
+	t, _ = t.Parse(`{{range .}}{{if .Passed}}PASS{{else}}FAIL{{end}}  {{.Assertion}}
+{{range .Failures}}      {{with .Instance}}instance {{.}}: {{end}}{{if .Error}}{{.Error}}{{else}}{{.Metric}}: {{formatStat .Value}}{{end}}
+{{end}}{{end}}`)
+
+	return t
+}
@@ -0,0 +1,154 @@
+package views
+
+import (
+	"fmt"
+	"html/template"
+	"math"
+	"strings"
+	"time"
+)
+
+// Size and margins of the svg charts of the html report, in pixels. The
+// left margin fits the labels of the y axis and the bottom margin those of
+// the x axis.
+const (
+	chartWidth  = 480
+	chartHeight = 180
+	chartLeft   = 56
+	chartRight  = 8
+	chartTop    = 8
+	chartBottom = 24
+	// maxAxisLabels is the number of labels shown at most below the bars.
+	maxAxisLabels = 12
+)
+
+// chartColors are the colors of the lines of the instances, repeating for
+// more instances.
+var chartColors = []string{"#1f77b4", "#ff7f0e", "#2ca02c", "#d62728", "#9467bd", "#8c564b", "#e377c2", "#7f7f7f"}
+
+// chartLine is a line of a line chart. Missing values are NaN and break the
+// line.
+type chartLine struct {
+	Name   string
+	Values []float64
+}
+
+// barChart draws a bar per value, labelled below the x axis.
+func barChart(labels []string, values []float64) template.HTML {
+	var b strings.Builder
+	openChart(&b)
+
+	hi := 0.0
+	for _, v := range values {
+		hi = math.Max(hi, v)
+	}
+	yAxis(&b, 0, hi)
+
+	plotWidth := float64(chartWidth - chartLeft - chartRight)
+	plotHeight := float64(chartHeight - chartTop - chartBottom)
+	step := plotWidth / float64(len(values))
+	every := (len(values) + maxAxisLabels - 1) / maxAxisLabels
+	for i, v := range values {
+		h := 0.0
+		if hi > 0 {
+			h = v / hi * plotHeight
+		}
+		x := chartLeft + float64(i)*step
+		fmt.Fprintf(&b, `<rect x="%.1f" y="%.1f" width="%.1f" height="%.1f" fill="%s"><title>%s: %s</title></rect>`,
+			x+1, chartTop+plotHeight-h, math.Max(step-2, 1), h, chartColors[0], template.HTMLEscapeString(labels[i]), formatStat(v))
+		if i%every == 0 {
+			fmt.Fprintf(&b, `<text x="%.1f" y="%d" text-anchor="middle">%s</text>`, x+step/2, chartHeight-8, template.HTMLEscapeString(labels[i]))
+		}
+	}
+
+	b.WriteString("</svg>")
+	return template.HTML(b.String())
+}
+
+// lineChart draws a line per instance over the times of the samples, with a
+// legend naming the lines.
+func lineChart(times []time.Time, lines []chartLine) template.HTML {
+	var b strings.Builder
+	openChart(&b)
+
+	lo, hi := math.Inf(1), math.Inf(-1)
+	for _, l := range lines {
+		for _, v := range l.Values {
+			if !math.IsNaN(v) {
+				lo, hi = math.Min(lo, v), math.Max(hi, v)
+			}
+		}
+	}
+	if math.IsInf(lo, 1) {
+		lo, hi = 0, 0
+	}
+	if lo == hi {
+		// Center flat lines.
+		lo, hi = lo-1, hi+1
+	}
+	yAxis(&b, lo, hi)
+
+	plotWidth := float64(chartWidth - chartLeft - chartRight)
+	plotHeight := float64(chartHeight - chartTop - chartBottom)
+	span := times[len(times)-1].Sub(times[0])
+	x := func(t time.Time) float64 {
+		if span <= 0 {
+			return chartLeft + plotWidth/2
+		}
+		return chartLeft + float64(t.Sub(times[0]))/float64(span)*plotWidth
+	}
+	y := func(v float64) float64 {
+		return chartTop + (hi-v)/(hi-lo)*plotHeight
+	}
+
+	for i, l := range lines {
+		color := chartColors[i%len(chartColors)]
+		var points [][2]float64
+		flush := func() {
+			switch len(points) {
+			case 0:
+			case 1:
+				// A lone point would not be visible as a line.
+				fmt.Fprintf(&b, `<circle cx="%.1f" cy="%.1f" r="2" fill="%s"/>`, points[0][0], points[0][1], color)
+			default:
+				coords := make([]string, len(points))
+				for k, p := range points {
+					coords[k] = fmt.Sprintf("%.1f,%.1f", p[0], p[1])
+				}
+				fmt.Fprintf(&b, `<polyline points="%s" fill="none" stroke="%s" stroke-width="1.5"/>`, strings.Join(coords, " "), color)
+			}
+			points = nil
+		}
+		for j, v := range l.Values {
+			if math.IsNaN(v) {
+				flush()
+				continue
+			}
+			points = append(points, [2]float64{x(times[j]), y(v)})
+		}
+		flush()
+	}
+
+	fmt.Fprintf(&b, `<text x="%d" y="%d">%s</text>`, chartLeft, chartHeight-8, times[0].Format("15:04:05"))
+	fmt.Fprintf(&b, `<text x="%d" y="%d" text-anchor="end">%s</text>`, chartWidth-chartRight, chartHeight-8, times[len(times)-1].Format("15:04:05"))
+	b.WriteString("</svg>")
+
+	b.WriteString(`<div class="legend">`)
+	for i, l := range lines {
+		fmt.Fprintf(&b, `<span><i style="background:%s"></i>%s</span>`, chartColors[i%len(chartColors)], template.HTMLEscapeString(l.Name))
+	}
+	b.WriteString("</div>")
+	return template.HTML(b.String())
+}
+
+func openChart(b *strings.Builder) {
+	fmt.Fprintf(b, `<svg xmlns="http://www.w3.org/2000/svg" width="%d" height="%d" viewBox="0 0 %d %d">`, chartWidth, chartHeight, chartWidth, chartHeight)
+}
+
+// yAxis draws the axes with the lowest and highest values as labels.
+func yAxis(b *strings.Builder, lo, hi float64) {
+	bottom := chartHeight - chartBottom
+	fmt.Fprintf(b, `<path d="M%d %d V%d H%d" fill="none" stroke="#999"/>`, chartLeft, chartTop, bottom, chartWidth-chartRight)
+	fmt.Fprintf(b, `<text x="%d" y="%d" text-anchor="end">%s</text>`, chartLeft-4, chartTop+8, formatStat(hi))
+	fmt.Fprintf(b, `<text x="%d" y="%d" text-anchor="end">%s</text>`, chartLeft-4, bottom, formatStat(lo))
+}
@@ -0,0 +1,110 @@
+package views
+
+import (
+	"fmt"
+	"text/tabwriter"
+	"text/template"
+
+	"github.com/wfernandes/app-metrics-plugin/pkg/diff"
+)
+
+// diffTable is the changes of one instance, or across instances, ready to
+// be printed. The STAT and RATE columns are only printed when needed.
+type diffTable struct {
+	Instance string
+	Error    string
+	Stat     bool
+	Rate     bool
+	Rows     []diffRow
+	Added    []string
+	Removed  []string
+}
+
+type diffRow struct {
+	Metric  string
+	Stat    string
+	Before  string
+	After   string
+	Delta   string
+	Percent string
+	Rate    string
+}
+
+// PresentDiff prints the changes of every instance followed by the changes
+// across instances, each as a table.
+func (v *View) PresentDiff(d diff.Diff) error {
+	w := tabwriter.NewWriter(v.writer, 0, 4, 2, ' ', 0)
+
+	var tables []diffTable
+	for _, i := range d.Instances {
+		t := newDiffTable(i.Changes)
+		t.Instance = fmt.Sprintf("Instance: %d", i.Instance)
+		t.Error = i.Error
+		tables = append(tables, t)
+	}
+	t := newDiffTable(d.Aggregate)
+	t.Instance = "All instances:"
+	t.Stat = true
+	tables = append(tables, t)
+
+	tmpl := buildDiffTemplate()
+	err := tmpl.Execute(w, tables)
+	if err != nil {
+		return fmt.Errorf("unable to render template %s: %s", tmpl.Name(), err)
+	}
+	return w.Flush()
+}
+
+func newDiffTable(c diff.Changes) diffTable {
+	t := diffTable{Added: c.Added, Removed: c.Removed}
+	for _, ch := range c.Changed {
+		row := diffRow{
+			Metric:  ch.Metric,
+			Stat:    ch.Stat,
+			Before:  formatStat(ch.Before),
+			After:   formatStat(ch.After),
+			Delta:   formatDelta(ch.Delta),
+			Percent: "-",
+			Rate:    "-",
+		}
+		if ch.Percent != nil {
+			row.Percent = formatDelta(*ch.Percent) + "%"
+		}
+		if ch.Counter {
+			t.Rate = true
+			row.Rate = formatStat(ch.Rate) + "/s"
+			if ch.Reset {
+				row.Rate += " (reset)"
+			}
+		}
+		t.Rows = append(t.Rows, row)
+	}
+	return t
+}
+
+func buildDiffTemplate() *template.Template {
+	t := template.New("diff").Funcs(template.FuncMap{
+		"join": join,
+	})
+	// Columns are separated by tabs and aligned by the tabwriter. Lines
+	// without tabs end a table so each one is aligned on its own.
+	t, _ = t.Parse(`{{range $i, $t := .}}{{if $i}}
+{{end}}{{.Instance}}
+{{if .Error}}Error: {{.Error}}
+{{else}}{{if .Rows}}METRIC{{if .Stat}}	STAT{{end}}	BEFORE	AFTER	DELTA	CHANGE{{if .Rate}}	RATE{{end}}
+{{range .Rows}}{{.Metric}}{{if $t.Stat}}	{{.Stat}}{{end}}	{{.Before}}	{{.After}}	{{.Delta}}	{{.Percent}}{{if $t.Rate}}	{{.Rate}}{{end}}
+{{end}}{{end}}{{with .Added}}Added: {{join .}}
+{{end}}{{with .Removed}}Removed: {{join .}}
+{{end}}{{if not (or .Rows .Added .Removed)}}No changes
+{{end}}{{end}}{{end}}`)
+
+	return t
+}
+
+// formatDelta prints a statistic with its sign.
+func formatDelta(f float64) string {
+	if f > 0 {
+		return "+" + formatStat(f)
+	}
+	return formatStat(f)
+}
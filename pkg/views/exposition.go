@@ -0,0 +1,231 @@
+package views
+
+import (
+	"fmt"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/wfernandes/app-metrics-plugin/pkg/agent"
+	"github.com/wfernandes/app-metrics-plugin/pkg/aggregate"
+	"github.com/wfernandes/app-metrics-plugin/pkg/parser"
+)
+
+// OutputPrometheus re-exports the metrics of every instance as one
+// Prometheus text exposition.
+const OutputPrometheus = "prometheus"
+
+// InstanceLabel holds the index of the instance in the Prometheus output.
+const InstanceLabel = "cf_instance_index"
+
+// WithLabels adds labels to every series of the Prometheus output, e.g.
+// the name of the app.
+func WithLabels(labels map[string]string) ViewOpt {
+	return func(v *View) {
+		v.labels = labels
+	}
+}
+
+var invalidNameChars = regexp.MustCompile(`[^a-zA-Z0-9_:]+`)
+
+// exposedFamily is a metric family merged across instances.
+type exposedFamily struct {
+	name   string
+	help   string
+	typ    string
+	series []string
+}
+
+// presentExposition prints the series of every instance with an
+// InstanceLabel and the labels of the view. Families keep their help and
+// type, and every other numeric metric becomes a gauge named after its
+// aggregate.Flatten key. Invalid characters in names are replaced and the
+// original name becomes the help. A label
+// that is already set is renamed with an exported_ prefix, like Prometheus
+// does when scraping.
+func (v *View) presentExposition(m []agent.InstanceMetric) error {
+	families := make(map[string]*exposedFamily)
+	family := func(name, help, typ string) *exposedFamily {
+		f, ok := families[name]
+		if !ok {
+			f = &exposedFamily{name: name, help: help, typ: typ}
+			families[name] = f
+		}
+		return f
+	}
+
+	var failures []string
+	for _, i := range m {
+		if i.Metrics == nil {
+			failures = append(failures, fmt.Sprintf("# %s %d failed: %s", InstanceLabel, i.Instance, escapeHelp(i.Error)))
+			continue
+		}
+		extra := make(map[string]string, len(v.labels)+1)
+		for k, l := range v.labels {
+			extra[k] = l
+		}
+		extra[InstanceLabel] = strconv.Itoa(i.Instance)
+
+		others := make(map[string]interface{})
+		for k, value := range i.Metrics {
+			pf, ok := value.(*parser.Family)
+			if !ok {
+				others[k] = value
+				continue
+			}
+			// Graphite families keep their dotted paths as names.
+			name := sanitizeName(pf.Name)
+			help := pf.Help
+			if help == "" && name != pf.Name {
+				help = pf.Name
+			}
+			f := family(name, help, exposedType(pf.Type))
+			f.series = append(f.series, familySeries(pf, extra)...)
+		}
+
+		values := aggregate.FlattenValues(others)
+		keys := make([]string, 0, len(values))
+		for k := range values {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+		for _, k := range keys {
+			// Rates of Prometheus series are keyed with their labels.
+			name, labels := parseSeriesKey(k)
+			sanitized := sanitizeName(name)
+			help := ""
+			if sanitized != name {
+				help = name
+			}
+			f := family(sanitized, help, "gauge")
+			f.series = append(f.series, sampleLine(sanitized, labels, extra, sampleValue(values[k])))
+		}
+	}
+
+	names := make([]string, 0, len(families))
+	for n := range families {
+		names = append(names, n)
+	}
+	sort.Strings(names)
+
+	var b strings.Builder
+	for _, n := range names {
+		f := families[n]
+		if f.help != "" {
+			fmt.Fprintf(&b, "# HELP %s %s\n", f.name, escapeHelp(f.help))
+		}
+		fmt.Fprintf(&b, "# TYPE %s %s\n", f.name, f.typ)
+		for _, s := range f.series {
+			b.WriteString(s + "\n")
+		}
+	}
+	for _, f := range failures {
+		b.WriteString(f + "\n")
+	}
+
+	_, err := fmt.Fprint(v.writer, b.String())
+	return err
+}
+
+// familySeries returns the sample lines of a family, with summaries and
+// histograms split into their quantiles or buckets, sum and count. Native
+// histogram buckets have no text representation and are left out.
+func familySeries(f *parser.Family, extra map[string]string) []string {
+	var lines []string
+	aggregate.EachSeries(f, func(name string, labels map[string]string, value float64) {
+		lines = append(lines, sampleLine(sanitizeName(name), labels, extra, parser.FormatFloat(value)))
+	})
+	return lines
+}
+
+// sanitizeName replaces the characters that are not valid in a metric name
+// with underscores, and prefixes names starting with a digit with one.
+func sanitizeName(name string) string {
+	sanitized := invalidNameChars.ReplaceAllString(name, "_")
+	if sanitized != "" && sanitized[0] >= '0' && sanitized[0] <= '9' {
+		sanitized = "_" + sanitized
+	}
+	return sanitized
+}
+
+// exposedType returns the text format type of a family type.
+func exposedType(t string) string {
+	switch t {
+	case "COUNTER", "GAUGE", "SUMMARY", "HISTOGRAM":
+		return strings.ToLower(t)
+	case "GAUGE_HISTOGRAM":
+		return "histogram"
+	}
+	return "untyped"
+}
+
+// sampleLine returns the line of a sample with the extra labels added.
+// Extra labels the series already has are renamed with an exported_ prefix.
+func sampleLine(name string, labels, extra map[string]string, value string) string {
+	all := make(map[string]string, len(labels)+len(extra))
+	for k, l := range labels {
+		if _, ok := extra[k]; ok {
+			k = "exported_" + k
+		}
+		all[k] = l
+	}
+	for k, l := range extra {
+		all[k] = l
+	}
+
+	names := make([]string, 0, len(all))
+	for k := range all {
+		names = append(names, k)
+	}
+	sort.Strings(names)
+	pairs := make([]string, len(names))
+	for i, k := range names {
+		pairs[i] = k + `="` + escapeLabel(all[k]) + `"`
+	}
+	return name + "{" + strings.Join(pairs, ",") + "} " + value
+}
+
+// sampleValue formats a value of aggregate.FlattenValues, with integers
+// printed exactly.
+func sampleValue(v interface{}) string {
+	if f, ok := v.(float64); ok {
+		return parser.FormatFloat(f)
+	}
+	return formatValue(v)
+}
+
+// parseSeriesKey splits a key of aggregate.SeriesKey, e.g.
+// `http_requests_total{code="200"}`, into its name and labels. Other keys
+// are names without labels.
+func parseSeriesKey(k string) (string, map[string]string) {
+	i := strings.IndexByte(k, '{')
+	if i <= 0 || !strings.HasSuffix(k, "}") {
+		return k, nil
+	}
+
+	labels := make(map[string]string)
+	rest := k[i+1 : len(k)-1]
+	for rest != "" {
+		eq := strings.IndexByte(rest, '=')
+		if eq <= 0 {
+			return k, nil
+		}
+		quoted, err := strconv.QuotedPrefix(rest[eq+1:])
+		if err != nil {
+			return k, nil
+		}
+		value, _ := strconv.Unquote(quoted)
+		labels[rest[:eq]] = value
+		rest = strings.TrimPrefix(rest[eq+1+len(quoted):], ",")
+	}
+	return k[:i], labels
+}
+
+func escapeLabel(s string) string {
+	return strings.NewReplacer(`\`, `\\`, "\n", `\n`, `"`, `\"`).Replace(s)
+}
+
+func escapeHelp(s string) string {
+	return strings.NewReplacer(`\`, `\\`, "\n", `\n`).Replace(s)
+}
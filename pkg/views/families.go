@@ -0,0 +1,72 @@
+package views
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/wfernandes/app-metrics-plugin/pkg/aggregate"
+	"github.com/wfernandes/app-metrics-plugin/pkg/parser"
+)
+
+// familyTemplate shows a metric family as its name, type and help followed
+// by a line per series.
+const familyTemplate = `{{define "family"}}
+{{- .Name}} [{{familyType .Type}}]{{with .Help}} {{.}}{{end}}
+{{- range .Metrics}}
+    {{formatSeries .}}
+{{- end}}
+{{- end}}`
+
+func isFamily(v interface{}) bool {
+	_, ok := v.(*parser.Family)
+	return ok
+}
+
+// familyType names a family type in lower case, e.g. gauge_histogram.
+func familyType(t string) string {
+	return strings.ToLower(t)
+}
+
+// formatSeries prints a series on one line: its labels and value, or for
+// summaries and histograms their count, sum and quantiles or cumulative
+// bucket counts keyed by upper bound, e.g.
+// `{path="/"} count=4 sum=450 buckets: 100=3 +Inf=4`.
+func formatSeries(s interface{}) string {
+	switch t := s.(type) {
+	case parser.Metric:
+		return seriesLabels(t.Labels) + formatValue(t.Value)
+	case parser.Summary:
+		var b strings.Builder
+		fmt.Fprintf(&b, "%scount=%d sum=%s", seriesLabels(t.Labels), t.Count, formatValue(t.Sum))
+		if len(t.Quantiles) > 0 {
+			b.WriteString(" quantiles:")
+			for _, q := range t.Quantiles {
+				fmt.Fprintf(&b, " %s=%s", formatValue(q.Quantile), formatValue(q.Value))
+			}
+		}
+		return b.String()
+	case parser.Histogram:
+		var b strings.Builder
+		fmt.Fprintf(&b, "%scount=%d sum=%s", seriesLabels(t.Labels), t.Count, formatValue(t.Sum))
+		if len(t.Buckets) > 0 {
+			b.WriteString(" buckets:")
+			for _, bucket := range t.Buckets {
+				fmt.Fprintf(&b, " %s=%d", formatValue(bucket.UpperBound), bucket.CumulativeCount)
+			}
+		}
+		if t.Native != nil {
+			fmt.Fprintf(&b, " native: schema=%d buckets=%d", t.Native.Schema, len(t.Native.Buckets))
+		}
+		return b.String()
+	}
+	return formatValue(s)
+}
+
+// seriesLabels prints the sorted labels followed by a space, or nothing for
+// a series without labels.
+func seriesLabels(labels map[string]string) string {
+	if len(labels) == 0 {
+		return ""
+	}
+	return aggregate.SeriesKey("", labels) + " "
+}
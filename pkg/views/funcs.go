@@ -0,0 +1,221 @@
+package views
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"os"
+	"path"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"text/template"
+	"time"
+
+	"github.com/wfernandes/app-metrics-plugin/pkg/agent"
+	"github.com/wfernandes/app-metrics-plugin/pkg/aggregate"
+	"github.com/wfernandes/app-metrics-plugin/pkg/parser"
+	"github.com/wfernandes/app-metrics-plugin/pkg/snapshot"
+)
+
+// colors are the ANSI escape codes of the colors the color function knows.
+var colors = map[string]string{
+	"bold":    "\x1b[1m",
+	"red":     "\x1b[31m",
+	"green":   "\x1b[32m",
+	"yellow":  "\x1b[33m",
+	"blue":    "\x1b[34m",
+	"magenta": "\x1b[35m",
+	"cyan":    "\x1b[36m",
+}
+
+// Funcs returns the functions available to every template. Custom templates
+// must be parsed with them, e.g.
+//
+//	template.New(name).Funcs(views.Funcs()).ParseFiles(path)
+func Funcs() template.FuncMap {
+	return template.FuncMap{
+		"formatValue":      formatValue,
+		"formatStat":       formatStat,
+		"formatNested":     formatNested,
+		"outlier":          noOutlier,
+		"isFamily":         isFamily,
+		"familyType":       familyType,
+		"formatSeries":     formatSeries,
+		"humanizeBytes":    humanizeBytes,
+		"humanizeDuration": humanizeDuration,
+		"sortedKeys":       sortedKeys,
+		"get":              get,
+		"sum":              sum,
+		"avg":              avg,
+		"toJSON":           toJSON,
+		"default":          defaultValue,
+		"color":            color,
+		"match":            match,
+		"flatten":          aggregate.Flatten,
+		"aggregates":       aggregate.Aggregate,
+		"app":              noApp,
+		"timestamp":        noTimestamp,
+	}
+}
+
+// humanizeBytes prints a byte count with binary units, e.g. 2.1 MiB.
+func humanizeBytes(v interface{}) (string, error) {
+	f, ok := aggregate.Float(v)
+	if !ok {
+		return "", fmt.Errorf("humanizeBytes: %v is not a number", v)
+	}
+	if f < 0 {
+		return "-" + parser.Bytes(-f).String(), nil
+	}
+	return parser.Bytes(f).String(), nil
+}
+
+// humanizeDuration prints a number of nanoseconds, e.g. the pause times of
+// memstats, as a duration like 1.5ms.
+func humanizeDuration(v interface{}) (string, error) {
+	f, ok := aggregate.Float(v)
+	if !ok {
+		return "", fmt.Errorf("humanizeDuration: %v is not a number", v)
+	}
+	return time.Duration(f).String(), nil
+}
+
+// sortedKeys returns the keys of a map with string keys in order, so
+// templates can range over them in a stable order.
+func sortedKeys(m interface{}) ([]string, error) {
+	rv := reflect.ValueOf(m)
+	if rv.Kind() != reflect.Map || rv.Type().Key().Kind() != reflect.String {
+		return nil, fmt.Errorf("sortedKeys: %T is not a map with string keys", m)
+	}
+	keys := make([]string, 0, rv.Len())
+	for _, k := range rv.MapKeys() {
+		keys = append(keys, k.String())
+	}
+	sort.Strings(keys)
+	return keys, nil
+}
+
+// get looks up a dotted path like memstats.PauseNs.0 in nested maps and
+// arrays, e.g. {{get "memstats.HeapInuse" .Metrics}}. Keys that contain
+// dots themselves are matched before shorter keys, and Prometheus families
+// with a single series resolve to its value, e.g. {{get "go_goroutines"
+// .Metrics}}. It returns nil when the path does not exist.
+func get(path string, v interface{}) interface{} {
+	if path == "" {
+		return v
+	}
+	return lookup(strings.Split(path, "."), v)
+}
+
+func lookup(segments []string, v interface{}) interface{} {
+	if f, ok := v.(*parser.Family); ok && len(f.Metrics) == 1 {
+		if m, ok := f.Metrics[0].(parser.Metric); ok {
+			v = m.Value
+		}
+	}
+	if len(segments) == 0 {
+		return v
+	}
+	switch t := v.(type) {
+	case map[string]interface{}:
+		for n := len(segments); n > 0; n-- {
+			child, ok := t[strings.Join(segments[:n], ".")]
+			if !ok {
+				continue
+			}
+			if found := lookup(segments[n:], child); found != nil {
+				return found
+			}
+		}
+	case []interface{}:
+		i, err := strconv.Atoi(segments[0])
+		if err == nil && i >= 0 && i < len(t) {
+			return lookup(segments[1:], t[i])
+		}
+	}
+	return nil
+}
+
+// sum adds the numeric values at a path across the instances, e.g.
+// {{sum "requests.total" .}}. Instances without the value are skipped.
+func sum(path string, m []agent.InstanceMetric) float64 {
+	total, _ := total(path, m)
+	return total
+}
+
+// avg is the mean of the numeric values at a path across the instances
+// that have it, or NaN when none has.
+func avg(path string, m []agent.InstanceMetric) float64 {
+	total, n := total(path, m)
+	if n == 0 {
+		return math.NaN()
+	}
+	return total / float64(n)
+}
+
+func total(path string, m []agent.InstanceMetric) (float64, int) {
+	var total float64
+	var n int
+	for _, i := range m {
+		f, ok := aggregate.Float(get(path, i.Metrics))
+		if !ok {
+			continue
+		}
+		total += f
+		n++
+	}
+	return total, n
+}
+
+// toJSON encodes a value as json.
+func toJSON(v interface{}) (string, error) {
+	b, err := json.Marshal(v)
+	if err != nil {
+		return "", fmt.Errorf("toJSON: %s", err)
+	}
+	return string(b), nil
+}
+
+// defaultValue returns v, or def when v is missing or an empty string, e.g.
+// {{default "n/a" (get "version" .Metrics)}}. Zero numbers are kept since
+// they are valid metric values.
+func defaultValue(def, v interface{}) interface{} {
+	if v == nil || v == "" {
+		return def
+	}
+	return v
+}
+
+// color wraps s in the ANSI escape codes of a color: bold, red, green,
+// yellow, blue, magenta or cyan. It returns s as is when NO_COLOR is set.
+func color(name string, s interface{}) (string, error) {
+	code, ok := colors[name]
+	if !ok {
+		return "", fmt.Errorf("color: unknown color %q", name)
+	}
+	text := fmt.Sprint(s)
+	if os.Getenv("NO_COLOR") != "" {
+		return text, nil
+	}
+	return code + text + "\x1b[0m", nil
+}
+
+// match reports whether a name matches a glob like the ones of -include,
+// e.g. {{if match "http_*" $k}}.
+func match(pattern, name string) (bool, error) {
+	ok, err := path.Match(pattern, name)
+	if err != nil {
+		return false, fmt.Errorf("match: %s", err)
+	}
+	return ok, nil
+}
+
+func noApp() snapshot.App {
+	return snapshot.App{}
+}
+
+func noTimestamp() interface{} {
+	return nil
+}
@@ -0,0 +1,129 @@
+package views
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"text/template"
+
+	"github.com/wfernandes/app-metrics-plugin/pkg/aggregate"
+)
+
+// histogramRow is a line of the histograms table. Instance is "all" for
+// the histograms merged across instances.
+type histogramRow struct {
+	Series   string
+	Instance string
+	Count    uint64
+	Values   []string
+}
+
+// PresentHistograms prints the estimated quantiles of each histogram series
+// per instance, followed by the merged histogram, as one table. Series
+// that could not be merged are listed with their bucket layouts.
+func (v *View) PresentHistograms(h aggregate.Histograms) error {
+	w := tabwriter.NewWriter(v.writer, 0, 4, 2, ' ', 0)
+
+	tmpl := buildHistogramsTemplate()
+	err := tmpl.Execute(w, struct {
+		Quantiles []float64
+		Rows      []histogramRow
+	}{h.Quantiles, histogramRows(h)})
+	if err != nil {
+		return fmt.Errorf("unable to render template %s: %s", tmpl.Name(), err)
+	}
+	err = w.Flush()
+	if err != nil {
+		return err
+	}
+
+	err = tmpl.ExecuteTemplate(v.writer, "incompatible", h.Incompatible)
+	if err != nil {
+		return fmt.Errorf("unable to render template %s: %s", tmpl.Name(), err)
+	}
+	return nil
+}
+
+func histogramRows(h aggregate.Histograms) []histogramRow {
+	bySeries := make(map[string][]histogramRow)
+	var series []string
+	add := func(instance string, e aggregate.Estimate) {
+		if _, ok := bySeries[e.Series]; !ok {
+			series = append(series, e.Series)
+		}
+		bySeries[e.Series] = append(bySeries[e.Series], histogramRow{
+			Series:   e.Series,
+			Instance: instance,
+			Count:    e.Count,
+			Values:   quantileValues(h.Quantiles, e),
+		})
+	}
+
+	for _, i := range h.Instances {
+		for _, e := range i.Estimates {
+			add(strconv.Itoa(i.Instance), e)
+		}
+	}
+	for _, e := range h.Merged {
+		add("all", e)
+	}
+
+	var rows []histogramRow
+	for _, s := range series {
+		rows = append(rows, bySeries[s]...)
+	}
+	return rows
+}
+
+// quantileValues formats the estimate of each quantile, or - when it could
+// not be estimated.
+func quantileValues(quantiles []float64, e aggregate.Estimate) []string {
+	values := make([]string, len(quantiles))
+	for i, q := range quantiles {
+		values[i] = "-"
+		for _, eq := range e.Quantiles {
+			if eq.Quantile == q {
+				values[i] = formatStat(eq.Value)
+			}
+		}
+	}
+	return values
+}
+
+func buildHistogramsTemplate() *template.Template {
+	t := template.New("histograms").Funcs(template.FuncMap{
+		"quantileName": quantileName,
+		"join":         join,
+	})
+	// Columns are separated by tabs and aligned by the tabwriter.
+	t, _ = t.Parse(`SERIES	INSTANCE	COUNT{{range .Quantiles}}	{{quantileName .}}{{end}}
+{{range .Rows}}{{.Series}}	{{.Instance}}	{{.Count}}{{range .Values}}	{{.}}{{end}}
+{{end}}`)
+	t, _ = t.Parse(`{{define "incompatible"}}{{range .}}
+Incompatible bucket layouts for {{.Series}}:
+{{- range .Layouts}}
+  instances {{join .Instances}}: {{join .UpperBounds}}
+{{- end}}
+{{end}}{{end}}`)
+
+	return t
+}
+
+// quantileName names a quantile as a percentile, e.g. P99 or P99.9.
+func quantileName(q float64) string {
+	return "P" + formatStat(q*100)
+}
+
+func join(v interface{}) string {
+	var parts []string
+	switch t := v.(type) {
+	case []int:
+		for _, i := range t {
+			parts = append(parts, strconv.Itoa(i))
+		}
+	case []string:
+		parts = t
+	}
+	return strings.Join(parts, ", ")
+}
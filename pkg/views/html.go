@@ -0,0 +1,278 @@
+package views
+
+import (
+	"fmt"
+	"html/template"
+	"math"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/wfernandes/app-metrics-plugin/pkg/agent"
+	"github.com/wfernandes/app-metrics-plugin/pkg/aggregate"
+	"github.com/wfernandes/app-metrics-plugin/pkg/snapshot"
+)
+
+// OutputHTML renders a self-contained html report, with the charts drawn as
+// inline svg so it can be attached to tickets.
+const OutputHTML = "html"
+
+// htmlReport is what the html template shows.
+type htmlReport struct {
+	App        snapshot.App
+	Time       time.Time
+	Samples    int
+	Instances  []htmlInstance
+	Stats      []aggregate.Stat
+	Quantiles  []float64
+	Histograms []histogramRow
+	Buckets    []htmlChart
+	Series     []htmlChart
+}
+
+type htmlInstance struct {
+	Instance int
+	Error    string
+	Outlier  *aggregate.Outlier
+	Metrics  []htmlMetric
+}
+
+type htmlMetric struct {
+	Name  string
+	Value string
+}
+
+type htmlChart struct {
+	Title   string
+	Caption string
+	Chart   template.HTML
+}
+
+// PresentReport writes an html page with a table of the metrics of every
+// instance in the last sample, their statistics across instances, the
+// estimated quantiles and buckets of every histogram and, when there are
+// several samples, a chart of every numeric metric over time.
+func (v *View) PresentReport(samples []agent.Sample, quantiles []float64) error {
+	last := samples[len(samples)-1]
+	h := aggregate.EstimateHistograms(last.Metrics, quantiles)
+	r := htmlReport{
+		App:        v.app,
+		Time:       v.time,
+		Samples:    len(samples),
+		Stats:      aggregate.Aggregate(last.Metrics),
+		Quantiles:  quantiles,
+		Histograms: histogramRows(h),
+		Buckets:    bucketCharts(last.Metrics),
+		Series:     seriesCharts(samples),
+	}
+	if r.Time.IsZero() {
+		r.Time = last.Time
+	}
+	for _, i := range last.Metrics {
+		r.Instances = append(r.Instances, htmlInstance{
+			Instance: i.Instance,
+			Error:    i.Error,
+			Outlier:  v.outlier(i.Instance),
+			Metrics:  htmlMetrics(i.Metrics),
+		})
+	}
+
+	err := reportTemplate.Execute(v.writer, r)
+	if err != nil {
+		return fmt.Errorf("unable to render template %s: %s", reportTemplate.Name(), err)
+	}
+	return nil
+}
+
+// htmlMetrics returns the numeric metrics keyed like aggregate.Flatten and
+// the other top level values, sorted by name.
+func htmlMetrics(metrics map[string]interface{}) []htmlMetric {
+	var out []htmlMetric
+	for k, f := range aggregate.Flatten(metrics) {
+		out = append(out, htmlMetric{Name: k, Value: formatStat(f)})
+	}
+	for k, m := range metrics {
+		switch t := m.(type) {
+		case string, bool:
+			out = append(out, htmlMetric{Name: k, Value: fmt.Sprint(t)})
+		}
+	}
+	sort.Slice(out, func(i, j int) bool {
+		return out[i].Name < out[j].Name
+	})
+	return out
+}
+
+// bucketCharts draws the number of observations in each bucket of every
+// classic histogram of each instance.
+func bucketCharts(metrics []agent.InstanceMetric) []htmlChart {
+	var charts []htmlChart
+	for _, i := range metrics {
+		histograms := aggregate.ClassicHistograms(i.Metrics)
+		series := make([]string, 0, len(histograms))
+		for s := range histograms {
+			series = append(series, s)
+		}
+		sort.Strings(series)
+
+		for _, s := range series {
+			hist := histograms[s]
+			labels := make([]string, len(hist.Buckets))
+			counts := make([]float64, len(hist.Buckets))
+			below := 0.0
+			for b, bucket := range hist.Buckets {
+				labels[b] = strconv.FormatFloat(bucket.UpperBound, 'g', -1, 64)
+				counts[b] = float64(bucket.CumulativeCount) - below
+				below = float64(bucket.CumulativeCount)
+			}
+			charts = append(charts, htmlChart{
+				Title:   fmt.Sprintf("%s, instance %d", s, i.Instance),
+				Caption: fmt.Sprintf("count %d, sum %s, observations per bucket by upper bound", hist.Count, formatStat(hist.Sum)),
+				Chart:   barChart(labels, counts),
+			})
+		}
+	}
+	return charts
+}
+
+// seriesCharts draws every numeric metric over the samples with a line per
+// instance, or nothing when there is a single sample.
+func seriesCharts(samples []agent.Sample) []htmlChart {
+	if len(samples) < 2 {
+		return nil
+	}
+
+	times := make([]time.Time, len(samples))
+	values := make(map[string]map[int][]float64)
+	instances := make(map[int]bool)
+	for s, smp := range samples {
+		times[s] = smp.Time
+		for _, i := range smp.Metrics {
+			instances[i.Instance] = true
+			for k, f := range aggregate.Flatten(i.Metrics) {
+				if values[k] == nil {
+					values[k] = make(map[int][]float64)
+				}
+				if values[k][i.Instance] == nil {
+					values[k][i.Instance] = nanValues(len(samples))
+				}
+				values[k][i.Instance][s] = f
+			}
+		}
+	}
+
+	metrics := make([]string, 0, len(values))
+	for k := range values {
+		metrics = append(metrics, k)
+	}
+	sort.Strings(metrics)
+	order := make([]int, 0, len(instances))
+	for i := range instances {
+		order = append(order, i)
+	}
+	sort.Ints(order)
+
+	charts := make([]htmlChart, 0, len(metrics))
+	for _, k := range metrics {
+		var lines []chartLine
+		for _, i := range order {
+			if v, ok := values[k][i]; ok {
+				lines = append(lines, chartLine{Name: "instance " + strconv.Itoa(i), Values: v})
+			}
+		}
+		charts = append(charts, htmlChart{Title: k, Chart: lineChart(times, lines)})
+	}
+	return charts
+}
+
+func nanValues(n int) []float64 {
+	v := make([]float64, n)
+	for i := range v {
+		v[i] = math.NaN()
+	}
+	return v
+}
+
+// reportTemplate renders the report page.
+var reportTemplate = template.Must(template.New("html").Funcs(template.FuncMap{
+	"formatStat":   formatStat,
+	"quantileName": quantileName,
+}).Parse(htmlTemplate))
+
+// htmlTemplate is the report page. Styles are inline so the page has no
+// external assets.
+const htmlTemplate = `<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<title>Metrics of {{.App.Name}}</title>
+<style>
+body { font-family: sans-serif; margin: 2em; color: #222; }
+table { border-collapse: collapse; margin-bottom: 1.5em; }
+th, td { border: 1px solid #ddd; padding: 4px 8px; text-align: left; }
+td.num { text-align: right; font-family: monospace; }
+.outlier { color: #d62728; }
+.error { color: #d62728; font-family: monospace; }
+figure { display: inline-block; margin: 0 1.5em 1.5em 0; vertical-align: top; }
+figcaption { font-size: 0.9em; margin-bottom: 4px; }
+svg text { font-size: 10px; fill: #555; }
+.legend span { margin-right: 1em; font-size: 0.8em; }
+.legend i { display: inline-block; width: 10px; height: 10px; margin-right: 4px; }
+</style>
+</head>
+<body>
+<h1>Metrics of {{.App.Name}}</h1>
+<p>
+{{- if .App.Org}}Org {{.App.Org}}, space {{.App.Space}}. {{end -}}
+Scraped at {{.Time.Format "2006-01-02T15:04:05Z07:00"}}{{if gt .Samples 1}}, {{.Samples}} samples{{end}}.</p>
+{{- if .Stats}}
+<h2>Aggregate</h2>
+<table>
+<tr><th>Metric</th><th>Instances</th><th>Sum</th><th>Mean</th><th>Min</th><th>Max</th><th>Stddev</th></tr>
+{{- range .Stats}}
+<tr><td>{{.Metric}}</td><td class="num">{{.Instances}}</td><td class="num">{{formatStat .Sum}}</td><td class="num">{{formatStat .Mean}}</td><td class="num">{{formatStat .Min}} (#{{.MinInstance}})</td><td class="num">{{formatStat .Max}} (#{{.MaxInstance}})</td><td class="num">{{formatStat .StdDev}}</td></tr>
+{{- end}}
+</table>
+{{- end}}
+{{- if .Histograms}}
+<h2>Histograms</h2>
+<table>
+<tr><th>Series</th><th>Instance</th><th>Count</th>{{range .Quantiles}}<th>{{quantileName .}}</th>{{end}}</tr>
+{{- range .Histograms}}
+<tr><td>{{.Series}}</td><td>{{.Instance}}</td><td class="num">{{.Count}}</td>{{range .Values}}<td class="num">{{.}}</td>{{end}}</tr>
+{{- end}}
+</table>
+{{- range .Buckets}}
+<figure><figcaption><b>{{.Title}}</b><br>{{.Caption}}</figcaption>{{.Chart}}</figure>
+{{- end}}
+{{- end}}
+{{- if .Series}}
+<h2>Over time</h2>
+{{- range .Series}}
+<figure><figcaption><b>{{.Title}}</b></figcaption>{{.Chart}}</figure>
+{{- end}}
+{{- end}}
+<h2>Instances</h2>
+{{- range .Instances}}
+<h3{{if .Outlier}} class="outlier"{{end}}>Instance {{.Instance}}{{if .Outlier}} [OUTLIER]{{end}}</h3>
+{{- if .Error}}
+<p class="error">{{.Error}}</p>
+{{- else}}
+{{- with .Outlier}}
+<ul class="outlier">
+{{- range .Deviations}}
+<li>{{.Metric}}: {{formatStat .Value}} (peers {{formatStat .Center}}, score {{formatStat .Score}})</li>
+{{- end}}
+</ul>
+{{- end}}
+<table>
+<tr><th>Metric</th><th>Value</th></tr>
+{{- range .Metrics}}
+<tr><td>{{.Name}}</td><td class="num">{{.Value}}</td></tr>
+{{- end}}
+</table>
+{{- end}}
+{{- end}}
+</body>
+</html>
+`
@@ -0,0 +1,97 @@
+package views
+
+import (
+	"fmt"
+	"reflect"
+	"sort"
+	"strings"
+)
+
+const (
+	// nestedIndent is the indentation of the first level of nested values in
+	// the default template, below the metric names.
+	nestedIndent = "    "
+	// maxArrayItems is the number of items shown of longer arrays.
+	maxArrayItems = 10
+)
+
+// formatNested prints the value of a metric after its name and colon.
+// Numbers and other scalars follow on the same line. Objects are printed
+// below with their keys sorted and indented, one key per line, and arrays
+// of scalars inline, e.g. [1, 2, 3], or one item per line with a dash when
+// they hold objects or arrays. Arrays longer than maxArrayItems show the
+// first items and how many more there are.
+func formatNested(v interface{}) string {
+	var b strings.Builder
+	writeNested(&b, v, nestedIndent)
+	return b.String()
+}
+
+func writeNested(b *strings.Builder, v interface{}, indent string) {
+	rv := reflect.ValueOf(v)
+	switch {
+	case isObject(rv):
+		if rv.Len() == 0 {
+			b.WriteString(" {}")
+			return
+		}
+		keys := make([]string, 0, rv.Len())
+		for _, k := range rv.MapKeys() {
+			keys = append(keys, k.String())
+		}
+		sort.Strings(keys)
+		for _, k := range keys {
+			b.WriteString("\n" + indent + k + ":")
+			writeNested(b, rv.MapIndex(reflect.ValueOf(k).Convert(rv.Type().Key())).Interface(), indent+"  ")
+		}
+	case isArray(rv):
+		n := rv.Len()
+		shown := n
+		if shown > maxArrayItems {
+			shown = maxArrayItems
+		}
+		if !hasNested(rv) {
+			items := make([]string, shown)
+			for i := range items {
+				items[i] = formatValue(rv.Index(i).Interface())
+			}
+			if n > shown {
+				items = append(items, fmt.Sprintf("… %d more", n-shown))
+			}
+			b.WriteString(" [" + strings.Join(items, ", ") + "]")
+			return
+		}
+		for i := 0; i < shown; i++ {
+			b.WriteString("\n" + indent + "-")
+			writeNested(b, rv.Index(i).Interface(), indent+"  ")
+		}
+		if n > shown {
+			fmt.Fprintf(b, "\n%s… %d more", indent, n-shown)
+		}
+	default:
+		b.WriteString(" " + formatValue(v))
+	}
+}
+
+// isObject reports whether v is a map with string keys.
+func isObject(v reflect.Value) bool {
+	return v.Kind() == reflect.Map && v.Type().Key().Kind() == reflect.String
+}
+
+func isArray(v reflect.Value) bool {
+	return v.Kind() == reflect.Slice || v.Kind() == reflect.Array
+}
+
+// hasNested reports whether an array holds objects or arrays.
+func hasNested(v reflect.Value) bool {
+	for i := 0; i < v.Len(); i++ {
+		item := v.Index(i)
+		if item.Kind() == reflect.Interface {
+			item = item.Elem()
+		}
+		if isObject(item) || isArray(item) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,35 @@
+package views
+
+import (
+	"fmt"
+	"text/tabwriter"
+	"text/template"
+
+	"github.com/wfernandes/app-metrics-plugin/pkg/query"
+)
+
+// PresentQuery prints the value of a scalar query, or the series of a
+// vector query and their values as a table.
+func (v *View) PresentQuery(r query.Result) error {
+	w := tabwriter.NewWriter(v.writer, 0, 4, 2, ' ', 0)
+
+	tmpl := buildQueryTemplate()
+	err := tmpl.Execute(w, r)
+	if err != nil {
+		return fmt.Errorf("unable to render template %s: %s", tmpl.Name(), err)
+	}
+	return w.Flush()
+}
+
+func buildQueryTemplate() *template.Template {
+	t := template.New("query").Funcs(template.FuncMap{
+		"formatStat": formatStat,
+	})
+	// Columns are separated by tabs and aligned by the tabwriter.
+	t, _ = t.Parse(`{{if eq .Type "scalar"}}{{formatStat .Scalar}}
+{{else}}SERIES	VALUE
+{{range .Vector}}{{.Name}}	{{formatStat .Value}}
+{{end}}{{end}}`)
+
+	return t
+}
@@ -0,0 +1,132 @@
+package views
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/wfernandes/app-metrics-plugin/pkg/agent"
+	"github.com/wfernandes/app-metrics-plugin/pkg/aggregate"
+)
+
+// Record outputs, which print the numeric metrics keyed like
+// aggregate.Flatten for other tools to read.
+const (
+	OutputCSV    = "csv"
+	OutputTSV    = "tsv"
+	OutputNDJSON = "ndjson"
+)
+
+// WithRecords renders the instance metrics in one of the record outputs
+// instead of with the template.
+func WithRecords(output string) ViewOpt {
+	return func(v *View) {
+		v.records = output
+	}
+}
+
+// recordHeader names the columns of the csv and tsv outputs.
+var recordHeader = []string{"instance", "metric", "value", "error"}
+
+// presentRecords prints a header and a row per instance and metric for csv
+// and tsv, or a json object per instance for ndjson. An instance that
+// could not be scraped gets a single row with its error. With WithTime
+// the records start with the time of the scrape, to tell apart the
+// scrapes of watch mode.
+func (v *View) presentRecords(m []agent.InstanceMetric) error {
+	if v.records == OutputNDJSON {
+		for _, i := range m {
+			if err := v.PresentInstance(i); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+
+	header := recordHeader
+	row := func(fields ...string) []string {
+		return fields
+	}
+	if !v.time.IsZero() {
+		header = append([]string{"time"}, recordHeader...)
+		row = func(fields ...string) []string {
+			return append([]string{v.time.Format(time.RFC3339Nano)}, fields...)
+		}
+	}
+	rows := [][]string{header}
+	for _, i := range m {
+		instance := strconv.Itoa(i.Instance)
+		if i.Metrics == nil {
+			rows = append(rows, row(instance, "", "", i.Error))
+			continue
+		}
+		values := aggregate.FlattenValues(i.Metrics)
+		keys := make([]string, 0, len(values))
+		for k := range values {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+		for _, k := range keys {
+			rows = append(rows, row(instance, k, formatValue(values[k]), ""))
+		}
+	}
+
+	if v.records == OutputTSV {
+		// Fields are not quoted, tabs and newlines in them become spaces.
+		replacer := strings.NewReplacer("\t", " ", "\n", " ", "\r", " ")
+		for _, r := range rows {
+			for i := range r {
+				r[i] = replacer.Replace(r[i])
+			}
+			if _, err := fmt.Fprintln(v.writer, strings.Join(r, "\t")); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+
+	w := csv.NewWriter(v.writer)
+	err := w.WriteAll(rows)
+	if err != nil {
+		return fmt.Errorf("unable to write csv: %s", err)
+	}
+	return nil
+}
+
+// instanceRecord is the ndjson object of an instance.
+type instanceRecord struct {
+	Time     *time.Time             `json:"time,omitempty"`
+	Instance int                    `json:"instance"`
+	Error    string                 `json:"error,omitempty"`
+	Metrics  map[string]interface{} `json:"metrics,omitempty"`
+}
+
+// PresentInstance prints the ndjson record of one instance, so instances
+// can be printed as soon as they are scraped. NaN and infinite values are
+// left out since json cannot represent them.
+func (v *View) PresentInstance(m agent.InstanceMetric) error {
+	r := instanceRecord{Instance: m.Instance, Error: m.Error}
+	if !v.time.IsZero() {
+		r.Time = &v.time
+	}
+	if m.Metrics != nil {
+		r.Metrics = aggregate.FlattenValues(m.Metrics)
+		for k, v := range r.Metrics {
+			if f, ok := v.(float64); ok && (math.IsNaN(f) || math.IsInf(f, 0)) {
+				delete(r.Metrics, k)
+			}
+		}
+	}
+
+	b, err := json.Marshal(r)
+	if err != nil {
+		return fmt.Errorf("unable to marshal instance %d: %s", m.Instance, err)
+	}
+	_, err = fmt.Fprintf(v.writer, "%s\n", b)
+	return err
+}
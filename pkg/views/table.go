@@ -0,0 +1,231 @@
+package views
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/wfernandes/app-metrics-plugin/pkg/agent"
+	"github.com/wfernandes/app-metrics-plugin/pkg/aggregate"
+)
+
+// Table configures the table Present renders instead of the template when
+// WithTable is given. Rows are metrics and columns instances, or the other
+// way around when Transpose is set. Sort names the column to sort the rows
+// by, e.g. METRIC or 1, and Width is the width to truncate the table to,
+// zero for no limit.
+type Table struct {
+	Sort       string
+	Descending bool
+	Transpose  bool
+	Width      int
+}
+
+// WithTable renders the numeric metrics of the instances as a table.
+func WithTable(t Table) ViewOpt {
+	return func(v *View) {
+		v.table = &t
+	}
+}
+
+const (
+	// minNameWidth is the width the first column can be truncated to.
+	minNameWidth = 20
+	// missingValue fills the cells of metrics an instance does not have.
+	missingValue = "-"
+)
+
+// presentTable prints the numeric metrics, keyed like aggregate.Flatten,
+// with a column per instance, or a row per instance when transposed.
+// Outlier instances are marked with a *, and the errors of the instances
+// that could not be scraped are listed below the table.
+func (v *View) presentTable(m []agent.InstanceMetric) error {
+	header, rows := tableCells(m, v.table.Transpose, v.outlier)
+	err := sortRows(header, rows, v.table.Sort, v.table.Descending)
+	if err != nil {
+		return err
+	}
+
+	widths := make([]int, len(header))
+	for _, r := range append([][]string{header}, rows...) {
+		for i, c := range r {
+			if n := utf8.RuneCountInString(c); n > widths[i] {
+				widths[i] = n
+			}
+		}
+	}
+	widths, hidden := fitWidths(widths, v.table.Width)
+
+	var b strings.Builder
+	for _, r := range append([][]string{header}, rows...) {
+		for i, w := range widths {
+			cell := truncate(r[i], w)
+			pad := strings.Repeat(" ", w-utf8.RuneCountInString(cell))
+			switch {
+			case i == 0 && len(widths) == 1:
+				b.WriteString(cell)
+			case i == 0:
+				b.WriteString(cell + pad)
+			default:
+				// Values are right aligned.
+				b.WriteString("  " + pad + cell)
+			}
+		}
+		b.WriteString("\n")
+	}
+	if hidden > 0 {
+		fmt.Fprintf(&b, "%d more columns do not fit in %d characters\n", hidden, v.table.Width)
+	}
+	if len(v.outliers) > 0 {
+		b.WriteString("* outlier\n")
+	}
+	for _, i := range m {
+		if i.Metrics == nil {
+			fmt.Fprintf(&b, "Instance %d: %s\n", i.Instance, i.Error)
+		}
+	}
+
+	_, err = fmt.Fprint(v.writer, b.String())
+	return err
+}
+
+// tableCells returns the header and the rows of the table.
+func tableCells(m []agent.InstanceMetric, transpose bool, outlier func(int) *aggregate.Outlier) ([]string, [][]string) {
+	values := make([]map[string]interface{}, len(m))
+	names := make(map[string]bool)
+	for i, instance := range m {
+		values[i] = aggregate.FlattenValues(instance.Metrics)
+		for k := range values[i] {
+			names[k] = true
+		}
+	}
+	metrics := make([]string, 0, len(names))
+	for k := range names {
+		metrics = append(metrics, k)
+	}
+	sort.Strings(metrics)
+
+	instances := make([]string, len(m))
+	for i, instance := range m {
+		instances[i] = strconv.Itoa(instance.Instance)
+		if outlier(instance.Instance) != nil {
+			instances[i] += "*"
+		}
+	}
+	cell := func(instance int, metric string) string {
+		if v, ok := values[instance][metric]; ok {
+			return formatCell(v)
+		}
+		return missingValue
+	}
+
+	if transpose {
+		rows := make([][]string, len(m))
+		for i := range m {
+			rows[i] = []string{instances[i]}
+			for _, k := range metrics {
+				rows[i] = append(rows[i], cell(i, k))
+			}
+		}
+		return append([]string{"INSTANCE"}, metrics...), rows
+	}
+
+	rows := make([][]string, len(metrics))
+	for r, k := range metrics {
+		rows[r] = []string{k}
+		for i := range m {
+			rows[r] = append(rows[r], cell(i, k))
+		}
+	}
+	return append([]string{"METRIC"}, instances...), rows
+}
+
+// formatCell rounds floats like the statistics and prints integers
+// exactly.
+func formatCell(v interface{}) string {
+	if f, ok := v.(float64); ok {
+		return formatStat(f)
+	}
+	return formatValue(v)
+}
+
+// sortRows sorts the rows by the named column, numerically when both values
+// are numbers. Missing values always come last.
+func sortRows(header []string, rows [][]string, column string, desc bool) error {
+	if column == "" {
+		return nil
+	}
+	col := -1
+	for i, h := range header {
+		if strings.EqualFold(strings.TrimSuffix(h, "*"), column) {
+			col = i
+			break
+		}
+	}
+	if col < 0 {
+		return fmt.Errorf("unknown sort column %q", column)
+	}
+
+	sort.SliceStable(rows, func(i, j int) bool {
+		a, b := rows[i][col], rows[j][col]
+		if a == missingValue || b == missingValue {
+			return b == missingValue && a != missingValue
+		}
+		fa, errA := strconv.ParseFloat(strings.TrimSuffix(a, "*"), 64)
+		fb, errB := strconv.ParseFloat(strings.TrimSuffix(b, "*"), 64)
+		if errA == nil && errB == nil {
+			if desc {
+				return fa > fb
+			}
+			return fa < fb
+		}
+		if desc {
+			return a > b
+		}
+		return a < b
+	})
+	return nil
+}
+
+// fitWidths shrinks the first column, down to minNameWidth, and then drops
+// the last columns until the table fits in width. It returns the widths of
+// the columns kept and the number of columns dropped.
+func fitWidths(widths []int, width int) ([]int, int) {
+	total := func(widths []int) int {
+		t := 0
+		for _, w := range widths {
+			t += w + 2
+		}
+		return t - 2
+	}
+	if width <= 0 || total(widths) <= width {
+		return widths, 0
+	}
+
+	fitted := append([]int(nil), widths...)
+	if over := total(fitted) - width; fitted[0] > minNameWidth {
+		fitted[0] -= over
+		if fitted[0] < minNameWidth {
+			fitted[0] = minNameWidth
+		}
+	}
+	kept := len(fitted)
+	for kept > 1 && total(fitted[:kept]) > width {
+		kept--
+	}
+	return fitted[:kept], len(fitted) - kept
+}
+
+// truncate shortens s to width characters, ending with an ellipsis.
+func truncate(s string, width int) string {
+	if utf8.RuneCountInString(s) <= width {
+		return s
+	}
+	r := []rune(s)
+	if width < 1 {
+		return ""
+	}
+	return string(r[:width-1]) + "…"
+}
@@ -0,0 +1,226 @@
+package views
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"text/template"
+	"time"
+
+	"github.com/wfernandes/app-metrics-plugin/pkg/snapshot"
+)
+
+// Built-in template names.
+const (
+	TemplateDefault    = "default"
+	TemplateCompact    = "compact"
+	TemplateDetailed   = "detailed"
+	TemplateGoRuntime  = "go-runtime"
+	TemplateHTTPServer = "http-server"
+)
+
+// mainTemplate is the template executed when a directory or glob of
+// template files is given without a template name.
+const mainTemplate = "main"
+
+// WithApp makes the app the metrics were scraped from available to
+// templates with the app function.
+func WithApp(app snapshot.App) ViewOpt {
+	return func(v *View) {
+		v.app = app
+	}
+}
+
+// WithTime makes the time the metrics were scraped at available to
+// templates with the timestamp function.
+func WithTime(t time.Time) ViewOpt {
+	return func(v *View) {
+		v.time = t
+	}
+}
+
+// defaultTemplate prints the metrics of every instance, their errors and
+// outlier deviations.
+const defaultTemplate = `{{define "default"}}
+{{- range .}}
+Instance: {{.Instance}}{{if outlier .Instance}} [OUTLIER]{{end}}
+{{ if .Metrics -}}
+Metrics:
+  {{- range $k, $v := .Metrics}}
+  {{if isFamily $v}}{{template "family" $v}}{{else}}{{print $k}}:{{formatNested $v}}{{end -}}
+  {{end -}}
+{{else -}}
+Error: {{.Error}}
+{{- end}}
+{{- with outlier .Instance}}
+Outlier:
+{{- template "deviations" .}}
+{{- end}}
+{{end}}
+{{- end}}`
+
+// compactTemplate prints a line per instance with its numeric metrics.
+const compactTemplate = `{{define "compact"}}
+{{- range .}}
+{{- .Instance}}{{if outlier .Instance}}*{{end}}:
+{{- if .Metrics}}
+{{- $values := flatten .Metrics}}
+{{- range $k := sortedKeys $values}} {{$k}}={{formatStat (index $values $k)}}{{end}}
+{{- else}} error: {{.Error}}
+{{- end}}
+{{end}}
+{{- end}}`
+
+// detailedTemplate adds the app, the time and the statistics across
+// instances to the default template.
+const detailedTemplate = `{{define "detailed"}}
+{{- with app}}{{if .Name}}App: {{.Name}}{{if .Org}} (org {{.Org}}, space {{.Space}}){{end}}
+{{end}}{{end}}
+{{- with timestamp}}Time: {{.Format "2006-01-02T15:04:05Z07:00"}}
+{{end}}
+{{- template "default" .}}
+{{- with aggregates .}}
+Aggregates:
+{{- range .}}
+  {{.Metric}}: sum {{formatStat .Sum}}, mean {{formatStat .Mean}}, min {{formatStat .Min}} (instance {{.MinInstance}}), max {{formatStat .Max}} (instance {{.MaxInstance}}), stddev {{formatStat .StdDev}}
+{{- end}}
+{{end}}
+{{- end}}`
+
+// goRuntimeTemplate shows the Go runtime metrics of expvar apps, scraped
+// with -memstats, or of the Prometheus Go client.
+const goRuntimeTemplate = `{{define "go-runtime"}}
+{{- range .}}
+Instance: {{.Instance}}{{if outlier .Instance}} [OUTLIER]{{end}}
+{{- if .Metrics}}
+{{- $m := .Metrics}}
+  goroutines: {{with default (get "go_goroutines" $m) (get "memstats.goroutines" $m)}}{{formatValue .}}{{else}}-{{end}}
+  heap in use: {{with default (get "go_memstats_heap_inuse_bytes" $m) (get "memstats.heap_inuse" $m)}}{{humanizeBytes .}}{{else}}-{{end}}
+  heap objects: {{with default (get "go_memstats_heap_objects" $m) (get "memstats.heap_objects" $m)}}{{formatValue .}}{{else}}-{{end}}
+  sys: {{with default (get "go_memstats_sys_bytes" $m) (get "memstats.sys" $m)}}{{humanizeBytes .}}{{else}}-{{end}}
+  gc count: {{with get "memstats.num_gc" $m}}{{formatValue .}}{{else}}-{{end}}
+  gc pause total: {{with get "memstats.pause_total" $m}}{{humanizeDuration .}}{{else}}-{{end}}
+  last gc pause: {{with get "memstats.last_pause" $m}}{{humanizeDuration .}}{{else}}-{{end}}
+{{- else}}
+Error: {{.Error}}
+{{- end}}
+{{end}}
+{{- end}}`
+
+// httpServerTemplate shows the metrics whose names mention http, requests
+// or responses.
+const httpServerTemplate = `{{define "http-server"}}
+{{- range .}}
+Instance: {{.Instance}}{{if outlier .Instance}} [OUTLIER]{{end}}
+{{- if .Metrics}}
+{{- $m := .Metrics}}
+{{- range $k := sortedKeys $m}}
+{{- if or (match "*http*" $k) (match "*request*" $k) (match "*response*" $k)}}
+{{- $v := index $m $k}}
+  {{if isFamily $v}}{{template "family" $v}}{{else}}{{$k}}:{{formatNested $v}}{{end}}
+{{- end}}
+{{- end}}
+{{- else}}
+Error: {{.Error}}
+{{- end}}
+{{end}}
+{{- end}}`
+
+var builtinTemplates = []string{
+	defaultTemplate,
+	compactTemplate,
+	detailedTemplate,
+	goRuntimeTemplate,
+	httpServerTemplate,
+	familyTemplate,
+	deviationsTemplate,
+}
+
+// TemplateNames returns the names of the built-in templates.
+func TemplateNames() []string {
+	return []string{TemplateDefault, TemplateCompact, TemplateDetailed, TemplateGoRuntime, TemplateHTTPServer}
+}
+
+// builtinSet holds every built-in template, parsed once.
+var builtinSet = template.Must(template.New("builtins").Funcs(Funcs()).Parse(strings.Join(builtinTemplates, "")))
+
+// builtins returns a copy of the built-in templates, which views add their
+// functions to and template files are parsed into.
+func builtins() *template.Template {
+	return template.Must(builtinSet.Clone())
+}
+
+// LoadTemplate returns the template named name of the built-in templates and
+// the template files path points to, a file, a directory or a glob. Files
+// are parsed after the built-in templates so they can use and redefine them
+// as partials. Without a name a single file is executed, and several files
+// execute the template they define as main. Without files the name defaults
+// to the default template.
+func LoadTemplate(path, name string) (*template.Template, error) {
+	t := builtins()
+	if path != "" {
+		files, err := templateFiles(path)
+		if err != nil {
+			return nil, err
+		}
+		t, err = t.ParseFiles(files...)
+		if err != nil {
+			return nil, err
+		}
+		if name == "" && len(files) == 1 {
+			name = filepath.Base(files[0])
+		}
+		if name == "" {
+			name = mainTemplate
+		}
+	}
+	if name == "" {
+		name = TemplateDefault
+	}
+
+	tmpl := t.Lookup(name)
+	if tmpl == nil {
+		return nil, fmt.Errorf("unknown template %q, expected one of %s", name, strings.Join(templateNames(t), ", "))
+	}
+	return tmpl, nil
+}
+
+// templateFiles returns the files of a directory or matching a glob.
+func templateFiles(path string) ([]string, error) {
+	pattern := path
+	if info, err := os.Stat(path); err == nil && info.IsDir() {
+		pattern = filepath.Join(path, "*")
+	}
+	matches, err := filepath.Glob(pattern)
+	if err != nil {
+		return nil, err
+	}
+
+	var files []string
+	for _, m := range matches {
+		if info, err := os.Stat(m); err == nil && !info.IsDir() {
+			files = append(files, m)
+		}
+	}
+	if len(files) == 0 {
+		return nil, fmt.Errorf("no template files match %s", path)
+	}
+	return files, nil
+}
+
+// templateNames returns the names of the templates of a set that can be
+// executed, leaving out the partials of the built-in templates.
+func templateNames(t *template.Template) []string {
+	var names []string
+	for _, tmpl := range t.Templates() {
+		switch tmpl.Name() {
+		case "builtins", "family", "deviations":
+			continue
+		}
+		names = append(names, tmpl.Name())
+	}
+	sort.Strings(names)
+	return names
+}
@@ -1,12 +1,17 @@
 package views
 
 import (
+	"encoding/json"
 	"fmt"
 	"io"
 	"os"
+	"strconv"
 	"text/template"
+	"time"
 
 	"github.com/wfernandes/app-metrics-plugin/pkg/agent"
+	"github.com/wfernandes/app-metrics-plugin/pkg/aggregate"
+	"github.com/wfernandes/app-metrics-plugin/pkg/snapshot"
 )
 
 type ViewOpt func(*View)
@@ -23,15 +28,29 @@ func WithTemplate(b *template.Template) ViewOpt {
 	}
 }
 
+// WithOutliers highlights the outlier instances and the metrics that caused
+// them to be flagged.
+func WithOutliers(o []aggregate.Outlier) ViewOpt {
+	return func(v *View) {
+		v.outliers = o
+	}
+}
+
 type View struct {
-	writer io.Writer
-	tmpl   *template.Template
+	writer   io.Writer
+	tmpl     *template.Template
+	outliers []aggregate.Outlier
+	table    *Table
+	records  string
+	labels   map[string]string
+	app      snapshot.App
+	time     time.Time
 }
 
 func New(opts ...ViewOpt) *View {
 	v := &View{
 		writer: os.Stdout,
-		tmpl:   buildDefaultTemplate(),
+		tmpl:   builtins().Lookup(TemplateDefault),
 	}
 
 	for _, o := range opts {
@@ -42,29 +61,81 @@ func New(opts ...ViewOpt) *View {
 }
 
 func (v *View) Present(m []agent.InstanceMetric) error {
+	if v.table != nil {
+		return v.presentTable(m)
+	}
+	if v.records == OutputPrometheus {
+		return v.presentExposition(m)
+	}
+	if v.records != "" {
+		return v.presentRecords(m)
+	}
 
-	err := v.tmpl.Execute(v.writer, m)
+	err := v.tmpl.Funcs(v.funcs()).Execute(v.writer, m)
 	if err != nil {
 		return fmt.Errorf("unable to render template %s: %s", v.tmpl.Name(), err)
 	}
 	return nil
 }
 
-func buildDefaultTemplate() *template.Template {
-	t := template.New("default")
-	// TODO: Ignoring this error for now
-	t, _ = t.Parse(`
-{{- range .}}
-Instance: {{.Instance}}
-{{ if .Metrics -}}
-Metrics:
-  {{- range $k, $v := .Metrics}}
-  {{print $k}}: {{print $v -}}
-  {{end -}}
-{{else -}}
-Error: {{.Error}}
-{{end }}
-{{end}}`)
-
-	return t
+// deviationsTemplate lists the metrics that made an instance an outlier.
+const deviationsTemplate = `{{define "deviations"}}
+{{- range .Deviations}}
+  {{.Metric}}: {{formatStat .Value}} (peers {{formatStat .Center}}, score {{formatStat .Score}})
+{{- end}}
+{{- end}}`
+
+// funcs returns the template functions that depend on the view options.
+func (v *View) funcs() template.FuncMap {
+	return template.FuncMap{
+		"outlier":   v.outlier,
+		"app":       v.appInfo,
+		"timestamp": v.timestamp,
+	}
+}
+
+// outlier returns the outlier entry of the instance, or nil when it is not
+// an outlier.
+func (v *View) outlier(instance int) *aggregate.Outlier {
+	for i := range v.outliers {
+		if v.outliers[i].Instance == instance {
+			return &v.outliers[i]
+		}
+	}
+	return nil
+}
+
+// appInfo returns the app given with WithApp.
+func (v *View) appInfo() snapshot.App {
+	return v.app
+}
+
+// timestamp returns the time given with WithTime, or nil when none was.
+func (v *View) timestamp() interface{} {
+	if v.time.IsZero() {
+		return nil
+	}
+	return v.time
+}
+
+func noOutlier(int) *aggregate.Outlier {
+	return nil
+}
+
+// formatValue prints numbers in plain decimal notation so large counters and
+// nanosecond totals are not shown as 1.2345e+09.
+func formatValue(v interface{}) string {
+	switch n := v.(type) {
+	case float64:
+		return strconv.FormatFloat(n, 'f', -1, 64)
+	case float32:
+		return strconv.FormatFloat(float64(n), 'f', -1, 32)
+	case int64:
+		return strconv.FormatInt(n, 10)
+	case uint64:
+		return strconv.FormatUint(n, 10)
+	case json.Number:
+		return n.String()
+	}
+	return fmt.Sprint(v)
 }
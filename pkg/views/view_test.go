@@ -3,9 +3,21 @@ package views_test
 import (
 	"bytes"
 	"encoding/json"
+	"io/ioutil"
+	"math"
+	"os"
+	"path/filepath"
+	"strings"
 	"text/template"
+	"time"
 
 	"github.com/wfernandes/app-metrics-plugin/pkg/agent"
+	"github.com/wfernandes/app-metrics-plugin/pkg/aggregate"
+	"github.com/wfernandes/app-metrics-plugin/pkg/assert"
+	"github.com/wfernandes/app-metrics-plugin/pkg/diff"
+	"github.com/wfernandes/app-metrics-plugin/pkg/parser"
+	"github.com/wfernandes/app-metrics-plugin/pkg/query"
+	"github.com/wfernandes/app-metrics-plugin/pkg/snapshot"
 	"github.com/wfernandes/app-metrics-plugin/pkg/views"
 
 	. "github.com/onsi/ginkgo"
@@ -31,11 +43,131 @@ var _ = Describe("Views", func() {
 			Expect(bufStr).To(ContainSubstring("  metric.float: 123.345"))
 			Expect(bufStr).To(ContainSubstring("  metric.int: 10"))
 			Expect(bufStr).To(ContainSubstring("  metric.string: expvarApp"))
-			Expect(bufStr).To(ContainSubstring("  metric.map: ")) // maps are unordered so `map[metric1:10 metric2:11]` prints in non-deterministic order
+			Expect(bufStr).To(ContainSubstring("  metric.map:\n    metric1: 10\n    metric2: 11\n"))
 			Expect(bufStr).To(ContainSubstring("Instance: 1"))
 			Expect(bufStr).To(ContainSubstring("Error: unable to parse response: invalid character 'p' after top-level value"))
 		})
 
+		It("displays large numbers without exponents", func() {
+			metrics := []agent.InstanceMetric{
+				{
+					Instance: 0,
+					Metrics: map[string]interface{}{
+						"bytes.total": float64(1234500000),
+						"ns.total":    int64(9007199254740993),
+					},
+				},
+			}
+			buf := &bytes.Buffer{}
+
+			v := views.New(views.WithWriter(buf))
+			err := v.Present(metrics)
+			Expect(err).ToNot(HaveOccurred())
+
+			bufStr := buf.String()
+			Expect(bufStr).To(ContainSubstring("  bytes.total: 1234500000"))
+			Expect(bufStr).To(ContainSubstring("  ns.total: 9007199254740993"))
+		})
+
+		It("indents nested objects and arrays and collapses long arrays", func() {
+			pauses := make([]interface{}, 256)
+			for i := range pauses {
+				pauses[i] = float64(i)
+			}
+			metrics := []agent.InstanceMetric{
+				{
+					Instance: 0,
+					Metrics: map[string]interface{}{
+						"memstats": map[string]interface{}{
+							"PauseNs": pauses,
+							"BySize": []interface{}{
+								map[string]interface{}{"Size": float64(8), "Mallocs": float64(2)},
+							},
+							"Empty": map[string]interface{}{},
+						},
+						"ports": []interface{}{float64(8080), float64(8443)},
+					},
+				},
+			}
+			buf := &bytes.Buffer{}
+
+			v := views.New(views.WithWriter(buf))
+			err := v.Present(metrics)
+			Expect(err).ToNot(HaveOccurred())
+
+			Expect(buf.String()).To(Equal(`
+Instance: 0
+Metrics:
+  memstats:
+    BySize:
+      -
+        Mallocs: 2
+        Size: 8
+    Empty: {}
+    PauseNs: [0, 1, 2, 3, 4, 5, 6, 7, 8, 9, … 246 more]
+  ports: [8080, 8443]
+`))
+		})
+
+		It("displays metric families with their series on one line each", func() {
+			metrics := []agent.InstanceMetric{
+				{
+					Instance: 0,
+					Metrics: map[string]interface{}{
+						"http_requests_total": &parser.Family{
+							Name: "http_requests_total",
+							Help: "Total requests.",
+							Type: "COUNTER",
+							Metrics: []interface{}{
+								parser.Metric{Labels: map[string]string{"method": "GET", "code": "200"}, Value: 1027},
+							},
+						},
+						"rpc_duration_seconds": &parser.Family{
+							Name: "rpc_duration_seconds",
+							Type: "SUMMARY",
+							Metrics: []interface{}{
+								parser.Summary{
+									Quantiles: []parser.Quantile{{Quantile: 0.5, Value: 0.01}, {Quantile: 0.99, Value: 0.05}},
+									Count:     10,
+									Sum:       0.2,
+								},
+							},
+						},
+						"request_size_bytes": &parser.Family{
+							Name: "request_size_bytes",
+							Type: "HISTOGRAM",
+							Metrics: []interface{}{
+								parser.Histogram{
+									Labels: map[string]string{"path": "/"},
+									Buckets: []parser.Bucket{
+										{UpperBound: 100, CumulativeCount: 3},
+										{UpperBound: math.Inf(1), CumulativeCount: 4},
+									},
+									Count: 4,
+									Sum:   450,
+								},
+							},
+						},
+					},
+				},
+			}
+			buf := &bytes.Buffer{}
+
+			v := views.New(views.WithWriter(buf))
+			err := v.Present(metrics)
+			Expect(err).ToNot(HaveOccurred())
+
+			Expect(buf.String()).To(Equal(`
+Instance: 0
+Metrics:
+  http_requests_total [counter] Total requests.
+    {code="200",method="GET"} 1027
+  request_size_bytes [histogram]
+    {path="/"} count=4 sum=450 buckets: 100=3 +Inf=4
+  rpc_duration_seconds [summary]
+    count=10 sum=0.2 quantiles: 0.5=0.01 0.99=0.05
+`))
+		})
 	})
 
 	Context("with custom template", func() {
@@ -86,6 +218,666 @@ var _ = Describe("Views", func() {
 			err = v.Present(metrics)
 			Expect(err).To(HaveOccurred())
 		})
+
+		It("renders with the template functions", func() {
+			metrics := []agent.InstanceMetric{
+				{
+					Instance: 0,
+					Metrics: map[string]interface{}{
+						"memstats": map[string]interface{}{
+							"HeapInuse": float64(2202009),
+							"PauseNs":   []interface{}{float64(1500000), float64(0)},
+						},
+						"requests.total": float64(10),
+						"version":        "1.2.0",
+					},
+				},
+				{
+					Instance: 1,
+					Metrics: map[string]interface{}{
+						"memstats":       map[string]interface{}{"HeapInuse": float64(1024)},
+						"requests.total": float64(30),
+					},
+				},
+				{Instance: 2, Error: "timeout"},
+			}
+			buf := &bytes.Buffer{}
+			tmpl, err := template.New("test").Funcs(views.Funcs()).Parse(
+				`{{range .}}{{.Instance}} {{humanizeBytes (default 0 (get "memstats.HeapInuse" .Metrics))}}` +
+					` {{humanizeDuration (default 0 (get "memstats.PauseNs.0" .Metrics))}}` +
+					` {{default "n/a" (get "version" .Metrics)}}` +
+					"{{if .Metrics}} {{sortedKeys .Metrics}}{{end}}\n{{end}}" +
+					`sum={{sum "requests.total" .}} avg={{avg "requests.total" .}}` +
+					` {{toJSON (index . 1).Metrics.memstats}} {{color "red" "down"}}`,
+			)
+			Expect(err).ToNot(HaveOccurred())
+
+			v := views.New(views.WithWriter(buf), views.WithTemplate(tmpl))
+			err = v.Present(metrics)
+			Expect(err).ToNot(HaveOccurred())
+
+			Expect(buf.String()).To(Equal(`0 2.1 MiB 1.5ms 1.2.0 [memstats requests.total version]
+1 1.0 KiB 0s n/a [memstats requests.total]
+2 0 B 0s n/a
+sum=40 avg=20 {"HeapInuse":1024} ` + "\x1b[31mdown\x1b[0m"))
+		})
+
+		It("returns an error for an unknown color", func() {
+			buf := &bytes.Buffer{}
+			tmpl, err := template.New("test").Funcs(views.Funcs()).Parse(`{{color "pink" "x"}}`)
+			Expect(err).ToNot(HaveOccurred())
+
+			v := views.New(views.WithWriter(buf), views.WithTemplate(tmpl))
+			err = v.Present(nil)
+			Expect(err).To(MatchError(ContainSubstring(`unknown color "pink"`)))
+		})
+	})
+
+	Context("with template files", func() {
+		var dir string
+
+		BeforeEach(func() {
+			var err error
+			dir, err = ioutil.TempDir("", "templates")
+			Expect(err).ToNot(HaveOccurred())
+			err = ioutil.WriteFile(filepath.Join(dir, "main.tmpl"), []byte(`{{define "main"}}{{range .}}{{template "instance" .}}{{end}}{{end}}`), 0600)
+			Expect(err).ToNot(HaveOccurred())
+			err = ioutil.WriteFile(filepath.Join(dir, "instance.tmpl"), []byte(`{{define "instance"}}{{.Instance}}: {{formatValue (get "a" .Metrics)}}{{"\n"}}{{end}}`), 0600)
+			Expect(err).ToNot(HaveOccurred())
+		})
+
+		AfterEach(func() {
+			os.RemoveAll(dir)
+		})
+
+		It("executes the main template of a directory with its partials", func() {
+			tmpl, err := views.LoadTemplate(dir, "")
+			Expect(err).ToNot(HaveOccurred())
+			buf := &bytes.Buffer{}
+
+			v := views.New(views.WithWriter(buf), views.WithTemplate(tmpl))
+			err = v.Present([]agent.InstanceMetric{{Instance: 0, Metrics: map[string]interface{}{"a": float64(1)}}})
+			Expect(err).ToNot(HaveOccurred())
+
+			Expect(buf.String()).To(Equal("0: 1\n"))
+		})
+
+		It("executes a named template of a glob", func() {
+			tmpl, err := views.LoadTemplate(filepath.Join(dir, "*.tmpl"), "instance")
+			Expect(err).ToNot(HaveOccurred())
+			Expect(tmpl.Name()).To(Equal("instance"))
+		})
+
+		It("returns an error when no files match", func() {
+			_, err := views.LoadTemplate(filepath.Join(dir, "*.txt"), "")
+			Expect(err).To(MatchError(ContainSubstring("no template files match")))
+		})
+
+		It("returns an error for an unknown template name", func() {
+			_, err := views.LoadTemplate("", "fancy")
+			Expect(err).To(MatchError(`unknown template "fancy", expected one of compact, default, detailed, go-runtime, http-server`))
+		})
+	})
+
+	Context("with built-in templates", func() {
+		metrics := []agent.InstanceMetric{
+			{
+				Instance: 0,
+				Metrics: map[string]interface{}{
+					"memstats": map[string]interface{}{
+						"heap_inuse":  parser.Bytes(2202009),
+						"num_gc":      uint64(3),
+						"last_pause":  time.Duration(1500000),
+						"pause_total": time.Duration(4000000),
+					},
+					"http.requests": float64(10),
+				},
+			},
+			{
+				Instance: 1,
+				Metrics: map[string]interface{}{
+					"go_goroutines": &parser.Family{
+						Name:    "go_goroutines",
+						Type:    "GAUGE",
+						Metrics: []interface{}{parser.Metric{Value: 6}},
+					},
+					"http.requests": float64(30),
+				},
+			},
+			{Instance: 2, Error: "timeout"},
+		}
+
+		present := func(name string, opts ...views.ViewOpt) string {
+			tmpl, err := views.LoadTemplate("", name)
+			Expect(err).ToNot(HaveOccurred())
+			buf := &bytes.Buffer{}
+			v := views.New(append(opts, views.WithWriter(buf), views.WithTemplate(tmpl))...)
+			err = v.Present(metrics)
+			Expect(err).ToNot(HaveOccurred())
+			return buf.String()
+		}
+
+		It("displays a line per instance with compact", func() {
+			Expect(present(views.TemplateCompact)).To(Equal(`0: http.requests=10 memstats.heap_inuse=2202009 memstats.last_pause=1500000 memstats.num_gc=3 memstats.pause_total=4000000
+1: go_goroutines=6 http.requests=30
+2: error: timeout
+`))
+		})
+
+		It("adds the app, the time and the aggregates with detailed", func() {
+			out := present(views.TemplateDetailed,
+				views.WithApp(snapshot.App{Name: "my-app", Org: "my-org", Space: "dev"}),
+				views.WithTime(time.Date(2017, 11, 5, 10, 0, 0, 0, time.UTC)),
+			)
+
+			Expect(out).To(HavePrefix("App: my-app (org my-org, space dev)\nTime: 2017-11-05T10:00:00Z\n\nInstance: 0\n"))
+			Expect(out).To(ContainSubstring("\nAggregates:\n"))
+			Expect(out).To(ContainSubstring("\n  http.requests: sum 40, mean 20, min 10 (instance 0), max 30 (instance 1), stddev 10\n"))
+		})
+
+		It("displays the go runtime metrics of expvar and prometheus apps with go-runtime", func() {
+			Expect(present(views.TemplateGoRuntime)).To(Equal(`
+Instance: 0
+  goroutines: -
+  heap in use: 2.1 MiB
+  heap objects: -
+  sys: -
+  gc count: 3
+  gc pause total: 4ms
+  last gc pause: 1.5ms
+
+Instance: 1
+  goroutines: 6
+  heap in use: -
+  heap objects: -
+  sys: -
+  gc count: -
+  gc pause total: -
+  last gc pause: -
+
+Instance: 2
+Error: timeout
+`))
+		})
+
+		It("displays the http metrics with http-server", func() {
+			Expect(present(views.TemplateHTTPServer)).To(Equal(`
+Instance: 0
+  http.requests: 10
+
+Instance: 1
+  http.requests: 30
+
+Instance: 2
+Error: timeout
+`))
+		})
+	})
+
+	Context("with outliers", func() {
+		It("highlights the outlier instances and their deviating metrics", func() {
+			metrics := []agent.InstanceMetric{
+				{Instance: 0, Metrics: map[string]interface{}{"latency": 10.0}},
+				{Instance: 1, Metrics: map[string]interface{}{"latency": 95.0}},
+			}
+			outliers := []aggregate.Outlier{
+				{Instance: 1, Deviations: []aggregate.Deviation{{Metric: "latency", Value: 95, Center: 11, Score: 56.658}}},
+			}
+			buf := &bytes.Buffer{}
+
+			v := views.New(views.WithWriter(buf), views.WithOutliers(outliers))
+			err := v.Present(metrics)
+			Expect(err).ToNot(HaveOccurred())
+
+			Expect(buf.String()).To(Equal("" +
+				"\nInstance: 0\nMetrics:\n  latency: 10\n" +
+				"\nInstance: 1 [OUTLIER]\nMetrics:\n  latency: 95\nOutlier:\n  latency: 95 (peers 11, score 56.658)\n"))
+		})
+
+		It("keeps the outliers of a view out of the other views", func() {
+			metrics := []agent.InstanceMetric{{Instance: 0, Metrics: map[string]interface{}{"latency": 95.0}}}
+			outliers := []aggregate.Outlier{{Instance: 0}}
+			flagged := views.New(views.WithWriter(&bytes.Buffer{}), views.WithOutliers(outliers))
+			buf := &bytes.Buffer{}
+			plain := views.New(views.WithWriter(buf))
+
+			Expect(flagged.Present(metrics)).To(Succeed())
+			Expect(plain.Present(metrics)).To(Succeed())
+
+			Expect(buf.String()).ToNot(ContainSubstring("OUTLIER"))
+		})
+	})
+
+	Context("with histogram estimates", func() {
+		It("displays the quantiles per instance and merged, then incompatible layouts", func() {
+			h := aggregate.Histograms{
+				Quantiles: []float64{0.5, 0.999},
+				Instances: []aggregate.InstanceHistograms{
+					{Instance: 0, Estimates: []aggregate.Estimate{
+						{Series: "a", Count: 40, Quantiles: []aggregate.Quantile{{Quantile: 0.5, Value: 0.3}, {Quantile: 0.999, Value: 0.998}}},
+						{Series: "b", Count: 0, Quantiles: []aggregate.Quantile{}},
+					}},
+					{Instance: 1, Estimates: []aggregate.Estimate{
+						{Series: "a", Count: 40, Quantiles: []aggregate.Quantile{{Quantile: 0.5, Value: 0.7}, {Quantile: 0.999, Value: 0.999}}},
+					}},
+				},
+				Merged: []aggregate.Estimate{
+					{Series: "a", Count: 80, Quantiles: []aggregate.Quantile{{Quantile: 0.5, Value: 0.5}, {Quantile: 0.999, Value: 0.999}}},
+				},
+				Incompatible: []aggregate.Incompatible{
+					{Series: "c", Layouts: []aggregate.Layout{
+						{UpperBounds: []string{"1", "+Inf"}, Instances: []int{0, 2}},
+						{UpperBounds: []string{"2", "+Inf"}, Instances: []int{1}},
+					}},
+				},
+			}
+			buf := &bytes.Buffer{}
+
+			v := views.New(views.WithWriter(buf))
+			err := v.PresentHistograms(h)
+			Expect(err).ToNot(HaveOccurred())
+
+			Expect(buf.String()).To(Equal("" +
+				"SERIES  INSTANCE  COUNT  P50  P99.9\n" +
+				"a       0         40     0.3  0.998\n" +
+				"a       1         40     0.7  0.999\n" +
+				"a       all       80     0.5  0.999\n" +
+				"b       0         0      -    -\n" +
+				"\n" +
+				"Incompatible bucket layouts for c:\n" +
+				"  instances 0, 2: 1, +Inf\n" +
+				"  instances 1: 2, +Inf\n"))
+		})
+	})
+
+	Context("with aggregate statistics", func() {
+		It("displays one aligned table", func() {
+			stats := []aggregate.Stat{
+				{Metric: "ingress.received", Instances: 3, Sum: 60, Mean: 20, Min: 10, Max: 30, StdDev: 8.16496580927726, MinInstance: 0, MaxInstance: 2},
+				{Metric: "ratio", Instances: 1, Sum: 0.25, Mean: 0.25, Min: 0.25, Max: 0.25, MinInstance: 1, MaxInstance: 1},
+			}
+			buf := &bytes.Buffer{}
+
+			v := views.New(views.WithWriter(buf))
+			err := v.PresentAggregate(stats)
+			Expect(err).ToNot(HaveOccurred())
+
+			Expect(buf.String()).To(Equal("" +
+				"METRIC            INSTANCES  SUM   MEAN  MIN        MAX        STDDEV\n" +
+				"ingress.received  3          60    20    10 (#0)    30 (#2)    8.165\n" +
+				"ratio             1          0.25  0.25  0.25 (#1)  0.25 (#1)  0\n"))
+		})
+	})
+
+	Context("with a diff", func() {
+		It("displays the changes of each instance and across instances", func() {
+			increase, drop := 100.0, -25.0
+			d := diff.Diff{
+				Instances: []diff.InstanceDiff{
+					{Instance: 0, Changes: diff.Changes{
+						Added:   []string{"new"},
+						Changed: []diff.Change{{Metric: "requests", Before: 100, After: 200, Delta: 100, Percent: &increase, Counter: true, Rate: 10}},
+					}},
+					{Instance: 1},
+					{Instance: 2, Error: "first scrape failed: boom"},
+				},
+				Aggregate: diff.Changes{
+					Changed: []diff.Change{{Metric: "latency", Stat: "mean", Before: 20, After: 15, Delta: -5, Percent: &drop}},
+				},
+			}
+			buf := &bytes.Buffer{}
+
+			v := views.New(views.WithWriter(buf))
+			err := v.PresentDiff(d)
+			Expect(err).ToNot(HaveOccurred())
+
+			Expect(buf.String()).To(Equal("" +
+				"Instance: 0\n" +
+				"METRIC    BEFORE  AFTER  DELTA  CHANGE  RATE\n" +
+				"requests  100     200    +100   +100%   10/s\n" +
+				"Added: new\n" +
+				"\n" +
+				"Instance: 1\n" +
+				"No changes\n" +
+				"\n" +
+				"Instance: 2\n" +
+				"Error: first scrape failed: boom\n" +
+				"\n" +
+				"All instances:\n" +
+				"METRIC   STAT  BEFORE  AFTER  DELTA  CHANGE\n" +
+				"latency  mean  20      15     -5     -25%\n"))
+		})
+	})
+
+	Context("with assertions", func() {
+		It("displays whether each assertion passed and the violations", func() {
+			instance := 1
+			results := []assert.Result{
+				{Assertion: "goroutines < 5000", Passed: true},
+				{Assertion: "max(heap) < 512MiB", Failures: []assert.Failure{{Metric: "heap", Value: 629145600}}},
+				{Assertion: "errors rate == 0", Failures: []assert.Failure{{Instance: &instance, Metric: "errors", Value: 0.5}, {Error: "no metric matches errors"}}},
+			}
+			buf := &bytes.Buffer{}
+
+			v := views.New(views.WithWriter(buf))
+			err := v.PresentAssertions(results)
+			Expect(err).ToNot(HaveOccurred())
+
+			Expect(buf.String()).To(Equal("" +
+				"PASS  goroutines < 5000\n" +
+				"FAIL  max(heap) < 512MiB\n" +
+				"      heap: 629145600\n" +
+				"FAIL  errors rate == 0\n" +
+				"      instance 1: errors: 0.5\n" +
+				"      no metric matches errors\n"))
+		})
+	})
+
+	Context("with a table", func() {
+		var metrics []agent.InstanceMetric
+
+		BeforeEach(func() {
+			metrics = []agent.InstanceMetric{
+				{Instance: 0, Metrics: map[string]interface{}{"goroutines": 10.0, "memstats": map[string]interface{}{"HeapInuse": 2048.0}, "version": "1.2"}},
+				{Instance: 1, Metrics: map[string]interface{}{"goroutines": 300.0}},
+				{Instance: 2, Error: "connection refused"},
+			}
+		})
+
+		It("displays a row per metric and a column per instance", func() {
+			buf := &bytes.Buffer{}
+
+			v := views.New(views.WithWriter(buf), views.WithTable(views.Table{}), views.WithOutliers([]aggregate.Outlier{{Instance: 1}}))
+			err := v.Present(metrics)
+			Expect(err).ToNot(HaveOccurred())
+
+			Expect(buf.String()).To(Equal("" +
+				"METRIC                 0   1*  2\n" +
+				"goroutines            10  300  -\n" +
+				"memstats.HeapInuse  2048    -  -\n" +
+				"* outlier\n" +
+				"Instance 2: connection refused\n"))
+		})
+
+		It("transposes and sorts the table", func() {
+			buf := &bytes.Buffer{}
+
+			v := views.New(views.WithWriter(buf), views.WithTable(views.Table{Transpose: true, Sort: "goroutines", Descending: true}))
+			err := v.Present(metrics)
+			Expect(err).ToNot(HaveOccurred())
+
+			Expect(buf.String()).To(Equal("" +
+				"INSTANCE  goroutines  memstats.HeapInuse\n" +
+				"1                300                   -\n" +
+				"0                 10                2048\n" +
+				"2                  -                   -\n" +
+				"Instance 2: connection refused\n"))
+		})
+
+		It("truncates the table to the width", func() {
+			metrics[0].Metrics["a_rather_long_metric_name_for_a_table"] = 1.0
+			buf := &bytes.Buffer{}
+
+			v := views.New(views.WithWriter(buf), views.WithTable(views.Table{Width: 31}))
+			err := v.Present(metrics[:2])
+			Expect(err).ToNot(HaveOccurred())
+
+			Expect(buf.String()).To(Equal("" +
+				"METRIC                   0    1\n" +
+				"a_rather_long_metri…     1    -\n" +
+				"goroutines              10  300\n" +
+				"memstats.HeapInuse    2048    -\n"))
+		})
+
+		It("returns an error for an unknown sort column", func() {
+			v := views.New(views.WithWriter(&bytes.Buffer{}), views.WithTable(views.Table{Sort: "7"}))
+			err := v.Present(metrics)
+			Expect(err).To(MatchError(`unknown sort column "7"`))
+		})
+	})
+
+	Context("with records", func() {
+		var metrics []agent.InstanceMetric
+
+		BeforeEach(func() {
+			metrics = []agent.InstanceMetric{
+				{Instance: 0, Metrics: map[string]interface{}{
+					"goroutines": 10.0,
+					"memstats":   map[string]interface{}{"HeapInuse": 2048.0},
+					"http_requests_total": &parser.Family{Name: "http_requests_total", Type: "COUNTER", Metrics: []interface{}{
+						parser.Metric{Labels: map[string]string{"method": "GET", "code": "200"}, Value: 7},
+					}},
+				}},
+				{Instance: 1, Error: "connection refused"},
+			}
+		})
+
+		It("displays a csv row per instance and metric", func() {
+			buf := &bytes.Buffer{}
+
+			v := views.New(views.WithWriter(buf), views.WithRecords(views.OutputCSV))
+			err := v.Present(metrics)
+			Expect(err).ToNot(HaveOccurred())
+
+			Expect(buf.String()).To(Equal("" +
+				"instance,metric,value,error\n" +
+				"0,goroutines,10,\n" +
+				"0,\"http_requests_total{code=\"\"200\"\",method=\"\"GET\"\"}\",7,\n" +
+				"0,memstats.HeapInuse,2048,\n" +
+				"1,,,connection refused\n"))
+		})
+
+		It("displays tsv rows without quoting", func() {
+			buf := &bytes.Buffer{}
+
+			v := views.New(views.WithWriter(buf), views.WithRecords(views.OutputTSV))
+			err := v.Present(metrics)
+			Expect(err).ToNot(HaveOccurred())
+
+			Expect(buf.String()).To(Equal("" +
+				"instance\tmetric\tvalue\terror\n" +
+				"0\tgoroutines\t10\t\n" +
+				"0\thttp_requests_total{code=\"200\",method=\"GET\"}\t7\t\n" +
+				"0\tmemstats.HeapInuse\t2048\t\n" +
+				"1\t\t\tconnection refused\n"))
+		})
+
+		It("prints integers above 2^53 exactly", func() {
+			metrics := []agent.InstanceMetric{{Instance: 0, Metrics: map[string]interface{}{"big": int64(9007199254740993)}}}
+
+			for _, output := range []string{views.OutputCSV, views.OutputNDJSON, views.OutputPrometheus} {
+				buf := &bytes.Buffer{}
+				v := views.New(views.WithWriter(buf), views.WithRecords(output))
+				Expect(v.Present(metrics)).To(Succeed())
+				Expect(buf.String()).To(ContainSubstring("9007199254740993"), output)
+			}
+
+			buf := &bytes.Buffer{}
+			v := views.New(views.WithWriter(buf), views.WithTable(views.Table{}))
+			Expect(v.Present(metrics)).To(Succeed())
+			Expect(buf.String()).To(ContainSubstring("9007199254740993"))
+		})
+
+		It("displays a json object per instance", func() {
+			buf := &bytes.Buffer{}
+
+			v := views.New(views.WithWriter(buf), views.WithRecords(views.OutputNDJSON))
+			err := v.Present(metrics)
+			Expect(err).ToNot(HaveOccurred())
+
+			lines := strings.Split(strings.TrimSuffix(buf.String(), "\n"), "\n")
+			Expect(lines).To(HaveLen(2))
+			Expect(lines[0]).To(MatchJSON(`{"instance":0,"metrics":{"goroutines":10,"http_requests_total{code=\"200\",method=\"GET\"}":7,"memstats.HeapInuse":2048}}`))
+			Expect(lines[1]).To(MatchJSON(`{"instance":1,"error":"connection refused"}`))
+		})
+
+		It("starts the records with the time of the scrape when it is given", func() {
+			scraped := time.Date(2018, 1, 2, 15, 4, 5, 0, time.UTC)
+			buf := &bytes.Buffer{}
+
+			v := views.New(views.WithWriter(buf), views.WithRecords(views.OutputCSV), views.WithTime(scraped))
+			err := v.Present(metrics[1:])
+			Expect(err).ToNot(HaveOccurred())
+			Expect(buf.String()).To(Equal("" +
+				"time,instance,metric,value,error\n" +
+				"2018-01-02T15:04:05Z,1,,,connection refused\n"))
+
+			buf.Reset()
+			v = views.New(views.WithWriter(buf), views.WithRecords(views.OutputNDJSON), views.WithTime(scraped))
+			err = v.Present(metrics[1:])
+			Expect(err).ToNot(HaveOccurred())
+			Expect(buf.String()).To(MatchJSON(`{"time":"2018-01-02T15:04:05Z","instance":1,"error":"connection refused"}`))
+		})
+	})
+
+	Context("with prometheus output", func() {
+		It("merges the series of every instance with their labels", func() {
+			family := &parser.Family{Name: "rpc_seconds", Help: "RPC latency.", Type: "HISTOGRAM", Metrics: []interface{}{
+				parser.Histogram{
+					Labels:  map[string]string{"cf_app": "upstream"},
+					Buckets: []parser.Bucket{{UpperBound: 0.5, CumulativeCount: 3}, {UpperBound: math.Inf(1), CumulativeCount: 4}},
+					Count:   4,
+					Sum:     2.5,
+				},
+			}}
+			metrics := []agent.InstanceMetric{
+				{Instance: 0, Metrics: map[string]interface{}{"rpc_seconds": family, "memstats": map[string]interface{}{"PauseNs": []interface{}{12.0}}}},
+				{Instance: 1, Metrics: map[string]interface{}{"goroutines": 7.0, "http_requests_total{code=\"200\"}": 0.5}},
+				{Instance: 2, Error: "connection refused"},
+			}
+			buf := &bytes.Buffer{}
+
+			v := views.New(views.WithWriter(buf), views.WithRecords(views.OutputPrometheus), views.WithLabels(map[string]string{"cf_app": "my-app"}))
+			err := v.Present(metrics)
+			Expect(err).ToNot(HaveOccurred())
+
+			Expect(buf.String()).To(Equal(`# TYPE goroutines gauge
+goroutines{cf_app="my-app",cf_instance_index="1"} 7
+# TYPE http_requests_total gauge
+http_requests_total{cf_app="my-app",cf_instance_index="1",code="200"} 0.5
+# HELP memstats_PauseNs_0_ memstats.PauseNs[0]
+# TYPE memstats_PauseNs_0_ gauge
+memstats_PauseNs_0_{cf_app="my-app",cf_instance_index="0"} 12
+# HELP rpc_seconds RPC latency.
+# TYPE rpc_seconds histogram
+rpc_seconds_bucket{cf_app="my-app",cf_instance_index="0",exported_cf_app="upstream",le="0.5"} 3
+rpc_seconds_bucket{cf_app="my-app",cf_instance_index="0",exported_cf_app="upstream",le="+Inf"} 4
+rpc_seconds_sum{cf_app="my-app",cf_instance_index="0",exported_cf_app="upstream"} 2.5
+rpc_seconds_count{cf_app="my-app",cf_instance_index="0",exported_cf_app="upstream"} 4
+# cf_instance_index 2 failed: connection refused
+`))
+		})
+
+		It("sanitizes the names of graphite families and keeps them as help", func() {
+			family := &parser.Family{Name: "servers.web1.cpu", Type: "UNTYPED", Metrics: []interface{}{
+				parser.Metric{Labels: map[string]string{"dc": "east"}, Value: 2.5},
+			}}
+			buf := &bytes.Buffer{}
+
+			v := views.New(views.WithWriter(buf), views.WithRecords(views.OutputPrometheus))
+			err := v.Present([]agent.InstanceMetric{{Instance: 0, Metrics: map[string]interface{}{"servers.web1.cpu": family}}})
+			Expect(err).ToNot(HaveOccurred())
+
+			Expect(buf.String()).To(Equal(`# HELP servers_web1_cpu servers.web1.cpu
+# TYPE servers_web1_cpu untyped
+servers_web1_cpu{cf_instance_index="0",dc="east"} 2.5
+`))
+		})
+	})
+
+	Context("with a query result", func() {
+		It("displays the series and their values", func() {
+			r := query.Result{Type: query.TypeVector, Vector: []query.Sample{
+				{Labels: map[string]string{"instance": "0"}, Value: 12.5},
+				{Labels: map[string]string{"__name__": "http_requests_total", "code": "500", "instance": "1"}, Value: 3},
+			}}
+			buf := &bytes.Buffer{}
+
+			v := views.New(views.WithWriter(buf))
+			err := v.PresentQuery(r)
+			Expect(err).ToNot(HaveOccurred())
+
+			Expect(buf.String()).To(Equal("" +
+				"SERIES                                        VALUE\n" +
+				"{instance=\"0\"}                                12.5\n" +
+				"http_requests_total{code=\"500\",instance=\"1\"}  3\n"))
+		})
+
+		It("displays a scalar", func() {
+			buf := &bytes.Buffer{}
+
+			v := views.New(views.WithWriter(buf))
+			err := v.PresentQuery(query.Result{Type: query.TypeScalar, Scalar: 0.25})
+			Expect(err).ToNot(HaveOccurred())
+
+			Expect(buf.String()).To(Equal("0.25\n"))
+		})
+	})
+
+	Context("with an html report", func() {
+		var histogram = func(fast uint64) *parser.Family {
+			return &parser.Family{Name: "rpc_seconds", Type: "HISTOGRAM", Metrics: []interface{}{
+				parser.Histogram{
+					Buckets: []parser.Bucket{{UpperBound: 0.1, CumulativeCount: fast}, {UpperBound: 1, CumulativeCount: 4}, {UpperBound: math.Inf(1), CumulativeCount: 4}},
+					Count:   4,
+					Sum:     1.5,
+				},
+			}}
+		}
+
+		It("displays the instances, aggregates and histogram charts", func() {
+			samples := []agent.Sample{{
+				Time: time.Date(2018, 1, 2, 15, 4, 5, 0, time.UTC),
+				Metrics: []agent.InstanceMetric{
+					{Instance: 0, Metrics: map[string]interface{}{"latency": 10.0, "name": "<app>", "rpc_seconds": histogram(1)}},
+					{Instance: 1, Error: "connection refused"},
+				},
+			}}
+			buf := &bytes.Buffer{}
+
+			v := views.New(views.WithWriter(buf), views.WithApp(snapshot.App{Name: "my-app", Org: "my-org", Space: "my-space"}))
+			err := v.PresentReport(samples, aggregate.DefaultQuantiles)
+			Expect(err).ToNot(HaveOccurred())
+
+			html := buf.String()
+			Expect(html).To(HavePrefix("<!DOCTYPE html>"))
+			Expect(html).To(ContainSubstring("<h1>Metrics of my-app</h1>"))
+			Expect(html).To(ContainSubstring("<p>Org my-org, space my-space. Scraped at 2018-01-02T15:04:05Z.</p>"))
+			Expect(html).To(ContainSubstring(`<tr><td>latency</td><td class="num">1</td><td class="num">10</td>`))
+			Expect(html).To(ContainSubstring(`<tr><td>rpc_seconds</td><td>0</td><td class="num">4</td><td class="num">0.4</td><td class="num">0.88</td>`))
+			Expect(html).To(ContainSubstring("<b>rpc_seconds, instance 0</b><br>count 4, sum 1.5"))
+			Expect(html).To(ContainSubstring(`<title>1: 3</title>`))
+			Expect(html).To(ContainSubstring(`<tr><td>name</td><td class="num">&lt;app&gt;</td></tr>`))
+			Expect(html).To(ContainSubstring(`<p class="error">connection refused</p>`))
+			Expect(html).ToNot(ContainSubstring("Over time"))
+			Expect(html).ToNot(MatchRegexp(`(src|href)=`))
+		})
+
+		It("charts the metrics over time when there are several samples", func() {
+			start := time.Date(2018, 1, 2, 15, 4, 5, 0, time.UTC)
+			samples := []agent.Sample{
+				{Time: start, Metrics: []agent.InstanceMetric{
+					{Instance: 0, Metrics: map[string]interface{}{"latency": 10.0}},
+					{Instance: 1, Metrics: map[string]interface{}{"latency": 20.0}},
+				}},
+				{Time: start.Add(time.Minute), Metrics: []agent.InstanceMetric{
+					{Instance: 0, Metrics: map[string]interface{}{"latency": 30.0}},
+					{Instance: 1, Error: "connection refused"},
+				}},
+			}
+			buf := &bytes.Buffer{}
+
+			v := views.New(views.WithWriter(buf))
+			err := v.PresentReport(samples, aggregate.DefaultQuantiles)
+			Expect(err).ToNot(HaveOccurred())
+
+			html := buf.String()
+			Expect(html).To(ContainSubstring("Scraped at 2018-01-02T15:05:05Z, 2 samples."))
+			Expect(html).To(ContainSubstring("<h2>Over time</h2>\n<figure><figcaption><b>latency</b></figcaption><svg"))
+			Expect(html).To(ContainSubstring(`<polyline points="56.0,156.0 472.0,8.0" fill="none" stroke="#1f77b4"`))
+			Expect(html).To(ContainSubstring(`<circle cx="56.0" cy="82.0" r="2" fill="#ff7f0e"/>`))
+			Expect(html).To(ContainSubstring(`<i style="background:#ff7f0e"></i>instance 1</span>`))
+		})
 	})
 })
 